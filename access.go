@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+New or changed photos checked for access on each refresh, picked at random. If any of them can't be read, all of them
+are checked, otherwise the rest are candidates again on the next refresh.
+*/
+const ACCESS_CHECK_SAMPLE = 10
+
+// Whether a HeadObject failed because the site's credentials can't read the object. Other errors are left to the photo's
+// page to show.
+func isForbidden(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusForbidden
+}
+
+/*
+Leaves out photos the site's credentials can't read, like ones locked down by a bucket policy, which would only be
+broken tiles. Checking every photo on every refresh would be too slow for big albums, so only a random sample of new
+and changed photos is checked, unless one of those turns out to be unreadable. Photos that weren't sampled stay
+candidates until they are, and photos that were checked and didn't change keep the verdict they got last time.
+*/
+func (a *Album) skipUnreadable(ctx context.Context, objects []*s3.Object, previous map[string]string) []*s3.Object {
+	unreadableBefore, _ := a.UnreadableCache.Load().(map[string]string)
+	stillUnreadable := func(key, etag string) bool {
+		before, ok := unreadableBefore[key]
+		return ok && before == etag
+	}
+
+	uncheckedBefore, _ := a.UncheckedCache.Load().(map[string]string)
+	var candidates []string
+	etags := make(map[string]string)
+	for _, obj := range objects {
+		key, etag := *obj.Key, aws.StringValue(obj.ETag)
+		readable, ok := previous[key]
+		changed := !(ok && readable == etag)
+		if unchecked, ok := uncheckedBefore[key]; ok && unchecked == etag {
+			changed = true
+		}
+		if changed && !stillUnreadable(key, etag) {
+			candidates = append(candidates, key)
+			etags[key] = etag
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+
+	check := func(keys []string) map[string]bool {
+		var mutex sync.Mutex
+		unreadable := make(map[string]bool)
+		a.headObjects(ctx, "access", keys, func(key string, head *s3.HeadObjectOutput, err error) {
+			if isForbidden(err) {
+				mutex.Lock()
+				unreadable[key] = true
+				mutex.Unlock()
+			}
+		})
+		return unreadable
+	}
+
+	unchecked := make(map[string]string)
+	unreadableNow := check(candidates[:min(len(candidates), ACCESS_CHECK_SAMPLE)])
+	if len(unreadableNow) > 0 && len(candidates) > ACCESS_CHECK_SAMPLE {
+		for key := range check(candidates[ACCESS_CHECK_SAMPLE:]) {
+			unreadableNow[key] = true
+		}
+	} else if len(candidates) > ACCESS_CHECK_SAMPLE {
+		for _, key := range candidates[ACCESS_CHECK_SAMPLE:] {
+			unchecked[key] = etags[key]
+		}
+	}
+	a.UncheckedCache.Store(unchecked)
+
+	unreadable := make(map[string]string)
+	var readable []*s3.Object
+	var example string
+	for _, obj := range objects {
+		key, etag := *obj.Key, aws.StringValue(obj.ETag)
+		if unreadableNow[key] || stillUnreadable(key, etag) {
+			unreadable[key] = etag
+			if unreadableNow[key] {
+				example = key
+			}
+			continue
+		}
+		readable = append(readable, obj)
+	}
+	a.UnreadableCache.Store(unreadable)
+
+	// Only warn about the ones just found, not again on every refresh
+	if len(unreadableNow) > 0 {
+		fmt.Printf("Skipping %d photos in album %s of %s that the site's AWS key can't read, like %s\n", len(unreadableNow),
+			a.Path, a.site.Domain, example)
+	}
+	return readable
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ACTIVITYPUB_CONTENT_TYPE = "application/activity+json"
+const ACTIVITYPUB_FOLLOWERS_STATE_FILE = "activitypub_followers.json"
+const ACTIVITYPUB_KEYS_DIR_NAME = "activitypub"
+const DEFAULT_ACTIVITYPUB_USER = "gallery"
+
+// How far off the Date of a signed request can be, for servers with clocks that aren't quite right
+const ACTIVITYPUB_SIGNATURE_MAX_AGE = 12 * time.Hour
+
+const WEBFINGER_PATH = "/.well-known/webfinger"
+const ACTIVITYPUB_ACTOR_PATH = "/activitypub/actor"
+const ACTIVITYPUB_INBOX_PATH = "/activitypub/inbox"
+const ACTIVITYPUB_OUTBOX_PATH = "/activitypub/outbox"
+
+var activityPubContext = []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+// Follower inboxes per site domain, keyed by the follower's actor id
+type ActivityPubFollowers struct {
+	mutex   sync.Mutex
+	loaded  bool
+	Inboxes map[string]map[string]string
+}
+
+var activityPubFollowers = &ActivityPubFollowers{Inboxes: make(map[string]map[string]string)}
+
+var activityPubKeys = struct {
+	sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}{keys: make(map[string]*rsa.PrivateKey)}
+
+func (s *Site) GetActivityPubUser() string {
+	if s.ActivityPubUser != "" {
+		return s.ActivityPubUser
+	}
+	return DEFAULT_ACTIVITYPUB_USER
+}
+
+func (s *Site) getActivityPubUrl(path string) string {
+	u := s.GetCanonicalUrl()
+	u.Path = path
+	return u.String()
+}
+
+// Each site gets its own key pair, created on first use and kept in the data dir so followers can keep verifying us
+func (s *Site) getActivityPubKey() (*rsa.PrivateKey, error) {
+	activityPubKeys.Lock()
+	defer activityPubKeys.Unlock()
+
+	if key, ok := activityPubKeys.keys[s.Domain]; ok {
+		return key, nil
+	}
+
+	path := filepath.Join(app.dataDir, ACTIVITYPUB_KEYS_DIR_NAME, s.Domain+".pem")
+	var key *rsa.PrivateKey
+	if data, err := ioutil.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("Invalid ActivityPub key file %s", path)
+		}
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	activityPubKeys.keys[s.Domain] = key
+	return key, nil
+}
+
+func writeActivityPubJSON(w http.ResponseWriter, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Unable to write ActivityPub response. Error: %s\n", err.Error())
+	}
+}
+
+func handleWebfinger(site *Site, w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	subject := fmt.Sprintf("acct:%s@%s", site.GetActivityPubUser(), site.Domain)
+	if resource != subject && resource != site.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown resource\n"))
+		return
+	}
+
+	writeActivityPubJSON(w, "application/jrd+json", map[string]interface{}{
+		"subject": subject,
+		"links": []map[string]string{
+			{"rel": "self", "type": ACTIVITYPUB_CONTENT_TYPE, "href": site.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH)},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": site.GetCanonicalUrl().String()},
+		},
+	})
+}
+
+func handleActivityPubActor(site *Site, w http.ResponseWriter, r *http.Request) {
+	key, err := site.getActivityPubKey()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	actorUrl := site.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH)
+	writeActivityPubJSON(w, ACTIVITYPUB_CONTENT_TYPE, map[string]interface{}{
+		"@context":          activityPubContext,
+		"id":                actorUrl,
+		"type":              "Service",
+		"preferredUsername": site.GetActivityPubUser(),
+		"name":              site.SiteTitle,
+		"summary":           site.MetaTitle,
+		"url":               site.GetCanonicalUrl().String(),
+		"inbox":             site.getActivityPubUrl(ACTIVITYPUB_INBOX_PATH),
+		"outbox":            site.getActivityPubUrl(ACTIVITYPUB_OUTBOX_PATH),
+		"publicKey": map[string]string{
+			"id":           actorUrl + "#main-key",
+			"owner":        actorUrl,
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})),
+		},
+	})
+}
+
+func (s *Site) newCreateActivity(album *Album, published time.Time) map[string]interface{} {
+	albumUrl := album.GetCanonicalUrl().String()
+	note := map[string]interface{}{
+		"id":           albumUrl + "#note",
+		"type":         "Note",
+		"attributedTo": s.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH),
+		"content":      fmt.Sprintf(`<p>New album: <a href="%s">%s</a></p>`, albumUrl, html.EscapeString(album.AlbumTitle)),
+		"url":          albumUrl,
+		"published":    published.UTC().Format(time.RFC3339),
+		"to":           []string{"https://www.w3.org/ns/activitystreams#Public"},
+	}
+
+	if cover := album.GetCoverPhotoForTemplate(); cover.Slug() != "" {
+		note["attachment"] = []map[string]string{
+			{"type": "Image", "mediaType": "image/jpeg", "url": cover.GetPhotoForWidth(800)},
+		}
+	}
+
+	return map[string]interface{}{
+		"id":        albumUrl + "#create",
+		"type":      "Create",
+		"actor":     s.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH),
+		"published": note["published"],
+		"to":        note["to"],
+		"object":    note,
+	}
+}
+
+func handleActivityPubOutbox(site *Site, w http.ResponseWriter, r *http.Request) {
+	type publishedAlbum struct {
+		album     *Album
+		published time.Time
+	}
+
+	var albums []publishedAlbum
+	for _, a := range site.GetAlbumsForIndex() {
+		if t, ok := announcements.PublishedAt(a); ok {
+			albums = append(albums, publishedAlbum{a, t})
+		}
+	}
+	sort.Slice(albums, func(i, j int) bool { return albums[i].published.After(albums[j].published) })
+
+	items := make([]interface{}, 0, len(albums))
+	for _, a := range albums {
+		items = append(items, site.newCreateActivity(a.album, a.published))
+	}
+
+	writeActivityPubJSON(w, ACTIVITYPUB_CONTENT_TYPE, map[string]interface{}{
+		"@context":     activityPubContext,
+		"id":           site.getActivityPubUrl(ACTIVITYPUB_OUTBOX_PATH),
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	})
+}
+
+/*
+The inbox only understands Follow and Undo Follow, which is all that's needed to let people follow the gallery.
+Activities must be signed by their actor with HTTP Signatures, like every Fediverse server does, otherwise anyone could
+follow or unfollow the gallery in someone else's name.
+*/
+func handleActivityPubInbox(site *Site, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var activity struct {
+		Id     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(body, &activity); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if activity.Type != "Follow" && activity.Type != "Undo" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	actor, err := site.verifyActivityPubSignature(r, body, activity.Actor)
+	if err != nil {
+		fmt.Printf("Refused ActivityPub %s from %s. Error: %s\n", activity.Type, activity.Actor, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		inbox := firstNonEmpty(actor.Endpoints.SharedInbox, actor.Inbox)
+		if err := checkActivityPubUrl(inbox); err != nil {
+			fmt.Printf("Unable to follow back ActivityPub actor %s. Error: %s\n", activity.Actor, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := activityPubFollowers.Add(site.Domain, activity.Actor, inbox); err != nil {
+			fmt.Printf("Unable to save ActivityPub followers. Error: %s\n", err.Error())
+		}
+
+		accept := map[string]interface{}{
+			"@context": activityPubContext,
+			"id":       fmt.Sprintf("%s#accept-%d", site.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH), time.Now().UnixNano()),
+			"type":     "Accept",
+			"actor":    site.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH),
+			"object":   activity,
+		}
+		go func() {
+			if err := site.deliverActivity(inbox, accept); err != nil {
+				fmt.Printf("Unable to accept ActivityPub follow from %s. Error: %s\n", activity.Actor, err.Error())
+			}
+		}()
+	case "Undo":
+		var object struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(activity.Object, &object) == nil && object.Type == "Follow" {
+			if err := activityPubFollowers.Remove(site.Domain, activity.Actor); err != nil {
+				fmt.Printf("Unable to save ActivityPub followers. Error: %s\n", err.Error())
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *ActivityPubFollowers) load() error {
+	if f.loaded {
+		return nil
+	}
+	if err := loadJSONState(ACTIVITYPUB_FOLLOWERS_STATE_FILE, &f.Inboxes); err != nil {
+		return err
+	}
+	f.loaded = true
+	return nil
+}
+
+func (f *ActivityPubFollowers) Add(domain, actor, inbox string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	if f.Inboxes[domain] == nil {
+		f.Inboxes[domain] = make(map[string]string)
+	}
+	f.Inboxes[domain][actor] = inbox
+	return saveJSONState(ACTIVITYPUB_FOLLOWERS_STATE_FILE, f.Inboxes)
+}
+
+func (f *ActivityPubFollowers) Remove(domain, actor string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	delete(f.Inboxes[domain], actor)
+	return saveJSONState(ACTIVITYPUB_FOLLOWERS_STATE_FILE, f.Inboxes)
+}
+
+// Returns the distinct inboxes of a site's followers
+func (f *ActivityPubFollowers) ForSite(domain string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var inboxes []string
+	for _, inbox := range f.Inboxes[domain] {
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes, nil
+}
+
+type activityPubActor struct {
+	Id        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		Id           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+/*
+Actors, keys and inboxes are URLs anyone can put in an activity, so they're only fetched over HTTPS from public
+addresses, checked again when connecting so a host can't resolve to a private address after the check.
+*/
+func checkActivityPubUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return fmt.Errorf("%s isn't an https URL", rawUrl)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) {
+		return fmt.Errorf("%s isn't a public address", rawUrl)
+	}
+	return nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+var activityPubClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("%s isn't a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	// Redirects are checked like the URLs themselves
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("Too many redirects")
+		}
+		return checkActivityPubUrl(req.URL.String())
+	},
+}
+
+func (s *Site) fetchActor(actorUrl string) (*activityPubActor, error) {
+	if err := checkActivityPubUrl(actorUrl); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, actorUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ACTIVITYPUB_CONTENT_TYPE)
+	if err := s.signActivityPubRequest(req, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := activityPubClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Actor %s returned %s", actorUrl, resp.Status)
+	}
+
+	var actor activityPubActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&actor); err != nil {
+		return nil, err
+	}
+	return &actor, nil
+}
+
+// Parses a Signature header, like keyId="...",algorithm="rsa-sha256",headers="...",signature="..."
+func parseSignatureHeader(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[name] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+/*
+Checks that a request to the inbox was signed by the key of the actor it claims to come from, and returns the actor.
+The key is fetched from the actor's own server, it has to belong to the actor, and the signature has to cover the
+request's target, host, date and the digest of its body, so it can't be replayed on another request.
+*/
+func (s *Site) verifyActivityPubSignature(r *http.Request, body []byte, actorUrl string) (*activityPubActor, error) {
+	params := parseSignatureHeader(r.Header.Get("Signature"))
+	keyId, signed := params["keyId"], strings.Fields(params["headers"])
+	if keyId == "" || params["signature"] == "" {
+		return nil, errors.New("The request isn't signed")
+	}
+	covered := make(map[string]bool)
+	for _, h := range signed {
+		covered[h] = true
+	}
+	for _, required := range []string{"(request-target)", "host", "date", "digest"} {
+		if !covered[required] {
+			return nil, fmt.Errorf("The signature doesn't cover %s", required)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > ACTIVITYPUB_SIGNATURE_MAX_AGE {
+		return nil, errors.New("The request's date is missing or too far off")
+	}
+	digest := sha256.Sum256(body)
+	if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return nil, errors.New("The body doesn't match its digest")
+	}
+
+	keyUrl, err := url.Parse(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if actor, err := url.Parse(actorUrl); err != nil || actor.Host != keyUrl.Host {
+		return nil, errors.New("The key isn't on the actor's server")
+	}
+	keyUrl.Fragment = ""
+	actor, err := s.fetchActor(keyUrl.String())
+	if err != nil {
+		return nil, err
+	}
+	if actor.Id != actorUrl || actor.PublicKey.Id != keyId || actor.PublicKey.Owner != actorUrl {
+		return nil, errors.New("The key doesn't belong to the actor")
+	}
+
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, errors.New("The actor's key is invalid")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The actor's key isn't an RSA key")
+	}
+
+	var signingString []string
+	for _, h := range signed {
+		switch h {
+		case "(request-target)":
+			signingString = append(signingString, fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "host":
+			signingString = append(signingString, "host: "+r.Host)
+		default:
+			signingString = append(signingString, fmt.Sprintf("%s: %s", h, r.Header.Get(h)))
+		}
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(strings.Join(signingString, "\n")))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return nil, errors.New("The signature doesn't match")
+	}
+	return actor, nil
+}
+
+func (s *Site) deliverActivity(inbox string, activity interface{}) error {
+	if err := checkActivityPubUrl(inbox); err != nil {
+		return err
+	}
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ACTIVITYPUB_CONTENT_TYPE)
+	if err := s.signActivityPubRequest(req, body); err != nil {
+		return err
+	}
+
+	resp, err := activityPubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Inbox %s returned %s", inbox, resp.Status)
+	}
+	return nil
+}
+
+// Delivers a Create activity for a newly published album to everyone following the site
+func (s *Site) PublishAlbumToFollowers(album *Album, published time.Time) {
+	inboxes, err := activityPubFollowers.ForSite(s.Domain)
+	if err != nil {
+		fmt.Printf("Unable to load ActivityPub followers. Error: %s\n", err.Error())
+		return
+	}
+
+	activity := s.newCreateActivity(album, published)
+	activity["@context"] = activityPubContext
+	for _, inbox := range inboxes {
+		if err := s.deliverActivity(inbox, activity); err != nil {
+			fmt.Printf("Unable to deliver album %s to %s. Error: %s\n", album.Path, inbox, err.Error())
+		}
+	}
+}
+
+// Signs a request with the site key using HTTP Signatures, which most ActivityPub servers require
+func (s *Site) signActivityPubRequest(req *http.Request, body []byte) error {
+	key, err := s.getActivityPubKey()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Host", req.URL.Host)
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		digest := sha256.Sum256(body)
+		req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+		headers = append(headers, "digest")
+	}
+
+	var signingString []string
+	for _, h := range headers {
+		if h == "(request-target)" {
+			signingString = append(signingString, fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI()))
+		} else {
+			signingString = append(signingString, fmt.Sprintf("%s: %s", h, req.Header.Get(h)))
+		}
+	}
+
+	hashed := sha256.Sum256([]byte(strings.Join(signingString, "\n")))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s#main-key",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		s.getActivityPubUrl(ACTIVITYPUB_ACTOR_PATH), strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
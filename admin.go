@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ADMIN_TOKEN_ENV_VAR = "FIFTYMM_ADMIN_TOKEN"
+const PROFILING_ENV_VAR = "FIFTYMM_PROFILING"
+
+const ADMIN_PATH_PREFIX = "/admin/"
+const ADMIN_CACHE_REFRESH_PATH = "/admin/cache/refresh"
+
+var startedAt = time.Now()
+
+/*
+Admin pages are served on every domain under /admin/, and need the admin token either as a bearer token or as the
+password of HTTP basic auth (with any username), so they can be opened in a browser.
+*/
+func checkAdminToken(r *http.Request) bool {
+	if app.adminToken == "" {
+		return false
+	}
+
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else if _, p, ok := r.BasicAuth(); ok {
+		token = p
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(app.adminToken)) == 1
+}
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.adminToken == "" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 page not found\n"))
+			return
+		}
+
+		if !checkAdminToken(r) {
+			// Browsers ask for a password first, only wrong ones are worth logging
+			if r.Header.Get("Authorization") != "" {
+				recordAuthFailure(r, "admin")
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="50mm admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Unauthorized\n"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	if app.profiling {
+		// pprof expects to be served at /debug/pprof/, so the /admin prefix is stripped first
+		debug := http.NewServeMux()
+		debug.HandleFunc("/debug/pprof/", pprof.Index)
+		debug.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debug.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debug.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debug.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/admin/debug/pprof/", http.StripPrefix("/admin", debug))
+		mux.HandleFunc("GET /admin/debug/runtime", handleAdminRuntime)
+		mux.Handle("GET /admin/debug/metrics", metrics)
+	}
+
+	mux.HandleFunc("POST "+ADMIN_CACHE_REFRESH_PATH, handleAdminCacheRefresh)
+	mux.HandleFunc("GET "+ADMIN_AUDIT_PATH, handleAdminAudit)
+	mux.HandleFunc("POST "+ADMIN_RESTORE_PATH, handleAdminRestore)
+	mux.HandleFunc("POST "+ADMIN_SESSIONS_REVOKE_PATH, handleAdminSessionsRevoke)
+	mux.HandleFunc("GET "+ADMIN_VISITORS_PATH, handleAdminVisitors)
+	mux.HandleFunc("GET "+ADMIN_STATS_PATH, handleAdminStats)
+	mux.HandleFunc("GET "+ADMIN_DOWNLOADS_CSV_PATH, handleAdminDownloadsCSV)
+	mux.HandleFunc("GET "+ADMIN_CAPTIONS_PATH, handleAdminCaptions)
+	mux.HandleFunc("POST "+ADMIN_CAPTIONS_PATH, handleAdminCaptionsSave)
+	mux.HandleFunc("GET "+ADMIN_UPLOADS_PATH, handleAdminUploads)
+	mux.HandleFunc("POST "+ADMIN_UPLOADS_PATH, handleAdminUploadsReview)
+
+	return requireAdmin(methodsMiddleware(mux, nil)(mux))
+}
+
+/*
+Reloads an album's photos straight away, used by `50mm import` and `50mm sync` after uploading. They also send how many
+photos they uploaded and deleted, for the audit log.
+*/
+func handleAdminCacheRefresh(w http.ResponseWriter, r *http.Request) {
+	site, err := app.SiteForDomain(r.FormValue("site"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	album, err := site.GetAlbumForPath(r.FormValue("album"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	for action, field := range map[string]string{AUDIT_UPLOAD: "uploaded", AUDIT_DELETE: "deleted"} {
+		if n, _ := strconv.Atoi(r.FormValue(field)); n > 0 {
+			recordAuditEvent(&AuditEvent{Action: action, Site: site.Domain, Album: album.Path, Remote: clientIP(r), Detail: fmt.Sprintf("%d photos", n)})
+		}
+	}
+	recordAuditEvent(&AuditEvent{Action: AUDIT_CACHE_REFRESH, Site: site.Domain, Album: album.Path, Remote: clientIP(r)})
+
+	if err := album.RefreshCache(r.Context()); err != nil {
+		reportError("refresh album cache", err, albumErrorContext(album))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+type RuntimeStats struct {
+	Uptime     string
+	Goroutines int
+	NumGC      uint32
+
+	HeapAlloc   uint64
+	HeapInuse   uint64
+	HeapObjects uint64
+	Sys         uint64
+
+	Sites         int
+	Albums        int
+	CachedKeys    int
+	CachedPages   int
+	CachedPagesKB int
+	QueuedJobs    int
+}
+
+// Memory stats next to the size of our own caches, to tell whether memory growth comes from big albums
+func handleAdminRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := &RuntimeStats{
+		Uptime:      time.Now().Sub(startedAt).Round(time.Second).String(),
+		Goroutines:  runtime.NumGoroutine(),
+		NumGC:       mem.NumGC,
+		HeapAlloc:   mem.HeapAlloc,
+		HeapInuse:   mem.HeapInuse,
+		HeapObjects: mem.HeapObjects,
+		Sys:         mem.Sys,
+		Sites:       len(app.sites),
+	}
+
+	for _, site := range app.sites {
+		for _, album := range site.Albums {
+			stats.Albums++
+			if keys, ok := album.KeyCache.Load().([]string); ok {
+				stats.CachedKeys += len(keys)
+			}
+		}
+	}
+	stats.CachedPages, stats.CachedPagesKB = pageCache.Size()
+	stats.QueuedJobs = jobQueue.Depth()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
@@ -12,28 +13,126 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/go-ini/ini"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const CACHE_INTERVAL = 1 * time.Hour
 
+// The number of photos the album page loads straight away, the rest are lazy loaded as visitors scroll
+const ABOVE_THE_FOLD_PHOTOS = 10
+
 type Album struct {
 	site *Site
 
-	Path         string
-	BucketPrefix string
+	Path         string `desc:"Path the album is served at, like /travel/"`
+	BucketPrefix string `desc:"Prefix of the album's photos in the bucket"`
+
+	FormerPrefixes []string `desc:"Prefixes the album's photos were at before, redirected here, like summer-2019/ or /summer/=summer-2019/"`
+
+	AuthUser string `desc:"Username for HTTP basic auth on the album"`
+	AuthPass string `desc:"Password for HTTP basic auth on the album"`
+
+	AuthRealm  string `default:"site" desc:"Text of the browser's login prompt"`
+	AuthPrompt string `default:"site" desc:"Text on the password page in cookie mode"`
+	AuthImage  string `default:"site" desc:"Key of a photo in the bucket shown on the password page in cookie mode"`
+
+	SessionHours   int `default:"site" desc:"Hours visitors stay logged in to the album with the cookie AuthMode"`
+	AuthGraceHours int `default:"site" desc:"Hours sessions from before the album's AuthPass changed keep working"`
+
+	MetaTitle  string `desc:"Page title of the album"`
+	AlbumTitle string `desc:"Title shown on the album page"`
+
+	Description string `desc:"Text shown below the album's title"`
+
+	InIndex   bool `default:"true" desc:"List the album in the site index"`
+	Crawlable bool `default:"true" desc:"Let search engines crawl the album, it's listed in robots.txt otherwise"`
+	OgImage   bool `default:"true" desc:"Make the album's link preview from its cover photo with its title on it"`
+
+	CanonicalUrl string `desc:"Full URL of the album elsewhere, for links and previews"`
+
+	EmbedDomains []string `desc:"Only these other domains (and their subdomains) can show the album's embed, like wedding.example.com"`
+
+	IndexThumbnails int   `default:"site" desc:"Thumbnails shown below the album's cover in the index (0 is none)"`
+	GridColumns     []int `default:"site" desc:"Photo columns on small, medium and large screens"`
+	MaxPhotos       int   `default:"0" desc:"Most photos the album shows, the first ones in its order, for prefixes too big to show whole (0 is no limit)"`
+
+	Theme           string `default:"site" desc:"Color theme, light or dark"`
+	BackgroundColor string `default:"site" desc:"Background color override"`
+	TextColor       string `default:"site" desc:"Text color override"`
+	GridGap         int    `default:"site" desc:"Space between photos in the grid, in pixels (0 is no gap)"`
+
+	ContactForm bool `default:"false" desc:"Show a contact form on the album page"`
+
+	ContactSheet bool `default:"false" desc:"Link to a printable contact sheet of numbered thumbnails with their file names, /<album path>/sheet"`
+	Compare      bool `default:"false" desc:"Let visitors pick 2 to 4 photos and compare them side by side"`
+
+	ZipDownload bool `default:"false" desc:"Let visitors download the album's photos as a zip"`
+	ZipMaxMB    int  `default:"site" desc:"Largest zip visitors can download at once, in MB"`
+
+	GuestUploadToken      string `desc:"Secret in the link guests upload photos with, /<album path>/upload/<token>"`
+	GuestUploadUntil      string `desc:"Last day guests can upload, like 2026-06-30"`
+	GuestUploadPrefix     string `default:"BucketPrefix" desc:"Folder in the bucket guest uploads go to"`
+	GuestUploadModeration bool   `default:"false" desc:"Hold guest uploads until they're approved in /admin/uploads"`
+	GuestUploadMaxMB      int    `default:"site" desc:"Largest photo guests can upload, in MB"`
+	GuestUploadTotalMB    int    `default:"site" desc:"Most guests can upload with the link altogether, in MB"`
+
+	AltTextTemplate string `default:"site" desc:"Alt text of photos without a caption or .alt file"`
+	AutoCaption     bool   `default:"false" desc:"Have the site's CaptionCommand or CaptionEndpoint describe photos without a caption or alt text"`
+
+	FilenamePattern string `default:"site" desc:"Reads photo titles and dates from file names, like %Y-%m-%d_%H%M_%t_*"`
+
+	PublishSchedule string `desc:"Cron schedules for publish, unpublish, refresh and rotate-cover, separated by |"`
 
-	AuthUser string
-	AuthPass string
+	VisitorCounter string `default:"off" desc:"Count unique visitors: off, owner (in /admin/visitors) or public (also in the footer)"`
 
-	MetaTitle  string
-	AlbumTitle string
+	BlurFaces bool `default:"false" desc:"Pixelate faces in the album's photos"`
 
-	InIndex bool
+	StackThreshold int `default:"0" desc:"Stack near-identical photos like bursts in the grid, up to this many of 64 bits apart (0 is off, 10 is a good start)"`
 
-	KeyCache        atomic.Value
-	LastCacheUpdate time.Time
+	DeepZoom bool `default:"false" desc:"Cut photos of at least the site's DeepZoomMegapixels into tiles, to zoom into them on their page"`
+
+	EventDate    string `desc:"Date of the event, YYYY-MM-DD"`
+	EventEndDate string `default:"EventDate" desc:"Last day of multi day events"`
+
+	KeyCache         atomic.Value
+	ETagCache        atomic.Value
+	PairCache        atomic.Value
+	SensitiveCache   atomic.Value
+	ArchiveCache     atomic.Value
+	UnreadableCache  atomic.Value // ETags of photos the site can't read, by key
+	UncheckedCache   atomic.Value // ETags of new or changed photos the access check hasn't sampled yet, by key
+	TextSidecarCache atomic.Value // Alt text, caption and tags sidecars, by their key
+	LastCacheUpdate  time.Time
+	cacheGeneration  uint64
 
 	CacheUpdateMutex sync.Mutex
+
+	S3Concurrency int `default:"site" desc:"S3 calls the album can make at once"`
+
+	dateRangeCache albumDateRangeCache
+	slugCache      albumSlugCache
+	photoCache     albumPhotoCache
+	s3Limit        albumS3Limit
+
+	// Key to *PhotoInfo, for photos whose EXIF data has been read
+	photoInfoCache sync.Map
+	// Key to the photo's hash, for albums with a StackThreshold
+	photoHashCache sync.Map
+	// Key to *GeneratedCaption, for albums with AutoCaption
+	generatedCaptionCache sync.Map
+	// Key to the photo's blurhash, for photos whose thumbnail is made
+	blurhashCache sync.Map
+	// Key to *DeepZoomInfo, for photos of albums with DeepZoom whose tiles are made
+	deepZoomCache sync.Map
+	// What the album's listing looked like when it was last polled, for sites with ChangePollSeconds
+	changePoll albumChangePoll
+	// Keys of photos flagged as sensitive in their metadata
+	sensitiveMetadata sync.Map
+	// Key to *existsResult, for keys ImageExists has looked up
+	existsCache     sync.Map
+	existsCacheSize int64
 }
 
 type GetFromCacheResult struct {
@@ -42,7 +141,7 @@ type GetFromCacheResult struct {
 }
 
 func NewAlbumFromConfig(section *ini.Section, s *Site) (*Album, error) {
-	album := &Album{site: s, InIndex: true}
+	album := &Album{site: s, InIndex: true, Crawlable: true, OgImage: true, GridGap: UNSET, IndexThumbnails: UNSET}
 	if err := section.MapTo(album); err != nil {
 		return nil, err
 	}
@@ -57,14 +156,18 @@ func NewAlbumFromConfig(section *ini.Section, s *Site) (*Album, error) {
 
 func NewAlbum(s *Site, path string, bucketPrefix string, authUser string, authPass string, metaTitle string, albumTitle string) (*Album, error) {
 	album := &Album{
-		site:         s,
-		Path:         path,
-		BucketPrefix: bucketPrefix,
-		AuthUser:     authUser,
-		AuthPass:     authPass,
-		MetaTitle:    metaTitle,
-		AlbumTitle:   albumTitle,
-		InIndex:      true,
+		site:            s,
+		Path:            path,
+		BucketPrefix:    bucketPrefix,
+		AuthUser:        authUser,
+		AuthPass:        authPass,
+		MetaTitle:       metaTitle,
+		AlbumTitle:      albumTitle,
+		InIndex:         true,
+		Crawlable:       true,
+		OgImage:         true,
+		GridGap:         UNSET,
+		IndexThumbnails: UNSET,
 	}
 
 	if err := album.IsValid(); err != nil {
@@ -80,8 +183,83 @@ func (a *Album) IsValid() error {
 		return errors.New("'Path' is a required parameters that must have a valid value.")
 	}
 
-	if a.InIndex && a.HasOwnAuth() {
-		return errors.New("An album that requires authentication can't be shown in the index. If you need authentication please add it to the site.")
+	// The admin pages and static files are served for every domain, ahead of the site's own routes
+	for _, reserved := range []string{ADMIN_PATH_PREFIX, STATIC_PATH} {
+		if strings.HasPrefix("/"+strings.Trim(a.Path, "/")+"/", reserved) {
+			return fmt.Errorf("Path can't start with %s, that's where 50mm serves its own pages", reserved)
+		}
+	}
+
+	if a.InIndex && a.HasOwnAuth() && !a.site.ShowLockedInIndex {
+		return errors.New("An album that requires authentication can't be shown in the index. If you need authentication please add it to the site, or set ShowLockedInIndex to list it as locked.")
+	}
+
+	if a.CanonicalUrl != "" {
+		if u, err := url.Parse(a.CanonicalUrl); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("CanonicalUrl must be a full URL, like https://photos.example.com/travel/")
+		}
+	}
+
+	for _, domain := range a.EmbedDomains {
+		if d := strings.TrimSpace(domain); d == "" || strings.ContainsAny(d, "/:* ;'") {
+			return fmt.Errorf("EmbedDomains must be domain names like wedding.example.com, not %q", domain)
+		}
+	}
+
+	if a.IndexThumbnails < 0 && a.IndexThumbnails != UNSET {
+		return errors.New("IndexThumbnails can't be negative")
+	}
+
+	if a.MaxPhotos < 0 {
+		return errors.New("MaxPhotos can't be negative")
+	}
+
+	if a.S3Concurrency < 0 {
+		return errors.New("S3Concurrency can't be negative")
+	}
+
+	if a.ZipMaxMB < 0 {
+		return errors.New("ZipMaxMB can't be negative")
+	}
+
+	if err := validateStackThreshold(a.StackThreshold); err != nil {
+		return err
+	}
+
+	if err := validateGuestUpload(a); err != nil {
+		return err
+	}
+
+	if err := validateGridColumns(a.GridColumns); err != nil {
+		return err
+	}
+
+	if err := validateTheme(a.Theme, a.BackgroundColor, a.TextColor, a.GridGap); err != nil {
+		return err
+	}
+
+	start, err := parseEventDate("EventDate", a.EventDate)
+	if err != nil {
+		return err
+	}
+	if end, err := parseEventDate("EventEndDate", a.EventEndDate); err != nil {
+		return err
+	} else if !end.IsZero() && (start.IsZero() || end.Before(start)) {
+		return errors.New("EventEndDate needs an EventDate on or before it")
+	}
+
+	if err := validateVisitorCounter(a); err != nil {
+		return err
+	}
+
+	if err := validatePublishSchedule(a); err != nil {
+		return err
+	}
+
+	if a.BlurFaces {
+		if _, err := loadFaceFinder(); err != nil {
+			return fmt.Errorf("BlurFaces needs the face detection cascade at %s. Error: %s", FACE_CASCADE_PATH, err.Error())
+		}
 	}
 	return nil
 }
@@ -96,6 +274,11 @@ func (a *Album) HasOwnAuth() bool {
 	return a.AuthUser != "" && a.AuthPass != ""
 }
 
+// Albums with their own password are shown in the index without their photos, if at all
+func (a *Album) IsLocked() bool {
+	return a.HasOwnAuth()
+}
+
 // An album inherits it's sites auth settings if the album config doesn't override them. If both the site and album have
 // auth enabled, the album auth takes precedence
 func (a *Album) HasAuth() bool {
@@ -118,17 +301,109 @@ func (a *Album) GetAuthPass() string {
 	}
 }
 
+// Like auth, the index thumbnail count and grid density fall back to the site settings when the album doesn't set them
+func (a *Album) GetIndexThumbnails() int {
+	if a.IndexThumbnails != UNSET {
+		return a.IndexThumbnails
+	}
+	return a.site.GetIndexThumbnails()
+}
+
+func (a *Album) GetGridColumns() *GridColumns {
+	if len(a.GridColumns) > 0 {
+		return NewGridColumns(a.GridColumns)
+	}
+	return a.site.GetGridColumns()
+}
+
+func (a *Album) GetS3Concurrency() int {
+	if a.S3Concurrency > 0 {
+		return a.S3Concurrency
+	}
+	return a.site.GetS3Concurrency()
+}
+
+/*
+The URL search engines, link previews and feeds are given for the album. Albums moving to another domain can point
+there with CanonicalUrl while this site still serves them, so links and forms on this site use GetSiteUrl instead.
+*/
 func (a *Album) GetCanonicalUrl() *url.URL {
+	if a.CanonicalUrl != "" {
+		if u, err := url.Parse(a.CanonicalUrl); err == nil {
+			if !strings.HasSuffix(u.Path, "/") {
+				u.Path += "/"
+			}
+			return u
+		}
+	}
+	return a.GetSiteUrl()
+}
+
+// The album's URL on this site, for requests that have to come back to this server
+func (a *Album) GetSiteUrl() *url.URL {
 	u := a.site.GetCanonicalUrl()
 	u.Path = a.Path
 	return u
 }
 
-func (a *Album) GetCoverPhoto() (Renderable, error) {
-	if photos, err := a.GetAllPhotos(); err != nil {
+// Files a registered renderer claims get its type, photos of albums that proxy them are served through 50mm
+func (a *Album) GetPhotoForKey(key string) Renderable {
+	var photo Renderable
+
+	if a.isArchived(key) {
+		photo = &ArchivedPhoto{Key: key}
+	} else if r := rendererForKey(key); r != nil {
+		photo = r.New(a, key)
+	} else if a.ProxiesPhotos() {
+		photo = &ProxyPhoto{Key: key, Url: a.GetMediaUrl(key)}
+	} else {
+		photo = a.site.GetPhotoForKey(key)
+		// Sites with a base URL that can't be parsed have no Imgix photos
+		if p, ok := photo.(*ImgixPhoto); ok && p == nil {
+			return photo
+		}
+	}
+
+	d, ok := photo.(photoDetails)
+	if !ok {
+		return photo
+	}
+	details := d.details()
+
+	if info, ok := a.photoInfoCache.Load(key); ok {
+		details.info = info.(*PhotoInfo)
+	}
+	details.pair = a.getPairedFile(key)
+	details.sensitive = a.isSensitive(key)
+	details.alt = a.altText(key, details.info)
+	details.caption = a.caption(key, details.info)
+	details.tags = a.tags(key)
+	details.title, details.date = a.parseFilename(key)
+	if hash := a.photoBlurhash(key); hash != "" {
+		details.setMetadata("blurhash", hash)
+	}
+	return photo
+}
+
+/*
+Remembers the size of a photo for templates. Cached photos and pages were built without it, so they're dropped the first
+time a photo's size is known.
+*/
+func (a *Album) setPhotoInfo(key string, info *PhotoInfo) {
+	if info == nil {
+		return
+	}
+	if _, loaded := a.photoInfoCache.Swap(key, info); !loaded {
+		a.photosChanged()
+	}
+}
+
+// The first photo that isn't sensitive or archived, which stands for the album on the index page, in link previews and in feeds
+func (a *Album) GetCoverPhoto(ctx context.Context) (Renderable, error) {
+	if photos, err := a.GetAllPhotos(ctx); err != nil {
 		return nil, err
 	} else {
-		if len(photos) > 0 {
+		if photos = a.rotateForCover(previewable(photos)); len(photos) > 0 {
 			return photos[0], nil
 		}
 	}
@@ -137,8 +412,8 @@ func (a *Album) GetCoverPhoto() (Renderable, error) {
 }
 
 func (a *Album) GetCoverPhotoForTemplate() Renderable {
-	if photo, err := a.GetCoverPhoto(); err != nil {
-		fmt.Printf("Unable to get cover photo. Error: %s\n", err.Error())
+	if photo, err := a.GetCoverPhoto(context.Background()); err != nil {
+		reportError("get cover photo", err, albumErrorContext(a))
 		return &ErrorPhoto{}
 	} else {
 		return photo
@@ -146,12 +421,14 @@ func (a *Album) GetCoverPhotoForTemplate() Renderable {
 }
 
 func (a *Album) GetThumbnailPhotosForTemplate() []Renderable {
-	if photos, err := a.GetAllPhotos(); err != nil {
-		fmt.Printf("Unable to get thumbnail photos. Error: %s\n", err.Error())
+	if photos, err := a.GetAllPhotos(context.Background()); err != nil {
+		reportError("get thumbnail photos", err, albumErrorContext(a))
 		return nil
 	} else {
-		if len(photos) > 6 {
-			return photos[1:6]
+		// The first one is the cover photo
+		photos = a.rotateForCover(previewable(photos))
+		if n := a.GetIndexThumbnails(); len(photos) > n+1 {
+			return photos[1 : n+1]
 		} else if len(photos) > 0 {
 			return photos[1:]
 		} else {
@@ -160,13 +437,24 @@ func (a *Album) GetThumbnailPhotosForTemplate() []Renderable {
 	}
 }
 
-func (a *Album) GetAllObjects() ([]*s3.Object, error) {
+func (a *Album) GetAllObjects(ctx context.Context) ([]*s3.Object, error) {
+	if a.site.HasInventory() {
+		return a.site.GetInventoryObjects(ctx, a.BucketPrefix)
+	}
+
 	svc, err := a.site.GetS3Service()
 	if err != nil {
 		return nil, err
 	}
 
-	objects, err := svc.ListObjects(&s3.ListObjectsInput{
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	defer startTiming(ctx, TIMING_S3_LIST)("")
+	objects, err := svc.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
 		Bucket:    aws.String(a.site.BucketName),
 		Prefix:    aws.String(a.BucketPrefix),
 		Delimiter: aws.String("/"),
@@ -178,41 +466,64 @@ func (a *Album) GetAllObjects() ([]*s3.Object, error) {
 	return objects.Contents, nil
 }
 
-func (a *Album) GetAllImageKeysFromBucket() ([]string, error) {
-	objects, err := a.GetAllObjects()
+// Returns the album's objects, without the placeholder objects some tools create for folders
+func (a *Album) GetAllImageObjectsFromBucket(ctx context.Context) ([]*s3.Object, error) {
+	objects, err := a.GetAllObjects(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	var imageKeys []string
+	var imageObjects []*s3.Object
 	for _, obj := range objects {
 		key := *obj.Key
 		if key[len(*obj.Key)-1] != '/' {
-			imageKeys = append(imageKeys, key)
+			imageObjects = append(imageObjects, obj)
 		}
 	}
 
-	return imageKeys, nil
+	imageObjects, archived := a.archivedObjects(ctx, imageObjects)
+	a.ArchiveCache.Store(archived)
+	imageObjects, sensitive := sensitiveObjects(imageObjects)
+	a.SensitiveCache.Store(sensitive)
+	imageObjects = a.textSidecarObjects(ctx, imageObjects)
+	imageObjects, pairs := pairObjects(imageObjects)
+	a.PairCache.Store(pairs)
+	return imageObjects, nil
 }
 
-func (a *Album) GetAllPhotos() ([]Renderable, error) {
-	var imageUrls []Renderable
-
-	imageKeys, err := a.GetAllImageKeys()
+func (a *Album) GetAllImageKeysFromBucket(ctx context.Context) ([]string, error) {
+	objects, err := a.GetAllImageObjectsFromBucket(ctx)
 	if err != nil {
-		fmt.Printf("Unable to get image keys from S3. Error: %s\n", err.Error())
-		return imageUrls, err
+		return nil, err
 	}
 
-	for _, v := range imageKeys {
-		imageUrl := a.site.GetPhotoForKey(v)
-		imageUrls = append(imageUrls, imageUrl)
+	var imageKeys []string
+	for _, obj := range objects {
+		imageKeys = append(imageKeys, *obj.Key)
 	}
 
-	return imageUrls, nil
+	return imageKeys, nil
 }
 
-func (a *Album) GetAllImageKeys() ([]string, error) {
+// The returned slice is shared with other requests, so it must not be modified
+func (a *Album) GetAllPhotos(ctx context.Context) ([]Renderable, error) {
+	entry, err := a.currentPhotos(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return entry.photos, nil
+}
+
+func (a *Album) GetAllImageKeys(ctx context.Context) ([]string, error) {
+	// No caching in dev mode, so new uploads show up straight away
+	if app.devMode {
+		return a.GetAllImageKeysFromBucket(ctx)
+	}
+
+	// The cache may be refreshed after the request that triggered it is done, so the refresh can't be cancelled along
+	// with the request. It still shows up as part of the request's trace.
+	refreshCtx := detachContext(ctx)
+
 	c := make(chan *GetFromCacheResult)
 	go func() {
 		var keys []string
@@ -223,10 +534,9 @@ func (a *Album) GetAllImageKeys() ([]string, error) {
 
 			a.CacheUpdateMutex.Lock()
 			if a.NeedsUpdate() {
-				keys, err = a.GetAllImageKeysFromBucket()
+				keys, err = a.refreshKeys(refreshCtx)
 				if err == nil {
-					a.KeyCache.Store(keys)
-					a.LastCacheUpdate = time.Now()
+					a.storeKeys(keys)
 				}
 			}
 
@@ -234,10 +544,9 @@ func (a *Album) GetAllImageKeys() ([]string, error) {
 		} else {
 			a.CacheUpdateMutex.Lock()
 
-			keys, err = a.GetAllImageKeysFromBucket()
+			keys, err = a.refreshKeys(refreshCtx)
 			if err == nil {
-				a.KeyCache.Store(keys)
-				a.LastCacheUpdate = time.Now()
+				a.storeKeys(keys)
 			}
 			c <- &GetFromCacheResult{keys, err}
 
@@ -253,22 +562,148 @@ func (a *Album) GetAllImageKeys() ([]string, error) {
 	}
 }
 
-func (a *Album) ImageExists(slug string) bool {
+func (a *Album) refreshKeys(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "album.refresh_cache", trace.WithAttributes(
+		attribute.String("site", a.site.Domain),
+		attribute.String("album", a.Path),
+	))
+	defer span.End()
+
+	objects, err := a.GetAllImageObjectsFromBucket(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	previous, _ := a.ETagCache.Load().(map[string]string)
+	objects = a.skipUnreadable(ctx, objects, previous)
+
+	// The listing already has the ETags that derivatives are keyed by, so keep them around with the keys
+	keys := make([]string, 0, len(objects))
+	etags := make(map[string]string, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, *obj.Key)
+		etags[*obj.Key] = aws.StringValue(obj.ETag)
+	}
+	a.ETagCache.Store(etags)
+	a.queueDerivatives(keys, previous)
+
+	span.SetAttributes(attribute.Int("keys", len(keys)))
+	return keys, nil
+}
+
+// Must be called with CacheUpdateMutex held. Every refresh starts a new cache generation, which drops cached pages.
+func (a *Album) storeKeys(keys []string) {
+	a.KeyCache.Store(keys)
+	a.LastCacheUpdate = time.Now()
+	atomic.AddUint64(&a.cacheGeneration, 1)
+	pageCache.Invalidate(a)
+	a.clearExistsCache()
+}
+
+// Reloads the keys right away instead of waiting for the cache to expire, e.g. after new photos were uploaded
+func (a *Album) RefreshCache(ctx context.Context) error {
+	a.CacheUpdateMutex.Lock()
+	defer a.CacheUpdateMutex.Unlock()
+
+	keys, err := a.refreshKeys(ctx)
+	if err != nil {
+		return err
+	}
+	a.storeKeys(keys)
+	return nil
+}
+
+func (a *Album) CacheGeneration() uint64 {
+	return atomic.LoadUint64(&a.cacheGeneration)
+}
+
+/*
+Works out the derivatives of new and changed photos in the background, so visitors don't have to wait for them. Photos
+near the top of the album page go first. Photos past the album's MaxPhotos aren't in its grid, so theirs are only made
+when their own page asks for them.
+*/
+func (a *Album) queueDerivatives(keys []string, previous map[string]string) {
+	etags, _ := a.ETagCache.Load().(map[string]string)
+	for i, key := range a.shownKeys(keys) {
+		if previous != nil && previous[key] == etags[key] {
+			continue
+		}
+		// They can't be read until they're restored
+		if a.isArchived(key) {
+			continue
+		}
+
+		priority := PRIORITY_LOW
+		if i < ABOVE_THE_FOLD_PHOTOS {
+			priority = PRIORITY_HIGH
+		}
+
+		key := key
+		jobQueue.Enqueue(&Job{
+			Name:     DERIVATIVE_EXIF + ":" + a.site.Domain + ":" + key,
+			Priority: priority,
+			Run: func(ctx context.Context) error {
+				_, err := a.GetPhotoExif(ctx, key)
+				return err
+			},
+			ErrorContext: albumErrorContext(a),
+		})
+
+		if a.isThumbnailable(key) {
+			a.queueThumbnail(key, priority)
+		}
+		if a.isStackable(key) {
+			jobQueue.Enqueue(&Job{
+				Name:     DERIVATIVE_PHOTO_HASH + ":" + a.site.Domain + ":" + key,
+				Priority: PRIORITY_LOW,
+				Run: func(ctx context.Context) error {
+					_, _, err := a.GetPhotoHash(ctx, key)
+					return err
+				},
+				ErrorContext: albumErrorContext(a),
+			})
+		}
+		if a.isCaptionable(key) {
+			a.queueGeneratedCaption(key)
+		}
+		if a.isDeepZoomable(key) {
+			a.queueDeepZoom(key)
+		}
+	}
+}
+
+// The ETag of one of the album's photos as of the last cache refresh, empty if the refresh didn't see it
+func (a *Album) cachedETag(key string) string {
+	etags, _ := a.ETagCache.Load().(map[string]string)
+	return etags[key]
+}
+
+// Returns the ETag of one of the album's photos, from the last cache refresh if possible
+func (a *Album) GetETag(ctx context.Context, key string) (string, error) {
+	if etags, ok := a.ETagCache.Load().(map[string]string); ok && etags[key] != "" {
+		return etags[key], nil
+	}
+
 	svc, err := a.site.GetS3Service()
 	if err != nil {
-		return false
+		return "", err
+	}
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return "", err
 	}
+	defer release()
 
-	key := strings.Join([]string{a.BucketPrefix, slug}, "/")
-	_, err = svc.HeadObject(&s3.HeadObjectInput{
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(a.site.BucketName),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return false
+		return "", err
 	}
-
-	return true
+	return aws.StringValue(head.ETag), nil
 }
 
 func (a *Album) NeedsUpdate() bool {
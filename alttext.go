@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+/*
+A photo's alt text, for screen readers, comes from a text file next to it with this added to its name, like
+IMG_1234.JPG.alt, or else from its caption. Photos with neither get the AltTextTemplate, which can use {album}, {site}
+and {name} (the file name, without its extension and with dashes and underscores as spaces).
+*/
+const ALT_TEXT_SIDECAR_EXT = ".alt"
+const DEFAULT_ALT_TEXT_TEMPLATE = "{album}, {name}"
+
+func (a *Album) GetAltTextTemplate() string {
+	return firstNonEmpty(a.AltTextTemplate, a.site.AltTextTemplate, DEFAULT_ALT_TEXT_TEMPLATE)
+}
+
+func (a *Album) altText(key string, info *PhotoInfo) string {
+	if text := a.sidecarText(key, ALT_TEXT_SIDECAR_EXT); text != "" {
+		return text
+	}
+	return a.defaultAltText(key, info)
+}
+
+// The alt text of a photo without an alt text sidecar. Written captions go before generated alt text.
+func (a *Album) defaultAltText(key string, info *PhotoInfo) string {
+	if caption := a.ownCaption(key, info); caption != "" {
+		return caption
+	}
+	if generated := a.generatedCaption(key); generated != nil {
+		return firstNonEmpty(generated.Alt, generated.Caption)
+	}
+
+	name := path.Base(key)
+	name = strings.NewReplacer("_", " ", "-", " ").Replace(strings.TrimSuffix(name, path.Ext(name)))
+	return strings.NewReplacer(
+		"{album}", a.AlbumTitle,
+		"{site}", a.site.SiteTitle,
+		"{name}", strings.TrimSpace(name),
+	).Replace(a.GetAltTextTemplate())
+}
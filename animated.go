@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+Checks whether a photo is animated from the start of its file: GIFs with more than one frame or a loop extension,
+WebPs with the animation flag, and PNGs with an animation control chunk (APNG). The data can be cut short, as only the
+first part of photos is downloaded.
+*/
+func isAnimated(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return isAnimatedGIF(data)
+	case len(data) >= 21 && string(data[:4]) == "RIFF" && string(data[8:16]) == "WEBPVP8X":
+		// The VP8X chunk starts with flags, where 0x02 is the animation flag
+		return data[20]&0x02 != 0
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return isAnimatedPNG(data)
+	}
+	return false
+}
+
+func isAnimatedGIF(data []byte) bool {
+	// The header and logical screen descriptor, followed by the global color table if there is one
+	i := 13
+	if len(data) < i {
+		return false
+	}
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	frames := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // Extension, made of sub-blocks
+			if i+2 > len(data) {
+				return false
+			}
+			label := data[i+1]
+			i += 2
+			if label == 0xFF && i+12 <= len(data) && data[i] == 11 && string(data[i+1:i+12]) == "NETSCAPE2.0" {
+				return true // The loop extension, which only animations have
+			}
+			i = skipGIFSubBlocks(data, i)
+		case 0x2C: // Image descriptor, then the local color table, LZW code size and the image data sub-blocks
+			if frames++; frames > 1 {
+				return true
+			}
+			if i+10 > len(data) {
+				return false
+			}
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&0x07 + 1)
+			}
+			i = skipGIFSubBlocks(data, i+1)
+		default: // The trailer, or something we don't understand
+			return false
+		}
+	}
+	return false
+}
+
+// Returns the index after a chain of GIF sub-blocks, which ends with an empty one
+func skipGIFSubBlocks(data []byte, i int) int {
+	for i < len(data) && data[i] != 0 {
+		i += int(data[i]) + 1
+	}
+	return i + 1
+}
+
+func isAnimatedPNG(data []byte) bool {
+	// Chunks are a 4 byte length, 4 byte type, the data, and a 4 byte CRC. acTL has to come before the image data.
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		switch string(data[i+4 : i+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		i += 12 + length
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ANNOUNCEMENTS_STATE_FILE = "announcements.json"
+
+var webmentionClient = &http.Client{Timeout: 30 * time.Second}
+
+var webmentionLinkRegexp = regexp.MustCompile(`<(?:link|a)\s[^>]*rel="[^"]*\bwebmention\b[^"]*"[^>]*>`)
+var hrefRegexp = regexp.MustCompile(`href="([^"]*)"`)
+
+/*
+Keeps track of when each album was first seen (keyed by canonical URL), so new albums are only announced once, and so
+the ActivityPub outbox can list albums by the date they were published.
+*/
+type Announcements struct {
+	mutex     sync.Mutex
+	Published map[string]time.Time
+}
+
+var announcements = &Announcements{Published: make(map[string]time.Time)}
+
+func (an *Announcements) PublishedAt(a *Album) (time.Time, bool) {
+	an.mutex.Lock()
+	defer an.mutex.Unlock()
+
+	t, ok := an.Published[a.GetCanonicalUrl().String()]
+	return t, ok
+}
+
+// Records any albums that haven't been seen before and returns them
+func (an *Announcements) markNew(albums []*Album) ([]*Album, error) {
+	an.mutex.Lock()
+	defer an.mutex.Unlock()
+
+	var newAlbums []*Album
+	for _, a := range albums {
+		u := a.GetCanonicalUrl().String()
+		if _, ok := an.Published[u]; !ok {
+			an.Published[u] = time.Now()
+			newAlbums = append(newAlbums, a)
+		}
+	}
+
+	if len(newAlbums) == 0 {
+		return nil, nil
+	}
+	return newAlbums, saveJSONState(ANNOUNCEMENTS_STATE_FILE, an.Published)
+}
+
+// Announces albums that appeared since the last run. Sites without announcement settings still get their albums
+// recorded, so turning announcements on later doesn't spam the targets with every existing album.
+func (a *App) AnnounceNewAlbums() {
+	announcements.mutex.Lock()
+	err := loadJSONState(ANNOUNCEMENTS_STATE_FILE, &announcements.Published)
+	firstRun := len(announcements.Published) == 0
+	announcements.mutex.Unlock()
+	if err != nil {
+		fmt.Printf("Unable to load album announcements. Error: %s\n", err.Error())
+		return
+	}
+
+	for _, site := range a.sites {
+		newAlbums, err := announcements.markNew(site.GetAlbumsForIndex())
+		if err != nil {
+			fmt.Printf("Unable to save album announcements. Error: %s\n", err.Error())
+		}
+
+		// On the very first run every album is new, and we don't want to announce a whole back catalogue at once
+		if firstRun {
+			continue
+		}
+
+		for _, album := range newAlbums {
+			for _, target := range site.WebmentionTargets {
+				if err := sendWebmention(album.GetCanonicalUrl().String(), target); err != nil {
+					fmt.Printf("Unable to send webmention for album %s to %s. Error: %s\n", album.Path, target, err.Error())
+				}
+			}
+
+			if site.ActivityPub {
+				published, _ := announcements.PublishedAt(album)
+				site.PublishAlbumToFollowers(album, published)
+			}
+		}
+	}
+}
+
+func sendWebmention(source, target string) error {
+	endpoint, err := discoverWebmentionEndpoint(target)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webmentionClient.PostForm(endpoint, url.Values{
+		"source": {source},
+		"target": {target},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webmention endpoint %s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Finds the webmention endpoint of a target from its Link headers or, failing that, its HTML
+func discoverWebmentionEndpoint(target string) (string, error) {
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := webmentionClient.Get(target)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	for _, link := range resp.Header["Link"] {
+		for _, l := range strings.Split(link, ",") {
+			parts := strings.Split(l, ";")
+			if len(parts) < 2 || !strings.Contains(strings.Join(parts[1:], ";"), "webmention") {
+				continue
+			}
+
+			href := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			if endpoint, err := targetUrl.Parse(href); err == nil {
+				return endpoint.String(), nil
+			}
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	if tag := webmentionLinkRegexp.Find(body); tag != nil {
+		if m := hrefRegexp.FindSubmatch(tag); m != nil {
+			if endpoint, err := targetUrl.Parse(string(m[1])); err == nil {
+				return endpoint.String(), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("No webmention endpoint found for %s", target)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/image/draw"
+)
+
+const APP_MANIFEST_PATH = "/manifest.webmanifest"
+const APP_ICON_PATH = "/icons/"
+
+// The sizes Android asks for, 192 for the home screen and 512 for the splash screen. iOS uses the 192 one.
+var APP_ICON_SIZES = []int{192, 512}
+
+// The background colors of the themes in base.css, for browsers to color their toolbar with
+var THEME_COLORS = map[string]string{"light": "#EEEEEE", "dark": "#111114"}
+
+type appIconCache struct {
+	mutex     sync.Mutex
+	icons     map[int][]byte
+	err       error // Why the icons couldn't be made from the Logo, which isn't tried again until they'd be refreshed
+	fetchedAt time.Time
+}
+
+type AppManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+type AppManifest struct {
+	Name            string             `json:"name"`
+	ShortName       string             `json:"short_name"`
+	StartUrl        string             `json:"start_url"`
+	Scope           string             `json:"scope"`
+	Display         string             `json:"display"`
+	BackgroundColor string             `json:"background_color"`
+	ThemeColor      string             `json:"theme_color"`
+	Icons           []*AppManifestIcon `json:"icons,omitempty"`
+}
+
+func (s *Site) GetAppName() string {
+	return firstNonEmpty(s.AppName, s.SiteTitle, s.Domain)
+}
+
+func (s *Site) GetThemeColor() string {
+	return firstNonEmpty(s.ThemeColor, s.BackgroundColor, THEME_COLORS[s.GetTheme().Name])
+}
+
+func validateAppManifest(s *Site) error {
+	if s.ThemeColor != "" && !cssColorPattern.MatchString(s.ThemeColor) {
+		return fmt.Errorf("ThemeColor must be a CSS color like #1A1A1A or rgb(26, 26, 26)")
+	}
+	return nil
+}
+
+// The URL of the app icon of the given size, or "" if the site has no Logo to make one from
+func (s *Site) GetAppIconUrl(size int) string {
+	if s.Logo == "" {
+		return ""
+	}
+	return APP_ICON_PATH + strconv.Itoa(size) + ".png"
+}
+
+/*
+Lets phones install the site as an app, which opens without the browser's address bar and has the site's logo on the
+home screen.
+*/
+func handleAppManifest(site *Site, w http.ResponseWriter, r *http.Request) {
+	manifest := &AppManifest{
+		Name:            site.GetAppName(),
+		ShortName:       site.GetAppName(),
+		StartUrl:        "/",
+		Scope:           "/",
+		Display:         "standalone",
+		BackgroundColor: firstNonEmpty(site.BackgroundColor, THEME_COLORS[site.GetTheme().Name]),
+		ThemeColor:      site.GetThemeColor(),
+	}
+	for _, size := range APP_ICON_SIZES {
+		if u := site.GetAppIconUrl(size); u != "" {
+			manifest.Icons = append(manifest.Icons, &AppManifestIcon{u, fmt.Sprintf("%dx%d", size, size), "image/png"})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+func handleAppIcon(site *Site, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	size, err := strconv.Atoi(strings.TrimSuffix(name, ".png"))
+	known := strings.HasSuffix(name, ".png")
+	sized := false
+	for _, s := range APP_ICON_SIZES {
+		sized = sized || size == s
+	}
+	if err != nil || !known || !sized || site.Logo == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	icon, err := site.getAppIcon(r.Context(), size)
+	if errors.Is(err, errObjectTooLarge) || errors.Is(err, errImageTooBig) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		reportError("make app icon", err, ErrorContext{"site": site.Domain, "logo": site.Logo})
+		http.Error(w, "Unable to make the app icon", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(icon)
+}
+
+/*
+Icons are made from the Logo in the bucket, and made again once the album caches would have been refreshed. Logos bigger
+than MaxObjectMB aren't downloaded, and ones with more pixels than FIFTYMM_DECODE_MAX_MEGAPIXELS aren't decoded. A Logo
+that can't be made into icons isn't tried again for every request for one.
+*/
+func (s *Site) getAppIcon(ctx context.Context, size int) ([]byte, error) {
+	s.appIcons.mutex.Lock()
+	defer s.appIcons.mutex.Unlock()
+
+	if (s.appIcons.icons != nil || s.appIcons.err != nil) && time.Now().Sub(s.appIcons.fetchedAt) < CACHE_INTERVAL {
+		return s.appIcons.icons[size], s.appIcons.err
+	}
+
+	icons, err := s.makeAppIcons(ctx)
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	s.appIcons.icons, s.appIcons.err, s.appIcons.fetchedAt = icons, err, time.Now()
+	return icons[size], err
+}
+
+func (s *Site) makeAppIcons(ctx context.Context) (map[int][]byte, error) {
+	data, err := s.getLogo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	icons := make(map[int][]byte)
+	for _, sz := range APP_ICON_SIZES {
+		if icons[sz], err = squareIcon(src, sz); err != nil {
+			return nil, err
+		}
+	}
+	return icons, nil
+}
+
+func (s *Site) getLogo(ctx context.Context) ([]byte, error) {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+	release, err := s.acquireS3(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(s.BucketName), Key: aws.String(s.Logo)})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return readObjectBody(obj.Body, obj.ContentLength, s.GetMaxObjectBytes())
+}
+
+// Crops the middle square out of logos that aren't square, as home screens show icons as squares or circles
+func squareIcon(src image.Image, size int) ([]byte, error) {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Photos in these storage classes have to be restored before they can be downloaded. Glacier Instant Retrieval can't.
+var ARCHIVE_STORAGE_CLASSES = []string{s3.ObjectStorageClassGlacier, s3.ObjectStorageClassDeepArchive}
+
+// What albums do with archived photos
+const ARCHIVED_HIDE = "hide"
+const ARCHIVED_BADGE = "badge"
+
+var ARCHIVED_BEHAVIOURS = []string{ARCHIVED_HIDE, ARCHIVED_BADGE}
+
+const ADMIN_RESTORE_PATH = "/admin/restore"
+const AUDIT_RESTORE = "restore"
+const RESTORE_STATE_FILE = "restores.json"
+const DEFAULT_RESTORE_DAYS = 7
+
+// Archived photos are shown as this until they're restored
+const ARCHIVED_PLACEHOLDER = "/static/placeholder.png"
+
+// HeadObject has the restore status of archived objects, like: ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+var restoreExpiryPattern = regexp.MustCompile(`ongoing-request="false".*expiry-date="([^"]+)"`)
+
+func isArchiveStorageClass(storageClass *string) bool {
+	for _, c := range ARCHIVE_STORAGE_CLASSES {
+		if aws.StringValue(storageClass) == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Site) GetArchivedPhotos() string {
+	return firstNonEmpty(s.ArchivedPhotos, ARCHIVED_HIDE)
+}
+
+func validateArchivedPhotos(s *Site) error {
+	for _, b := range ARCHIVED_BEHAVIOURS {
+		if s.GetArchivedPhotos() == b {
+			return nil
+		}
+	}
+	return fmt.Errorf("ArchivedPhotos must be one of %s", strings.Join(ARCHIVED_BEHAVIOURS, ", "))
+}
+
+type RestoreRequest struct {
+	Requested time.Time
+	Expires   time.Time // Until then the restored copy can be downloaded, zero while the restore is still going
+}
+
+// Archived photos we asked S3 to restore, by bucket and key, so albums know to check on them
+type RestoreTracker struct {
+	mutex    sync.Mutex
+	requests map[string]*RestoreRequest
+}
+
+var restores = &RestoreTracker{requests: make(map[string]*RestoreRequest)}
+
+func (t *RestoreTracker) Load() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return loadJSONState(RESTORE_STATE_FILE, &t.requests)
+}
+
+// Must be called with the mutex held
+func (t *RestoreTracker) save() {
+	if err := saveJSONState(RESTORE_STATE_FILE, t.requests); err != nil {
+		fmt.Printf("Unable to save restore requests. Error: %s\n", err.Error())
+	}
+}
+
+func (t *RestoreTracker) Add(bucket, key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.requests[bucket+"/"+key] = &RestoreRequest{Requested: time.Now()}
+	t.save()
+}
+
+/*
+Whether an archived photo has a restored copy that can be shown, or a restore that's still going and has to be checked
+with HeadObject. Photos we haven't asked to restore aren't checked, so albums don't make a HeadObject call for every
+archived photo each time they refresh.
+*/
+func (a *Album) restoreStatus(key string) (restored bool, pending bool) {
+	id := a.site.BucketName + "/" + key
+	restores.mutex.Lock()
+	defer restores.mutex.Unlock()
+
+	request, ok := restores.requests[id]
+	if !ok {
+		return false, false
+	}
+	if request.Expires.IsZero() {
+		return false, true
+	}
+	if time.Now().Before(request.Expires) {
+		return true, false
+	}
+
+	// Back in the archive
+	delete(restores.requests, id)
+	restores.save()
+	return false, false
+}
+
+// Remembers until when the restored copy of a photo lasts, from its HeadObject. False if it's not restored yet.
+func (a *Album) recordRestore(key string, head *s3.HeadObjectOutput) bool {
+	match := restoreExpiryPattern.FindStringSubmatch(aws.StringValue(head.Restore))
+	if match == nil {
+		return false
+	}
+	expires, err := time.Parse(http.TimeFormat, match[1])
+	if err != nil {
+		return false
+	}
+
+	restores.mutex.Lock()
+	defer restores.mutex.Unlock()
+	if request, ok := restores.requests[a.site.BucketName+"/"+key]; ok {
+		request.Expires = expires
+		restores.save()
+	}
+	return true
+}
+
+/*
+Finds the album's photos in archive storage that haven't been restored. They're taken out of the objects unless the site
+shows them with a badge. Restores still going are checked in parallel, a failed check leaves its photo archived.
+*/
+func (a *Album) archivedObjects(ctx context.Context, objects []*s3.Object) ([]*s3.Object, map[string]bool) {
+	restored := make(map[string]bool)
+	var pending []string
+	for _, obj := range objects {
+		if !isArchiveStorageClass(obj.StorageClass) {
+			continue
+		}
+		if done, checking := a.restoreStatus(*obj.Key); done {
+			restored[*obj.Key] = true
+		} else if checking {
+			pending = append(pending, *obj.Key)
+		}
+	}
+
+	var mutex sync.Mutex
+	a.headObjects(ctx, "restore", pending, func(key string, head *s3.HeadObjectOutput, err error) {
+		if err != nil {
+			reportError("check restore status", err, albumErrorContext(a))
+			return
+		}
+		if a.recordRestore(key, head) {
+			mutex.Lock()
+			restored[key] = true
+			mutex.Unlock()
+		}
+	})
+
+	archived := make(map[string]bool)
+	var photos []*s3.Object
+	for _, obj := range objects {
+		if isArchiveStorageClass(obj.StorageClass) && !restored[*obj.Key] {
+			archived[*obj.Key] = true
+			if a.site.GetArchivedPhotos() == ARCHIVED_HIDE {
+				continue
+			}
+		}
+		photos = append(photos, obj)
+	}
+	return photos, archived
+}
+
+func (a *Album) isArchived(key string) bool {
+	archived, _ := a.ArchiveCache.Load().(map[string]bool)
+	return archived[key]
+}
+
+/*
+Asks S3 to restore an album's archived photos, one of them if `key` (the photo's file name) is given, or all of them.
+Restores take minutes to hours depending on the `tier` (Expedited, Standard or Bulk), and the copies last `days` days.
+Albums show restored photos once they notice, the next time their cache refreshes.
+*/
+func handleAdminRestore(w http.ResponseWriter, r *http.Request) {
+	site, err := app.SiteForDomain(r.FormValue("site"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	album, err := site.GetAlbumForPath(r.FormValue("album"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	days := DEFAULT_RESTORE_DAYS
+	if d := r.FormValue("days"); d != "" {
+		if days, err = strconv.Atoi(d); err != nil || days < 1 {
+			http.Error(w, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	tier := firstNonEmpty(r.FormValue("tier"), s3.TierStandard)
+
+	var keys []string
+	if name := r.FormValue("key"); name != "" {
+		keys = []string{albumObjectKey(album, name)}
+	} else {
+		archived, _ := album.ArchiveCache.Load().(map[string]bool)
+		for key := range archived {
+			keys = append(keys, key)
+		}
+	}
+
+	svc, err := site.GetS3Service()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	requested := 0
+	for _, key := range keys {
+		_, err := svc.RestoreObjectWithContext(r.Context(), &s3.RestoreObjectInput{
+			Bucket: aws.String(site.BucketName),
+			Key:    aws.String(key),
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(int64(days)),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+			},
+		})
+		// Asking again while a restore is going is fine, it may have been started outside of 50mm
+		if aerr, ok := err.(awserr.Error); err != nil && !(ok && aerr.Code() == "RestoreAlreadyInProgress") {
+			reportError("restore archived photo", err, albumErrorContext(album))
+			continue
+		}
+		restores.Add(site.BucketName, key)
+		requested++
+	}
+
+	recordAuditEvent(&AuditEvent{Action: AUDIT_RESTORE, Site: site.Domain, Album: album.Path, Remote: clientIP(r),
+		Detail: fmt.Sprintf("%d of %d photos, %s tier, %d days", requested, len(keys), tier, days)})
+	fmt.Fprintf(w, "Requested restores of %d of %d photos\n", requested, len(keys))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const STATIC_PATH = "/static/"
+const STATIC_DIR = "static"
+
+// Long enough to tell versions apart, short enough to keep URLs readable
+const ASSET_HASH_LENGTH = 10
+
+/*
+Static files are served under names with a hash of their contents, like base.1a2b3c4d5e.css, which browsers can cache for
+good. A new version of a file gets a new name, so upgrades never leave visitors with stale CSS. Templates look the names
+up with {{asset "base.css"}}.
+*/
+type AssetManifest struct {
+	mutex  sync.RWMutex
+	hashed map[string]string // Name to hashed name
+	files  map[string]string // Hashed name to name
+}
+
+var assets = &AssetManifest{hashed: make(map[string]string), files: make(map[string]string)}
+
+func hashedAssetName(name string, data []byte) string {
+	sum := sha256.Sum256(data)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:])[:ASSET_HASH_LENGTH] + ext
+}
+
+func (m *AssetManifest) Load(dir string) error {
+	hashed, files := make(map[string]string), make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		hashed[name] = hashedAssetName(name, data)
+		files[hashed[name]] = name
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hashed, m.files = hashed, files
+	return nil
+}
+
+/*
+The URL of a static file for templates. Files that aren't in the manifest, and every file in dev mode, where they're
+edited while the server runs, get their plain name.
+*/
+func (m *AssetManifest) Url(name string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if hashed, ok := m.hashed[name]; ok && !app.devMode {
+		return STATIC_PATH + hashed
+	}
+	return STATIC_PATH + name
+}
+
+func assetUrl(name string) string {
+	return assets.Url(name)
+}
+
+/*
+Serves hashed names with a Cache-Control that lets browsers keep them for a year. Plain names keep working for anything
+that doesn't use the asset helper, but browsers have to check back for changes.
+*/
+func (m *AssetManifest) Handler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.StripPrefix(STATIC_PATH, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.RLock()
+		name, ok := m.files[r.URL.Path]
+		m.mutex.RUnlock()
+
+		if ok {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			r.URL.Path = name
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
+
+func loadAssets() {
+	if err := assets.Load(STATIC_DIR); err != nil {
+		fmt.Printf("Unable to fingerprint static files, serving them under their plain names. Error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	_ "golang.org/x/image/webp"
+)
+
+// Enough of the start of a photo to get past its metadata to the image header
+const AUDIT_HEADER_BYTES = 256 * 1024
+
+type AuditIssue struct {
+	Site    string
+	Album   string
+	Key     string
+	Problem string
+}
+
+type AuditReport struct {
+	Sites   int
+	Albums  int
+	Photos  int
+	Issues  []*AuditIssue
+	Skipped []*AuditIssue // Photos only checked for being there, as there's no decoder for their format
+}
+
+// Photos 50mm serves but can't decode itself, so the audit can't tell whether they're broken
+var auditUndecodableExtensions = []string{".heic", ".heif", ".avif"}
+
+const AUDIT_NO_DECODER = "No decoder for this format, only checked that it's there"
+
+type auditJob struct {
+	album  *Album
+	key    string
+	paired bool // The Live Photo video or RAW file of a photo
+}
+
+func fetchObjectRange(ctx context.Context, album *Album, key string, length int64) ([]byte, error) {
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{Bucket: aws.String(album.site.BucketName), Key: aws.String(key)}
+	if length > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=0-%d", length-1))
+	}
+	out, err := svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+/*
+Checks a single key, returning what's wrong with it or an empty string if it's fine. Keys are told apart like albums
+do: paired files and files a renderer shows, like documents, only have to be there, everything else has to be an image.
+Images in a format there's no decoder for are skipped once they're found to be there, with the reason as the problem.
+*/
+func auditKey(ctx context.Context, album *Album, key string, paired bool) (problem string, skipped bool) {
+	isImage, undecodable := true, false
+	if paired || rendererForKey(key) != nil {
+		isImage = false
+	} else if hasExtension(key, auditUndecodableExtensions) {
+		undecodable = true
+	} else if contentType := mime.TypeByExtension(strings.ToLower(path.Ext(key))); !strings.HasPrefix(contentType, "image/") {
+		if hasExtension(key, pairLiveExtensions) || hasExtension(key, pairRawExtensions) {
+			return "Video or RAW file without a photo of the same name", false
+		}
+		return "Not an image", false
+	}
+
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		return err.Error(), false
+	}
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(album.site.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Sprintf("Missing from the bucket (%s)", err.Error()), false
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if size == 0 {
+		return "Empty file", false
+	}
+	if undecodable {
+		return AUDIT_NO_DECODER, true
+	}
+	if !isImage {
+		return "", false
+	}
+
+	data, err := fetchObjectRange(ctx, album, key, AUDIT_HEADER_BYTES)
+	if err != nil {
+		return fmt.Sprintf("Unable to read (%s)", err.Error()), false
+	}
+	_, _, err = image.DecodeConfig(bytes.NewReader(data))
+	if err == io.ErrUnexpectedEOF && size > int64(len(data)) {
+		// The metadata is bigger than usual, so try again with the whole photo
+		if data, err = fetchObjectRange(ctx, album, key, 0); err != nil {
+			return fmt.Sprintf("Unable to read (%s)", err.Error()), false
+		}
+		_, _, err = image.DecodeConfig(bytes.NewReader(data))
+	}
+	if err == image.ErrFormat {
+		return AUDIT_NO_DECODER, true
+	} else if err != nil {
+		return fmt.Sprintf("Corrupt image (%s)", err.Error()), false
+	}
+	return "", false
+}
+
+func auditAlbums(albums []*Album, concurrency int) (*AuditReport, error) {
+	ctx := context.Background()
+	report := &AuditReport{Albums: len(albums)}
+
+	var jobs []*auditJob
+	sites := make(map[*Site]bool)
+	for _, album := range albums {
+		sites[album.site] = true
+
+		// The keys the album shows, from its cache if it has them
+		keys, err := album.GetAllImageKeys(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list album %s%s. Error: %s", album.site.Domain, album.Path, err.Error())
+		}
+		for _, key := range keys {
+			jobs = append(jobs, &auditJob{album, key, false})
+		}
+		// Listing the album sets its pairs, whose files aren't in the keys
+		pairs, _ := album.PairCache.Load().(map[string]pairedKey)
+		for _, pair := range pairs {
+			jobs = append(jobs, &auditJob{album, pair.key, true})
+		}
+	}
+	report.Sites = len(sites)
+	report.Photos = len(jobs)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	queue := make(chan *auditJob)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				problem, skipped := auditKey(ctx, job.album, job.key, job.paired)
+				if problem == "" {
+					continue
+				}
+				issue := &AuditIssue{job.album.site.Domain, job.album.Path, job.key, problem}
+				mutex.Lock()
+				if skipped {
+					report.Skipped = append(report.Skipped, issue)
+				} else {
+					report.Issues = append(report.Issues, issue)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	sortAuditIssues(report.Issues)
+	sortAuditIssues(report.Skipped)
+	return report, nil
+}
+
+func sortAuditIssues(issues []*AuditIssue) {
+	sort.Slice(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		if a.Album != b.Album {
+			return a.Album < b.Album
+		}
+		return a.Key < b.Key
+	})
+}
+
+func runAudit(args []string) int {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	domain := flags.String("site", "", "Only audit the site with this domain")
+	jsonPath := flags.String("json", "", "Also write the report as JSON to this file")
+	concurrency := flags.Int("concurrency", 8, "Number of photos to check at the same time")
+	flags.Parse(args)
+	if flags.NArg() > 0 || *concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	app = NewApp()
+	var albums []*Album
+	for _, site := range app.sites {
+		if *domain == "" || site.Domain == *domain {
+			albums = append(albums, site.Albums...)
+		}
+	}
+	if len(albums) == 0 {
+		fmt.Fprintf(os.Stderr, "No albums to audit in %s\n", app.configDir)
+		return 1
+	}
+
+	report, err := auditAlbums(albums, *concurrency)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Printf("%s%s  %s: %s\n", issue.Site, issue.Album, issue.Key, issue.Problem)
+	}
+	for _, issue := range report.Skipped {
+		fmt.Printf("%s%s  %s: skipped (%s)\n", issue.Site, issue.Album, issue.Key, issue.Problem)
+	}
+	fmt.Printf("Checked %d files in %d albums on %d sites, found %d problems, skipped %d\n", report.Photos, report.Albums,
+		report.Sites, len(report.Issues), len(report.Skipped))
+
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*jsonPath, data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write report to %s. Error: %s\n", *jsonPath, err.Error())
+			return 1
+		}
+	}
+
+	if len(report.Issues) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const AUDIT_LOG_FILE = "audit.log"
+
+// Once the log is this big it's moved to audit.log.1, replacing the one before, so it never takes more than twice this
+const AUDIT_LOG_MAX_BYTES = 10 * 1024 * 1024
+const ADMIN_AUDIT_PATH = "/admin/audit"
+const DEFAULT_AUDIT_EVENTS_SHOWN = 200
+
+const AUDIT_CACHE_REFRESH = "cache_refresh"
+const AUDIT_UPLOAD = "upload"
+const AUDIT_DELETE = "delete"
+const AUDIT_CONFIG_LOAD = "config_load"
+const AUDIT_AUTH_FAILURE = "auth_failure"
+const AUDIT_SCHEDULE = "schedule"
+
+type AuditEvent struct {
+	Time   time.Time
+	Action string
+	Site   string `json:",omitempty"`
+	Album  string `json:",omitempty"`
+	Remote string `json:",omitempty"`
+	Detail string `json:",omitempty"`
+}
+
+type AuditLogPageContext struct {
+	Events []*AuditEvent
+	Action string
+	Limit  int
+}
+
+var auditLogMutex sync.Mutex
+
+// Anyone can fail a password, so each visitor only gets so many of them logged
+var authFailureLogLimiter = NewRateLimiter(20, 1*time.Hour)
+
+// Parsed when the server starts
+var auditLogTemplate *template.Template
+
+func auditLogPath() string {
+	return filepath.Join(app.dataDir, AUDIT_LOG_FILE)
+}
+
+// Must be called with the mutex held
+func rotateAuditLog() {
+	info, err := os.Stat(auditLogPath())
+	if err != nil || info.Size() < AUDIT_LOG_MAX_BYTES {
+		return
+	}
+	if err := os.Rename(auditLogPath(), auditLogPath()+".1"); err != nil {
+		fmt.Printf("Unable to rotate audit log. Error: %s\n", err.Error())
+	}
+}
+
+/*
+Appends an event to the audit log in the data dir, one JSON object per line. The log is only ever appended to, so people
+sharing an instance can see who refreshed, uploaded or deleted what, until it's rotated at AUDIT_LOG_MAX_BYTES. Failing
+to write it doesn't fail the action itself.
+*/
+func recordAuditEvent(event *AuditEvent) {
+	event.Time = time.Now().UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	if err := os.MkdirAll(app.dataDir, 0755); err != nil {
+		fmt.Printf("Unable to write audit log. Error: %s\n", err.Error())
+		return
+	}
+	rotateAuditLog()
+	f, err := os.OpenFile(auditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		fmt.Printf("Unable to write audit log. Error: %s\n", err.Error())
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Printf("Unable to write audit log. Error: %s\n", err.Error())
+	}
+}
+
+// Who is "admin" for the admin pages, or the username given for albums and sites
+func recordAuthFailure(r *http.Request, who string) {
+	if !authFailureLogLimiter.Allow(clientIP(r)) {
+		return
+	}
+	recordAuditEvent(&AuditEvent{Action: AUDIT_AUTH_FAILURE, Site: r.Host, Remote: clientIP(r), Detail: who + " " + r.URL.Path})
+}
+
+// Returns the last `limit` events, newest first, optionally only those with the given action
+func readAuditEvents(action string, limit int) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	// The rotated log has the older events
+	for _, path := range []string{auditLogPath() + ".1", auditLogPath()} {
+		var err error
+		if events, err = readAuditLogFile(path, action, limit, events); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// Adds the events in one log file to the ones read before, keeping the last `limit`
+func readAuditLogFile(path, action string, limit int, events []*AuditEvent) ([]*AuditEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue // A line cut short by a crash
+		}
+		if action != "" && event.Action != action {
+			continue
+		}
+
+		events = append(events, event)
+		if len(events) > limit {
+			events = events[1:]
+		}
+	}
+	return events, scanner.Err()
+}
+
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = DEFAULT_AUDIT_EVENTS_SHOWN
+	}
+	action := r.FormValue("action")
+
+	events, err := readAuditEvents(action, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := auditLogTemplate.Execute(w, &AuditLogPageContext{events, action, limit}); err != nil {
+		fmt.Printf("Unable to render audit log. Error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How visitors of password protected albums and sites log in
+const AUTH_MODE_BASIC = "basic"
+const AUTH_MODE_COOKIE = "cookie"
+
+var AUTH_MODES = []string{AUTH_MODE_BASIC, AUTH_MODE_COOKIE}
+
+const DEFAULT_AUTH_REALM = "You need a username/password to access this page"
+
+const LOGIN_PATH = "/login"
+const LOGOUT_PATH = "/logout"
+const AUTH_COOKIE_PREFIX = "fiftymm_auth_"
+const DEFAULT_SESSION_HOURS = 30 * 24
+
+// Only failed attempts count, so visitors who got the password right are never held up
+var loginRateLimiter = NewRateLimiter(10, 15*time.Minute)
+
+type LoginPageContext struct {
+	*BasePageContext
+
+	Prompt   string
+	ImageUrl string
+	Next     string // Where the visitor goes after logging in
+	Failed   bool
+}
+
+func (s *Site) GetAuthMode() string {
+	return firstNonEmpty(s.AuthMode, AUTH_MODE_BASIC)
+}
+
+func validateAuthMode(s *Site) error {
+	for _, mode := range AUTH_MODES {
+		if s.GetAuthMode() == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("AuthMode must be one of %s", strings.Join(AUTH_MODES, ", "))
+}
+
+func validateSessionHours(s *Site) error {
+	if s.SessionHours < 0 {
+		return errors.New("SessionHours can't be negative")
+	}
+	if s.AuthGraceHours < 0 {
+		return errors.New("AuthGraceHours can't be negative")
+	}
+	for _, album := range s.Albums {
+		if album.SessionHours < 0 {
+			return fmt.Errorf("SessionHours of album %s can't be negative", album.Path)
+		}
+		if album.AuthGraceHours < 0 {
+			return fmt.Errorf("AuthGraceHours of album %s can't be negative", album.Path)
+		}
+	}
+	return nil
+}
+
+func (s *Site) GetAuthRealm() string {
+	return firstNonEmpty(s.AuthRealm, DEFAULT_AUTH_REALM)
+}
+
+func (s *Site) GetAuthPrompt() string {
+	return s.AuthPrompt
+}
+
+func (s *Site) GetAuthImage() string {
+	return s.AuthImage
+}
+
+func (s *Site) GetSessionLifetime() time.Duration {
+	if s.SessionHours > 0 {
+		return time.Duration(s.SessionHours) * time.Hour
+	}
+	return DEFAULT_SESSION_HOURS * time.Hour
+}
+
+func (s *Site) GetAuthGracePeriod() time.Duration {
+	return time.Duration(s.AuthGraceHours) * time.Hour
+}
+
+func (s *Site) authSite() *Site {
+	return s
+}
+
+func (s *Site) authScope() string {
+	return "/"
+}
+
+func (a *Album) GetAuthRealm() string {
+	return firstNonEmpty(a.AuthRealm, a.site.GetAuthRealm())
+}
+
+func (a *Album) GetAuthPrompt() string {
+	return firstNonEmpty(a.AuthPrompt, a.site.GetAuthPrompt())
+}
+
+func (a *Album) GetAuthImage() string {
+	return firstNonEmpty(a.AuthImage, a.site.GetAuthImage())
+}
+
+func (a *Album) GetSessionLifetime() time.Duration {
+	if a.SessionHours > 0 {
+		return time.Duration(a.SessionHours) * time.Hour
+	}
+	return a.site.GetSessionLifetime()
+}
+
+func (a *Album) GetAuthGracePeriod() time.Duration {
+	if a.AuthGraceHours > 0 {
+		return time.Duration(a.AuthGraceHours) * time.Hour
+	}
+	return a.site.GetAuthGracePeriod()
+}
+
+func (a *Album) authSite() *Site {
+	return a.site
+}
+
+// Albums without their own password use the site's, and logging in to the site is enough for them
+func (a *Album) authScope() string {
+	if !a.HasOwnAuth() {
+		return a.site.authScope()
+	}
+	// Without the slash, so the cookie is sent to the album page with either TrailingSlash
+	return firstNonEmpty(strings.TrimSuffix(a.Path, "/"), "/")
+}
+
+func checkCredentials(provider AuthCredentialsProvider, user, pass string) bool {
+	return user == provider.GetAuthUser() && subtle.ConstantTimeCompare([]byte(pass), []byte(provider.GetAuthPass())) == 1
+}
+
+func authCookieName(scope string) string {
+	hash := sha1.Sum([]byte(scope))
+	return AUTH_COOKIE_PREFIX + hex.EncodeToString(hash[:4])
+}
+
+/*
+Auth cookies hold the time the visitor logged in, signed with a session key made from the credentials they were given
+for (see sessions.go). Changing the password logs everyone out, unless there's an AuthGraceHours, and a cookie for one
+album doesn't work for another, even with the same password. Sessions end once they're older than the SessionHours, so
+shortening it applies to visitors already logged in too.
+*/
+func authToken(key []byte, scope string, issued int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(scope + "|" + strconv.FormatInt(issued, 10)))
+	return strconv.FormatInt(issued, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func hasAuthCookie(r *http.Request, provider AuthCredentialsProvider) bool {
+	cookie, err := r.Cookie(authCookieName(provider.authScope()))
+	if err != nil {
+		return false
+	}
+	i := strings.IndexByte(cookie.Value, '.')
+	if i < 0 {
+		return false
+	}
+	issued, err := strconv.ParseInt(cookie.Value[:i], 10, 64)
+	if err != nil || time.Now().After(time.Unix(issued, 0).Add(provider.GetSessionLifetime())) {
+		return false
+	}
+	for _, key := range sessionSecrets.Keys(provider) {
+		if hmac.Equal([]byte(cookie.Value), []byte(authToken(key, provider.authScope(), issued))) {
+			return true
+		}
+	}
+	return false
+}
+
+func setAuthCookie(w http.ResponseWriter, provider AuthCredentialsProvider) {
+	now := time.Now()
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName(provider.authScope()),
+		Value:    authToken(sessionSecrets.Keys(provider)[0], provider.authScope(), now.Unix()),
+		Path:     provider.authScope(),
+		Expires:  now.Add(provider.GetSessionLifetime()),
+		Secure:   provider.authSite().CanonicalSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The album with its own password that a path belongs to, or the site if it's not in one of those
+func (s *Site) authProviderForPath(path string) AuthCredentialsProvider {
+	var provider AuthCredentialsProvider
+	longest := -1
+	for _, album := range s.Albums {
+		scope := album.authScope()
+		if !album.HasOwnAuth() || len(scope) <= longest {
+			continue
+		}
+		if scope == "/" || path == scope || strings.HasPrefix(path, scope+"/") {
+			provider, longest = album, len(scope)
+		}
+	}
+	if provider == nil && s.HasAuth() {
+		return s
+	}
+	return provider
+}
+
+// Only paths on this site, so the login form can't send visitors elsewhere
+func isLocalRedirect(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// The password page that cookie mode shows instead of the browser's login prompt
+func renderLoginPage(w http.ResponseWriter, r *http.Request, provider AuthCredentialsProvider, next string, failed bool) {
+	site := provider.authSite()
+
+	// Other requests, like photos behind the proxy, can't show a page
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Path != LOGIN_PATH {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized\n"))
+		return
+	}
+
+	ctx := &LoginPageContext{
+		&BasePageContext{
+			site.GetCanonicalUrl().String(),
+			site.GetCanonicalUrl().String(),
+			site.GetCanonicalUrl().String(),
+			site.SiteTitle,
+			site.SiteTitle,
+			site.GetNavigation(),
+			site.GetLanguage(),
+			site.GetTheme(),
+			site.GetPhotoWidth(false),
+			false,
+			newSiteView(site),
+		},
+		firstNonEmpty(provider.GetAuthPrompt(), translate(site.GetLanguage(), "login_prompt")),
+		"",
+		next,
+		failed,
+	}
+	if key := provider.GetAuthImage(); key != "" {
+		photo := site.GetPhotoForKey(key)
+		// Sites with a base URL that can't be parsed have no Imgix photos
+		if p, ok := photo.(*ImgixPhoto); !ok || p != nil {
+			ctx.ImageUrl = photo.GetPhotoForWidth(site.GetPhotoWidth(false))
+		}
+	}
+
+	body, err := renderTemplate("login.html", ctx)
+	if err != nil {
+		writeTemplateError(w, "login.html", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(body)
+}
+
+// Checks the password page's form and sets the auth cookie, then sends the visitor back to the page they wanted
+func handleLogin(site *Site, w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !isLocalRedirect(next) {
+		next = "/"
+	}
+
+	provider := site.authProviderForPath(next)
+	if provider == nil {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	if !checkLoginRateLimit(site, w, r) {
+		return
+	}
+	user := r.FormValue("user")
+	if !checkCredentials(provider, user, r.FormValue("password")) {
+		loginRateLimiter.Allow(clientIP(r))
+		recordAuthFailure(r, "user "+user)
+		renderLoginPage(w, r, provider, next, true)
+		return
+	}
+
+	setAuthCookie(w, provider)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// Answers with a 429 when the visitor got the password wrong too often, before their next guess is checked
+func checkLoginRateLimit(site *Site, w http.ResponseWriter, r *http.Request) bool {
+	if !loginRateLimiter.Exceeded(clientIP(r)) {
+		return true
+	}
+	w.Header().Set("Retry-After", "900")
+	renderErrorPage(site, w, http.StatusTooManyRequests, translate(site.GetLanguage(), "login_too_many"))
+	return false
+}
+
+func getLogoutUrl(next string) string {
+	return LOGOUT_PATH + "?" + url.Values{"next": {next}}.Encode()
+}
+
+/*
+Logs the visitor out of the site and all of its albums. Cookies are cleared, then the visitor is sent back to the page
+they were on, which asks for the password again. Browsers keep basic auth credentials until they're closed, the 401
+with the same realm makes most of them forget them.
+*/
+func handleLogout(site *Site, w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !isLocalRedirect(next) {
+		next = "/"
+	}
+
+	providers := []AuthCredentialsProvider{site}
+	for _, album := range site.Albums {
+		providers = append(providers, album)
+	}
+	for _, provider := range providers {
+		name := authCookieName(provider.authScope())
+		if _, err := r.Cookie(name); err == nil {
+			http.SetCookie(w, &http.Cookie{Name: name, Path: provider.authScope(), MaxAge: -1,
+				Secure: site.CanonicalSecure, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		}
+	}
+
+	provider := site.authProviderForPath(next)
+	if site.GetAuthMode() == AUTH_MODE_COOKIE || provider == nil {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", provider.GetAuthRealm()))
+	renderErrorPage(site, w, http.StatusUnauthorized, translate(site.GetLanguage(), "logged_out"))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+Albums with AutoCaption have a captioning service describe their photos that don't have a caption or alt text of their
+own. The site's CaptionCommand or CaptionEndpoint gets the photo and answers with JSON like
+{"caption": "...", "alt": "..."}, or with plain text, which is taken as the alt text. What it says is kept with the
+other derivatives, along with which provider said it and when, so each photo is only described once.
+*/
+const DERIVATIVE_GENERATED_CAPTION = "caption-v1"
+
+// Photos are scaled down before they're sent, describing them doesn't take every pixel
+const CAPTION_PHOTO_SIZE = 1024
+
+const CAPTION_JOB_TIMEOUT = 2 * time.Minute
+
+// More than any caption needs, but keeps a chatty provider from filling the store
+const MAX_GENERATED_CAPTION_BYTES = 16 * 1024
+
+var captionableExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic"}
+
+var captionClient = &http.Client{Timeout: CAPTION_JOB_TIMEOUT}
+
+type CaptionProvider interface {
+	// Recorded with each caption, so it's known where the text came from
+	Name() string
+	Describe(ctx context.Context, key string, data []byte, contentType string) (*GeneratedCaption, error)
+}
+
+type GeneratedCaption struct {
+	Caption     string
+	Alt         string
+	Provider    string
+	GeneratedAt time.Time
+}
+
+// Runs a command with the photo on its standard input, and its key and type in FIFTYMM_PHOTO_KEY and FIFTYMM_PHOTO_TYPE
+type CommandCaptionProvider struct {
+	args []string
+}
+
+// POSTs the photo to a URL, with the CaptionToken as a bearer token if there is one
+type HTTPCaptionProvider struct {
+	endpoint string
+	token    string
+}
+
+func (p *CommandCaptionProvider) Name() string {
+	return "command:" + p.args[0]
+}
+
+func (p *CommandCaptionProvider) Describe(ctx context.Context, key string, data []byte, contentType string) (*GeneratedCaption, error) {
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), "FIFTYMM_PHOTO_KEY="+key, "FIFTYMM_PHOTO_TYPE="+contentType)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return parseGeneratedCaption(out)
+}
+
+func (p *HTTPCaptionProvider) Name() string {
+	if u, err := url.Parse(p.endpoint); err == nil {
+		return "http:" + u.Host
+	}
+	return "http"
+}
+
+func (p *HTTPCaptionProvider) Describe(ctx context.Context, key string, data []byte, contentType string) (*GeneratedCaption, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Photo-Key", key)
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := captionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_GENERATED_CAPTION_BYTES))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("caption endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return parseGeneratedCaption(body)
+}
+
+func parseGeneratedCaption(out []byte) (*GeneratedCaption, error) {
+	if len(out) > MAX_GENERATED_CAPTION_BYTES {
+		out = out[:MAX_GENERATED_CAPTION_BYTES]
+	}
+	text := strings.TrimSpace(string(out))
+
+	generated := &GeneratedCaption{}
+	if strings.HasPrefix(text, "{") {
+		var fields struct {
+			Caption string `json:"caption"`
+			Alt     string `json:"alt"`
+		}
+		if err := json.Unmarshal([]byte(text), &fields); err != nil {
+			return nil, err
+		}
+		generated.Caption, generated.Alt = fields.Caption, fields.Alt
+	} else {
+		generated.Alt = text
+	}
+
+	generated.Caption = strings.Join(strings.Fields(generated.Caption), " ")
+	generated.Alt = strings.Join(strings.Fields(generated.Alt), " ")
+	return generated, nil
+}
+
+func validateCaptionProvider(s *Site) error {
+	if s.CaptionCommand != "" && s.CaptionEndpoint != "" {
+		return errors.New("Only one of CaptionCommand and CaptionEndpoint can be set")
+	}
+	// The command runs as the server's user, which tenants must never get to do
+	if s.CaptionCommand != "" && s.tenant != nil {
+		return errors.New("CaptionCommand can't be set in a tenant's site, use CaptionEndpoint instead")
+	}
+	if s.CaptionEndpoint != "" {
+		if u, err := url.Parse(s.CaptionEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("CaptionEndpoint must be a full http or https URL")
+		}
+	}
+	return nil
+}
+
+// The site's captioning provider, nil if it has none. The command is split on spaces, without any shell quoting.
+func (s *Site) GetCaptionProvider() CaptionProvider {
+	if args := strings.Fields(s.CaptionCommand); len(args) > 0 && s.tenant == nil {
+		return &CommandCaptionProvider{args}
+	}
+	if s.CaptionEndpoint != "" {
+		return &HTTPCaptionProvider{s.CaptionEndpoint, s.CaptionToken}
+	}
+	return nil
+}
+
+func (a *Album) isCaptionable(key string) bool {
+	return a.AutoCaption && a.site.GetCaptionProvider() != nil && !a.isArchived(key) && rendererForKey(key) == nil &&
+		hasExtension(key, captionableExtensions)
+}
+
+// Photos with a caption or alt text of their own, from a sidecar or their EXIF data, are left alone
+func (a *Album) needsGeneratedCaption(key string, photoExif *PhotoExif) bool {
+	return a.sidecarText(key, CAPTION_SIDECAR_EXT) == "" && a.sidecarText(key, ALT_TEXT_SIDECAR_EXT) == "" &&
+		photoExif.Caption == ""
+}
+
+/*
+Has the site's provider describe one of the album's photos, unless it already did for this version of the photo. Photos
+the provider answers with nothing for get an empty caption, so they aren't sent again either.
+*/
+func (a *Album) GetGeneratedCaption(ctx context.Context, key string) (*GeneratedCaption, error) {
+	provider := a.site.GetCaptionProvider()
+	if provider == nil {
+		return nil, nil
+	}
+
+	data, err := a.GetDerivative(ctx, DERIVATIVE_GENERATED_CAPTION, key, func(ctx context.Context) ([]byte, error) {
+		photo, err := a.getObjectData(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		contentType := http.DetectContentType(photo)
+		if resized, err := resizeImage(photo, contentType, CAPTION_PHOTO_SIZE, COLOR_PROFILE_SRGB); err == nil {
+			photo = resized
+		}
+
+		generated, err := provider.Describe(ctx, key, photo, contentType)
+		if err != nil {
+			return nil, err
+		}
+		generated.Provider, generated.GeneratedAt = provider.Name(), time.Now().UTC()
+		return json.Marshal(generated)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	generated := &GeneratedCaption{}
+	if err := json.Unmarshal(data, generated); err != nil {
+		return nil, err
+	}
+	if generated.Caption == "" && generated.Alt == "" {
+		return nil, nil
+	}
+	if _, loaded := a.generatedCaptionCache.Swap(key, generated); !loaded {
+		a.photosChanged()
+	}
+	return generated, nil
+}
+
+// What the provider said about a photo, nil if it hasn't been described
+func (a *Album) generatedCaption(key string) *GeneratedCaption {
+	if generated, ok := a.generatedCaptionCache.Load(key); ok {
+		return generated.(*GeneratedCaption)
+	}
+	return nil
+}
+
+func (a *Album) queueGeneratedCaption(key string) {
+	jobQueue.Enqueue(&Job{
+		Name:     DERIVATIVE_GENERATED_CAPTION + ":" + a.site.Domain + ":" + key,
+		Priority: PRIORITY_LOW,
+		Timeout:  CAPTION_JOB_TIMEOUT,
+		Run: func(ctx context.Context) error {
+			photoExif, err := a.GetPhotoExif(ctx, key)
+			if err != nil {
+				return err
+			}
+			if !a.needsGeneratedCaption(key, photoExif) {
+				return nil
+			}
+			_, err = a.GetGeneratedCaption(ctx, key)
+			return err
+		},
+		ErrorContext: albumErrorContext(a),
+	})
+}
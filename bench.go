@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const BENCH_DOMAIN = "bench.50mm.local"
+
+/*
+Performance budget for the render path, in nanoseconds per photo per operation, except for cache hits which shouldn't
+depend on the album size at all. `50mm bench -budget` and
+`go test -bench . -args -budget` fail if any benchmark goes over.
+*/
+var benchBudgets = map[string]float64{
+	"template":          20000,
+	"render-cache-miss": 30000,
+	"render-cache-hit":  200000,
+	"s3-list":           20000,
+}
+
+// An album whose keys are cached, with the context its page renders with
+type albumBench struct {
+	album  *Album
+	photos int
+	ctx    *AlbumPageContext
+	req    *http.Request
+}
+
+// A ResponseWriter that throws everything away, so the benchmarks measure rendering and not buffering
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{make(http.Header)}
+}
+
+// Answers ListObjects calls with a listing of fake photos. The album prefix says how many photos to return.
+func newFakeS3Server() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(prefix, "bench-"), "/"))
+
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+		b.WriteString(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+		fmt.Fprintf(&b, "<Name>bench</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>", template.HTMLEscapeString(prefix))
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, `<Contents><Key>%sIMG_%05d.jpg</Key><LastModified>2020-01-01T00:00:00.000Z</LastModified>`, prefix, i)
+			b.WriteString(`<ETag>"d41d8cd98f00b204e9800998ecf8427e"</ETag><Size>4194304</Size><StorageClass>STANDARD</StorageClass></Contents>`)
+		}
+		b.WriteString(`</ListBucketResult>`)
+
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(b.String()))
+	}))
+}
+
+func newBenchSite(s3Url string, sizes []int) (*Site, error) {
+	s := &Site{
+		Domain:            BENCH_DOMAIN,
+		BucketRegion:      "us-east-1",
+		BucketName:        "bench",
+		UseImgix:          true,
+		BaseUrl:           "https://bench.imgix.net",
+		AWS_SECRET_KEY_ID: "bench",
+		AWS_SECRET_KEY:    "bench",
+		SiteTitle:         "Bench",
+		MetaTitle:         "Bench",
+		HasAlbumIndex:     true,
+		GridGap:           UNSET,
+		IndexThumbnails:   UNSET,
+	}
+
+	for _, n := range sizes {
+		prefix := fmt.Sprintf("bench-%d/", n)
+		album, err := NewAlbum(s, "/"+prefix, prefix, "", "", "Bench", fmt.Sprintf("%d photos", n))
+		if err != nil {
+			return nil, err
+		}
+		s.Albums = append(s.Albums, album)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(s.BucketRegion),
+		Endpoint:         aws.String(s3Url),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials(s.AWS_SECRET_KEY_ID, s.AWS_SECRET_KEY, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.awsSession = sess
+
+	if s.router, err = NewRouter(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newAlbumBench(album *Album, n int) (*albumBench, error) {
+	keys, err := album.GetAllImageKeysFromBucket(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	album.CacheUpdateMutex.Lock()
+	album.storeKeys(keys)
+	album.CacheUpdateMutex.Unlock()
+	req := httptest.NewRequest(http.MethodGet, album.GetSiteUrl().String(), nil)
+	ctx := &AlbumPageContext{
+		&BasePageContext{
+			album.site.GetCanonicalUrl().String(),
+			album.GetCanonicalUrl().String(),
+			album.GetSiteUrl().String(),
+			album.MetaTitle,
+			album.site.SiteTitle,
+			album.GetNavigation(),
+			album.site.GetLanguage(),
+			album.GetTheme(),
+			album.site.GetPhotoWidth(false),
+			false,
+			newSiteView(album.site),
+		},
+		album.AlbumTitle,
+		nil,
+		ABOVE_THE_FOLD_PHOTOS,
+		album.GetGridColumns(),
+		false,
+		false,
+		false,
+		false,
+		"",
+		false,
+		"",
+		0,
+		album.GetCoverPhotoForTemplate(),
+		"",
+		nil,
+	}
+	if ctx.Photos, ctx.Album, err = album.GetPhotosAndView(context.Background(), album.site.GetPhotoWidth(false)); err != nil {
+		return nil, err
+	}
+
+	return &albumBench{album, n, ctx, req}, nil
+}
+
+type albumBenchmark struct {
+	name string
+	fn   func(b *testing.B, bench *albumBench)
+}
+
+// The benchmarks `50mm bench` runs, which bench_test.go also runs with `go test -bench`
+var albumBenchmarks = []*albumBenchmark{
+	{"template", func(b *testing.B, bench *albumBench) {
+		for i := 0; i < b.N; i++ {
+			if _, err := renderTemplate("album.html", bench.ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}},
+	{"render-cache-miss", func(b *testing.B, bench *albumBench) {
+		for i := 0; i < b.N; i++ {
+			pageCache.Invalidate(bench.album)
+			handleAlbumPage(bench.album, newDiscardResponseWriter(), bench.req)
+		}
+	}},
+	{"render-cache-hit", func(b *testing.B, bench *albumBench) {
+		handleAlbumPage(bench.album, newDiscardResponseWriter(), bench.req)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			handleAlbumPage(bench.album, newDiscardResponseWriter(), bench.req)
+		}
+	}},
+	{"s3-list", func(b *testing.B, bench *albumBench) {
+		for i := 0; i < b.N; i++ {
+			if _, err := bench.album.GetAllImageKeysFromBucket(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}},
+}
+
+func findAlbumBenchmark(name string) *albumBenchmark {
+	for _, bm := range albumBenchmarks {
+		if bm.name == name {
+			return bm
+		}
+	}
+	return nil
+}
+
+// Returns how much of its budget a benchmark used, where anything over 1 is a regression
+func benchBudgetUsed(name string, photos int, nsPerOp float64) float64 {
+	budget := benchBudgets[name]
+	if name != "render-cache-hit" {
+		budget *= float64(photos)
+	}
+	return nsPerOp / budget
+}
+
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizesFlag := flags.String("photos", "100,1000,10000", "Comma separated album sizes to benchmark")
+	enforceBudget := flags.Bool("budget", false, "Exit with an error if any benchmark is over its performance budget")
+	flags.Parse(args)
+
+	var sizes []int
+	for _, s := range strings.Split(*sizesFlag, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "Invalid album size '%s'\n", s)
+			return 2
+		}
+		sizes = append(sizes, n)
+	}
+
+	app = &App{dataDir: os.TempDir(), sites: make(map[string]*Site)}
+	var err error
+	if templates, err = parseTemplates(filepath.Join(templatesDir, "*.html")); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse templates. Run the benchmarks from the deploy folder. Error: %s\n", err.Error())
+		return 1
+	}
+
+	s3 := newFakeS3Server()
+	defer s3.Close()
+
+	site, err := newBenchSite(s3.URL, sizes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up benchmark site. Error: %s\n", err.Error())
+		return 1
+	}
+
+	overBudget := false
+	for i, album := range site.Albums {
+		bench, err := newAlbumBench(album, sizes[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed. Error: %s\n", err.Error())
+			return 1
+		}
+
+		for _, bm := range albumBenchmarks {
+			fn := bm.fn
+			result := testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				fn(b, bench)
+			})
+			if result.N == 0 {
+				fmt.Fprintf(os.Stderr, "Benchmark %s/%d failed\n", bm.name, bench.photos)
+				return 1
+			}
+
+			used := benchBudgetUsed(bm.name, bench.photos, float64(result.T.Nanoseconds())/float64(result.N))
+			status := "ok"
+			if used > 1 {
+				status = "OVER BUDGET"
+				overBudget = true
+			}
+			fmt.Printf("%-32s %s %s  %5.1f%% of budget  %s\n", fmt.Sprintf("%s/%d", bm.name, bench.photos), result.String(),
+				result.MemString(), used*100, status)
+		}
+	}
+
+	if overBudget && *enforceBudget {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var benchBudget = flag.Bool("budget", false, "Fail benchmarks that are over their performance budget")
+var benchSizes = []int{100, 1000, 10000}
+
+var benchSetup struct {
+	once   sync.Once
+	albums []*albumBench
+	err    error
+}
+
+// Sets up the albums the first time a benchmark needs them. The fake bucket is left running for the other benchmarks.
+func benchAlbums(b *testing.B) []*albumBench {
+	benchSetup.once.Do(func() {
+		app = &App{dataDir: os.TempDir(), sites: make(map[string]*Site)}
+		if templates, benchSetup.err = parseTemplates(filepath.Join(templatesDir, "*.html")); benchSetup.err != nil {
+			return
+		}
+
+		site, err := newBenchSite(newFakeS3Server().URL, benchSizes)
+		if err != nil {
+			benchSetup.err = err
+			return
+		}
+		for i, album := range site.Albums {
+			bench, err := newAlbumBench(album, benchSizes[i])
+			if err != nil {
+				benchSetup.err = err
+				return
+			}
+			benchSetup.albums = append(benchSetup.albums, bench)
+		}
+	})
+	if benchSetup.err != nil {
+		b.Fatal(benchSetup.err)
+	}
+	return benchSetup.albums
+}
+
+// Runs the benchmark for every album size, and reports how much of its budget it used
+func runAlbumBenchmark(b *testing.B, name string) {
+	bm := findAlbumBenchmark(name)
+	for _, bench := range benchAlbums(b) {
+		b.Run(strconv.Itoa(bench.photos), func(b *testing.B) {
+			b.ReportAllocs()
+			bm.fn(b, bench)
+
+			used := benchBudgetUsed(name, bench.photos, float64(b.Elapsed().Nanoseconds())/float64(b.N))
+			b.ReportMetric(used*100, "%budget")
+			// The first run is a single warm up iteration, too noisy to judge
+			if *benchBudget && b.N > 1 && used > 1 {
+				b.Errorf("%s/%d is over its performance budget, at %.1f%%", name, bench.photos, used*100)
+			}
+		})
+	}
+}
+
+func BenchmarkAlbumTemplate(b *testing.B) {
+	runAlbumBenchmark(b, "template")
+}
+
+func BenchmarkAlbumRenderCacheMiss(b *testing.B) {
+	runAlbumBenchmark(b, "render-cache-miss")
+}
+
+func BenchmarkAlbumRenderCacheHit(b *testing.B) {
+	runAlbumBenchmark(b, "render-cache-hit")
+}
+
+func BenchmarkAlbumS3List(b *testing.B) {
+	runAlbumBenchmark(b, "s3-list")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Buckets that can't tell 50mm about new photos themselves, like R2 and Backblaze B2 without a relay, can be watched
+instead: every ChangePollSeconds each album's listing is boiled down to its number of objects and the newest upload,
+and the album is only refreshed if either changed. That's one listing per album, without the HEAD requests, sidecars
+and derivatives of a full refresh. Buckets that can send events POST them to BUCKET_WEBHOOK_PATH.
+*/
+const BUCKET_WEBHOOK_PATH = "/webhooks/bucket"
+
+// How often the watcher looks for albums that are due, each site's ChangePollSeconds is rounded up to it
+const CHANGE_POLL_TICK = 15 * time.Second
+
+const MIN_CHANGE_POLL_SECONDS = 30
+
+// Far more than a batch of events takes, just so nobody can make us read forever
+const MAX_BUCKET_WEBHOOK_BYTES = 1024 * 1024
+
+// The signature header of Backblaze B2 event notifications, v1= and the hex HMAC-SHA256 of the body
+const B2_SIGNATURE_HEADER = "X-Bz-Event-Notification-Signature"
+
+// What an album's listing looked like when it was last polled
+type bucketFingerprint struct {
+	Count        int
+	LastModified time.Time
+}
+
+type albumChangePoll struct {
+	mutex       sync.Mutex
+	fingerprint *bucketFingerprint
+	polledAt    time.Time
+}
+
+func validateChangeDetection(s *Site) error {
+	if s.ChangePollSeconds != 0 && s.ChangePollSeconds < MIN_CHANGE_POLL_SECONDS {
+		return fmt.Errorf("ChangePollSeconds must be 0 (off) or at least %d", MIN_CHANGE_POLL_SECONDS)
+	}
+	if s.ChangePollSeconds > 0 && s.HasInventory() {
+		return errors.New("ChangePollSeconds can't be used with an InventoryPrefix, albums are listed from the inventory")
+	}
+	if s.BucketWebhookSecret != "" && len(s.BucketWebhookSecret) < 16 {
+		return errors.New("BucketWebhookSecret must be at least 16 characters")
+	}
+	return nil
+}
+
+func (a *Album) bucketFingerprint(ctx context.Context) (*bucketFingerprint, error) {
+	objects, err := a.GetAllObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := &bucketFingerprint{Count: len(objects)}
+	for _, obj := range objects {
+		if obj.LastModified != nil && obj.LastModified.After(fingerprint.LastModified) {
+			fingerprint.LastModified = *obj.LastModified
+		}
+	}
+	return fingerprint, nil
+}
+
+/*
+Refreshes the album if its listing changed since the last poll. The first poll only takes note of the listing, the
+album was just loaded anyway. Deleting a photo lowers the count and replacing one makes it the newest, so the only
+change that goes unnoticed is deleting one photo while uploading an older one in between two polls.
+*/
+func (a *Album) pollBucketChanges(ctx context.Context) (bool, error) {
+	a.changePoll.mutex.Lock()
+	defer a.changePoll.mutex.Unlock()
+
+	a.changePoll.polledAt = time.Now()
+	fingerprint, err := a.bucketFingerprint(ctx)
+	if err != nil {
+		return false, err
+	}
+	previous := a.changePoll.fingerprint
+	a.changePoll.fingerprint = fingerprint
+	if previous == nil || *previous == *fingerprint {
+		return false, nil
+	}
+	return true, a.RefreshCache(ctx)
+}
+
+func (a *Album) changePollDue(now time.Time) bool {
+	a.changePoll.mutex.Lock()
+	defer a.changePoll.mutex.Unlock()
+	return now.Sub(a.changePoll.polledAt) >= time.Duration(a.site.ChangePollSeconds)*time.Second
+}
+
+// Polls the albums of sites with ChangePollSeconds that are due, one at a time, so polling never floods a bucket
+func (a *App) PollBucketChanges(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for _, site := range a.sites {
+			if site.ChangePollSeconds <= 0 {
+				continue
+			}
+			for _, album := range site.Albums {
+				if !album.changePollDue(now) {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				changed, err := album.pollBucketChanges(ctx)
+				cancel()
+				if err != nil {
+					reportError("poll bucket for changes", err, albumErrorContext(album))
+				} else if changed {
+					recordAuditEvent(&AuditEvent{Action: AUDIT_CACHE_REFRESH, Site: site.Domain, Album: album.Path, Detail: "bucket changed"})
+				}
+			}
+		}
+	}
+}
+
+/*
+The keys of the objects a bucket event is about. Events come in a few shapes: S3 style with Records (S3, MinIO and
+Ceph), Backblaze B2's with events, and R2's queue messages, one at a time or as a list, as a Worker forwarding them
+would send them. Keys in S3 style events are URL encoded.
+*/
+func bucketEventKeys(body []byte) ([]string, error) {
+	var keys []string
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err == nil {
+		for _, message := range batch {
+			messageKeys, err := bucketEventKeys(message)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, messageKeys...)
+		}
+		return keys, nil
+	}
+
+	var event struct {
+		Records []struct {
+			S3 struct {
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+		Events []struct {
+			ObjectName string `json:"objectName"`
+		} `json:"events"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	for _, record := range event.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	for _, e := range event.Events {
+		keys = append(keys, e.ObjectName)
+	}
+	if event.Object.Key != "" {
+		keys = append(keys, event.Object.Key)
+	}
+	return keys, nil
+}
+
+// The albums listing the key, albums only list the objects right in their BucketPrefix
+func (s *Site) albumsForKey(key string) []*Album {
+	var albums []*Album
+	for _, a := range s.Albums {
+		if strings.HasPrefix(key, a.BucketPrefix) && !strings.Contains(key[len(a.BucketPrefix):], "/") {
+			albums = append(albums, a)
+		}
+	}
+	return albums
+}
+
+// Webhooks are signed like Backblaze B2 signs them, or carry the secret as a bearer token, for relays like R2 Workers
+func (s *Site) isValidBucketWebhook(r *http.Request, body []byte) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(s.BucketWebhookSecret)) == 1
+	}
+	if signature, ok := strings.CutPrefix(r.Header.Get(B2_SIGNATURE_HEADER), "v1="); ok {
+		mac := hmac.New(sha256.New, []byte(s.BucketWebhookSecret))
+		mac.Write(body)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(expected)) == 1
+	}
+	return false
+}
+
+/*
+Refreshes the albums a batch of bucket events is about, in the background, as senders give up on webhooks that take
+long to answer. Events about other objects, like test events, are accepted and ignored.
+*/
+func handleBucketWebhook(site *Site, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_BUCKET_WEBHOOK_BYTES))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !site.isValidBucketWebhook(r, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := bucketEventKeys(body)
+	if err != nil {
+		http.Error(w, "Unknown event format", http.StatusBadRequest)
+		return
+	}
+
+	albums := make(map[*Album]bool)
+	for _, key := range keys {
+		for _, album := range site.albumsForKey(key) {
+			albums[album] = true
+		}
+	}
+	for album := range albums {
+		recordAuditEvent(&AuditEvent{Action: AUDIT_CACHE_REFRESH, Site: site.Domain, Album: album.Path, Remote: clientIP(r), Detail: "bucket event"})
+		go func(album *Album) {
+			if err := album.RefreshCache(context.Background()); err != nil {
+				reportError("refresh album cache", err, albumErrorContext(album))
+			}
+		}(album)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"albums": len(albums)})
+}
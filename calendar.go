@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CALENDAR_PATH = "/calendar.ics"
+const EVENT_DATE_FORMAT = "2006-01-02"
+
+type DateRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+type albumDateRangeCache struct {
+	mutex     sync.Mutex
+	dates     *DateRange
+	updatedAt time.Time
+}
+
+func parseEventDate(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(EVENT_DATE_FORMAT, value)
+	if err != nil {
+		return t, fmt.Errorf("%s must be a date in the format YYYY-MM-DD", name)
+	}
+	return t, nil
+}
+
+/*
+Returns the dates the album's photos were taken. The EventDate/EventEndDate options win if they're set, otherwise we
+read the dates of the first and last photos in the album from their names (with a FilenamePattern) or EXIF data, which
+are usually the first and last shots of the day for camera file names. Returns nil if no dates are known.
+*/
+func (a *Album) GetDateRange(ctx context.Context) *DateRange {
+	if start, _ := parseEventDate("EventDate", a.EventDate); !start.IsZero() {
+		end, _ := parseEventDate("EventEndDate", a.EventEndDate)
+		if end.IsZero() {
+			end = start
+		}
+		return &DateRange{start, end}
+	}
+
+	a.dateRangeCache.mutex.Lock()
+	defer a.dateRangeCache.mutex.Unlock()
+
+	if app.devMode || a.dateRangeCache.updatedAt.IsZero() || time.Now().Sub(a.dateRangeCache.updatedAt) > CACHE_INTERVAL {
+		a.dateRangeCache.dates = a.getExifDateRange(ctx)
+		a.dateRangeCache.updatedAt = time.Now()
+	}
+	return a.dateRangeCache.dates
+}
+
+func (a *Album) getExifDateRange(ctx context.Context) *DateRange {
+	keys, err := a.GetAllImageKeys(ctx)
+	if err != nil || len(keys) == 0 {
+		return nil
+	}
+
+	var dates []time.Time
+	for _, key := range []string{keys[0], keys[len(keys)-1]} {
+		if _, date := a.parseFilename(key); !date.IsZero() {
+			dates = append(dates, date)
+		} else if photoExif, err := a.GetPhotoExif(ctx, key); err != nil {
+			fmt.Printf("Unable to read EXIF date of %s. Error: %s\n", key, err.Error())
+		} else if !photoExif.TakenAt.IsZero() {
+			dates = append(dates, photoExif.TakenAt)
+		}
+	}
+
+	if len(dates) == 0 {
+		return nil
+	}
+
+	r := &DateRange{dates[0], dates[len(dates)-1]}
+	if r.End.Before(r.Start) {
+		r.Start, r.End = r.End, r.Start
+	}
+	return r
+}
+
+// Escapes text values as described in RFC 5545 section 3.3.11
+func escapeICalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// Lines longer than 75 octets must be folded onto continuation lines starting with a space
+func writeICalLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 { // don't split UTF-8 sequences
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The space that starts a continuation line counts towards its 75
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func handleCalendar(site *Site, w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:-//Agile Leaf//50mm//EN")
+	writeICalLine(&b, "CALSCALE:GREGORIAN")
+	writeICalLine(&b, "X-WR-CALNAME:"+escapeICalText(site.SiteTitle))
+
+	now := time.Now().UTC().Format("20060102T150405Z")
+	for _, album := range site.GetAlbumsForIndex() {
+		dates := album.GetDateRange(r.Context())
+		if dates == nil {
+			continue
+		}
+
+		albumUrl := album.GetCanonicalPageUrl()
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, "UID:"+escapeICalText(albumUrl))
+		writeICalLine(&b, "DTSTAMP:"+now)
+		writeICalLine(&b, "DTSTART;VALUE=DATE:"+dates.Start.Format("20060102"))
+		// DTEND is exclusive for all day events
+		writeICalLine(&b, "DTEND;VALUE=DATE:"+dates.End.AddDate(0, 0, 1).Format("20060102"))
+		writeICalLine(&b, "SUMMARY:"+escapeICalText(album.AlbumTitle))
+		writeICalLine(&b, "URL:"+albumUrl)
+		writeICalLine(&b, "DESCRIPTION:"+escapeICalText(albumUrl))
+		writeICalLine(&b, "END:VEVENT")
+	}
+	writeICalLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
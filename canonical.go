@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Whether album pages are served at /album/ (the default) or /album
+const TRAILING_SLASH_ADD = "add"
+const TRAILING_SLASH_REMOVE = "remove"
+
+var TRAILING_SLASHES = []string{TRAILING_SLASH_ADD, TRAILING_SLASH_REMOVE}
+
+func (s *Site) GetTrailingSlash() string {
+	return firstNonEmpty(s.TrailingSlash, TRAILING_SLASH_ADD)
+}
+
+func validateTrailingSlash(s *Site) error {
+	for _, t := range TRAILING_SLASHES {
+		if s.GetTrailingSlash() == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("TrailingSlash must be one of %s", strings.Join(TRAILING_SLASHES, ", "))
+}
+
+func (a *Album) pagePath() string {
+	if a.site.GetTrailingSlash() == TRAILING_SLASH_REMOVE && a.Path != "/" {
+		return strings.TrimSuffix(a.Path, "/")
+	}
+	return a.Path
+}
+
+func (a *Album) pageUrl(u *url.URL) string {
+	if a.site.GetTrailingSlash() == TRAILING_SLASH_REMOVE && u.Path != "/" {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	}
+	return u.String()
+}
+
+// The URL of the album page on this site, which depends on the site's TrailingSlash. Photo URLs are built on GetSiteUrl instead.
+func (a *Album) GetPageUrl() string {
+	return a.pageUrl(a.GetSiteUrl())
+}
+
+// Like GetPageUrl, but at the album's CanonicalUrl, for feeds that should point wherever the album now lives
+func (a *Album) GetCanonicalPageUrl() string {
+	return a.pageUrl(a.GetCanonicalUrl())
+}
+
+/*
+Paths that try to climb out of an album, or hide slashes from the router, never name a file in the bucket. Encoded
+slashes would otherwise end up inside a slug, and from there in an S3 key.
+*/
+func isTraversalPath(r *http.Request) bool {
+	if strings.ContainsAny(r.URL.Path, "\\\x00") {
+		return true
+	}
+	raw := strings.ToLower(r.URL.EscapedPath())
+	if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") {
+		return true
+	}
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectToPath(w http.ResponseWriter, r *http.Request, p string) {
+	u := *r.URL
+	u.Path, u.RawPath = p, ""
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+/*
+Runs before routing, so every route sees one spelling of each path: duplicate slashes are collapsed, album pages get
+(or lose) their trailing slash according to TrailingSlash, and path traversal attempts are turned away.
+*/
+func canonicalPathMiddleware(site *Site) Middleware {
+	albumPaths := make(map[string]bool)
+	for _, album := range site.Albums {
+		albumPaths[album.Path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isTraversalPath(r) {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+
+			if strings.Contains(r.URL.Path, "//") {
+				p := r.URL.Path
+				for strings.Contains(p, "//") {
+					p = strings.ReplaceAll(p, "//", "/")
+				}
+				redirectToPath(w, r, p)
+				return
+			}
+
+			p := r.URL.Path
+			if p == "/" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch site.GetTrailingSlash() {
+			case TRAILING_SLASH_ADD:
+				if albumPaths[p+"/"] {
+					redirectToPath(w, r, p+"/")
+					return
+				}
+			case TRAILING_SLASH_REMOVE:
+				if albumPaths[p] {
+					redirectToPath(w, r, strings.TrimSuffix(p, "/"))
+					return
+				}
+				// Albums are routed at their path with the slash, so the page is served from there
+				if albumPaths[p+"/"] {
+					r2 := r.Clone(r.Context())
+					r2.URL.Path, r2.URL.RawPath = p+"/", ""
+					next.ServeHTTP(w, r2)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
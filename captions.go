@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+A photo's caption comes from a text file next to it with this added to its name, like IMG_1234.JPG.caption, or else from
+the caption in its EXIF data. Tags come from a .tags file, separated by commas.
+*/
+const CAPTION_SIDECAR_EXT = ".caption"
+const TAGS_SIDECAR_EXT = ".tags"
+
+const ADMIN_CAPTIONS_PATH = "/admin/captions"
+const AUDIT_CAPTIONS = "captions"
+
+const ADMIN_THUMBNAIL_SIZE = 80
+
+type CaptionRow struct {
+	Key          string
+	Slug         string
+	ThumbnailUrl string
+
+	Caption            string
+	CaptionPlaceholder string // What the photo shows without a caption sidecar
+	Alt                string
+	AltPlaceholder     string
+	Tags               string
+	Generated          string // Where the placeholders came from, if a captioning provider wrote them
+}
+
+type CaptionsPageContext struct {
+	Site  string
+	Album string
+	Title string
+	Saved int // Sidecars changed by the last save
+	Rows  []*CaptionRow
+}
+
+func (a *Album) caption(key string, info *PhotoInfo) string {
+	if text := a.ownCaption(key, info); text != "" {
+		return text
+	}
+	if generated := a.generatedCaption(key); generated != nil {
+		return generated.Caption
+	}
+	return ""
+}
+
+// The caption written for the photo, leaving out the one a captioning provider came up with, see autocaption.go
+func (a *Album) ownCaption(key string, info *PhotoInfo) string {
+	if text := a.sidecarText(key, CAPTION_SIDECAR_EXT); text != "" {
+		return text
+	}
+	if info != nil {
+		return info.Caption
+	}
+	return ""
+}
+
+func (a *Album) tags(key string) []string {
+	return splitTags(a.sidecarText(key, TAGS_SIDECAR_EXT))
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func adminAlbum(r *http.Request) (*Album, error) {
+	site, err := app.SiteForDomain(r.FormValue("site"))
+	if err != nil {
+		return nil, err
+	}
+	return site.GetAlbumForPath(r.FormValue("album"))
+}
+
+// Every photo of an album in one table, with its caption, alt text and tags to edit
+func handleAdminCaptions(w http.ResponseWriter, r *http.Request) {
+	album, err := adminAlbum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keys, err := album.GetAllImageKeys(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	ctx := &CaptionsPageContext{Site: album.site.Domain, Album: album.Path, Title: album.AlbumTitle}
+	ctx.Saved, _ = strconv.Atoi(r.FormValue("saved"))
+	for _, key := range keys {
+		photo := album.GetPhotoForKey(key)
+		info := photo.Info()
+		row := &CaptionRow{
+			Key:                key,
+			Slug:               photo.Slug(),
+			ThumbnailUrl:       photo.GetThumbnailForWidthAndHeight(ADMIN_THUMBNAIL_SIZE, ADMIN_THUMBNAIL_SIZE),
+			Caption:            album.sidecarText(key, CAPTION_SIDECAR_EXT),
+			CaptionPlaceholder: album.caption(key, info),
+			Alt:                album.sidecarText(key, ALT_TEXT_SIDECAR_EXT),
+			AltPlaceholder:     album.defaultAltText(key, info),
+			Tags:               strings.Join(album.tags(key), ", "),
+		}
+		if generated := album.generatedCaption(key); generated != nil && album.ownCaption(key, info) == "" {
+			row.Generated = fmt.Sprintf("Generated by %s on %s", generated.Provider, generated.GeneratedAt.Format("2006-01-02"))
+		}
+		ctx.Rows = append(ctx.Rows, row)
+	}
+
+	tmpl, err := template.ParseFiles("templates/admin/captions.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, ctx); err != nil {
+		fmt.Printf("Unable to render captions page. Error: %s\n", err.Error())
+	}
+}
+
+/*
+Saves the captions page. Only the sidecars that changed are uploaded, empty fields delete theirs. The album is refreshed
+afterwards, which reads the new sidecars and drops its cached pages.
+*/
+func handleAdminCaptionsSave(w http.ResponseWriter, r *http.Request) {
+	// Browsers send the saved admin password along with forms posted from other sites too
+	if !isAllowedReferrer(r, (&url.URL{Host: r.Host}).Hostname(), nil) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	album, err := adminAlbum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keys, err := album.GetAllImageKeys(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	inAlbum := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		inAlbum[key] = true
+	}
+
+	r.ParseForm()
+	rows := r.PostForm["key"]
+	fields := map[string][]string{
+		CAPTION_SIDECAR_EXT:  r.PostForm["caption"],
+		ALT_TEXT_SIDECAR_EXT: r.PostForm["alt"],
+		TAGS_SIDECAR_EXT:     r.PostForm["tags"],
+	}
+	for _, values := range fields {
+		if len(values) != len(rows) {
+			http.Error(w, "Every photo needs a caption, alt and tags field", http.StatusBadRequest)
+			return
+		}
+	}
+
+	saved := 0
+	for i, key := range rows {
+		if !inAlbum[key] {
+			http.Error(w, fmt.Sprintf("%s isn't in the album", key), http.StatusBadRequest)
+			return
+		}
+		for ext, values := range fields {
+			text := strings.Join(strings.Fields(values[i]), " ")
+			if ext == TAGS_SIDECAR_EXT {
+				text = strings.Join(splitTags(text), ", ")
+			}
+			if text == album.sidecarText(key, ext) {
+				continue
+			}
+			if err := album.writeTextSidecar(r.Context(), key, ext, text); err != nil {
+				reportError("write text sidecar", err, albumErrorContext(album))
+				http.Error(w, fmt.Sprintf("Unable to save %s%s. Error: %s", key, ext, err.Error()), http.StatusBadGateway)
+				return
+			}
+			saved++
+		}
+	}
+
+	if saved > 0 {
+		recordAuditEvent(&AuditEvent{Action: AUDIT_CAPTIONS, Site: album.site.Domain, Album: album.Path, Remote: clientIP(r),
+			Detail: fmt.Sprintf("%d sidecars", saved)})
+		if err := album.RefreshCache(r.Context()); err != nil {
+			reportError("refresh album cache", err, albumErrorContext(album))
+		}
+	}
+
+	query := url.Values{"site": {album.site.Domain}, "album": {album.Path}, "saved": {fmt.Sprint(saved)}}
+	http.Redirect(w, r, ADMIN_CAPTIONS_PATH+"?"+query.Encode(), http.StatusSeeOther)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// What happens to the color profile of a photo when it's resized
+const COLOR_PROFILE_PRESERVE = "preserve"
+const COLOR_PROFILE_SRGB = "srgb"
+
+var COLOR_PROFILES = []string{COLOR_PROFILE_PRESERVE, COLOR_PROFILE_SRGB}
+
+// JPEGs keep their ICC profile in APP2 segments, split up into chunks that each fit in one
+var iccJpegPrefix = []byte("ICC_PROFILE\x00")
+
+const ICC_JPEG_CHUNK_SIZE = 65519
+
+func (s *Site) GetColorProfile() string {
+	return firstNonEmpty(s.ColorProfile, COLOR_PROFILE_PRESERVE)
+}
+
+func validateColorProfile(s *Site) error {
+	for _, p := range COLOR_PROFILES {
+		if s.GetColorProfile() == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("ColorProfile must be one of %s", strings.Join(COLOR_PROFILES, ", "))
+}
+
+// Returns the ICC profile of a JPEG, or nil if it doesn't have one
+func readJpegIccProfile(data []byte) []byte {
+	chunks := make(map[int][]byte)
+	eachJpegSegment(data, func(marker byte, _ int, segment []byte) bool {
+		// After the prefix come the chunk's sequence number, from 1, and the number of chunks
+		if marker == 0xE2 && bytes.HasPrefix(segment, iccJpegPrefix) && len(segment) > len(iccJpegPrefix)+2 {
+			chunks[int(segment[len(iccJpegPrefix)])] = segment[len(iccJpegPrefix)+2:]
+		}
+		return true
+	})
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	var seqs []int
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var profile []byte
+	for _, seq := range seqs {
+		profile = append(profile, chunks[seq]...)
+	}
+	return profile
+}
+
+// Adds an ICC profile to a JPEG that doesn't have one, right after its SOI marker
+func writeJpegIccProfile(data, profile []byte) []byte {
+	if len(profile) == 0 {
+		return data
+	}
+
+	count := (len(profile) + ICC_JPEG_CHUNK_SIZE - 1) / ICC_JPEG_CHUNK_SIZE
+	result := make([]byte, 0, len(data)+len(profile)+count*18)
+	result = append(result, data[:2]...)
+	for n := 0; n < count; n++ {
+		chunk := profile[n*ICC_JPEG_CHUNK_SIZE : min((n+1)*ICC_JPEG_CHUNK_SIZE, len(profile))]
+		length := 2 + len(iccJpegPrefix) + 2 + len(chunk)
+		result = append(result, 0xFF, 0xE2, byte(length>>8), byte(length))
+		result = append(result, iccJpegPrefix...)
+		result = append(result, byte(n+1), byte(count))
+		result = append(result, chunk...)
+	}
+	return append(result, data[2:]...)
+}
+
+// Returns the iCCP chunk of a PNG as it is, length and CRC included, and the profile in it, or nils if there isn't one
+func readPngIccChunk(data []byte) ([]byte, []byte) {
+	// Chunks follow the 8 byte signature as a 4 byte length, 4 byte type, the data and a 4 byte CRC
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		if kind == "IDAT" || i+12+length > len(data) {
+			break
+		}
+
+		if kind == "iCCP" {
+			// The profile's name, a null byte, the compression method and the compressed profile
+			body := data[i+8 : i+8+length]
+			nul := bytes.IndexByte(body, 0)
+			if nul < 0 || nul+2 > len(body) {
+				return nil, nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(body[nul+2:]))
+			if err != nil {
+				return nil, nil
+			}
+			defer r.Close()
+			profile, err := io.ReadAll(r)
+			if err != nil {
+				return nil, nil
+			}
+			return data[i : i+12+length], profile
+		}
+		i += 12 + length
+	}
+	return nil, nil
+}
+
+// Adds a chunk to a PNG right after its IHDR chunk, where iCCP has to go
+func writePngChunk(data, chunk []byte) []byte {
+	if len(chunk) == 0 || len(data) < 33 {
+		return data
+	}
+
+	// The signature and the IHDR chunk, which is always first and 13 bytes long
+	result := make([]byte, 0, len(data)+len(chunk))
+	result = append(result, data[:33]...)
+	result = append(result, chunk...)
+	return append(result, data[33:]...)
+}
+
+// Returns the description of an ICC profile, like "Display P3", from its desc tag
+func iccProfileDescription(profile []byte) string {
+	// The 128 byte header is followed by the number of tags and a table of their signature, offset and size
+	if len(profile) < 132 {
+		return ""
+	}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for n, entry := 0, 132; n < count && entry+12 <= len(profile); n, entry = n+1, entry+12 {
+		if string(profile[entry:entry+4]) != "desc" {
+			continue
+		}
+		offset, size := int(binary.BigEndian.Uint32(profile[entry+4:])), int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset+size > len(profile) || size < 12 {
+			return ""
+		}
+		tag := profile[offset : offset+size]
+
+		switch string(tag[:4]) {
+		case "desc": // ICC v2, an ASCII string with its length
+			length := int(binary.BigEndian.Uint32(tag[8:]))
+			if 12+length > len(tag) {
+				return ""
+			}
+			return strings.TrimRight(string(tag[12:12+length]), "\x00")
+		case "mluc": // ICC v4, UTF-16 strings in different languages, the first will do
+			if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+				return ""
+			}
+			length, start := int(binary.BigEndian.Uint32(tag[20:])), int(binary.BigEndian.Uint32(tag[24:]))
+			if start+length > len(tag) {
+				return ""
+			}
+			runes := make([]uint16, length/2)
+			for i := range runes {
+				runes[i] = binary.BigEndian.Uint16(tag[start+2*i:])
+			}
+			return string(utf16.Decode(runes))
+		}
+		return ""
+	}
+	return ""
+}
+
+// Whether a profile is Display P3, the wide gamut profile of photos from iPhones and recent cameras
+func isDisplayP3Profile(profile []byte) bool {
+	return strings.Contains(iccProfileDescription(profile), "Display P3")
+}
+
+// Display P3 and sRGB share their transfer curve and white point, so only the primaries need converting
+var displayP3ToSRGB = [3][3]float64{
+	{1.2249401, -0.2249404, 0.0000000},
+	{-0.0420569, 1.0420571, 0.0000000},
+	{-0.0196376, -0.0786361, 1.0982735},
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+/*
+Converts a Display P3 photo to sRGB, in place. Colors outside of sRGB are clipped, which is what browsers would do when
+showing the photo on an sRGB screen anyway.
+*/
+func convertDisplayP3ToSRGB(img *image.RGBA) {
+	var toLinear [256]float64
+	for i := range toLinear {
+		toLinear[i] = srgbToLinear(float64(i) / 255)
+	}
+	// Linear values are looked up at 12 bits, so dark colors don't band
+	var fromLinear [4096]uint8
+	for i := range fromLinear {
+		fromLinear[i] = uint8(math.Round(linearToSRGB(float64(i)/4095) * 255))
+	}
+
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[(y-img.Rect.Min.Y)*img.Stride:]
+		for x := 0; x < img.Rect.Dx(); x++ {
+			p := row[x*4 : x*4+3]
+			a := float64(row[x*4+3])
+			if a == 0 {
+				continue
+			}
+
+			// RGBA images are alpha premultiplied, the transfer curve only applies to the actual color
+			var rgb [3]float64
+			for c := range rgb {
+				rgb[c] = toLinear[min(255, int(math.Round(float64(p[c])*255/a)))]
+			}
+			for c, m := range displayP3ToSRGB {
+				v := m[0]*rgb[0] + m[1]*rgb[1] + m[2]*rgb[2]
+				v = math.Max(0, math.Min(1, v))
+				p[c] = uint8(math.Round(float64(fromLinear[int(v*4095)]) * a / 255))
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type Command struct {
+	Run         func(args []string) int
+	Description string
+}
+
+// Running 50mm without a command starts the server, like it always has
+const DEFAULT_COMMAND = "serve"
+
+var commands = map[string]*Command{
+	"serve":         {runServe, "Start the gallery server (default)"},
+	"audit":         {runAudit, "Check every album for missing, empty, and broken photos"},
+	"bench":         {runBench, "Benchmark the album render pipeline"},
+	"config-schema": {runConfigSchema, "List every site and album option with its type and default"},
+	"decode-worker": {runDecodeWorker, "Decode images for a server with FIFTYMM_DECODE_WORKERS (started by the server)"},
+	"export-state":  {runExportState, "Write the server's saved state to an archive, to move it to another host"},
+	"import":        {runImport, "Upload a folder of exported photos to an album"},
+	"import-state":  {runImportState, "Restore the server's saved state from an export-state archive"},
+	"init":          {runInit, "Write a first site config and check the bucket can be reached"},
+	"migrate":       {runMigrate, "Move albums over from Piwigo, Lychee or PhotoPrism"},
+	"sync":          {runSync, "Mirror a folder of photos to an album"},
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: 50mm [command] [flags]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '50mm <command> -h' for the flags of a command.\n")
+}
+
+// Parses flags that come before, after, or between the positional arguments, and returns the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func runCommand(args []string) int {
+	name := DEFAULT_COMMAND
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		printUsage()
+		return 0
+	}
+
+	if cmd, ok := commands[name]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", name)
+		printUsage()
+		return 2
+	} else {
+		return cmd.Run(args)
+	}
+}
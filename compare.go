@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+)
+
+const COMPARE_SLUG = "compare"
+
+const MIN_COMPARE_PHOTOS = 2
+const MAX_COMPARE_PHOTOS = 4
+
+// Wider than the album grid, so there's detail left to see when zooming in
+const COMPARE_PHOTO_WIDTH = 2400
+
+type ComparePageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	Photos     []Renderable
+}
+
+func (a *Album) HasCompare() bool {
+	return a.Compare
+}
+
+/*
+The photos picked for comparing, from the photo parameters of the album's compare form, in the order they were picked.
+Picking the same photo twice counts once. Only photos can be compared, not videos, documents or archived photos.
+*/
+func (a *Album) comparePhotos(r *http.Request) ([]Renderable, bool) {
+	var photos []Renderable
+	seen := make(map[string]bool)
+	for _, slug := range r.URL.Query()["photo"] {
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		if !a.ImageExists(r.Context(), slug) {
+			return nil, false
+		}
+		photo := a.GetPhotoForKey(a.keyForSlug(slug))
+		if photo.Type() != "photo" || photo.IsArchived() {
+			return nil, false
+		}
+		photos = append(photos, photo)
+	}
+	return photos, len(photos) >= MIN_COMPARE_PHOTOS && len(photos) <= MAX_COMPARE_PHOTOS
+}
+
+// Not cached like the album page, there's a page for every combination of photos
+func handleComparePage(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	photos, ok := album.comparePhotos(r)
+	if !ok {
+		renderErrorPage(album.site, w, http.StatusBadRequest,
+			translate(album.site.GetLanguage(), "compare_invalid", MIN_COMPARE_PHOTOS, MAX_COMPARE_PHOTOS))
+		return
+	}
+
+	ctx := &ComparePageContext{
+		&BasePageContext{
+			album.site.GetCanonicalUrl().String(),
+			album.GetCanonicalUrl().String(),
+			album.GetSiteUrl().String(),
+			album.MetaTitle,
+			album.site.SiteTitle,
+			album.GetNavigation(),
+			album.site.GetLanguage(),
+			album.GetTheme(),
+			COMPARE_PHOTO_WIDTH,
+			false,
+			newSiteView(album.site),
+		},
+		album.AlbumTitle,
+		photos,
+	}
+	executeTemplateHelper(w, "compare.html", ctx)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 const CONFIG_DIR_ENV_VAR = "FIFTYMM_CONFIG_DIR"
@@ -12,11 +13,26 @@ const DEFAULT_CONFIG_DIR = "/etc/fiftymm/"
 const PORT_ENV_VAR = "FIFTYMM_PORT"
 const DEFAULT_PORT = "8080"
 
+const DEV_MODE_ENV_VAR = "FIFTYMM_DEV_MODE"
+
+const DATA_DIR_ENV_VAR = "FIFTYMM_DATA_DIR"
+const DEFAULT_DATA_DIR = "/var/lib/fiftymm/"
+
 type App struct {
-	port string
+	port    string
+	devMode bool
+
+	adminToken string
+	profiling  bool
+
+	s3Semaphore *Semaphore
 
-	configDir string
-	sites     map[string]*Site
+	dataDir        string
+	derivativesDir string
+	stateDB        *StateDB // Unless FIFTYMM_STATE_DB is off
+	configDir      string
+	sites          map[string]*Site
+	failedConfigs  []string // Files that couldn't be loaded, their sites aren't served
 }
 
 func NewApp() *App {
@@ -25,12 +41,28 @@ func NewApp() *App {
 		port = DEFAULT_PORT
 	}
 
+	dataDir := os.Getenv(DATA_DIR_ENV_VAR)
+	if dataDir == "" {
+		dataDir = DEFAULT_DATA_DIR
+	}
+
+	derivativesDir := os.Getenv(DERIVATIVES_DIR_ENV_VAR)
+	if derivativesDir == "" {
+		derivativesDir = filepath.Join(dataDir, DEFAULT_DERIVATIVES_DIR_NAME)
+	}
+
+	s3Concurrency, err := strconv.Atoi(os.Getenv(S3_CONCURRENCY_ENV_VAR))
+	if err != nil || s3Concurrency < 1 {
+		s3Concurrency = DEFAULT_S3_CONCURRENCY
+	}
+
 	configDir := os.Getenv(CONFIG_DIR_ENV_VAR)
 	if configDir == "" {
 		configDir = DEFAULT_CONFIG_DIR
 	}
 
 	configFilesMap := make(map[string]*Site)
+	var failedConfigs []string
 	filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
 		// We only look at the top level files in the config dir
 		if info.Mode().IsDir() && path != configDir {
@@ -44,17 +76,29 @@ func NewApp() *App {
 		siteConfig, loadErr := LoadSiteFromFile(path)
 		if loadErr != nil {
 			fmt.Printf("Unable to load config from file %s. Error: %s\n", path, loadErr.Error())
+			failedConfigs = append(failedConfigs, path)
 			return nil
 		}
 
 		configFilesMap[siteConfig.Domain] = siteConfig
 		return nil
 	})
+	failedConfigs = append(failedConfigs, loadTenantSites(configDir, configFilesMap)...)
 
 	return &App{
-		port:      port,
-		configDir: configDir,
-		sites:     configFilesMap,
+		port:    port,
+		devMode: os.Getenv(DEV_MODE_ENV_VAR) == "1",
+
+		adminToken: os.Getenv(ADMIN_TOKEN_ENV_VAR),
+		profiling:  os.Getenv(PROFILING_ENV_VAR) == "1",
+
+		s3Semaphore: NewSemaphore(s3Concurrency),
+
+		dataDir:        dataDir,
+		derivativesDir: derivativesDir,
+		configDir:      configDir,
+		sites:          configFilesMap,
+		failedConfigs:  failedConfigs,
 	}
 }
 
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const CONTACT_SLUG = "contact"
+
+// Hidden form field that real visitors never fill in. Bots that fill every field are silently dropped.
+const CONTACT_HONEYPOT_FIELD = "website"
+
+const CONTACT_MAX_MESSAGE_LENGTH = 5000
+
+var contactRateLimiter = NewRateLimiter(3, 1*time.Hour)
+
+type ContactMessage struct {
+	SiteTitle  string
+	AlbumTitle string
+	AlbumUrl   string
+
+	Name    string
+	Email   string
+	Message string
+
+	RemoteAddr string
+	SentAt     time.Time
+}
+
+func (s *Site) HasSmtp() bool {
+	return s.SmtpHost != "" && s.ContactEmail != ""
+}
+
+func (a *Album) HasContactForm() bool {
+	return a.ContactForm && a.site.HasSmtp()
+}
+
+func (s *Site) GetSmtpAddr() string {
+	port := s.SmtpPort
+	if port == 0 {
+		port = 587
+	}
+	return fmt.Sprintf("%s:%d", s.SmtpHost, port)
+}
+
+func (s *Site) GetContactFrom() string {
+	if s.ContactFrom != "" {
+		return s.ContactFrom
+	}
+	return s.ContactEmail
+}
+
+func (s *Site) SendContactMessage(msg *ContactMessage) error {
+	tmpl, err := template.ParseFiles("templates/email/contact.txt")
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.GetContactFrom())
+	fmt.Fprintf(&body, "To: %s\r\n", s.ContactEmail)
+	fmt.Fprintf(&body, "Reply-To: %s\r\n", msg.Email)
+	fmt.Fprintf(&body, "Subject: [%s] Message about %s\r\n", s.SiteTitle, msg.AlbumTitle)
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	if err := tmpl.Execute(&body, msg); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.SmtpUser != "" {
+		auth = smtp.PlainAuth("", s.SmtpUser, s.SmtpPass, s.SmtpHost)
+	}
+
+	return smtp.SendMail(s.GetSmtpAddr(), auth, s.GetContactFrom(), []string{s.ContactEmail}, body.Bytes())
+}
+
+func newContactMessage(album *Album, r *http.Request) (*ContactMessage, error) {
+	msg := &ContactMessage{
+		SiteTitle:  album.site.SiteTitle,
+		AlbumTitle: album.AlbumTitle,
+		AlbumUrl:   album.GetPageUrl(),
+		Name:       strings.TrimSpace(r.PostFormValue("name")),
+		Email:      strings.TrimSpace(r.PostFormValue("email")),
+		Message:    strings.TrimSpace(r.PostFormValue("message")),
+		RemoteAddr: clientIP(r),
+		SentAt:     time.Now(),
+	}
+
+	if msg.Name == "" || msg.Email == "" || msg.Message == "" {
+		return nil, errors.New("Name, email, and message are all required")
+	}
+
+	// Header values can't contain new lines, otherwise visitors could inject their own headers into the email
+	if strings.ContainsAny(msg.Name+msg.Email, "\r\n") {
+		return nil, errors.New("Invalid name or email")
+	}
+
+	if _, err := mail.ParseAddress(msg.Email); err != nil {
+		return nil, errors.New("Invalid email address")
+	}
+
+	if len(msg.Message) > CONTACT_MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("Message can't be longer than %d characters", CONTACT_MAX_MESSAGE_LENGTH)
+	}
+
+	return msg, nil
+}
+
+func handleContactForm(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !album.HasContactForm() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+		return
+	}
+
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	redirectUrl := album.GetSiteUrl()
+	if r.PostFormValue(CONTACT_HONEYPOT_FIELD) != "" {
+		// Pretend everything went fine so the bot doesn't try again
+		redirectUrl.RawQuery = "contact=sent"
+		http.Redirect(w, r, redirectUrl.String(), http.StatusSeeOther)
+		return
+	}
+
+	if !contactRateLimiter.Allow(clientIP(r)) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too many messages. Please try again later.\n"))
+		return
+	}
+
+	msg, err := newContactMessage(album, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := album.site.SendContactMessage(msg); err != nil {
+		fmt.Printf("Unable to send contact message for album %s. Error: %s\n", album.Path, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to send your message. Please try again later.\n"))
+		return
+	}
+
+	redirectUrl.RawQuery = "contact=sent"
+	http.Redirect(w, r, redirectUrl.String(), http.StatusSeeOther)
+}
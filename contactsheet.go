@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const CONTACT_SHEET_SLUG = "sheet"
+
+// Small enough for a few hundred frames to load quickly, big enough to tell a closed eye from an open one
+const CONTACT_SHEET_THUMBNAIL_SIZE = 240
+
+const DERIVATIVE_CONTACT_SHEET_THUMBNAIL = "sheet-240-v1"
+
+// Made from the blurred photo, kept apart so turning on BlurFaces never serves a thumbnail made before it
+const DERIVATIVE_CONTACT_SHEET_BLURRED = "sheet-240-faces-v1"
+
+var contactSheetExtensions = []string{".jpg", ".jpeg", ".png"}
+
+var errNoContactSheetThumbnail = errors.New("Only JPEGs and PNGs have contact sheet thumbnails")
+
+/*
+One photo on the contact sheet. Frames are numbered in album order and show their file name, so photographers and
+clients can talk about "frame 12" or "IMG_0345" and mean the same photo.
+*/
+type ContactSheetFrame struct {
+	Number       string // Padded to the same width for every frame, like 007
+	Name         string
+	Slug         string
+	Alt          string
+	ThumbnailUrl string
+	Sensitive    bool
+	Archived     bool
+}
+
+type ContactSheetPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	Frames     []*ContactSheetFrame
+}
+
+func (a *Album) HasContactSheet() bool {
+	return a.ContactSheet
+}
+
+func (a *Album) GetContactSheetUrl() string {
+	if !a.HasContactSheet() {
+		return ""
+	}
+	return a.GetSiteUrl().String() + CONTACT_SHEET_SLUG
+}
+
+/*
+Imgix scales its photos itself. Photos served from the bucket would be sent at full size, so JPEGs and PNGs get a small
+copy of their own, and everything else, like videos and documents, keeps the thumbnail it has in the grid.
+*/
+func (a *Album) contactSheetThumbnailUrl(key string, photo Renderable) string {
+	if _, ok := photo.(*ImgixPhoto); ok {
+		return photo.GetPhotoForWidth(CONTACT_SHEET_THUMBNAIL_SIZE)
+	}
+	if photo.IsArchived() || rendererForKey(key) != nil || !hasExtension(key, contactSheetExtensions) {
+		return photo.GetThumbnailForWidthAndHeight(CONTACT_SHEET_THUMBNAIL_SIZE, CONTACT_SHEET_THUMBNAIL_SIZE)
+	}
+	u := a.GetSiteUrl()
+	u.Path += CONTACT_SHEET_SLUG + "/" + photo.Slug()
+	a.site.signMediaUrl(u)
+	return u.String()
+}
+
+func (a *Album) contactSheetFrames(photos []Renderable) []*ContactSheetFrame {
+	digits := len(strconv.Itoa(len(photos)))
+	frames := make([]*ContactSheetFrame, 0, len(photos))
+	for i, photo := range photos {
+		key := a.keyForSlug(photo.Slug())
+		frames = append(frames, &ContactSheetFrame{
+			Number:       fmt.Sprintf("%0*d", digits, i+1),
+			Name:         path.Base(key),
+			Slug:         photo.Slug(),
+			Alt:          photo.Alt(),
+			ThumbnailUrl: a.contactSheetThumbnailUrl(key, photo),
+			Sensitive:    photo.IsSensitive(),
+			Archived:     photo.IsArchived(),
+		})
+	}
+	return frames
+}
+
+// Albums with BlurFaces shrink the blurred photo, so the sheet never shows a face the album hides
+func (a *Album) buildContactSheetThumbnail(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	var err error
+	if a.BlurFaces {
+		data, err = a.GetDerivative(ctx, DERIVATIVE_BLURRED_FACES, key, func(ctx context.Context) ([]byte, error) {
+			return a.buildBlurredPhoto(ctx, key)
+		})
+	} else {
+		data, err = a.getObjectData(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, errNoContactSheetThumbnail
+	}
+	return resizeImage(data, contentType, CONTACT_SHEET_THUMBNAIL_SIZE, a.site.GetColorProfile())
+}
+
+func handleContactSheet(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	renderCachedPage(album, "sheet", w, r, "sheet.html", func() (interface{}, error) {
+		photos, _, err := album.GetPhotosAndView(r.Context(), album.site.GetPhotoWidth(false))
+		if err != nil {
+			return nil, err
+		}
+
+		return &ContactSheetPageContext{
+			&BasePageContext{
+				album.site.GetCanonicalUrl().String(),
+				album.GetCanonicalUrl().String(),
+				album.GetSiteUrl().String(),
+				album.MetaTitle,
+				album.site.SiteTitle,
+				album.GetNavigation(),
+				album.site.GetLanguage(),
+				album.GetTheme(),
+				album.site.GetPhotoWidth(false),
+				false,
+				newSiteView(album.site),
+			},
+			album.AlbumTitle,
+			album.contactSheetFrames(photos),
+		}, nil
+	})
+}
+
+func handleContactSheetThumbnail(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	if !checkHotlink(w, r, album.site) {
+		return
+	}
+
+	slug := r.PathValue("slug")
+	key := album.keyForSlug(slug)
+	if !album.ImageExists(r.Context(), slug) || !hasExtension(key, contactSheetExtensions) {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	kind := DERIVATIVE_CONTACT_SHEET_THUMBNAIL
+	if album.BlurFaces {
+		kind = DERIVATIVE_CONTACT_SHEET_BLURRED
+	}
+	etag := ""
+	if original := album.cachedETag(key); original != "" {
+		etag = strings.TrimSuffix(original, `"`) + "-" + kind + `"`
+	}
+	if checkNotModified(w, r, album, etag) {
+		return
+	}
+
+	data, err := album.GetDerivative(r.Context(), kind, key, func(ctx context.Context) ([]byte, error) {
+		return album.buildContactSheetThumbnail(ctx, key)
+	})
+	if err == errNoContactSheetThumbnail || err == errCantBlurFaces {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	} else if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const DEFAULT_PHOTO_WIDTH = 800
+const DEFAULT_LITE_PHOTO_WIDTH = 400
+const DEFAULT_LITE_EAGER_PHOTOS = 2
+
+const LITE_COOKIE = "lite"
+
+/*
+Whether to send the page in data saver mode, for browsers that ask for it with the Save-Data header, or for visitors who
+opened a page with ?lite=1. The query parameter is remembered in a cookie until ?lite=0, so it sticks while visitors
+browse the site.
+*/
+func isLiteRequest(w http.ResponseWriter, r *http.Request) bool {
+	// Pages differ by the header, so caches in between mustn't mix them up
+	w.Header().Add("Vary", "Save-Data")
+
+	switch r.URL.Query().Get("lite") {
+	case "1":
+		http.SetCookie(w, &http.Cookie{Name: LITE_COOKIE, Value: "1", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		return true
+	case "0":
+		http.SetCookie(w, &http.Cookie{Name: LITE_COOKIE, Value: "", Path: "/", MaxAge: -1})
+		return false
+	}
+
+	if cookie, err := r.Cookie(LITE_COOKIE); err == nil && cookie.Value == "1" {
+		return true
+	}
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Save-Data")), "on")
+}
+
+func validateDataSaver(s *Site) error {
+	if s.LitePhotoWidth < 0 || s.LiteEagerPhotos < 0 {
+		return errors.New("LitePhotoWidth and LiteEagerPhotos can't be negative")
+	}
+	return nil
+}
+
+// The width photos are shown at on album and photo pages
+func (s *Site) GetPhotoWidth(lite bool) int {
+	if !lite {
+		return DEFAULT_PHOTO_WIDTH
+	} else if s.LitePhotoWidth > 0 {
+		return s.LitePhotoWidth
+	}
+	return DEFAULT_LITE_PHOTO_WIDTH
+}
+
+// The number of photos album pages load straight away, the rest are lazy loaded
+func (s *Site) GetEagerPhotos(lite bool) int {
+	if !lite {
+		return ABOVE_THE_FOLD_PHOTOS
+	} else if s.LiteEagerPhotos > 0 {
+		return s.LiteEagerPhotos
+	}
+	return DEFAULT_LITE_EAGER_PHOTOS
+}
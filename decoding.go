@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const DECODE_MAX_MEGAPIXELS_ENV_VAR = "FIFTYMM_DECODE_MAX_MEGAPIXELS"
+const DECODE_TIMEOUT_ENV_VAR = "FIFTYMM_DECODE_TIMEOUT"
+const DECODE_WORKERS_ENV_VAR = "FIFTYMM_DECODE_WORKERS"
+
+// About 1 GB of memory while decoding, more than any camera takes, but less than some panoramas and scans
+const DEFAULT_DECODE_MAX_MEGAPIXELS = 250
+const DEFAULT_DECODE_TIMEOUT = 30 * time.Second
+
+// The command the server starts its decode workers with
+const DECODE_WORKER_COMMAND = "decode-worker"
+
+var errImageTooBig = errors.New("The image has more pixels than FIFTYMM_DECODE_MAX_MEGAPIXELS")
+var errDecodeTimeout = errors.New("Decoding the image took too long")
+
+type decodeLimits struct {
+	maxPixels int64
+	timeout   time.Duration
+	workers   int
+}
+
+var decodeSettings struct {
+	once   sync.Once
+	limits decodeLimits
+	slots  *Semaphore         // Decodes running in this process
+	pool   chan *decodeWorker // Idle workers, nil for ones that aren't running
+}
+
+func decodeLimitsFromEnv() decodeLimits {
+	limits := decodeLimits{DEFAULT_DECODE_MAX_MEGAPIXELS * 1000 * 1000, DEFAULT_DECODE_TIMEOUT, 0}
+	if n, err := strconv.Atoi(os.Getenv(DECODE_MAX_MEGAPIXELS_ENV_VAR)); err == nil && n > 0 {
+		limits.maxPixels = int64(n) * 1000 * 1000
+	}
+	if seconds, err := strconv.Atoi(os.Getenv(DECODE_TIMEOUT_ENV_VAR)); err == nil && seconds > 0 {
+		limits.timeout = time.Duration(seconds) * time.Second
+	}
+	if n, err := strconv.Atoi(os.Getenv(DECODE_WORKERS_ENV_VAR)); err == nil && n > 0 {
+		limits.workers = n
+	}
+	return limits
+}
+
+func setupDecoding(limits decodeLimits) {
+	decodeSettings.once.Do(func() {
+		decodeSettings.limits = limits
+		decodeSettings.slots = NewSemaphore(runtime.NumCPU())
+		decodeSettings.pool = make(chan *decodeWorker, limits.workers)
+		for i := 0; i < limits.workers; i++ {
+			decodeSettings.pool <- nil
+		}
+	})
+}
+
+/*
+Decodes an image like image.Decode, but safely enough for whatever ends up in a bucket: images with more pixels than
+FIFTYMM_DECODE_MAX_MEGAPIXELS are refused before they're decoded, decoders that panic on a malformed file return an
+error instead of taking the server down, and decoding gives up after FIFTYMM_DECODE_TIMEOUT. With
+FIFTYMM_DECODE_WORKERS, images are decoded by that many worker processes, so not even running out of memory or a
+decoder that never returns can hurt the server, the worker is just started again.
+*/
+func decodeImage(data []byte) (image.Image, string, error) {
+	setupDecoding(decodeLimitsFromEnv())
+
+	config, err := decodeConfigRecovering(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(config.Width)*int64(config.Height) > decodeSettings.limits.maxPixels {
+		return nil, "", fmt.Errorf("%w (%dx%d)", errImageTooBig, config.Width, config.Height)
+	}
+
+	if decodeSettings.limits.workers > 0 {
+		return decodeInWorker(data)
+	}
+	return decodeInProcess(data)
+}
+
+type decodeResult struct {
+	img    image.Image
+	format string
+	err    error
+}
+
+// Header parsers trip over malformed files like the decoders themselves
+func decodeConfigRecovering(data []byte) (config image.Config, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("The image decoder crashed: %v", p)
+		}
+	}()
+	config, _, err = image.DecodeConfig(bytes.NewReader(data))
+	return config, err
+}
+
+func decodeRecovering(data []byte) (result decodeResult) {
+	defer func() {
+		if p := recover(); p != nil {
+			result = decodeResult{err: fmt.Errorf("The image decoder crashed: %v", p)}
+		}
+	}()
+	img, format, err := image.Decode(bytes.NewReader(data))
+	return decodeResult{img, format, err}
+}
+
+/*
+Decodes at most one image per CPU at a time. Go can't stop a decoder that's taking too long, so after the timeout it's
+left to finish on its own, and keeps its slot until it does, so stuck decoders can't pile up. Waiting for a slot counts
+towards the timeout, so once every slot is stuck, decodes time out instead of waiting forever.
+*/
+func decodeInProcess(data []byte) (image.Image, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), decodeSettings.limits.timeout)
+	defer cancel()
+	if err := decodeSettings.slots.Acquire(ctx); err != nil {
+		return nil, "", errDecodeTimeout
+	}
+
+	done := make(chan decodeResult, 1)
+	go func() {
+		defer decodeSettings.slots.Release()
+		done <- decodeRecovering(data)
+	}()
+
+	select {
+	case result := <-done:
+		return result.img, result.format, result.err
+	case <-ctx.Done():
+		return nil, "", errDecodeTimeout
+	}
+}
+
+// A child process decoding images sent to it on stdin, one at a time
+type decodeWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// What a worker said was wrong with an image, as opposed to the worker itself breaking down
+type decodeWorkerError string
+
+func (e decodeWorkerError) Error() string {
+	return string(e)
+}
+
+func startDecodeWorker() (*decodeWorker, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(executable, DECODE_WORKER_COMMAND)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &decodeWorker{cmd, stdin, bufio.NewReader(stdout)}, nil
+}
+
+func (w *decodeWorker) kill() {
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+}
+
+/*
+Images go to workers as their length and bytes, and come back as a status, then either an error message, or the format,
+size and pixels of the image as NRGBA.
+*/
+func (w *decodeWorker) decode(data []byte) (image.Image, string, error) {
+	if err := binary.Write(w.stdin, binary.BigEndian, uint64(len(data))); err != nil {
+		return nil, "", err
+	}
+	if _, err := w.stdin.Write(data); err != nil {
+		return nil, "", err
+	}
+
+	status, err := w.stdout.ReadByte()
+	if err != nil {
+		return nil, "", err
+	}
+	message, err := readDecodeString(w.stdout)
+	if err != nil {
+		return nil, "", err
+	}
+	if status != 0 {
+		return nil, "", decodeWorkerError(message)
+	}
+
+	var size [2]uint32
+	if err := binary.Read(w.stdout, binary.BigEndian, &size); err != nil {
+		return nil, "", err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, int(size[0]), int(size[1])))
+	if _, err := io.ReadFull(w.stdout, img.Pix); err != nil {
+		return nil, "", err
+	}
+	return img, message, nil
+}
+
+// Workers that time out or break down are killed, and started again by the next decode that needs one
+func decodeInWorker(data []byte) (image.Image, string, error) {
+	worker := <-decodeSettings.pool
+	if worker == nil {
+		var err error
+		if worker, err = startDecodeWorker(); err != nil {
+			decodeSettings.pool <- nil
+			return nil, "", fmt.Errorf("Unable to start a decode worker. Error: %w", err)
+		}
+	}
+
+	done := make(chan decodeResult, 1)
+	go func() {
+		img, format, err := worker.decode(data)
+		done <- decodeResult{img, format, err}
+	}()
+
+	timer := time.NewTimer(decodeSettings.limits.timeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		if _, ok := result.err.(decodeWorkerError); result.err != nil && !ok {
+			worker.kill()
+			decodeSettings.pool <- nil
+			return nil, "", fmt.Errorf("The decode worker stopped. Error: %w", result.err)
+		}
+		decodeSettings.pool <- worker
+		return result.img, result.format, result.err
+	case <-timer.C:
+		worker.kill()
+		<-done
+		decodeSettings.pool <- nil
+		return nil, "", errDecodeTimeout
+	}
+}
+
+func readDecodeString(r io.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+func writeDecodeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func writeDecodeResult(w *bufio.Writer, result decodeResult) error {
+	if result.err != nil {
+		w.WriteByte(1)
+		writeDecodeString(w, result.err.Error())
+		return w.Flush()
+	}
+
+	bounds := result.img.Bounds()
+	nrgba, ok := result.img.(*image.NRGBA)
+	if !ok || bounds.Min != (image.Point{}) || nrgba.Stride != 4*bounds.Dx() {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(nrgba, nrgba.Bounds(), result.img, bounds.Min, draw.Src)
+	}
+
+	w.WriteByte(0)
+	writeDecodeString(w, result.format)
+	binary.Write(w, binary.BigEndian, [2]uint32{uint32(bounds.Dx()), uint32(bounds.Dy())})
+	w.Write(nrgba.Pix)
+	return w.Flush()
+}
+
+// The worker process the server starts for FIFTYMM_DECODE_WORKERS, it decodes images until its stdin is closed
+func runDecodeWorker(args []string) int {
+	limits := decodeLimitsFromEnv()
+	limits.workers = 0
+	setupDecoding(limits)
+
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	for {
+		var length uint64
+		if err := binary.Read(in, binary.BigEndian, &length); err != nil {
+			return 0
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return 1
+		}
+
+		img, format, err := decodeInProcess(data)
+		if err := writeDecodeResult(out, decodeResult{img, format, err}); err != nil {
+			return 1
+		}
+	}
+}
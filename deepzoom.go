@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+)
+
+/*
+Albums with DeepZoom cut their biggest photos into tiles at every zoom level, so the photo page can zoom into a
+gigapixel scan without downloading all of it. The tiles are served as a IIIF Image API level 0 service, which
+OpenSeadragon and other IIIF viewers read, at /<album path>/iiif/<slug>/info.json.
+*/
+const IIIF_SLUG = "iiif/"
+
+// The service's info, stored once all the tiles are, so a photo never gets a viewer with tiles missing
+const DERIVATIVE_DEEP_ZOOM = "iiif-v1"
+
+// One derivative per tile, named after the photo's ETag and the tile's scale factor, column and row
+const DERIVATIVE_DEEP_ZOOM_TILE = "iiif-tile-v1"
+
+const DEEP_ZOOM_TILE_SIZE = 512
+const DEEP_ZOOM_JOB_TIMEOUT = 30 * time.Minute
+const DEFAULT_DEEP_ZOOM_MEGAPIXELS = 40
+
+const IIIF_IMAGE_CONTEXT = "http://iiif.io/api/image/3/context.json"
+
+// Formats that are decoded into tiles. Videos, documents and the like have no pixels to zoom into.
+var deepZoomExtensions = []string{".jpg", ".jpeg", ".png"}
+
+var errNoDeepZoomTile = errors.New("There's no such tile")
+
+type DeepZoomInfo struct {
+	Width        int
+	Height       int
+	TileSize     int
+	ScaleFactors []int
+}
+
+// The info.json of a IIIF Image API 3.0 level 0 service, which only has the tiles listed in it
+type iiifImageInfo struct {
+	Context  string      `json:"@context"`
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	Protocol string      `json:"protocol"`
+	Profile  string      `json:"profile"`
+	Width    int         `json:"width"`
+	Height   int         `json:"height"`
+	Tiles    []iiifTiles `json:"tiles"`
+}
+
+type iiifTiles struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+func (s *Site) GetDeepZoomMegapixels() int {
+	if s.DeepZoomMegapixels > 0 {
+		return s.DeepZoomMegapixels
+	}
+	return DEFAULT_DEEP_ZOOM_MEGAPIXELS
+}
+
+func (a *Album) isDeepZoomable(key string) bool {
+	return a.DeepZoom && !a.isArchived(key) && rendererForKey(key) == nil && hasExtension(key, deepZoomExtensions)
+}
+
+// Only photos at least DeepZoomMegapixels big are tiled, smaller ones are shown well enough by the photo page
+func (a *Album) needsDeepZoom(photoExif *PhotoExif) bool {
+	return photoExif.Width*photoExif.Height >= a.site.GetDeepZoomMegapixels()*1000*1000
+}
+
+func (a *Album) GetIIIFServiceUrl(slug string) string {
+	return a.GetSiteUrl().String() + IIIF_SLUG + slug
+}
+
+// The info.json of the photo's tiles, empty until they're made
+func (a *Album) deepZoomUrl(key string) string {
+	if !a.DeepZoom || a.deepZoomInfo(key) == nil {
+		return ""
+	}
+	return a.GetIIIFServiceUrl(fileSlug(key)) + "/info.json"
+}
+
+func (a *Album) deepZoomInfo(key string) *DeepZoomInfo {
+	if info, ok := a.deepZoomCache.Load(key); ok {
+		return info.(*DeepZoomInfo)
+	}
+	return nil
+}
+
+func deepZoomTileName(etag string, scale, col, row int) string {
+	return fmt.Sprintf("%s-%d-%d-%d", derivativeName(etag), scale, col, row)
+}
+
+/*
+Cuts one of the album's photos into tiles, unless that was done for this version of the photo already. Photos in a
+format that can't be decoded get empty info, so they aren't downloaded again, and no tiles. Photos that are too big or
+take too long to decode are an error, so they're tried again rather than never tiled.
+*/
+func (a *Album) GetDeepZoomInfo(ctx context.Context, key string) (*DeepZoomInfo, error) {
+	etag, err := a.GetETag(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// Tiles are stored by ETag, without one they'd be made for every visitor
+	if derivativeName(etag) == "" {
+		return nil, nil
+	}
+
+	data, err := a.GetDerivative(ctx, DERIVATIVE_DEEP_ZOOM, key, func(ctx context.Context) ([]byte, error) {
+		return a.buildDeepZoomTiles(ctx, key, etag)
+	})
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	info := &DeepZoomInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	if _, loaded := a.deepZoomCache.Swap(key, info); !loaded {
+		a.photosChanged()
+	}
+	return info, nil
+}
+
+// Albums with BlurFaces tile the blurred photo, so zooming in never shows a face the album hides
+func (a *Album) buildDeepZoomTiles(ctx context.Context, key, etag string) ([]byte, error) {
+	var data []byte
+	var err error
+	if a.BlurFaces {
+		data, err = a.GetDerivative(ctx, DERIVATIVE_BLURRED_FACES, key, func(ctx context.Context) ([]byte, error) {
+			return a.buildBlurredPhoto(ctx, key)
+		})
+	} else {
+		// Tiling is for photos too big to show whole, so MaxObjectMB doesn't apply. The decoder's pixel limit still does.
+		data, err = a.getObjectDataUpTo(ctx, key, 0)
+	}
+	if err == errObjectTooLarge {
+		return []byte{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	src, format, err := decodeImage(data)
+	if err == errImageTooBig || err == errDecodeTimeout {
+		return nil, err
+	} else if err != nil {
+		return []byte{}, nil
+	}
+
+	// Tiles don't carry EXIF data, so they're cut from the photo turned the right way up
+	orientation := 1
+	if x, err := exif.Decode(bytes.NewReader(data)); err == nil {
+		if tag, err := x.Get(exif.Orientation); err == nil {
+			orientation, _ = tag.Int(0)
+		}
+	}
+	var level image.Image = src
+	if orientation > 1 && orientation <= 8 {
+		rgba := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+		level = orientImage(rgba, orientation)
+	}
+
+	// They do keep the photo's color profile, like resized photos
+	var profile []byte
+	if format == "png" {
+		_, profile = readPngIccChunk(data)
+	} else {
+		profile = readJpegIccProfile(data)
+	}
+	// Big photos take a lot of memory, let go of what isn't needed anymore
+	src, data = nil, nil
+
+	bounds := level.Bounds()
+	info := &DeepZoomInfo{Width: bounds.Dx(), Height: bounds.Dy(), TileSize: DEEP_ZOOM_TILE_SIZE}
+	store := a.site.GetDerivativeStore()
+	for scale := 1; ; scale *= 2 {
+		if scale > 1 {
+			level = halveImage(level)
+		}
+		if err := storeDeepZoomTiles(ctx, store, level, profile, etag, scale); err != nil {
+			return nil, err
+		}
+		info.ScaleFactors = append(info.ScaleFactors, scale)
+
+		if level.Bounds().Dx() <= DEEP_ZOOM_TILE_SIZE && level.Bounds().Dy() <= DEEP_ZOOM_TILE_SIZE {
+			break
+		}
+	}
+	return json.Marshal(info)
+}
+
+// Half the size, rounded up, so each level is the photo's size divided by the scale factor, rounded up, like IIIF has it
+func halveImage(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, (b.Dx()+1)/2, (b.Dy()+1)/2))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+func storeDeepZoomTiles(ctx context.Context, store DerivativeStore, level image.Image, profile []byte, etag string, scale int) error {
+	b := level.Bounds()
+	for row := 0; row*DEEP_ZOOM_TILE_SIZE < b.Dy(); row++ {
+		for col := 0; col*DEEP_ZOOM_TILE_SIZE < b.Dx(); col++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			rect := image.Rect(col*DEEP_ZOOM_TILE_SIZE, row*DEEP_ZOOM_TILE_SIZE,
+				(col+1)*DEEP_ZOOM_TILE_SIZE, (row+1)*DEEP_ZOOM_TILE_SIZE).Add(b.Min).Intersect(b)
+			tile := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			draw.Draw(tile, tile.Bounds(), level, rect.Min, draw.Src)
+
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, tile, &jpeg.Options{Quality: IMPORT_JPEG_QUALITY}); err != nil {
+				return err
+			}
+			if err := store.Put(ctx, DERIVATIVE_DEEP_ZOOM_TILE, deepZoomTileName(etag, scale, col, row),
+				writeJpegIccProfile(buf.Bytes(), profile)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Works out which tile a IIIF region and size ask for. Level 0 services only have to serve the tiles they list, so
+anything else, like a crop of the photo, isn't found. Viewers don't all round sizes the same way, so they can be a
+pixel off.
+*/
+func (info *DeepZoomInfo) tileFor(region, size string) (scale, col, row int, err error) {
+	var x, y, w, h int
+	if region == "full" {
+		w, h = info.Width, info.Height
+	} else if n, _ := fmt.Sscanf(region, "%d,%d,%d,%d", &x, &y, &w, &h); n != 4 || w <= 0 || h <= 0 {
+		return 0, 0, 0, errNoDeepZoomTile
+	}
+
+	sw, sh := -1, -1
+	if size == "max" {
+		sw, sh = w, h
+	} else if i := strings.Index(size, ","); i >= 0 {
+		if v, err := strconv.Atoi(size[:i]); err == nil {
+			sw = v
+		}
+		if v, err := strconv.Atoi(size[i+1:]); err == nil {
+			sh = v
+		}
+	}
+	if sw < 0 && sh < 0 {
+		return 0, 0, 0, errNoDeepZoomTile
+	}
+
+	near := func(want, got int) bool {
+		return want < 0 || (got-want <= 1 && want-got <= 1)
+	}
+	for _, scale := range info.ScaleFactors {
+		span := info.TileSize * scale
+		if x%span != 0 || y%span != 0 || w != min(span, info.Width-x) || h != min(span, info.Height-y) {
+			continue
+		}
+		if near(sw, (w+scale-1)/scale) && near(sh, (h+scale-1)/scale) {
+			return scale, x / span, y / span, nil
+		}
+	}
+	return 0, 0, 0, errNoDeepZoomTile
+}
+
+func (a *Album) queueDeepZoom(key string) {
+	jobQueue.Enqueue(&Job{
+		Name:     DERIVATIVE_DEEP_ZOOM + ":" + a.site.Domain + ":" + key,
+		Priority: PRIORITY_LOW,
+		Timeout:  DEEP_ZOOM_JOB_TIMEOUT,
+		Run: func(ctx context.Context) error {
+			photoExif, err := a.GetPhotoExif(ctx, key)
+			if err != nil {
+				return err
+			}
+			if !a.needsDeepZoom(photoExif) {
+				return nil
+			}
+			_, err = a.GetDeepZoomInfo(ctx, key)
+			return err
+		},
+		ErrorContext: albumErrorContext(a),
+	})
+}
+
+// Other sites' viewers can read the tiles of public albums, that's what IIIF is for
+func writeIIIFHeaders(w http.ResponseWriter, album *Album) {
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+}
+
+func handleIIIFInfo(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	if !checkHotlinkReferrer(w, r, album.site) {
+		return
+	}
+
+	slug := r.PathValue("slug")
+	info := album.deepZoomInfo(album.keyForSlug(slug))
+	if info == nil || !album.ImageExists(r.Context(), slug) {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	writeIIIFHeaders(w, album)
+	w.Header().Set("Content-Type", `application/ld+json;profile="`+IIIF_IMAGE_CONTEXT+`"`)
+	json.NewEncoder(w).Encode(&iiifImageInfo{
+		Context:  IIIF_IMAGE_CONTEXT,
+		ID:       album.GetIIIFServiceUrl(slug),
+		Type:     "ImageService3",
+		Protocol: "http://iiif.io/api/image",
+		Profile:  "level0",
+		Width:    info.Width,
+		Height:   info.Height,
+		Tiles:    []iiifTiles{{info.TileSize, info.ScaleFactors}},
+	})
+}
+
+func handleIIIFTile(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	if !checkHotlinkReferrer(w, r, album.site) {
+		return
+	}
+
+	slug := r.PathValue("slug")
+	key := album.keyForSlug(slug)
+	info := album.deepZoomInfo(key)
+	if info == nil || !album.ImageExists(r.Context(), slug) || r.PathValue("rotation") != "0" ||
+		r.PathValue("quality") != "default.jpg" {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	}
+	scale, col, row, err := info.tileFor(r.PathValue("region"), r.PathValue("size"))
+	if err != nil {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	etag, err := album.GetETag(r.Context(), key)
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+	name := deepZoomTileName(etag, scale, col, row)
+	tileETag := `"` + name + `"`
+	if checkNotModified(w, r, album, tileETag) {
+		return
+	}
+
+	data, ok, err := album.site.GetDerivativeStore().Get(r.Context(), DERIVATIVE_DEEP_ZOOM_TILE, name)
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	} else if !ok {
+		// The photo changed since it was tiled, the tiles of the new version are on their way
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	writeIIIFHeaders(w, album)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", tileETag)
+	w.Write(data)
+}
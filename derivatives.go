@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const DERIVATIVES_DIR_ENV_VAR = "FIFTYMM_DERIVATIVES_DIR"
+const DEFAULT_DERIVATIVES_DIR_NAME = "derivatives"
+
+// The version is bumped whenever PhotoExif changes, so photos are read again
+const DERIVATIVE_EXIF = "exif-v6"
+
+// EXIF data lives at the start of the file, so there's no need to download whole photos to read it
+const EXIF_READ_BYTES = 128 * 1024
+
+/*
+Stores things we work out from photos, like their EXIF data, so it only has to be done once per photo. Derivatives are
+keyed by the kind of derivative and the photo's ETag instead of its key, so uploading a new version of a photo makes us
+start over, and renaming a photo doesn't.
+*/
+type DerivativeStore interface {
+	Get(ctx context.Context, kind, etag string) ([]byte, bool, error)
+	Put(ctx context.Context, kind, etag string, data []byte) error
+}
+
+// Keeps derivatives in a local folder, split in sub folders like git objects so no folder gets too big
+type LocalDerivativeStore struct {
+	dir string
+}
+
+// Keeps derivatives in the site's bucket under a prefix of their own, so they can be shared by several servers
+type BucketDerivativeStore struct {
+	site   *Site
+	prefix string
+}
+
+// What we read from the start of a photo. Fields are zero if the photo doesn't have them.
+type PhotoExif struct {
+	TakenAt     time.Time
+	Orientation int
+
+	// In pixels, as stored, so before applying the orientation
+	Width  int
+	Height int
+
+	Animated    bool
+	Photosphere bool
+
+	// From the object's metadata rather than the EXIF data, since it's read along with it
+	Sensitive bool
+
+	Caption string // The EXIF ImageDescription
+}
+
+// ETags come quoted, and multipart ETags have a dash, turn them into something that's safe in paths and keys
+func derivativeName(etag string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '-' {
+			return r
+		}
+		return -1
+	}, etag)
+}
+
+func (s *LocalDerivativeStore) path(kind, etag string) string {
+	name := derivativeName(etag)
+	return filepath.Join(s.dir, kind, name[:min(2, len(name))], name)
+}
+
+func (s *LocalDerivativeStore) Get(ctx context.Context, kind, etag string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(s.path(kind, etag))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *LocalDerivativeStore) Put(ctx context.Context, kind, etag string, data []byte) error {
+	p := s.path(kind, etag)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so concurrent readers never see half a derivative
+	if err := ioutil.WriteFile(p+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (s *BucketDerivativeStore) key(kind, etag string) string {
+	return path.Join(s.prefix, kind, derivativeName(etag))
+}
+
+func (s *BucketDerivativeStore) Get(ctx context.Context, kind, etag string) ([]byte, bool, error) {
+	svc, err := s.site.GetS3Service()
+	if err != nil {
+		return nil, false, err
+	}
+
+	release, err := s.site.acquireS3(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.site.BucketName),
+		Key:    aws.String(s.key(kind, etag)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *BucketDerivativeStore) Put(ctx context.Context, kind, etag string, data []byte) error {
+	svc, err := s.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+
+	release, err := s.site.acquireS3(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.site.BucketName),
+		Key:    aws.String(s.key(kind, etag)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Derivatives go in the site's bucket if it has a DerivativesPrefix, and in the local store otherwise
+func (s *Site) GetDerivativeStore() DerivativeStore {
+	if s.DerivativesPrefix != "" {
+		return &BucketDerivativeStore{s, s.DerivativesPrefix}
+	}
+	return localDerivativeStore()
+}
+
+// The state database, or the local derivatives folder if FIFTYMM_STATE_DB is off
+func localDerivativeStore() DerivativeStore {
+	if app.stateDB != nil {
+		return &StateDBDerivativeStore{app.stateDB}
+	}
+	return &LocalDerivativeStore{app.derivativesDir}
+}
+
+/*
+Returns a derivative of one of the album's photos, making it on the job queue and storing it if it doesn't exist yet.
+Derivatives decode and resize whole photos, so they're made by the queue's workers, with its timeout and recovery.
+Failing to store a derivative isn't fatal, we'll just have to make it again next time.
+*/
+func (a *Album) GetDerivative(ctx context.Context, kind, key string,
+	build func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	done := startTiming(ctx, TIMING_DERIVATIVE)
+	defer done("")
+
+	etag, err := a.GetETag(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	store := a.site.GetDerivativeStore()
+	if derivativeName(etag) == "" {
+		store = nil
+	} else if data, ok, err := store.Get(ctx, kind, etag); err != nil {
+		reportError("read derivative", err, albumErrorContext(a))
+	} else if ok {
+		return data, nil
+	}
+
+	// Stored by the job, so a derivative a request gave up waiting for is there for the next one
+	var data []byte
+	err = jobQueue.Wait(ctx, &Job{
+		Name: kind + ":" + a.site.Domain + ":" + key,
+		Run: func(ctx context.Context) (err error) {
+			if data, err = build(ctx); err != nil || store == nil {
+				return err
+			}
+			if err := store.Put(ctx, kind, etag, data); err != nil {
+				reportError("store derivative", err, albumErrorContext(a))
+			}
+			return nil
+		},
+		ErrorContext: albumErrorContext(a),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (a *Album) GetPhotoExif(ctx context.Context, key string) (*PhotoExif, error) {
+	data, err := a.GetDerivative(ctx, DERIVATIVE_EXIF, key, func(ctx context.Context) ([]byte, error) {
+		release, err := a.acquireS3(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		photoExif, err := a.site.ReadPhotoExif(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(photoExif)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	photoExif := &PhotoExif{}
+	if err := json.Unmarshal(data, photoExif); err != nil {
+		return nil, err
+	}
+	a.setPhotoInfo(key, NewPhotoInfo(photoExif))
+	if photoExif.Sensitive {
+		a.setSensitive(key)
+	}
+	return photoExif, nil
+}
+
+/*
+Reads the EXIF data and pixel size of a photo. Photos without EXIF data, like most PNGs, just get an empty PhotoExif,
+but EXIF data that's there and broken is an error, like errors reading the photo from S3.
+*/
+func (s *Site) ReadPhotoExif(ctx context.Context, key string) (*PhotoExif, error) {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", EXIF_READ_BYTES-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	photoExif := &PhotoExif{Animated: isAnimated(data), Photosphere: isPhotosphere(data), Sensitive: isSensitiveMetadata(obj.Metadata)}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		photoExif.Width, photoExif.Height = config.Width, config.Height
+	}
+
+	x, err := exif.Decode(bytes.NewReader(data))
+	if isMissingExif(err) {
+		return photoExif, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if t, err := x.DateTime(); err == nil {
+		photoExif.TakenAt = t
+	} else if !exif.IsTagNotPresentError(err) && !isUnsetExifDate(x) {
+		return nil, err
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		photoExif.Orientation, _ = tag.Int(0)
+	}
+	if tag, err := x.Get(exif.ImageDescription); err == nil {
+		if caption, err := tag.StringVal(); err == nil {
+			photoExif.Caption = strings.TrimSpace(strings.Trim(caption, "\x00"))
+		}
+	}
+	// The image header can be past the part we read if the photo has a big embedded preview
+	if photoExif.Width == 0 {
+		if tag, err := x.Get(exif.PixelXDimension); err == nil {
+			photoExif.Width, _ = tag.Int(0)
+		}
+		if tag, err := x.Get(exif.PixelYDimension); err == nil {
+			photoExif.Height, _ = tag.Int(0)
+		}
+	}
+	return photoExif, nil
+}
+
+// goexif runs out of data when a photo has no EXIF segment, and says so when it has an APP1 segment that isn't EXIF
+func isMissingExif(err error) bool {
+	return err == io.EOF || (err != nil && strings.Contains(err.Error(), "failed to find exif intro marker"))
+}
+
+// Cameras whose clock was never set write zeros, which is as good as no date at all
+func isUnsetExifDate(x *exif.Exif) bool {
+	for _, name := range []exif.FieldName{exif.DateTimeOriginal, exif.DateTime} {
+		if tag, err := x.Get(name); err == nil {
+			if date, err := tag.StringVal(); err == nil && strings.HasPrefix(date, "0000:00:00") {
+				return true
+			}
+		}
+	}
+	return false
+}
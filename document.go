@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Files shown as documents instead of photos
+var DOCUMENT_EXTENSIONS = []string{".pdf"}
+
+const DOCUMENT_PREVIEW_SLUG = "preview/"
+const DOCUMENT_PREVIEW_SIZE = 800
+const DERIVATIVE_DOCUMENT_PREVIEW = "doc-preview-v1"
+
+// Shown for documents we can't make a preview of
+const DOCUMENT_PLACEHOLDER = "/static/document.svg"
+
+// A PDF or other document in an album, shown as a preview of its first page with a link to open it
+type Document struct {
+	photoInfo
+	Key        string
+	Url        string
+	previewUrl *url.URL
+}
+
+func init() {
+	RegisterRenderer(&Renderer{Type: "document", Matches: isDocumentKey, New: newDocument})
+}
+
+func isDocumentKey(key string) bool {
+	for _, ext := range DOCUMENT_EXTENSIONS {
+		if strings.HasSuffix(strings.ToLower(key), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Documents are opened through the album's download link, which counts them
+func newDocument(a *Album, key string) Renderable {
+	doc := &Document{Key: key, Url: a.GetDownloadUrl(key), previewUrl: a.GetSiteUrl()}
+	doc.previewUrl.Path += DOCUMENT_PREVIEW_SLUG + fileSlug(key)
+	return doc
+}
+
+func (d *Document) Type() string {
+	return "document"
+}
+
+func (d *Document) Template() string {
+	return "document"
+}
+
+func (d *Document) Slug() string {
+	return fileSlug(d.Key)
+}
+
+// There's only the one preview size, browsers scale it
+func (d *Document) GetPhotoForWidth(w int) string {
+	return d.previewUrl.String()
+}
+
+func (d *Document) GetThumbnailForWidthAndHeight(w, h int) string {
+	return d.previewUrl.String()
+}
+
+func (d *Document) GetSourcesForWidth(w int) []*PhotoSource {
+	return nil
+}
+
+/*
+Finds the first JPEG image in a PDF. Scans are mostly one JPEG per page, so that's usually the first page. PDFs of
+anything else, or scans stored in other formats, don't have one.
+*/
+func firstPdfJpeg(data []byte) []byte {
+	for i := 0; ; {
+		filter := bytes.Index(data[i:], []byte("/DCTDecode"))
+		if filter < 0 {
+			return nil
+		}
+		i += filter + len("/DCTDecode")
+
+		// The image's data follows its dictionary, after the end of the line
+		start := bytes.Index(data[i:], []byte("stream"))
+		if start < 0 {
+			return nil
+		}
+		start += i + len("stream")
+		if start < len(data) && data[start] == '\r' {
+			start++
+		}
+		if start < len(data) && data[start] == '\n' {
+			start++
+		}
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			return nil
+		}
+
+		if jpegData := bytes.TrimRight(data[start:start+end], "\r\n"); bytes.HasPrefix(jpegData, []byte{0xFF, 0xD8}) {
+			return jpegData
+		}
+	}
+}
+
+// An empty preview means the document doesn't have one, which is stored too, so the document isn't downloaded again
+func (a *Album) buildDocumentPreview(ctx context.Context, key string) ([]byte, error) {
+	data, err := a.getObjectData(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	jpegData := firstPdfJpeg(data)
+	if jpegData == nil {
+		return []byte{}, nil
+	}
+	preview, err := resizeImage(jpegData, "image/jpeg", DOCUMENT_PREVIEW_SIZE, a.site.GetColorProfile())
+	if err != nil {
+		return []byte{}, nil
+	}
+	return preview, nil
+}
+
+/*
+Serves the preview of a document in the album. Albums with BlurFaces get the placeholder, as faces in scans can't be
+blurred.
+*/
+func handleDocumentPreview(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	key := album.keyForSlug(r.PathValue("slug"))
+	if !isDocumentKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	if album.BlurFaces {
+		http.Redirect(w, r, DOCUMENT_PLACEHOLDER, http.StatusFound)
+		return
+	}
+
+	data, err := album.GetDerivative(r.Context(), DERIVATIVE_DOCUMENT_PREVIEW, key, func(ctx context.Context) ([]byte, error) {
+		return album.buildDocumentPreview(ctx, key)
+	})
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+	if len(data) == 0 {
+		http.Redirect(w, r, DOCUMENT_PLACEHOLDER, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Write(data)
+}
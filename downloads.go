@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DOWNLOAD_SLUG = "download/"
+const DOWNLOADS_STATE_FILE = "downloads.json"
+const DOWNLOADS_SAVE_INTERVAL = 1 * time.Minute
+const ADMIN_STATS_PATH = "/admin/stats"
+const ADMIN_DOWNLOADS_CSV_PATH = "/admin/stats/downloads.csv"
+const DEFAULT_TOP_DOWNLOADS_SHOWN = 50
+
+type DownloadCount struct {
+	Count int
+	Last  time.Time
+}
+
+type DownloadTracker struct {
+	mutex  sync.Mutex
+	counts map[string]map[string]*DownloadCount // By domain and album path, then by file name
+	dirty  bool
+}
+
+var downloads = &DownloadTracker{counts: make(map[string]map[string]*DownloadCount)}
+
+func (d *DownloadTracker) Load() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return loadJSONState(DOWNLOADS_STATE_FILE, &d.counts)
+}
+
+func (d *DownloadTracker) Save() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.dirty {
+		return nil
+	}
+	if err := saveJSONState(DOWNLOADS_STATE_FILE, d.counts); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// Saves the counts every now and then. A crash loses at most DOWNLOADS_SAVE_INTERVAL of them.
+func (d *DownloadTracker) SaveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := d.Save(); err != nil {
+			fmt.Printf("Unable to save download counts. Error: %s\n", err.Error())
+		}
+	}
+}
+
+func (d *DownloadTracker) Add(album *Album, slug string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	albumKey := album.site.Domain + album.Path
+	if d.counts[albumKey] == nil {
+		d.counts[albumKey] = make(map[string]*DownloadCount)
+	}
+	count, ok := d.counts[albumKey][slug]
+	if !ok {
+		count = &DownloadCount{}
+		d.counts[albumKey][slug] = count
+	}
+	count.Count++
+	count.Last = time.Now().UTC()
+	d.dirty = true
+}
+
+type DownloadStat struct {
+	Site  string
+	Album string
+	Slug  string
+	DownloadCount
+}
+
+// Files of the configured albums, most downloaded first. A limit of zero returns all of them.
+func (d *DownloadTracker) Top(domain string, limit int) []*DownloadStat {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var stats []*DownloadStat
+	for _, site := range app.sites {
+		if domain != "" && site.Domain != domain {
+			continue
+		}
+		for _, album := range site.Albums {
+			for slug, count := range d.counts[site.Domain+album.Path] {
+				stats = append(stats, &DownloadStat{site.Domain, album.Path, slug, *count})
+			}
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Last.After(stats[j].Last)
+	})
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
+
+// All downloads of the album's files, for the stats page
+func (d *DownloadTracker) AlbumTotal(album *Album) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	total := 0
+	for _, count := range d.counts[album.site.Domain+album.Path] {
+		total += count.Count
+	}
+	return total
+}
+
+// Where the original of a file is served from: through 50mm for proxied albums, or straight from the bucket
+func (a *Album) GetOriginalUrl(key string) string {
+	if a.ProxiesPhotos() {
+		return a.GetMediaUrl(key).String()
+	}
+	return a.site.GetS3Photo(key).GetPhotoForWidth(0)
+}
+
+// The album's download link for a file, which counts the download before sending the visitor to the original
+func (a *Album) GetDownloadUrl(key string) string {
+	u := a.GetSiteUrl()
+	u.Path += DOWNLOAD_SLUG + fileSlug(key)
+	return u.String()
+}
+
+// Only files the album offers for download can be downloaded: RAW files paired with a photo, and documents
+func (a *Album) isDownloadable(r *http.Request, slug string) bool {
+	key := a.keyForSlug(slug)
+	if !a.BlurFaces {
+		pairs, _ := a.PairCache.Load().(map[string]pairedKey)
+		for _, pair := range pairs {
+			if pair.kind == PAIR_RAW && pair.key == key {
+				return true
+			}
+		}
+	}
+	return isDocumentKey(key) && a.ImageExists(r.Context(), slug)
+}
+
+func handleDownload(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	slug := r.PathValue("slug")
+	if !album.isDownloadable(r, slug) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Link checkers only look, they don't download
+	if r.Method != http.MethodHead {
+		downloads.Add(album, slug)
+	}
+	// The original's URL may be presigned, so it can't be cached for longer than that
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, album.GetOriginalUrl(album.keyForSlug(slug)), http.StatusFound)
+}
+
+type AlbumStats struct {
+	Site      string
+	Album     string
+	Visitors  int // Last 30 days, for albums with a VisitorCounter
+	Downloads int
+}
+
+type StatsPageContext struct {
+	Site         string
+	Albums       []*AlbumStats
+	TopDownloads []*DownloadStat
+	Limit        int
+}
+
+// Visitors and downloads of every album, with the most downloaded files. Filter with ?site=<domain> and ?limit=50.
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = DEFAULT_TOP_DOWNLOADS_SHOWN
+	}
+	domain := r.FormValue("site")
+
+	ctx := &StatsPageContext{Site: domain, TopDownloads: downloads.Top(domain, limit), Limit: limit}
+	for _, site := range app.sites {
+		if domain != "" && site.Domain != domain {
+			continue
+		}
+		for _, album := range site.Albums {
+			stats := &AlbumStats{Site: site.Domain, Album: album.Path, Downloads: downloads.AlbumTotal(album)}
+			if album.GetVisitorCounter() != VISITOR_COUNTER_OFF {
+				stats.Visitors = visitors.Count(album, VISITORS_FOOTER_DAYS)
+			}
+			ctx.Albums = append(ctx.Albums, stats)
+		}
+	}
+	sort.Slice(ctx.Albums, func(i, j int) bool {
+		if ctx.Albums[i].Site != ctx.Albums[j].Site {
+			return ctx.Albums[i].Site < ctx.Albums[j].Site
+		}
+		return ctx.Albums[i].Album < ctx.Albums[j].Album
+	})
+
+	tmpl, err := template.ParseFiles("templates/admin/stats.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, ctx); err != nil {
+		fmt.Printf("Unable to render stats page. Error: %s\n", err.Error())
+	}
+}
+
+// File names come from whoever uploaded them, spreadsheets would run the ones that look like formulas
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// Every file's download count as CSV, for spreadsheets. Takes ?site=<domain> like the stats page.
+func handleAdminDownloadsCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="downloads.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"site", "album", "file", "downloads", "last_download"})
+	for _, stat := range downloads.Top(r.FormValue("site"), 0) {
+		out.Write([]string{csvCell(stat.Site), csvCell(stat.Album), csvCell(stat.Slug), strconv.Itoa(stat.Count),
+			stat.Last.Format(time.RFC3339)})
+	}
+	out.Flush()
+}
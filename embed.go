@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const EMBED_SLUG = "embed"
+const OEMBED_PATH = "/oembed"
+
+const DEFAULT_EMBED_WIDTH = 800
+const DEFAULT_EMBED_HEIGHT = 600
+
+type EmbedPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	Photos     []Renderable
+
+	Album *AlbumView
+}
+
+type OEmbedResponse struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title,omitempty"`
+	ProviderName string `json:"provider_name"`
+	ProviderUrl  string `json:"provider_url"`
+
+	Html   string `json:"html"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	ThumbnailUrl    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+var oembedAlbumHtml = template.Must(template.New("oembed-album").Parse(
+	`<iframe src="{{.Src}}" width="{{.Width}}" height="{{.Height}}" title="{{.Title}}" frameborder="0" loading="lazy"></iframe>`))
+
+var oembedPhotoHtml = template.Must(template.New("oembed-photo").Parse(
+	`<a href="{{.Href}}"><img src="{{.Src}}" width="{{.Width}}" alt="{{.Title}}"></a>`))
+
+// Sensitive photos are embedded as a link, other sites can't blur them
+var oembedLinkHtml = template.Must(template.New("oembed-link").Parse(`<a href="{{.Href}}">{{.Title}}</a>`))
+
+func (a *Album) GetEmbedUrl() string {
+	return a.GetSiteUrl().String() + EMBED_SLUG
+}
+
+// Link used for oEmbed discovery in the album and photo page heads. Empty for albums that can't be embedded.
+func (a *Album) GetOEmbedUrl(slug string) string {
+	if a.HasAuth() {
+		return ""
+	}
+
+	u := a.site.GetCanonicalUrl()
+	u.Path = OEMBED_PATH
+	u.RawQuery = url.Values{"url": {a.GetSiteUrl().String() + slug}, "format": {"json"}}.Encode()
+	return u.String()
+}
+
+/*
+Albums with EmbedDomains can only be embedded on those domains. Browsers enforce the frame-ancestors policy, checking the
+Referer as well turns the embed away before rendering it for the ones that don't.
+*/
+func (a *Album) isAllowedEmbedder(r *http.Request) bool {
+	return len(a.EmbedDomains) == 0 || isAllowedReferrer(r, a.site.Domain, a.EmbedDomains)
+}
+
+func (a *Album) embedFrameAncestors() string {
+	sources := []string{"frame-ancestors", "'self'"}
+	for _, domain := range a.EmbedDomains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		sources = append(sources, domain, "*."+domain)
+	}
+	return strings.Join(sources, " ")
+}
+
+func handleAlbumEmbed(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	if !album.isAllowedEmbedder(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This album can't be embedded here\n"))
+		return
+	}
+
+	// The whole point of this page is to be shown in an iframe on other sites
+	w.Header().Del("X-Frame-Options")
+	if len(album.EmbedDomains) > 0 {
+		w.Header().Set("Content-Security-Policy", album.embedFrameAncestors())
+	}
+
+	renderCachedPage(album, "embed", w, r, "embed.html", func() (interface{}, error) {
+		photos, view, err := album.GetPhotosAndView(r.Context(), album.site.GetPhotoWidth(false))
+		if err != nil {
+			return nil, err
+		}
+
+		return &EmbedPageContext{
+			&BasePageContext{
+				album.site.GetCanonicalUrl().String(),
+				album.GetCanonicalUrl().String(),
+				album.GetSiteUrl().String(),
+				album.MetaTitle,
+				album.site.SiteTitle,
+				album.GetNavigation(),
+				album.site.GetLanguage(),
+				album.GetTheme(),
+				album.site.GetPhotoWidth(false),
+				false,
+				newSiteView(album.site),
+			},
+			album.AlbumTitle,
+			photos,
+			view,
+		}, nil
+	})
+}
+
+func parseOEmbedDimension(v string, def int) int {
+	if n, err := strconv.Atoi(v); err == nil && n > 0 && n < def {
+		return n
+	}
+	return def
+}
+
+func handleOEmbed(site *Site, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Only the json format is supported\n"))
+		return
+	}
+
+	pageUrl, err := url.Parse(query.Get("url"))
+	if err != nil || pageUrl.Host != site.Domain || pageUrl.Path == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown URL\n"))
+		return
+	}
+
+	width := parseOEmbedDimension(query.Get("maxwidth"), DEFAULT_EMBED_WIDTH)
+	height := parseOEmbedDimension(query.Get("maxheight"), DEFAULT_EMBED_HEIGHT)
+
+	// Only public albums can be embedded, otherwise oEmbed would leak photos from password protected albums
+	path := pageUrl.Path
+	album, err := site.GetAlbumForPath(path)
+	slug := ""
+	if err != nil {
+		i := strings.LastIndex(path, "/") + 1
+		slug = path[i:]
+		album, err = site.GetAlbumForPath(path[:i])
+	}
+	if err != nil || album.HasAuth() || !album.IsPublished() || (slug != "" && !album.ImageExists(r.Context(), slug)) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown URL\n"))
+		return
+	}
+
+	resp := &OEmbedResponse{
+		Version:      "1.0",
+		Type:         "rich",
+		Title:        album.AlbumTitle,
+		ProviderName: site.SiteTitle,
+		ProviderUrl:  site.GetCanonicalUrl().String(),
+		Width:        width,
+		Height:       height,
+	}
+
+	var html strings.Builder
+	if slug == "" {
+		err = oembedAlbumHtml.Execute(&html, map[string]interface{}{
+			"Src": album.GetEmbedUrl(), "Width": width, "Height": height, "Title": album.AlbumTitle,
+		})
+		if cover := album.GetCoverPhotoForTemplate(); cover.Slug() != "" {
+			resp.ThumbnailUrl = cover.GetPhotoForWidth(width)
+			resp.ThumbnailWidth = width
+		}
+	} else {
+		photo := album.GetPhotoForKey(album.keyForSlug(slug))
+		resp.Title = fmt.Sprintf("%s - %s", album.AlbumTitle, firstNonEmpty(photo.Title(), slug))
+		if photo.IsSensitive() {
+			err = oembedLinkHtml.Execute(&html, map[string]interface{}{
+				"Href": album.GetSiteUrl().String() + slug, "Title": resp.Title,
+			})
+		} else {
+			resp.ThumbnailUrl = photo.GetPhotoForWidth(width)
+			resp.ThumbnailWidth = width
+			err = oembedPhotoHtml.Execute(&html, map[string]interface{}{
+				"Href": album.GetSiteUrl().String() + slug, "Src": resp.ThumbnailUrl, "Width": width, "Title": resp.Title,
+			})
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	resp.Html = html.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(resp)
+}
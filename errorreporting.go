@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const SENTRY_DSN_ENV_VAR = "FIFTYMM_SENTRY_DSN"
+
+// A single S3 hiccup isn't worth an alert. Errors are reported once they happen this many times within the window,
+// and then at most once per window, so a broken bucket doesn't flood the error tracker.
+const ERROR_REPORT_THRESHOLD = 3
+const ERROR_REPORT_WINDOW = 10 * time.Minute
+
+type ErrorContext map[string]string
+
+type errorOccurrences struct {
+	count      int
+	firstSeen  time.Time
+	reportedAt time.Time
+}
+
+var errorReporter = struct {
+	sync.Mutex
+	enabled bool
+	seen    map[string]*errorOccurrences
+}{seen: make(map[string]*errorOccurrences)}
+
+func initErrorReporting() error {
+	dsn := os.Getenv(SENTRY_DSN_ENV_VAR)
+	if dsn == "" {
+		return nil
+	}
+
+	if err := sentry.Init(sentry.ClientOptions{Dsn: dsn, Release: "50mm"}); err != nil {
+		return err
+	}
+
+	errorReporter.Lock()
+	errorReporter.enabled = true
+	errorReporter.Unlock()
+	return nil
+}
+
+func flushErrorReports() {
+	sentry.Flush(5 * time.Second)
+}
+
+func siteErrorContext(s *Site) ErrorContext {
+	return ErrorContext{"site": s.Domain, "bucket": s.BucketName}
+}
+
+func albumErrorContext(a *Album) ErrorContext {
+	ctx := siteErrorContext(a.site)
+	ctx["album"] = a.Path
+	ctx["prefix"] = a.BucketPrefix
+	return ctx
+}
+
+func sendErrorReport(err error, ctx ErrorContext, count int) {
+	sentry.WithScope(func(scope *sentry.Scope) {
+		for k, v := range ctx {
+			scope.SetTag(k, v)
+		}
+		scope.SetContext("occurrences", sentry.Context{"count": count})
+		sentry.CaptureException(err)
+	})
+}
+
+/*
+Logs an error with its context and, when error reporting is set up, sends it to the error tracker once it keeps
+happening. `what` identifies the failing operation, e.g. "list album", and is used to group repeats.
+*/
+func reportError(what string, err error, ctx ErrorContext) {
+	fmt.Printf("Unable to %s. Context: %v. Error: %s\n", what, ctx, err.Error())
+
+	errorReporter.Lock()
+	defer errorReporter.Unlock()
+	if !errorReporter.enabled {
+		return
+	}
+
+	// Every request has its own ID, repeats of the same error on different requests are still repeats
+	group := make(ErrorContext, len(ctx))
+	for k, v := range ctx {
+		if k != "request_id" {
+			group[k] = v
+		}
+	}
+	key := fmt.Sprintf("%s|%v", what, group)
+	now := time.Now()
+	o, ok := errorReporter.seen[key]
+	if !ok || now.Sub(o.firstSeen) > ERROR_REPORT_WINDOW && now.Sub(o.reportedAt) > ERROR_REPORT_WINDOW {
+		o = &errorOccurrences{firstSeen: now}
+		errorReporter.seen[key] = o
+	}
+	o.count++
+
+	if o.count >= ERROR_REPORT_THRESHOLD && now.Sub(o.reportedAt) > ERROR_REPORT_WINDOW {
+		o.reportedAt = now
+		go sendErrorReport(fmt.Errorf("Unable to %s: %w", what, err), ctx, o.count)
+	}
+}
+
+// Panics are always reported straight away. Must be called from the deferred function that recovered the panic, so the
+// stack trace still shows where it happened.
+func reportPanic(p interface{}, r *http.Request) {
+	errorReporter.Lock()
+	enabled := errorReporter.enabled
+	errorReporter.Unlock()
+	if !enabled {
+		return
+	}
+
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetRequest(r)
+	hub.Scope().SetTag("site", r.Host)
+	if id := requestID(r); id != "" {
+		hub.Scope().SetTag("request_id", id)
+	}
+	hub.Recover(p)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Photos that exist rarely disappear, but ones that don't may be uploaded any minute, so misses are kept for less long
+const EXISTS_CACHE_TTL = CACHE_INTERVAL
+const EXISTS_CACHE_MISSING_TTL = 1 * time.Minute
+
+// Visitors can ask for any slug, so the cache starts over once it has this many keys instead of growing forever
+const EXISTS_CACHE_MAX_ENTRIES = 10000
+
+type existsResult struct {
+	exists    bool
+	checkedAt time.Time
+}
+
+func init() {
+	metrics.RegisterCounter("fiftymm_exists_lookups_total", "Number of ImageExists lookups, by where the answer came from.")
+}
+
+/*
+Checks that a file is in the album. Photo permalinks call this on every visit, so answers come from the KeyCache when the
+key is listed there, and HeadObject results are remembered until the next cache refresh.
+*/
+func (a *Album) ImageExists(ctx context.Context, slug string) bool {
+	key := a.keyForSlug(slug)
+
+	if _, ok := a.slugKeys()[slug]; ok && !app.devMode {
+		metrics.Add("fiftymm_exists_lookups_total", 1, "source", "keycache")
+		return true
+	}
+
+	if cached, ok := a.existsCache.Load(key); ok && !app.devMode {
+		result := cached.(*existsResult)
+		ttl := EXISTS_CACHE_TTL
+		if !result.exists {
+			ttl = EXISTS_CACHE_MISSING_TTL
+		}
+		if time.Now().Sub(result.checkedAt) < ttl {
+			metrics.Add("fiftymm_exists_lookups_total", 1, "source", "cache")
+			return result.exists
+		}
+	}
+
+	metrics.Add("fiftymm_exists_lookups_total", 1, "source", "s3")
+	exists, err := a.headObjectExists(ctx, key)
+	if err != nil {
+		return false
+	}
+	a.storeExistsResult(key, &existsResult{exists, time.Now()})
+	return exists
+}
+
+func (a *Album) storeExistsResult(key string, result *existsResult) {
+	if atomic.LoadInt64(&a.existsCacheSize) >= EXISTS_CACHE_MAX_ENTRIES {
+		a.clearExistsCache()
+	}
+	if _, loaded := a.existsCache.Swap(key, result); !loaded {
+		atomic.AddInt64(&a.existsCacheSize, 1)
+	}
+}
+
+// Errors other than the object not being there (like S3 being unreachable) aren't answers, so they aren't cached
+func (a *Album) headObjectExists(ctx context.Context, key string) (bool, error) {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return false, err
+	}
+
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	_, err = svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(key),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *Album) clearExistsCache() {
+	a.existsCache.Range(func(key, _ interface{}) bool {
+		if _, loaded := a.existsCache.LoadAndDelete(key); loaded {
+			atomic.AddInt64(&a.existsCacheSize, -1)
+		}
+		return true
+	})
+}
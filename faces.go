@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	pigo "github.com/esimov/pigo/core"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+)
+
+// The face detection cascade that comes with pigo (https://github.com/esimov/pigo), which is MIT licensed
+const FACE_CASCADE_PATH = "cascade/facefinder"
+
+const DERIVATIVE_BLURRED_FACES = "faces-v1"
+
+// Faces are looked for in a copy of the photo this size, which is plenty to find them and much quicker than the original
+const FACE_DETECTION_SIZE = 1200
+
+// Detections scoring below this are mostly false positives
+const FACE_MIN_QUALITY = 5.0
+
+// Faces are pixelated in blocks of this fraction of their size, too coarse to recognise anyone
+const FACE_PIXELATE_BLOCKS = 8
+
+var faceFinderOnce sync.Once
+var faceFinder *pigo.Pigo
+var faceFinderErr error
+
+func loadFaceFinder() (*pigo.Pigo, error) {
+	faceFinderOnce.Do(func() {
+		data, err := os.ReadFile(FACE_CASCADE_PATH)
+		if err != nil {
+			faceFinderErr = err
+			return
+		}
+		faceFinder, faceFinderErr = pigo.NewPigo().Unpack(data)
+	})
+	return faceFinder, faceFinderErr
+}
+
+// Returns the areas of a photo with faces in them, a bit bigger than the faces so hair and ears are covered too
+func detectFaces(img *image.RGBA) ([]image.Rectangle, error) {
+	finder, err := loadFaceFinder()
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	scale := 1.0
+	small := image.Image(img)
+	if w > FACE_DETECTION_SIZE || h > FACE_DETECTION_SIZE {
+		scale = float64(max(w, h)) / FACE_DETECTION_SIZE
+		dst := image.NewRGBA(image.Rect(0, 0, int(float64(w)/scale), int(float64(h)/scale)))
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+		small = dst
+	}
+
+	cols, rows := small.Bounds().Dx(), small.Bounds().Dy()
+	detections := finder.RunCascade(pigo.CascadeParams{
+		MinSize:     20,
+		MaxSize:     max(cols, rows),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{Pixels: pigo.RgbToGrayscale(small), Rows: rows, Cols: cols, Dim: cols},
+	}, 0)
+	detections = finder.ClusterDetections(detections, 0.2)
+
+	var faces []image.Rectangle
+	for _, d := range detections {
+		if d.Q < FACE_MIN_QUALITY {
+			continue
+		}
+		// Detections are the center of a face and the size of the square around it
+		half := float64(d.Scale) * 0.6 * scale
+		x, y := float64(d.Col)*scale, float64(d.Row)*scale
+		faces = append(faces, image.Rect(int(x-half), int(y-half), int(x+half), int(y+half)).Intersect(img.Bounds()))
+	}
+	return faces, nil
+}
+
+// Replaces an area of a photo with blocks of its average colors
+func pixelate(img *image.RGBA, area image.Rectangle) {
+	block := max(1, max(area.Dx(), area.Dy())/FACE_PIXELATE_BLOCKS)
+	for by := area.Min.Y; by < area.Max.Y; by += block {
+		for bx := area.Min.X; bx < area.Max.X; bx += block {
+			cell := image.Rect(bx, by, bx+block, by+block).Intersect(area)
+
+			var sum [4]int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					p := img.Pix[img.PixOffset(x, y):]
+					for c := range sum {
+						sum[c] += int(p[c])
+					}
+				}
+			}
+
+			n := cell.Dx() * cell.Dy()
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					p := img.Pix[img.PixOffset(x, y):]
+					for c := range sum {
+						p[c] = uint8(sum[c] / n)
+					}
+				}
+			}
+		}
+	}
+}
+
+var errCantBlurFaces = errors.New("Only JPEGs and PNGs that aren't animated can have faces blurred")
+
+/*
+Pixelates the faces in a photo. The photo is turned the right way up first, so faces on their side are found too, and
+its EXIF data is left out, since albums that hide faces shouldn't give away where photos were taken either.
+*/
+func blurFaces(data []byte, contentType string) ([]byte, error) {
+	if (contentType != "image/jpeg" && contentType != "image/png") || isAnimated(data) {
+		return nil, errCantBlurFaces
+	}
+
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	orientation := 1
+	if x, err := exif.Decode(bytes.NewReader(data)); err == nil {
+		if tag, err := x.Get(exif.Orientation); err == nil {
+			orientation, _ = tag.Int(0)
+		}
+	}
+	img = orientImage(img, orientation)
+
+	faces, err := detectFaces(img)
+	if err != nil {
+		return nil, err
+	}
+	for _, face := range faces {
+		pixelate(img, face)
+	}
+
+	var buf bytes.Buffer
+	if contentType == "image/png" {
+		iccChunk, _ := readPngIccChunk(data)
+		if err = png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return writePngChunk(buf.Bytes(), iccChunk), nil
+	}
+
+	if err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: IMPORT_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+	return writeJpegIccProfile(buf.Bytes(), readJpegIccProfile(data)), nil
+}
+
+func (a *Album) buildBlurredPhoto(ctx context.Context, key string) ([]byte, error) {
+	data, err := a.getObjectData(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return blurFaces(data, http.DetectContentType(data))
+}
+
+// Serves a photo of an album with BlurFaces, with the faces pixelated. Files that can't be blurred aren't served at all.
+func serveBlurredPhoto(album *Album, w http.ResponseWriter, r *http.Request) {
+	key := album.keyForSlug(r.PathValue("slug"))
+	// Named after the original, but never the same, so a copy of the original from before BlurFaces stays stale
+	etag := ""
+	if original := album.cachedETag(key); original != "" {
+		etag = strings.TrimSuffix(original, `"`) + "-" + DERIVATIVE_BLURRED_FACES + `"`
+	}
+	if checkNotModified(w, r, album, etag) {
+		return
+	}
+
+	data, err := album.GetDerivative(r.Context(), DERIVATIVE_BLURRED_FACES, key, func(ctx context.Context) ([]byte, error) {
+		return album.buildBlurredPhoto(ctx, key)
+	})
+	if err == errCantBlurFaces {
+		renderErrorPage(album.site, w, http.StatusForbidden, "This file can't be shown in this album.")
+		return
+	} else if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A FilenamePattern reads photo titles and dates out of file names like 2024-06-12_1432_Lisbon_001.jpg, which the pattern
+%Y-%m-%d_%H%M_%t_* matches. %Y, %m, %d, %H, %M and %S are the parts of the date like in strftime, %t is the title and *
+skips anything. Patterns starting with regex: are regular expressions instead, with named groups for the same parts:
+year, month, day, hour, minute, second and title. Patterns are matched against the name without its extension, and
+photos whose names don't match have no title or date.
+*/
+const FILENAME_REGEX_PREFIX = "regex:"
+
+var FILENAME_PATTERN_PARTS = map[byte]string{
+	'Y': `(?P<year>\d{4})`,
+	'm': `(?P<month>\d{2})`,
+	'd': `(?P<day>\d{2})`,
+	'H': `(?P<hour>\d{2})`,
+	'M': `(?P<minute>\d{2})`,
+	'S': `(?P<second>\d{2})`,
+	't': `(?P<title>.+)`,
+}
+
+// Compiled patterns, as every photo of every album goes through them
+var filenamePatterns sync.Map
+
+func (a *Album) GetFilenamePattern() string {
+	return firstNonEmpty(a.FilenamePattern, a.site.FilenamePattern)
+}
+
+func compileFilenamePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := filenamePatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	expr := strings.TrimPrefix(pattern, FILENAME_REGEX_PREFIX)
+	if expr == pattern {
+		var b strings.Builder
+		b.WriteString("^")
+		for i := 0; i < len(pattern); i++ {
+			switch c := pattern[i]; {
+			case c == '*':
+				b.WriteString(".*?")
+			case c == '%' && i+1 < len(pattern) && pattern[i+1] == '%':
+				b.WriteString("%")
+				i++
+			case c == '%' && i+1 < len(pattern):
+				part, ok := FILENAME_PATTERN_PARTS[pattern[i+1]]
+				if !ok {
+					return nil, fmt.Errorf("unknown part %%%c", pattern[i+1])
+				}
+				b.WriteString(part)
+				i++
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		b.WriteString("$")
+		expr = b.String()
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	filenamePatterns.Store(pattern, re)
+	return re, nil
+}
+
+func validateFilenamePattern(s *Site) error {
+	if s.FilenamePattern != "" {
+		if _, err := compileFilenamePattern(s.FilenamePattern); err != nil {
+			return fmt.Errorf("Invalid FilenamePattern: %s", err.Error())
+		}
+	}
+	for _, album := range s.Albums {
+		if album.FilenamePattern == "" {
+			continue
+		}
+		if _, err := compileFilenamePattern(album.FilenamePattern); err != nil {
+			return fmt.Errorf("Invalid FilenamePattern of album %s: %s", album.Path, err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+The title and date the album's FilenamePattern finds in a key. Titles get dashes and underscores as spaces. The date is
+zero unless there's at least a year, and is in the server's time zone like EXIF dates.
+*/
+func (a *Album) parseFilename(key string) (string, time.Time) {
+	pattern := a.GetFilenamePattern()
+	if pattern == "" {
+		return "", time.Time{}
+	}
+	re, err := compileFilenamePattern(pattern)
+	if err != nil {
+		return "", time.Time{}
+	}
+
+	name := path.Base(key)
+	match := re.FindStringSubmatch(strings.TrimSuffix(name, path.Ext(name)))
+	if match == nil {
+		return "", time.Time{}
+	}
+
+	parts := map[string]int{"month": 1, "day": 1}
+	var title string
+	for i, group := range re.SubexpNames() {
+		if group == "title" {
+			title = strings.Join(strings.Fields(strings.NewReplacer("_", " ", "-", " ").Replace(match[i])), " ")
+		} else if n, err := strconv.Atoi(match[i]); group != "" && err == nil {
+			parts[group] = n
+		}
+	}
+
+	var date time.Time
+	if year, ok := parts["year"]; ok {
+		date = time.Date(year, time.Month(parts["month"]), parts["day"], parts["hour"], parts["minute"], parts["second"], 0,
+			time.Local)
+		// time.Date would make the 31st of June the 1st of July
+		if date.Month() != time.Month(parts["month"]) || date.Day() != parts["day"] {
+			date = time.Time{}
+		}
+	}
+	return title, date
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const FIXTURE_REGION = "us-east-1"
+const FIXTURE_BUCKET = "fixtures"
+const FIXTURE_CREDENTIAL = "fixtures"
+
+// Set by `50mm serve --fixtures`. When set, every site reads its photos from the fixture bucket at this URL instead of S3.
+var fixtureBucketUrl string
+
+type fixtureListing struct {
+	XMLName        xml.Name          `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string            `xml:"Name"`
+	Prefix         string            `xml:"Prefix"`
+	Delimiter      string            `xml:"Delimiter"`
+	IsTruncated    bool              `xml:"IsTruncated"`
+	Contents       []fixtureObject   `xml:"Contents"`
+	CommonPrefixes []fixturePrefixes `xml:"CommonPrefixes"`
+}
+
+type fixtureObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type fixturePrefixes struct {
+	Prefix string `xml:"Prefix"`
+}
+
+/*
+A pretend S3 bucket backed by a local directory, so sites can be previewed offline. It understands just enough of the S3
+API for 50mm: ListObjects with a "/" delimiter, and GetObject/HeadObject on path style URLs. Folders in the directory
+are the prefixes, and the bucket name in the URL is ignored, so every site shares the same directory.
+*/
+type FixtureBucket struct {
+	root string
+}
+
+func NewFixtureBucket(root string) (*FixtureBucket, error) {
+	if info, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: root, Err: os.ErrInvalid}
+	}
+	return &FixtureBucket{root}, nil
+}
+
+func (b *FixtureBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Path style URLs look like /<bucket>/<key>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		b.serveListing(w, r)
+	} else {
+		b.serveObject(w, r, parts[1])
+	}
+}
+
+func (b *FixtureBucket) serveListing(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	dir, namePrefix := path.Split(prefix)
+
+	listing := &fixtureListing{Name: FIXTURE_BUCKET, Prefix: prefix, Delimiter: "/"}
+	// A prefix without a folder behind it is an empty listing, like it would be on S3
+	entries, _ := os.ReadDir(filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+dir))))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), namePrefix) {
+			continue
+		}
+
+		if entry.IsDir() {
+			listing.CommonPrefixes = append(listing.CommonPrefixes, fixturePrefixes{dir + entry.Name() + "/"})
+		} else if info, err := entry.Info(); err == nil {
+			listing.Contents = append(listing.Contents, fixtureObject{
+				dir + entry.Name(),
+				info.ModTime().UTC().Format(time.RFC3339),
+				fixtureETag(filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+dir)), entry.Name())),
+				info.Size(),
+				"STANDARD",
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(listing)
+}
+
+// Like S3 for objects that weren't uploaded in parts, the ETag is the quoted MD5 of the file
+func fixtureETag(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
+func (b *FixtureBucket) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	// http.Dir keeps keys like ../../etc/passwd inside the fixture directory
+	f, err := http.Dir(b.root).Open("/" + key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// ServeContent takes care of HEAD, conditional requests, and the ranged requests used to read EXIF data
+	w.Header().Set("ETag", fixtureETag(filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+key)))))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// A running fixture bucket. Not an httptest.Server, which would build the testing package into the binary.
+type FixtureServer struct {
+	URL    string
+	server *http.Server
+}
+
+func (s *FixtureServer) Close() {
+	s.server.Close()
+}
+
+// Starts the fixture bucket on a local port, which the browser also loads photos from
+func startFixtureBucket(root string) (*FixtureServer, error) {
+	bucket, err := NewFixtureBucket(root)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: bucket}
+	go server.Serve(listener)
+	return &FixtureServer{"http://" + listener.Addr().String(), server}, nil
+}
+
+/*
+Points the site at the fixture bucket. Photos are served straight from the bucket as Imgix can't reach it, and the
+bucket and credentials options can be left out of configs that are only used for previews.
+*/
+func (s *Site) useFixtureBucket() {
+	s.S3Host = fixtureBucketUrl
+	s.UseImgix = false
+
+	if s.BucketRegion == "" {
+		s.BucketRegion = FIXTURE_REGION
+	}
+	if s.BucketName == "" {
+		s.BucketName = FIXTURE_BUCKET
+	}
+	if s.AWS_SECRET_KEY_ID == "" || s.AWS_SECRET_KEY == "" {
+		s.AWS_SECRET_KEY_ID, s.AWS_SECRET_KEY = FIXTURE_CREDENTIAL, FIXTURE_CREDENTIAL
+	}
+}
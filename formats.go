@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Modern formats that can be offered next to JPEG, and their content types
+var IMAGE_FORMATS = map[string]string{
+	"avif": "image/avif",
+	"webp": "image/webp",
+}
+
+// Best first, as browsers pick the first one they support. Sites with ImageFormats choose their own order.
+var DEFAULT_IMAGE_FORMATS = []string{"avif", "webp"}
+
+// A format Imgix can convert photos to. A Quality of 0 leaves it to Imgix.
+type ImageFormat struct {
+	Name    string
+	Type    string
+	Quality int
+}
+
+// One of the <source> elements of a <picture>
+type PhotoSource struct {
+	Type string
+	Url  string
+}
+
+func validateImageFormats(s *Site) error {
+	for _, name := range s.ImageFormats {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := IMAGE_FORMATS[name]; !ok && name != "none" {
+			return fmt.Errorf("Unknown image format '%s', ImageFormats can be avif, webp or none", name)
+		}
+	}
+
+	for option, quality := range map[string]int{"AvifQuality": s.AvifQuality, "WebpQuality": s.WebpQuality, "JpegQuality": s.JpegQuality} {
+		if quality < 0 || quality > 100 {
+			return fmt.Errorf("%s must be between 1 and 100, or 0 for the default", option)
+		}
+	}
+	return nil
+}
+
+// The formats photos are offered in besides JPEG, with their quality settings
+func (s *Site) GetImageFormats() []*ImageFormat {
+	names := s.ImageFormats
+	if len(names) == 0 {
+		names = DEFAULT_IMAGE_FORMATS
+	}
+
+	qualities := map[string]int{"avif": s.AvifQuality, "webp": s.WebpQuality}
+	var formats []*ImageFormat
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if contentType, ok := IMAGE_FORMATS[name]; ok {
+			formats = append(formats, &ImageFormat{name, contentType, qualities[name]})
+		}
+	}
+	return formats
+}
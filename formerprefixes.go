@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+/*
+FormerPrefixes are the bucket prefixes an album's photos were at before the bucket was reorganized, like summer-2019/,
+whose album was served at the same path, /summer-2019/. Albums that were served elsewhere give the path first, like
+/summer/=summer-2019/. Photo URLs are the album path followed by the file's slug, which only depends on its name, so a
+photo that moved to another prefix keeps its slug, and old links only need the old album path swapped for the new one.
+*/
+func formerAlbumPath(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	albumPath, prefix, ok := strings.Cut(entry, "=")
+	if !ok {
+		prefix, albumPath = entry, "/"+entry
+	}
+	albumPath, prefix = strings.TrimSpace(albumPath), strings.TrimSpace(prefix)
+	if prefix == "" || !strings.HasPrefix(albumPath, "/") || albumPath == "/" {
+		return "", fmt.Errorf("FormerPrefixes must be prefixes like summer-2019/ or /summer/=summer-2019/, not %q", entry)
+	}
+	if !strings.HasSuffix(albumPath, "/") {
+		albumPath += "/"
+	}
+	return albumPath, nil
+}
+
+func (a *Album) formerPaths() []string {
+	var paths []string
+	for _, entry := range a.FormerPrefixes {
+		if albumPath, err := formerAlbumPath(entry); err == nil {
+			paths = append(paths, albumPath)
+		}
+	}
+	return paths
+}
+
+func (s *Site) hasFormerPrefixes() bool {
+	for _, album := range s.Albums {
+		if len(album.FormerPrefixes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Former paths can't be served by an album anymore, or nothing would ever be redirected
+func validateFormerPrefixes(s *Site) error {
+	owners := make(map[string]string)
+	for _, album := range s.Albums {
+		for _, entry := range album.FormerPrefixes {
+			albumPath, err := formerAlbumPath(entry)
+			if err != nil {
+				return fmt.Errorf("Album %s: %s", album.Path, err.Error())
+			}
+			if other, err := s.GetAlbumForPath(albumPath); err == nil {
+				return fmt.Errorf("Album %s has the former path %s, which album %s is served at", album.Path, albumPath, other.Path)
+			}
+			if owner, ok := owners[albumPath]; ok && owner != album.Path {
+				return fmt.Errorf("Albums %s and %s both have the former path %s", owner, album.Path, albumPath)
+			}
+			owners[albumPath] = album.Path
+		}
+	}
+	return nil
+}
+
+// The album that took over the photos of a path, and what comes after the former album's path
+func (s *Site) matchFormerLocation(urlPath string) (*Album, string) {
+	for _, album := range s.Albums {
+		for _, formerPath := range album.formerPaths() {
+			if urlPath == strings.TrimSuffix(formerPath, "/") {
+				return album, ""
+			}
+			if rest, ok := strings.CutPrefix(urlPath, formerPath); ok {
+				return album, rest
+			}
+		}
+	}
+	return nil, ""
+}
+
+/*
+Redirects links into albums that moved with a bucket reorganization to the album that has their photos now. Photos are
+only redirected if the new album has them, renamed or deleted photos are still not found.
+*/
+func redirectFormerLocation(site *Site, w http.ResponseWriter, r *http.Request) bool {
+	album, rest := site.matchFormerLocation(r.URL.Path)
+	if album == nil || !album.IsPublished() {
+		return false
+	}
+	if rest != "" && !album.ImageExists(r.Context(), path.Base(rest)) {
+		return false
+	}
+
+	u := *r.URL
+	u.Path, u.RawPath = album.Path+rest, ""
+	if rest == "" {
+		u.Path = album.pagePath()
+	}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	return true
+}
+
+// Whatever no route matches: links into albums that moved, then, on sites with LenientUrls, links with the wrong case
+func handleUnmatchedUrl(site *Site, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	if redirectFormerLocation(site, w, r) {
+		return
+	}
+	if site.LenientUrls {
+		handleLenientUrl(site, w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
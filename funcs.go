@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+const DEFAULT_LANGUAGE = "en"
+
+var dateLayouts = map[string]string{
+	"short": "2 Jan 2006",
+	"long":  "Monday, 2 January 2006",
+	"month": "January 2006",
+	"iso":   "2006-01-02",
+}
+
+// Translations for each language, loaded from translations/<lang>.ini
+var translations = make(map[string]map[string]string)
+
+/*
+Functions available to every template, so custom themes can format data without code changes. For example:
+
+	{{formatDate .Date "short"}}, {{humanizeBytes .Size}}, {{fNumber 2.8}}, {{exposure 0.004}},
+	{{urlJoin $.CanonicalUrl .Slug}}, {{range chunk .Photos 3}}...{{end}}, {{t $.Lang "view_all"}} and {{asset "base.css"}}
+*/
+var templateFuncs = template.FuncMap{
+	"formatDate":     formatDate,
+	"humanizeBytes":  humanizeBytes,
+	"fNumber":        formatFNumber,
+	"exposure":       formatExposure,
+	"focalLength":    formatFocalLength,
+	"urlJoin":        urlJoin,
+	"withQuery":      withQuery,
+	"chunk":          chunk,
+	"first":          first,
+	"seq":            seq,
+	"photoClass":     photoClass,
+	"renderTemplate": renderRenderableTemplate,
+	"t":              translate,
+	"asset":          assetUrl,
+}
+
+func loadTranslations(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ini"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		cfg, err := ini.Load(path)
+		if err != nil {
+			return err
+		}
+
+		lang := strings.TrimSuffix(filepath.Base(path), ".ini")
+		translations[lang] = cfg.Section("").KeysHash()
+	}
+	return nil
+}
+
+// Looks up a key for a language, falling back to English and then to the key itself
+func translate(lang, key string, args ...interface{}) string {
+	for _, l := range []string{lang, DEFAULT_LANGUAGE} {
+		if s, ok := translations[l][key]; ok {
+			if len(args) > 0 {
+				return fmt.Sprintf(s, args...)
+			}
+			return s
+		}
+	}
+	return key
+}
+
+// Takes either a named layout (short, long, month, iso) or a Go time layout
+func formatDate(t time.Time, layout string) string {
+	if t.IsZero() {
+		return ""
+	}
+	if named, ok := dateLayouts[layout]; ok {
+		layout = named
+	}
+	return t.Format(layout)
+}
+
+func humanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatFNumber(f float64) string {
+	if f <= 0 {
+		return ""
+	}
+	return "f/" + strings.TrimSuffix(fmt.Sprintf("%.1f", f), ".0")
+}
+
+// Shutter speeds under a second are shown as fractions, e.g. 0.004 becomes 1/250s
+func formatExposure(seconds float64) string {
+	if seconds <= 0 {
+		return ""
+	}
+	if seconds < 1 {
+		return fmt.Sprintf("1/%ds", int(math.Round(1/seconds)))
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", seconds), ".0") + "s"
+}
+
+func formatFocalLength(mm float64) string {
+	if mm <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dmm", int(math.Round(mm)))
+}
+
+// Joins path parts onto a base URL, escaping each part, e.g. urlJoin "https://a.com/album/" "my photo.jpg"
+func urlJoin(base string, parts ...string) (template.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = url.PathEscape(p)
+	}
+
+	ref, err := url.Parse(strings.Join(escaped, "/"))
+	if err != nil {
+		return "", err
+	}
+	return template.URL(u.ResolveReference(ref).String()), nil
+}
+
+// Adds query parameters to a URL, given as key/value pairs
+func withQuery(rawUrl string, pairs ...string) (template.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		q.Set(pairs[i], pairs[i+1])
+	}
+	u.RawQuery = q.Encode()
+	return template.URL(u.String()), nil
+}
+
+// Splits a slice into rows of `size` items, for laying out grids
+func chunk(items interface{}, size int) ([]interface{}, error) {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("chunk expects a slice, got %s", v.Kind())
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("chunk size must be at least 1")
+	}
+
+	var chunks []interface{}
+	for i := 0; i < v.Len(); i += size {
+		end := i + size
+		if end > v.Len() {
+			end = v.Len()
+		}
+		chunks = append(chunks, v.Slice(i, end).Interface())
+	}
+	return chunks, nil
+}
+
+func first(n int, items interface{}) (interface{}, error) {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("first expects a slice, got %s", v.Kind())
+	}
+	if n > v.Len() {
+		n = v.Len()
+	}
+	if n < 0 {
+		n = 0
+	}
+	return v.Slice(0, n).Interface(), nil
+}
+
+// seq 3 returns [0 1 2], for looping a fixed number of times
+func seq(n int) []int {
+	s := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+// CSS classes for a photo in a grid, like "animated panorama"
+func photoClass(photo Renderable) string {
+	var classes []string
+	// Types added by renderers, like "video"
+	if t := photo.Type(); t != "photo" {
+		classes = append(classes, t)
+	}
+	if photo.IsAnimated() {
+		classes = append(classes, "animated")
+	}
+	if photo.IsPanorama() {
+		classes = append(classes, "panorama")
+	}
+	if photo.IsPhotosphere() {
+		classes = append(classes, "photosphere")
+	}
+	if pair := photo.Pair(); pair != nil {
+		classes = append(classes, pair.Kind)
+	}
+	if photo.IsSensitive() {
+		classes = append(classes, "sensitive")
+	}
+	if photo.IsArchived() {
+		classes = append(classes, "archived")
+	}
+	if stack := photo.Stack(); stack != nil && stack.Index == 0 {
+		classes = append(classes, "stack")
+	} else if stack != nil {
+		classes = append(classes, "stacked")
+	}
+	return strings.Join(classes, " ")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+)
+
+const DEFAULT_INDEX_THUMBNAILS = 5
+
+// Columns used by the album page grid on small, medium and large screens
+var DEFAULT_GRID_COLUMNS = []int{1, 1, 1}
+
+type GridColumns struct {
+	Small  int
+	Medium int
+	Large  int
+}
+
+/*
+Builds the grid density from the GridColumns config option. The option takes up to 3 comma separated values, one for
+each breakpoint. Missing values repeat the last one given, so `GridColumns = 2` means 2 columns on every screen size.
+*/
+func NewGridColumns(columns []int) *GridColumns {
+	values := make([]int, 3)
+	for i := range values {
+		if i < len(columns) {
+			values[i] = columns[i]
+		} else {
+			values[i] = values[i-1]
+		}
+	}
+
+	return &GridColumns{
+		Small:  values[0],
+		Medium: values[1],
+		Large:  values[2],
+	}
+}
+
+func validateGridColumns(columns []int) error {
+	if len(columns) > 3 {
+		return errors.New("GridColumns takes at most 3 values (small, medium and large screens)")
+	}
+
+	for _, c := range columns {
+		if c < 1 {
+			return errors.New("GridColumns values must be at least 1")
+		}
+	}
+
+	return nil
+}
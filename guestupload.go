@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+Albums with a GuestUploadToken take photos from guests at /<album path>/upload/<token>, like attendees of a wedding
+sharing their shots. The link stops working after GuestUploadUntil. Uploads go to the GuestUploadPrefix, or with
+GuestUploadModeration into a folder below the album's prefix, which albums don't list, until they're approved at
+/admin/uploads.
+*/
+const GUEST_UPLOAD_SLUG = "upload"
+const GUEST_UPLOAD_PENDING_DIR = "pending-uploads/"
+const ADMIN_UPLOADS_PATH = "/admin/uploads"
+
+const DEFAULT_GUEST_UPLOAD_MAX_MB = 25
+const DEFAULT_GUEST_UPLOAD_TOTAL_MB = 5120
+const GUEST_UPLOAD_MAX_FILES = 20
+
+// Photos each guest can upload an hour, however many requests they come in
+const GUEST_UPLOAD_PER_HOUR = 100
+
+const GUEST_UPLOAD_STATE_FILE = "guestuploads.json"
+const GUEST_UPLOAD_SAVE_INTERVAL = 1 * time.Minute
+
+// Long enough that it can't be guessed, as it's all that stands between the bucket and anyone with the link
+const GUEST_UPLOAD_MIN_TOKEN_LENGTH = 16
+
+const AUDIT_GUEST_UPLOAD = "guest_upload"
+const AUDIT_GUEST_UPLOAD_REVIEW = "guest_upload_review"
+
+// Extensions guests can upload, and the type their contents must sniff as
+var GUEST_UPLOAD_TYPES = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+}
+
+// Major brands in the ftyp box of HEIC files, which http.DetectContentType doesn't know
+var HEIC_BRANDS = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+var guestUploadRateLimiter = NewRateLimiter(GUEST_UPLOAD_PER_HOUR, 1*time.Hour)
+
+// How much has been uploaded with an album's link. A new GuestUploadToken starts from zero.
+type GuestUploadUsage struct {
+	Link  string // Hash of the token
+	Bytes int64
+}
+
+type GuestUploadTracker struct {
+	mutex sync.Mutex
+	usage map[string]*GuestUploadUsage // By domain and album path
+	dirty bool
+}
+
+var guestUploads = &GuestUploadTracker{usage: make(map[string]*GuestUploadUsage)}
+
+type GuestUploadPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	MaxMB      int
+	MaxFiles   int
+	Accept     string
+	Uploaded   int
+	Moderated  bool
+	Errors     []string
+}
+
+type PendingUpload struct {
+	Key          string
+	Name         string
+	ThumbnailUrl string
+	SizeKB       int64
+	Uploaded     time.Time
+}
+
+type UploadsPageContext struct {
+	Site    string
+	Album   string
+	Title   string
+	Pending []*PendingUpload
+}
+
+func (a *Album) HasGuestUpload() bool {
+	return a.GuestUploadToken != ""
+}
+
+func (a *Album) GetGuestUploadPrefix() string {
+	return firstNonEmpty(a.GuestUploadPrefix, a.BucketPrefix)
+}
+
+func (a *Album) getGuestUploadPendingPrefix() string {
+	return a.BucketPrefix + GUEST_UPLOAD_PENDING_DIR
+}
+
+func (a *Album) GetGuestUploadMaxBytes() int64 {
+	mb := a.GuestUploadMaxMB
+	if mb <= 0 {
+		mb = a.site.GuestUploadMaxMB
+	}
+	if mb <= 0 {
+		mb = DEFAULT_GUEST_UPLOAD_MAX_MB
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+func (a *Album) GetGuestUploadTotalBytes() int64 {
+	mb := a.GuestUploadTotalMB
+	if mb <= 0 {
+		mb = a.site.GuestUploadTotalMB
+	}
+	if mb <= 0 {
+		mb = DEFAULT_GUEST_UPLOAD_TOTAL_MB
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+// The link stops working at the end of the GuestUploadUntil day, in UTC
+func (a *Album) isGuestUploadOpen() bool {
+	until, _ := parseEventDate("GuestUploadUntil", a.GuestUploadUntil)
+	return until.IsZero() || time.Now().Before(until.AddDate(0, 0, 1))
+}
+
+func (a *Album) GetGuestUploadUrl() string {
+	return a.GetSiteUrl().String() + GUEST_UPLOAD_SLUG + "/" + url.PathEscape(a.GuestUploadToken)
+}
+
+func validateGuestUpload(a *Album) error {
+	if a.GuestUploadToken != "" && len(a.GuestUploadToken) < GUEST_UPLOAD_MIN_TOKEN_LENGTH {
+		return fmt.Errorf("GuestUploadToken must be at least %d characters long", GUEST_UPLOAD_MIN_TOKEN_LENGTH)
+	}
+	if _, err := parseEventDate("GuestUploadUntil", a.GuestUploadUntil); err != nil {
+		return err
+	}
+	if a.GuestUploadMaxMB < 0 || a.GuestUploadTotalMB < 0 {
+		return errors.New("GuestUploadMaxMB and GuestUploadTotalMB can't be negative")
+	}
+	return nil
+}
+
+func checkGuestUploadToken(album *Album, w http.ResponseWriter, r *http.Request) bool {
+	lang := album.site.GetLanguage()
+	if subtle.ConstantTimeCompare([]byte(r.PathValue("token")), []byte(album.GuestUploadToken)) != 1 {
+		recordAuthFailure(r, "guest upload")
+		renderErrorPage(album.site, w, http.StatusNotFound, translate(lang, "upload_unknown"))
+		return false
+	}
+	if !album.isGuestUploadOpen() {
+		renderErrorPage(album.site, w, http.StatusGone, translate(lang, "upload_closed"))
+		return false
+	}
+	return true
+}
+
+func renderGuestUploadPage(album *Album, w http.ResponseWriter, uploaded int, errs []string) {
+	var extensions []string
+	for ext := range GUEST_UPLOAD_TYPES {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+
+	ctx := &GuestUploadPageContext{
+		&BasePageContext{
+			album.site.GetCanonicalUrl().String(),
+			album.GetSiteUrl().String(),
+			album.GetSiteUrl().String(),
+			album.MetaTitle,
+			album.site.SiteTitle,
+			album.GetNavigation(),
+			album.site.GetLanguage(),
+			album.GetTheme(),
+			album.site.GetPhotoWidth(false),
+			false,
+			newSiteView(album.site),
+		},
+		album.AlbumTitle,
+		int(album.GetGuestUploadMaxBytes() / 1024 / 1024),
+		GUEST_UPLOAD_MAX_FILES,
+		strings.Join(extensions, ","),
+		uploaded,
+		album.GuestUploadModeration,
+		errs,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	// The token is in the URL, which mustn't leak to other sites through links on the page
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if len(errs) > 0 && uploaded == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	executeTemplateHelper(w, "upload.html", ctx)
+}
+
+func handleGuestUploadPage(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !checkGuestUploadToken(album, w, r) {
+		return
+	}
+	renderGuestUploadPage(album, w, 0, nil)
+}
+
+/*
+Takes the guests' photos and puts them in the bucket. Files that are too big or aren't photos are skipped and listed on
+the page, the rest are still uploaded.
+*/
+func handleGuestUpload(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !checkGuestUploadToken(album, w, r) {
+		return
+	}
+	lang := album.site.GetLanguage()
+	ip := clientIP(r)
+	if guestUploadRateLimiter.Exceeded(ip) {
+		w.Header().Set("Retry-After", "3600")
+		renderErrorPage(album.site, w, http.StatusTooManyRequests, translate(lang, "upload_too_many"))
+		return
+	}
+
+	maxBytes := album.GetGuestUploadMaxBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes*GUEST_UPLOAD_MAX_FILES+1024*1024)
+	if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil {
+		renderGuestUploadPage(album, w, 0, []string{translate(lang, "upload_too_big_total")})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["photos"]
+	if len(files) > GUEST_UPLOAD_MAX_FILES {
+		renderGuestUploadPage(album, w, 0, []string{translate(lang, "upload_too_many_files", GUEST_UPLOAD_MAX_FILES)})
+		return
+	}
+
+	prefix := album.GetGuestUploadPrefix()
+	if album.GuestUploadModeration {
+		prefix = album.getGuestUploadPendingPrefix()
+	}
+
+	var errs []string
+	uploaded := 0
+	for _, header := range files {
+		if header.Size > maxBytes {
+			errs = append(errs, translate(lang, "upload_too_big", header.Filename, maxBytes/1024/1024))
+			continue
+		}
+		// Counts photos rather than requests, a request can carry up to GUEST_UPLOAD_MAX_FILES of them
+		if !guestUploadRateLimiter.Allow(ip) {
+			errs = append(errs, translate(lang, "upload_too_many_photos", header.Filename, GUEST_UPLOAD_PER_HOUR))
+			continue
+		}
+		if !guestUploads.Reserve(album, header.Size) {
+			errs = append(errs, translate(lang, "upload_link_full", header.Filename))
+			continue
+		}
+		if err := album.putGuestUpload(r, prefix, header); err != nil {
+			guestUploads.Reserve(album, -header.Size)
+			if err == errGuestUploadType {
+				errs = append(errs, translate(lang, "upload_wrong_type", header.Filename))
+			} else {
+				reportError("store guest upload", err, albumErrorContext(album))
+				errs = append(errs, translate(lang, "upload_failed", header.Filename))
+			}
+			continue
+		}
+		uploaded++
+	}
+
+	if uploaded > 0 {
+		recordAuditEvent(&AuditEvent{Action: AUDIT_GUEST_UPLOAD, Site: album.site.Domain, Album: album.Path, Remote: ip,
+			Detail: fmt.Sprintf("%d photos", uploaded)})
+		if !album.GuestUploadModeration {
+			if err := album.RefreshCache(r.Context()); err != nil {
+				reportError("refresh album cache", err, albumErrorContext(album))
+			}
+		}
+	}
+	renderGuestUploadPage(album, w, uploaded, errs)
+}
+
+var errGuestUploadType = errors.New("not a photo")
+
+// Uploads under a new name, so guests can't overwrite each other's photos (or the album's) by using the same name
+func (a *Album) putGuestUpload(r *http.Request, prefix string, header *multipart.FileHeader) error {
+	ext := strings.ToLower(path.Ext(header.Filename))
+	contentType, ok := GUEST_UPLOAD_TYPES[ext]
+	if !ok {
+		return errGuestUploadType
+	}
+
+	f, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(f, sniff)
+	if sniffGuestUpload(sniff[:n]) != contentType {
+		return errGuestUploadType
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	name := safeSlugPart(strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename)))
+	key := fmt.Sprintf("%s%s-%s-%s%s", prefix, time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(random),
+		firstNonEmpty(name, "photo"), ext)
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+	release, err := a.acquireS3(r.Context())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = svc.PutObjectWithContext(r.Context(), &s3.PutObjectInput{
+		Bucket:      aws.String(a.site.BucketName),
+		Key:         aws.String(key),
+		Body:        f,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func sniffGuestUpload(data []byte) string {
+	// An ISO base media file starts with the size of its ftyp box, then "ftyp" and the major brand
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		for _, brand := range HEIC_BRANDS {
+			if string(data[8:12]) == brand {
+				return "image/heic"
+			}
+		}
+	}
+	return http.DetectContentType(data)
+}
+
+func (g *GuestUploadTracker) Load() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return loadJSONState(GUEST_UPLOAD_STATE_FILE, &g.usage)
+}
+
+func (g *GuestUploadTracker) Save() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.dirty {
+		return nil
+	}
+	if err := saveJSONState(GUEST_UPLOAD_STATE_FILE, g.usage); err != nil {
+		return err
+	}
+	g.dirty = false
+	return nil
+}
+
+// Saves the usage every now and then. A crash loses at most GUEST_UPLOAD_SAVE_INTERVAL of it.
+func (g *GuestUploadTracker) SaveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := g.Save(); err != nil {
+			fmt.Printf("Unable to save guest upload usage. Error: %s\n", err.Error())
+		}
+	}
+}
+
+/*
+Counts an upload against the link's GuestUploadTotalMB before it's stored, so guests uploading at the same time can't
+go over it together. Returns false when it doesn't fit. Uploads that fail give their bytes back with a negative size.
+*/
+func (g *GuestUploadTracker) Reserve(album *Album, bytes int64) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	hash := sha256.Sum256([]byte(album.GuestUploadToken))
+	link := hex.EncodeToString(hash[:8])
+	usage, ok := g.usage[album.site.Domain+album.Path]
+	if !ok || usage.Link != link {
+		usage = &GuestUploadUsage{Link: link}
+		g.usage[album.site.Domain+album.Path] = usage
+	}
+	if bytes > 0 && usage.Bytes+bytes > album.GetGuestUploadTotalBytes() {
+		return false
+	}
+	usage.Bytes += bytes
+	g.dirty = true
+	return true
+}
+
+// Guest uploads waiting for a look, for albums with GuestUploadModeration
+func handleAdminUploads(w http.ResponseWriter, r *http.Request) {
+	album, err := adminAlbum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	objects, err := svc.ListObjectsWithContext(r.Context(), &s3.ListObjectsInput{
+		Bucket: aws.String(album.site.BucketName),
+		Prefix: aws.String(album.getGuestUploadPendingPrefix()),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	ctx := &UploadsPageContext{Site: album.site.Domain, Album: album.Path, Title: album.AlbumTitle}
+	for _, obj := range objects.Contents {
+		photo := album.site.GetPhotoForKey(*obj.Key)
+		thumbnail := ""
+		if p, ok := photo.(*ImgixPhoto); !ok || p != nil {
+			thumbnail = photo.GetThumbnailForWidthAndHeight(ADMIN_THUMBNAIL_SIZE*2, ADMIN_THUMBNAIL_SIZE*2)
+		}
+		ctx.Pending = append(ctx.Pending, &PendingUpload{*obj.Key, path.Base(*obj.Key), thumbnail, aws.Int64Value(obj.Size) / 1024,
+			aws.TimeValue(obj.LastModified)})
+	}
+
+	tmpl, err := template.ParseFiles("templates/admin/uploads.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, ctx); err != nil {
+		fmt.Printf("Unable to render uploads page. Error: %s\n", err.Error())
+	}
+}
+
+// Approves pending uploads by moving them to the GuestUploadPrefix, or deletes them
+func handleAdminUploadsReview(w http.ResponseWriter, r *http.Request) {
+	// Browsers send the saved admin password along with forms posted from other sites too
+	if !isAllowedReferrer(r, (&url.URL{Host: r.Host}).Hostname(), nil) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	album, err := adminAlbum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	r.ParseForm()
+	approve := r.PostFormValue("action") == "approve"
+	pending := album.getGuestUploadPendingPrefix()
+	keys := r.PostForm["key"]
+	for _, key := range keys {
+		if !strings.HasPrefix(key, pending) || strings.Contains(strings.TrimPrefix(key, pending), "/") {
+			http.Error(w, fmt.Sprintf("%s isn't a pending upload of the album", key), http.StatusBadRequest)
+			return
+		}
+		if approve {
+			_, err = svc.CopyObjectWithContext(r.Context(), &s3.CopyObjectInput{
+				Bucket:     aws.String(album.site.BucketName),
+				CopySource: aws.String(url.PathEscape(album.site.BucketName + "/" + key)),
+				Key:        aws.String(album.GetGuestUploadPrefix() + strings.TrimPrefix(key, pending)),
+			})
+		}
+		if err == nil {
+			_, err = svc.DeleteObjectWithContext(r.Context(), &s3.DeleteObjectInput{Bucket: aws.String(album.site.BucketName),
+				Key: aws.String(key)})
+		}
+		if err != nil {
+			reportError("review guest upload", err, albumErrorContext(album))
+			http.Error(w, fmt.Sprintf("Unable to review %s. Error: %s", key, err.Error()), http.StatusBadGateway)
+			return
+		}
+	}
+
+	if len(keys) > 0 {
+		recordAuditEvent(&AuditEvent{Action: AUDIT_GUEST_UPLOAD_REVIEW, Site: album.site.Domain, Album: album.Path,
+			Remote: clientIP(r), Detail: fmt.Sprintf("%s %d photos", r.PostFormValue("action"), len(keys))})
+	}
+	if approve && len(keys) > 0 {
+		if err := album.RefreshCache(r.Context()); err != nil {
+			reportError("refresh album cache", err, albumErrorContext(album))
+		}
+	}
+
+	query := url.Values{"site": {album.site.Domain}, "album": {album.Path}}
+	http.Redirect(w, r, ADMIN_UPLOADS_PATH+"?"+query.Encode(), http.StatusSeeOther)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Google only reads so many images of a page, and the list would make big albums' pages heavy
+const MAX_STRUCTURED_DATA_PHOTOS = 100
+
+var metaNamePattern = regexp.MustCompile(`^[A-Za-z0-9:._-]+$`)
+
+// A meta tag from the site's MetaTags. Open Graph style names, like og:site_name, are properties instead of names.
+type MetaTag struct {
+	Name     string
+	Content  string
+	Property bool
+}
+
+// Tags are separated by commas like other lists, but descriptions have commas too, so a part without a | goes with the tag before it
+func parseMetaTags(parts []string) ([]*MetaTag, error) {
+	var tags []*MetaTag
+	for _, part := range parts {
+		name, content, ok := strings.Cut(part, "|")
+		if !ok && len(tags) > 0 {
+			tags[len(tags)-1].Content += ", " + strings.TrimSpace(part)
+			continue
+		}
+		name, content = strings.TrimSpace(name), strings.TrimSpace(content)
+		if !ok || content == "" || !metaNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("Invalid MetaTags entry '%s'. Tags must be in the form name|content", part)
+		}
+		tags = append(tags, &MetaTag{name, content, strings.Contains(name, ":")})
+	}
+	return tags, nil
+}
+
+func validateSiteVerification(s *Site) error {
+	for option, token := range map[string]string{"GoogleSiteVerification": s.GoogleSiteVerification, "BingSiteVerification": s.BingSiteVerification} {
+		if token != "" && !metaNamePattern.MatchString(token) {
+			return fmt.Errorf("%s must be the token from the meta tag the search engine gives you, not the whole tag", option)
+		}
+	}
+	return nil
+}
+
+/*
+Describes the album page as a schema.org ImageGallery, as JSON-LD in its head, so search engines can tell it's a
+gallery and which photos are in it. Sensitive and archived photos are left out, like they are in link previews.
+*/
+func (c *AlbumPageContext) StructuredData() map[string]interface{} {
+	if c.Site == nil || !c.Site.StructuredData || c.Album == nil {
+		return nil
+	}
+
+	var images []map[string]interface{}
+	for _, photo := range c.Album.Photos {
+		if len(images) >= MAX_STRUCTURED_DATA_PHOTOS {
+			break
+		}
+		if photo.Type != "photo" || photo.Sensitive || photo.Archived {
+			continue
+		}
+		image := map[string]interface{}{
+			"@type":      "ImageObject",
+			"url":        c.CanonicalUrl + photo.Slug,
+			"contentUrl": photo.Src(),
+			"name":       firstNonEmpty(photo.Title, photo.Slug),
+		}
+		if photo.Caption != "" {
+			image["caption"] = photo.Caption
+		}
+		if photo.Width > 0 {
+			image["width"], image["height"] = photo.Width, photo.Height
+		}
+		if !photo.Date.IsZero() {
+			image["dateCreated"] = photo.Date.Format("2006-01-02T15:04:05")
+		}
+		images = append(images, image)
+	}
+
+	data := map[string]interface{}{
+		"@context":   "https://schema.org",
+		"@type":      "ImageGallery",
+		"name":       firstNonEmpty(c.Album.Title, c.Album.MetaTitle),
+		"url":        c.CanonicalUrl,
+		"inLanguage": c.Site.Lang,
+		"isPartOf":   map[string]interface{}{"@type": "WebSite", "name": c.Site.Title, "url": c.Site.Url},
+	}
+	if len(images) > 0 {
+		data["image"] = images
+	}
+	return data
+}
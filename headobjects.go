@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func init() {
+	metrics.RegisterCounter("fiftymm_head_objects_total", "Number of HeadObject calls made while refreshing albums, by result.")
+	metrics.RegisterGauge("fiftymm_head_objects_seconds", "Time the last HeadObject pass of each album took.")
+}
+
+// What a pass of HeadObject calls over some of an album's photos came to
+type HeadObjectStats struct {
+	Keys     int
+	Failed   int // Calls that returned an error, which includes a 403 for photos that can't be read
+	Skipped  int // Keys never checked because the refresh was cancelled
+	Duration time.Duration
+}
+
+/*
+Calls HeadObject for each key and hands the result to fn, from as many goroutines as the album's S3Concurrency. One
+failed call doesn't stop the others, fn decides what an error means for its photo. Once the context is done the keys
+left aren't checked. fn must be safe to call from several goroutines.
+*/
+func (a *Album) headObjects(ctx context.Context, what string, keys []string,
+	fn func(key string, head *s3.HeadObjectOutput, err error)) *HeadObjectStats {
+	stats := &HeadObjectStats{Keys: len(keys)}
+	if len(keys) == 0 {
+		return stats
+	}
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		for _, key := range keys {
+			fn(key, nil, err)
+		}
+		stats.Failed = len(keys)
+		return stats
+	}
+
+	start := time.Now()
+	work := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < min(a.GetS3Concurrency(), len(keys)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				head, err := a.headObject(ctx, svc, key)
+				if ctx.Err() != nil {
+					// Cancelled while waiting for a slot, not an answer from S3
+					mutex.Lock()
+					stats.Skipped++
+					mutex.Unlock()
+					continue
+				}
+
+				result := "ok"
+				if err != nil {
+					result = "failed"
+					mutex.Lock()
+					stats.Failed++
+					mutex.Unlock()
+				}
+				metrics.Add("fiftymm_head_objects_total", 1, a.site.metricLabels("result", result)...)
+				fn(key, head, err)
+			}
+		}()
+	}
+
+	for i, key := range keys {
+		if ctx.Err() != nil {
+			mutex.Lock()
+			stats.Skipped += len(keys) - i
+			mutex.Unlock()
+			break
+		}
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	stats.Duration = time.Since(start)
+	metrics.Set("fiftymm_head_objects_seconds", stats.Duration.Seconds(), a.site.metricLabels("album", a.Path, "pass", what)...)
+	if stats.Failed > 0 || stats.Skipped > 0 {
+		fmt.Printf("HeadObject pass %s of album %s on %s: %d keys, %d failed, %d skipped in %s\n", what, a.Path,
+			a.site.Domain, stats.Keys, stats.Failed, stats.Skipped, stats.Duration.Round(time.Millisecond))
+	}
+	return stats
+}
+
+func (a *Album) headObject(ctx context.Context, svc *s3.S3, key string) (*s3.HeadObjectOutput, error) {
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(a.site.BucketName), Key: aws.String(key)})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Photo URLs on pages are presigned for this long, unless the site has HotlinkProtection
+const PRESIGNED_URL_LIFETIME = 24 * time.Hour
+
+/*
+With HotlinkProtection, photo URLs only work for a few hours. They have to outlive the cached pages they're on, plus a
+bit for visitors who keep a page open.
+*/
+const HOTLINK_URL_LIFETIME = PAGE_CACHE_MAX_AGE + 1*time.Hour
+
+var hotlinkSecretOnce sync.Once
+var generatedHotlinkSecret []byte
+
+// The HotlinkSecret option, or a random secret for sites without one, which changes every time the server starts
+func (s *Site) getHotlinkSecret() []byte {
+	if s.HotlinkSecret != "" {
+		return []byte(s.HotlinkSecret)
+	}
+
+	hotlinkSecretOnce.Do(func() {
+		generatedHotlinkSecret = make([]byte, 32)
+		rand.Read(generatedHotlinkSecret)
+	})
+	return generatedHotlinkSecret
+}
+
+func (s *Site) GetPhotoUrlLifetime() time.Duration {
+	if s.HotlinkProtection {
+		return HOTLINK_URL_LIFETIME
+	}
+	return PRESIGNED_URL_LIFETIME
+}
+
+func (s *Site) signMediaPath(mediaPath string, expires int64) string {
+	mac := hmac.New(sha256.New, s.getHotlinkSecret())
+	fmt.Fprintf(mac, "%s|%d", mediaPath, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+With HotlinkProtection, signs a URL of a file 50mm serves so it passes checkHotlink until it expires. The expiry is
+rounded up to the hour, so pages rendered close together share URLs that browsers can cache.
+*/
+func (s *Site) signMediaUrl(u *url.URL) {
+	if s.HotlinkProtection {
+		expires := time.Now().Add(HOTLINK_URL_LIFETIME).Truncate(time.Hour).Add(time.Hour).Unix()
+		u.RawQuery = url.Values{
+			"expires": {strconv.FormatInt(expires, 10)},
+			"sig":     {s.signMediaPath(u.Path, expires)},
+		}.Encode()
+	}
+}
+
+// Returns the URL 50mm serves one of the album's files at, for sites with ProxyPhotos
+func (a *Album) GetMediaUrl(key string) *url.URL {
+	u := a.GetSiteUrl()
+	u.Path += MEDIA_SLUG + fileSlug(key)
+	a.site.signMediaUrl(u)
+	return u
+}
+
+func (s *Site) checkMediaSignature(r *http.Request) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(s.signMediaPath(r.URL.Path, expires)))
+}
+
+// Checks the Referer and Origin headers against the site's domain and HotlinkAllowlist
+func (s *Site) isAllowedReferrer(r *http.Request) bool {
+	return isAllowedReferrer(r, s.Domain, s.HotlinkAllowlist)
+}
+
+/*
+Whether the Referer and Origin headers are the domain, or one of the allowed domains or their subdomains. Requests
+without either header are let through, browsers leave them out for direct visits and some privacy settings strip them.
+*/
+func isAllowedReferrer(r *http.Request, domain string, allowlist []string) bool {
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil {
+			return false
+		}
+		host := strings.ToLower(u.Hostname())
+		if host == strings.ToLower(domain) {
+			continue
+		}
+
+		allowed := false
+		for _, d := range allowlist {
+			d = strings.ToLower(strings.TrimSpace(d))
+			allowed = allowed || host == d || strings.HasSuffix(host, "."+d)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Turns away proxied photo requests from other sites, or with a missing or expired signature
+func checkHotlink(w http.ResponseWriter, r *http.Request, site *Site) bool {
+	if !site.HotlinkProtection {
+		return true
+	}
+
+	if !site.isAllowedReferrer(r) || !site.checkMediaSignature(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden\n"))
+		return false
+	}
+	return true
+}
+
+// Like checkHotlink, for URLs that can't be signed, like the tiles IIIF viewers work out from info.json
+func checkHotlinkReferrer(w http.ResponseWriter, r *http.Request, site *Site) bool {
+	if site.HotlinkProtection && !site.isAllowedReferrer(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden\n"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+const IIIF_MANIFEST_SLUG = IIIF_SLUG + "manifest.json"
+
+const IIIF_PRESENTATION_CONTEXT = "http://iiif.io/api/presentation/3/context.json"
+
+const IIIF_THUMBNAIL_SIZE = 300
+
+// Text in IIIF is keyed by language, so viewers can pick the one they show
+type iiifLanguageMap map[string][]string
+
+type iiifManifest struct {
+	Context           string            `json:"@context"`
+	ID                string            `json:"id"`
+	Type              string            `json:"type"`
+	Label             iiifLanguageMap   `json:"label"`
+	RequiredStatement *iiifLabeledValue `json:"requiredStatement,omitempty"`
+	Homepage          []*iiifResource   `json:"homepage"`
+	Thumbnail         []*iiifResource   `json:"thumbnail,omitempty"`
+	Items             []*iiifCanvas     `json:"items"`
+}
+
+type iiifLabeledValue struct {
+	Label iiifLanguageMap `json:"label"`
+	Value iiifLanguageMap `json:"value"`
+}
+
+type iiifResource struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Format  string          `json:"format,omitempty"`
+	Label   iiifLanguageMap `json:"label,omitempty"`
+	Width   int             `json:"width,omitempty"`
+	Height  int             `json:"height,omitempty"`
+	Service []*iiifService  `json:"service,omitempty"`
+}
+
+type iiifService struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Profile string `json:"profile"`
+}
+
+type iiifCanvas struct {
+	ID        string                `json:"id"`
+	Type      string                `json:"type"`
+	Label     iiifLanguageMap       `json:"label"`
+	Summary   iiifLanguageMap       `json:"summary,omitempty"`
+	NavDate   string                `json:"navDate,omitempty"`
+	Width     int                   `json:"width"`
+	Height    int                   `json:"height"`
+	Thumbnail []*iiifResource       `json:"thumbnail,omitempty"`
+	Items     []*iiifAnnotationPage `json:"items"`
+}
+
+type iiifAnnotationPage struct {
+	ID    string            `json:"id"`
+	Type  string            `json:"type"`
+	Items []*iiifAnnotation `json:"items"`
+}
+
+type iiifAnnotation struct {
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	Motivation string        `json:"motivation"`
+	Target     string        `json:"target"`
+	Body       *iiifResource `json:"body"`
+}
+
+func (a *Album) GetIIIFManifestUrl() string {
+	return a.GetSiteUrl().String() + IIIF_MANIFEST_SLUG
+}
+
+func imageFormat(key string) string {
+	if format := mime.TypeByExtension(path.Ext(key)); format != "" {
+		return format
+	}
+	return "image/jpeg"
+}
+
+/*
+One canvas per photo, painted with the photo at its full size. Photos whose size isn't known yet are left out, canvases
+need one, and so are sensitive photos, which other viewers would show without the blur. Photos tiled for DeepZoom get
+their IIIF image service, so viewers can zoom into them.
+*/
+func (a *Album) iiifCanvas(photo Renderable, lang string) *iiifCanvas {
+	info := photo.Info()
+	if photo.Type() != "photo" || photo.IsArchived() || photo.IsSensitive() || info == nil {
+		return nil
+	}
+
+	key := a.keyForSlug(photo.Slug())
+	id := a.GetSiteUrl().String() + IIIF_SLUG + "canvas/" + photo.Slug()
+	body := &iiifResource{
+		ID:     photo.GetPhotoForWidth(info.Width),
+		Type:   "Image",
+		Format: imageFormat(key),
+		Width:  info.Width,
+		Height: info.Height,
+	}
+	if a.DeepZoom && a.deepZoomInfo(key) != nil {
+		body.Service = []*iiifService{{a.GetIIIFServiceUrl(photo.Slug()), "ImageService3", "level0"}}
+	}
+
+	canvas := &iiifCanvas{
+		ID:     id,
+		Type:   "Canvas",
+		Label:  iiifLanguageMap{lang: {firstNonEmpty(photo.Title(), photo.Slug())}},
+		Width:  info.Width,
+		Height: info.Height,
+		Thumbnail: []*iiifResource{{
+			ID:     photo.GetThumbnailForWidthAndHeight(IIIF_THUMBNAIL_SIZE, IIIF_THUMBNAIL_SIZE),
+			Type:   "Image",
+			Format: imageFormat(key),
+		}},
+		Items: []*iiifAnnotationPage{{
+			ID:   id + "/page",
+			Type: "AnnotationPage",
+			Items: []*iiifAnnotation{{
+				ID:         id + "/painting",
+				Type:       "Annotation",
+				Motivation: "painting",
+				Target:     id,
+				Body:       body,
+			}},
+		}},
+	}
+	if caption := photo.Caption(); caption != "" {
+		canvas.Summary = iiifLanguageMap{lang: {caption}}
+	}
+	if date := photo.Date(); !date.IsZero() {
+		canvas.NavDate = date.UTC().Format(time.RFC3339)
+	}
+	return canvas
+}
+
+/*
+Describes the album as a IIIF Presentation 3.0 manifest, so IIIF viewers and archival tools can show it and take it in
+like any other collection. Photos from S3 are linked with signed URLs, which expire like they do on the album page.
+*/
+func handleIIIFManifest(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	photos, _, err := album.GetPhotosAndView(r.Context(), album.site.GetPhotoWidth(false))
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+
+	lang := album.site.GetLanguage()
+	title := firstNonEmpty(album.AlbumTitle, album.MetaTitle)
+	manifest := &iiifManifest{
+		Context: IIIF_PRESENTATION_CONTEXT,
+		ID:      album.GetIIIFManifestUrl(),
+		Type:    "Manifest",
+		Label:   iiifLanguageMap{lang: {title}},
+		Homepage: []*iiifResource{{
+			ID:     album.GetSiteUrl().String(),
+			Type:   "Text",
+			Format: "text/html",
+			Label:  iiifLanguageMap{lang: {title}},
+		}},
+		Items: []*iiifCanvas{},
+	}
+	if album.site.SiteTitle != "" {
+		manifest.RequiredStatement = &iiifLabeledValue{
+			iiifLanguageMap{lang: {translate(lang, "iiif_attribution")}},
+			iiifLanguageMap{lang: {album.site.SiteTitle}},
+		}
+	}
+	for _, photo := range photos {
+		if canvas := album.iiifCanvas(photo, lang); canvas != nil {
+			manifest.Items = append(manifest.Items, canvas)
+		}
+	}
+	if len(manifest.Items) > 0 {
+		manifest.Thumbnail = manifest.Items[0].Thumbnail
+	}
+
+	writeIIIFHeaders(w, album)
+	w.Header().Set("Content-Type", `application/ld+json;profile="`+IIIF_PRESENTATION_CONTEXT+`"`)
+	json.NewEncoder(w).Encode(manifest)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+)
+
+const IMPORT_JPEG_QUALITY = 90
+
+type importFile struct {
+	path        string
+	key         string
+	contentType string
+}
+
+type importOptions struct {
+	concurrency  int
+	maxSize      int
+	colorProfile string
+}
+
+// Looks up the site a command works on, by its domain. The domain can be left out if only one site is configured.
+func findSite(domain string) (*Site, error) {
+	if domain != "" {
+		return app.SiteForDomain(domain)
+	}
+	if len(app.sites) != 1 {
+		return nil, fmt.Errorf("Found %d sites in %s, use -site to pick one", len(app.sites), app.configDir)
+	}
+	for _, s := range app.sites {
+		return s, nil
+	}
+	return nil, nil
+}
+
+// Looks up the album a command works on, by its path. The site can be left out if only one is configured.
+func findAlbum(domain, albumPath string) (*Album, error) {
+	site, err := findSite(domain)
+	if err != nil {
+		return nil, err
+	}
+	return site.GetAlbumForPath("/" + strings.Trim(albumPath, "/"))
+}
+
+// Returns the bucket key for a file in an album, making sure the album prefix is a folder
+func albumObjectKey(album *Album, name string) string {
+	prefix := album.BucketPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + name
+}
+
+// Detects the content type from the file extension, and from the file contents for files without a known extension
+func detectContentType(path string) (string, error) {
+	if contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); contentType != "" {
+		return contentType, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+/*
+Finds the photos in an export folder. Albums only show the photos at the top level of their prefix, so sub folders are
+skipped, as are hidden files and anything that isn't an image (like sidecar files).
+*/
+func findImportFiles(dir string, album *Album) ([]*importFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*importFile
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		contentType, err := detectContentType(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(contentType, "image/") {
+			fmt.Printf("Skipping %s, it's not an image (%s)\n", entry.Name(), contentType)
+			continue
+		}
+
+		files = append(files, &importFile{path, albumObjectKey(album, entry.Name()), contentType})
+	}
+	return files, nil
+}
+
+// Copies the EXIF segment of a JPEG into a re-encoded version of it, so photo dates survive resizing
+func copyExif(original, resized []byte) []byte {
+	var exif []byte
+	eachJpegSegment(original, func(marker byte, offset int, segment []byte) bool {
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00")) {
+			// The whole segment, with its marker and length
+			exif = original[offset : offset+4+len(segment)]
+			return false
+		}
+		return true
+	})
+	if exif == nil || len(resized) < 2 {
+		return resized
+	}
+
+	result := make([]byte, 0, len(resized)+len(exif))
+	result = append(result, resized[:2]...)
+	result = append(result, exif...)
+	return append(result, resized[2:]...)
+}
+
+/*
+Scales a photo down so its longest side is at most maxSize pixels. Only JPEGs and PNGs that aren't animated are resized, and photos
+that are already small enough are uploaded as they are. The colorProfile is one of COLOR_PROFILES.
+*/
+func resizeImage(data []byte, contentType string, maxSize int, colorProfile string) ([]byte, error) {
+	// Animated PNGs would lose all but their first frame
+	if (contentType != "image/jpeg" && contentType != "image/png") || isAnimated(data) {
+		return data, nil
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= maxSize && config.Height <= maxSize {
+		return data, nil
+	}
+
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := maxSize, config.Height*maxSize/config.Width
+	if config.Height > config.Width {
+		width, height = config.Width*maxSize/config.Height, maxSize
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	/*
+		Go's decoders ignore color profiles, so resized photos get the original's profile back, or else colors shift
+		when browsers take them for sRGB. Sites that want sRGB have Display P3 photos converted instead.
+	*/
+	var profile, iccChunk []byte
+	if contentType == "image/png" {
+		iccChunk, profile = readPngIccChunk(data)
+	} else {
+		profile = readJpegIccProfile(data)
+	}
+	if colorProfile == COLOR_PROFILE_SRGB && isDisplayP3Profile(profile) {
+		convertDisplayP3ToSRGB(dst)
+		profile, iccChunk = nil, nil
+	}
+
+	var buf bytes.Buffer
+	if contentType == "image/png" {
+		if err = png.Encode(&buf, dst); err != nil {
+			return nil, err
+		}
+		return writePngChunk(buf.Bytes(), iccChunk), nil
+	}
+
+	/*
+		Browsers don't all agree on EXIF orientation, so resized photos are stored the right way up. The EXIF data is
+		kept, with its orientation reset so nothing rotates the photo a second time.
+	*/
+	orientation := 1
+	if x, err := exif.Decode(bytes.NewReader(data)); err == nil {
+		if tag, err := x.Get(exif.Orientation); err == nil {
+			orientation, _ = tag.Int(0)
+		}
+	}
+
+	if err = jpeg.Encode(&buf, orientImage(dst, orientation), &jpeg.Options{Quality: IMPORT_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+	resized := copyExif(data, writeJpegIccProfile(buf.Bytes(), profile))
+	resetExifOrientation(resized)
+	return resized, nil
+}
+
+// Turns a photo the right way up for its EXIF orientation, 1 to 8, where 1 is already the right way up
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-x, y
+			case 3: // Upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored and upside down
+				sx, sy = x, h-1-y
+			case 5: // Mirrored and turned left
+				sx, sy = y, x
+			case 6: // Turned left, needs turning right
+				sx, sy = y, h-1-x
+			case 7: // Mirrored and turned right
+				sx, sy = w-1-y, h-1-x
+			case 8: // Turned right, needs turning left
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// Sets the orientation in the EXIF segment of a JPEG to 1, in place. JPEGs without one are left alone.
+func resetExifOrientation(data []byte) {
+	eachJpegSegment(data, func(marker byte, _ int, segment []byte) bool {
+		if marker != 0xE1 || !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return true
+		}
+
+		// The EXIF data is a TIFF file, which starts with its byte order and the offset of the first IFD
+		tiff := segment[6:]
+		if len(tiff) < 8 {
+			return false
+		}
+		var order binary.ByteOrder = binary.BigEndian
+		if string(tiff[:2]) == "II" {
+			order = binary.LittleEndian
+		}
+
+		ifd := int64(order.Uint32(tiff[4:]))
+		if ifd+2 > int64(len(tiff)) {
+			return false
+		}
+		// Entries are 12 bytes: tag, type, count and a value that fits in 4 bytes for orientations
+		for n, entry := int(order.Uint16(tiff[ifd:])), int(ifd)+2; n > 0 && entry+12 <= len(tiff); n, entry = n-1, entry+12 {
+			if order.Uint16(tiff[entry:]) == 0x0112 {
+				order.PutUint16(tiff[entry+8:], 1)
+				break
+			}
+		}
+		return false
+	})
+}
+
+func uploadImportFile(ctx context.Context, storage AlbumStorage, file *importFile, opts *importOptions) error {
+	data, err := os.ReadFile(file.path)
+	if err != nil {
+		return err
+	}
+
+	if opts.maxSize > 0 {
+		if data, err = resizeImage(data, file.contentType, opts.maxSize, opts.colorProfile); err != nil {
+			return fmt.Errorf("Unable to resize %s. Error: %s", file.path, err.Error())
+		}
+	}
+	return storage.Upload(ctx, file.key, file.contentType, data)
+}
+
+// Uploads the files with a pool of workers
+func uploadImportFiles(storage AlbumStorage, files []*importFile, opts *importOptions) int {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var done, failed int32
+	queue := make(chan *importFile)
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				if err := uploadImportFile(ctx, storage, file, opts); err != nil {
+					atomic.AddInt32(&failed, 1)
+					fmt.Printf("Unable to upload %s. Error: %s\n", file.path, err.Error())
+					continue
+				}
+				fmt.Printf("[%d/%d] Uploaded %s\n", atomic.AddInt32(&done, 1), len(files), file.key)
+			}
+		}()
+	}
+
+	for _, file := range files {
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+
+	return int(failed)
+}
+
+/*
+Asks the running server to refresh the album's cache, so the new photos show up without waiting for the cache to
+expire. Needs the admin token, like the other admin endpoints.
+*/
+func refreshServerCache(server string, album *Album, uploaded, deleted int) error {
+	if app.adminToken == "" {
+		return fmt.Errorf("%s isn't set", ADMIN_TOKEN_ENV_VAR)
+	}
+
+	form := url.Values{
+		"site": {album.site.Domain}, "album": {album.Path},
+		"uploaded": {strconv.Itoa(uploaded)}, "deleted": {strconv.Itoa(deleted)},
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+ADMIN_CACHE_REFRESH_PATH, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+app.adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(strings.TrimSpace(fmt.Sprintf("%s %s", resp.Status, body)))
+	}
+	return nil
+}
+
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	albumPath := flags.String("album", "", "Path of the album to import into, e.g. travel/2024")
+	domain := flags.String("site", "", "Domain of the album's site, if more than one site is configured")
+	concurrency := flags.Int("concurrency", 4, "Number of photos to upload at the same time")
+	maxSize := flags.Int("max-size", 0, "Resize photos so their longest side is at most this many pixels (0 to upload them as they are)")
+	server := flags.String("server", "", "URL of the running 50mm server to refresh the album cache on (default http://localhost:$FIFTYMM_PORT)")
+	fixtures := flags.String("fixtures", "", "Import into this local directory, as read by 'serve -fixtures', instead of S3")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: 50mm import <dir> -album <path> [flags]\n\n")
+		flags.PrintDefaults()
+	}
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) != 1 || *albumPath == "" || *concurrency < 1 || *maxSize < 0 {
+		flags.Usage()
+		return 2
+	}
+	dir := positional[0]
+
+	app = NewApp()
+	album, err := findAlbum(*domain, *albumPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	storage, err := newAlbumStorage(album, *fixtures)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to use fixtures directory %s. Error: %s\n", *fixtures, err.Error())
+		return 1
+	}
+
+	files, err := findImportFiles(dir, album)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s. Error: %s\n", dir, err.Error())
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Printf("No photos found in %s\n", dir)
+		return 0
+	}
+
+	fmt.Printf("Uploading %d photos to %s\n", len(files), storage.Location())
+	failed := uploadImportFiles(storage, files, &importOptions{*concurrency, *maxSize, album.site.GetColorProfile()})
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d photos failed to upload\n", failed, len(files))
+	}
+
+	if *server == "" {
+		*server = fmt.Sprintf("http://localhost:%s", app.port)
+	}
+	if err := refreshServerCache(*server, album, len(files)-failed, 0); err != nil {
+		fmt.Printf("Unable to refresh the album cache on %s, new photos will show up within %s. Error: %s\n", *server, CACHE_INTERVAL, err.Error())
+	} else {
+		fmt.Printf("Refreshed the album cache on %s\n", *server)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
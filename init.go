@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const INIT_ENV_FILE_NAME = "fiftymm.env"
+const INIT_SAMPLE_ALBUM_PREFIX = "sample/"
+const INIT_BUCKET_CHECK_TIMEOUT = 15 * time.Second
+
+type initOptions struct {
+	Domain     string
+	SiteTitle  string
+	BucketName string
+	Region     string
+	S3Host     string
+	KeyId      string
+	Key        string
+
+	ConfigDir  string
+	DataDir    string
+	Port       string
+	AdminToken string
+
+	SampleAlbumPrefix string
+}
+
+// Values are quoted with iniValue, so a title with a ; or # in it isn't cut short
+var initSiteConfigTemplate = template.Must(template.New("site").Funcs(template.FuncMap{"ini": iniValue}).Parse(`; Written by 50mm init. Run '50mm config-schema' to see every option.
+[DEFAULT]
+Domain = {{ini .Domain}}
+BucketRegion = {{ini .Region}}
+BucketName = {{ini .BucketName}}
+{{- if .S3Host}}
+S3Host = {{ini .S3Host}}
+{{- end}}
+AWSKeyId = {{ini .KeyId}}
+AWSKey = {{ini .Key}}
+SiteTitle = {{ini .SiteTitle}}
+MetaTitle = {{ini .SiteTitle}}
+HasAlbumIndex = 1
+
+; A sample album, its photos go in the bucket under {{.SampleAlbumPrefix}}
+[Sample]
+Path = /sample/
+BucketPrefix = {{ini .SampleAlbumPrefix}}
+MetaTitle = {{ini (printf "Sample album | %s" .SiteTitle)}}
+AlbumTitle = Sample album
+`))
+
+var initEnvTemplate = template.Must(template.New("env").Parse(`{{.ConfigDirEnv}}={{.Options.ConfigDir}}
+{{.DataDirEnv}}={{.Options.DataDir}}
+{{.PortEnv}}={{.Options.Port}}
+{{.AdminTokenEnv}}={{.Options.AdminToken}}
+`))
+
+// Asks for a value on the terminal, showing the current one (if any) as the default
+func promptValue(in *bufio.Reader, label string, value *string, secret bool) error {
+	shown := *value
+	if secret && shown != "" {
+		shown = "****"
+	}
+
+	if shown != "" {
+		fmt.Printf("%s [%s]: ", label, shown)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	line, err := in.ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		*value = line
+	}
+	return nil
+}
+
+/*
+Returns the first setting with a line break in it. Neither the site config nor the environment file can hold one, it
+would start a new line of config.
+*/
+func (opts *initOptions) multiLineSetting() string {
+	for name, value := range map[string]string{
+		"domain": opts.Domain, "title": opts.SiteTitle, "bucket": opts.BucketName, "region": opts.Region,
+		"s3-host": opts.S3Host, "key-id": opts.KeyId, "key": opts.Key, "config-dir": opts.ConfigDir,
+		"data-dir": opts.DataDir, "port": opts.Port,
+	} {
+		if strings.ContainsAny(value, "\r\n") {
+			return name
+		}
+	}
+	return ""
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func writeInitFile(path string, tmpl *template.Template, data interface{}, force bool) error {
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) // Both files hold secrets
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Lists a single object in the sample album's prefix, which needs the same permissions the server does
+func checkBucket(site *Site) error {
+	svc, err := site.GetS3Service()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), INIT_BUCKET_CHECK_TIMEOUT)
+	defer cancel()
+	_, err = svc.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+		Bucket:  aws.String(site.BucketName),
+		Prefix:  aws.String(INIT_SAMPLE_ALBUM_PREFIX),
+		MaxKeys: aws.Int64(1),
+	})
+	return err
+}
+
+func runInit(args []string) int {
+	opts := &initOptions{
+		ConfigDir:         firstNonEmpty(os.Getenv(CONFIG_DIR_ENV_VAR), DEFAULT_CONFIG_DIR),
+		DataDir:           firstNonEmpty(os.Getenv(DATA_DIR_ENV_VAR), DEFAULT_DATA_DIR),
+		Port:              firstNonEmpty(os.Getenv(PORT_ENV_VAR), DEFAULT_PORT),
+		KeyId:             os.Getenv("AWS_ACCESS_KEY_ID"),
+		Key:               os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Region:            firstNonEmpty(os.Getenv("AWS_REGION"), "us-east-1"),
+		SiteTitle:         "50mm",
+		SampleAlbumPrefix: INIT_SAMPLE_ALBUM_PREFIX,
+	}
+
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	flags.StringVar(&opts.Domain, "domain", "", "Domain the site is served on, e.g. photos.example.com")
+	flags.StringVar(&opts.SiteTitle, "title", opts.SiteTitle, "Name of the site")
+	flags.StringVar(&opts.BucketName, "bucket", "", "Name of the S3 bucket with the photos")
+	flags.StringVar(&opts.Region, "region", opts.Region, "Region of the bucket")
+	flags.StringVar(&opts.S3Host, "s3-host", "", "Endpoint of an S3 compatible object store other than AWS")
+	flags.StringVar(&opts.KeyId, "key-id", opts.KeyId, "AWS access key with read access to the bucket (default $AWS_ACCESS_KEY_ID)")
+	flags.StringVar(&opts.Key, "key", opts.Key, "AWS secret key (default $AWS_SECRET_ACCESS_KEY)")
+	flags.StringVar(&opts.ConfigDir, "config-dir", opts.ConfigDir, "Folder to write the site config to")
+	flags.StringVar(&opts.DataDir, "data-dir", opts.DataDir, "Folder for the server's data, like caches and logs")
+	flags.StringVar(&opts.Port, "port", opts.Port, "Port the server listens on")
+	envFile := flags.String("env-file", "", "File to write the server's environment variables to (default <config dir>/"+INIT_ENV_FILE_NAME+")")
+	interactive := flags.Bool("interactive", isTerminal(os.Stdin), "Ask for the settings (default when run in a terminal)")
+	noCheck := flags.Bool("no-check", false, "Don't check that the bucket can be reached")
+	force := flags.Bool("force", false, "Overwrite config files that already exist")
+	flags.Parse(args)
+
+	if *interactive {
+		in := bufio.NewReader(os.Stdin)
+		for _, p := range []struct {
+			label  string
+			value  *string
+			secret bool
+		}{
+			{"Domain", &opts.Domain, false},
+			{"Site title", &opts.SiteTitle, false},
+			{"Bucket name", &opts.BucketName, false},
+			{"Bucket region", &opts.Region, false},
+			{"S3 endpoint (leave empty for AWS)", &opts.S3Host, false},
+			{"AWS access key", &opts.KeyId, false},
+			{"AWS secret key", &opts.Key, true},
+			{"Config folder", &opts.ConfigDir, false},
+			{"Data folder", &opts.DataDir, false},
+		} {
+			if err := promptValue(in, p.label, p.value, p.secret); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read %s. Error: %s\n", strings.ToLower(p.label), err.Error())
+				return 1
+			}
+		}
+		fmt.Println()
+	}
+
+	if opts.Domain == "" || opts.BucketName == "" || opts.KeyId == "" || opts.Key == "" {
+		fmt.Fprintf(os.Stderr, "A domain, bucket and AWS keys are needed, pass them with -domain, -bucket, -key-id and -key\n\n")
+		flags.Usage()
+		return 2
+	}
+	if name := opts.multiLineSetting(); name != "" {
+		fmt.Fprintf(os.Stderr, "The %s can't have line breaks in it\n", name)
+		return 2
+	}
+	if *envFile == "" {
+		*envFile = filepath.Join(opts.ConfigDir, INIT_ENV_FILE_NAME)
+	}
+
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to make an admin token. Error: %s\n", err.Error())
+		return 1
+	}
+	opts.AdminToken = hex.EncodeToString(token)
+
+	for _, dir := range []string{opts.ConfigDir, opts.DataDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create %s. Error: %s\n", dir, err.Error())
+			return 1
+		}
+	}
+
+	siteConfig := filepath.Join(opts.ConfigDir, opts.Domain+".ini")
+	if err := writeInitFile(siteConfig, initSiteConfigTemplate, opts, *force); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s. Error: %s\n", siteConfig, err.Error())
+		return 1
+	}
+	fmt.Printf("Wrote the site config to %s\n", siteConfig)
+
+	env := map[string]interface{}{
+		"ConfigDirEnv": CONFIG_DIR_ENV_VAR, "DataDirEnv": DATA_DIR_ENV_VAR, "PortEnv": PORT_ENV_VAR,
+		"AdminTokenEnv": ADMIN_TOKEN_ENV_VAR, "Options": opts,
+	}
+	if err := writeInitFile(*envFile, initEnvTemplate, env, *force); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s. Error: %s\n", *envFile, err.Error())
+		return 1
+	}
+	fmt.Printf("Wrote the server's environment variables to %s\n", *envFile)
+
+	// Loading the config the way the server does catches anything the server would refuse
+	site, err := LoadSiteFromFile(siteConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "The site config doesn't load. Error: %s\n", err.Error())
+		return 1
+	}
+
+	status := 0
+	if !*noCheck {
+		if err := checkBucket(site); err != nil {
+			var hint string
+			if errors.Is(err, context.DeadlineExceeded) {
+				hint = ", check the region and S3 endpoint"
+			}
+			fmt.Fprintf(os.Stderr, "Unable to list s3://%s/%s%s. Error: %s\n", opts.BucketName, INIT_SAMPLE_ALBUM_PREFIX, hint, err.Error())
+			fmt.Fprintf(os.Stderr, "Fix the bucket settings in %s, the keys need permission to list and read the bucket\n", siteConfig)
+			status = 1
+		} else {
+			fmt.Printf("Connected to s3://%s\n", opts.BucketName)
+		}
+	}
+
+	fmt.Printf(`
+Next steps:
+  1. Upload some photos to the sample album:
+       env $(cat %[1]s | xargs) 50mm import <folder> -album sample
+  2. Start the server:
+       env $(cat %[1]s | xargs) 50mm serve
+     or in Docker:
+       docker run --env-file %[1]s -p %[2]s:%[2]s -v <config folder>:%[3]s -v <data folder>:%[4]s 50mm:latest
+  3. Open http://%[5]s/sample/ (or http://localhost:%[2]s/sample/ with %[5]s in the Host header)
+
+The admin token for /admin is in %[1]s.
+`, *envFile, opts.Port, opts.ConfigDir, opts.DataDir, opts.Domain)
+	return status
+}
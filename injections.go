@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where the default templates let a site's config add its own HTML
+const INJECT_HEAD_EXTRA = "head_extra"
+const INJECT_BEFORE_GRID = "before_grid"
+const INJECT_PHOTO_OVERLAY = "photo_overlay"
+const INJECT_FOOTER = "footer"
+
+func (s *Site) injectionOptions() map[string]string {
+	return map[string]string{
+		INJECT_HEAD_EXTRA:    s.HeadExtra,
+		INJECT_BEFORE_GRID:   s.BeforeGrid,
+		INJECT_PHOTO_OVERLAY: s.PhotoOverlay,
+		INJECT_FOOTER:        s.Footer,
+	}
+}
+
+/*
+Resolves a partial's path, which has to stay inside the folder of the site's config, symlinks and all, otherwise a
+tenant's config could read any .html file on the server.
+*/
+func partialPath(configDir, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("%s must be relative to the config's folder", name)
+	}
+	dir, err := filepath.EvalSymlinks(configDir)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s isn't inside the config's folder", name)
+	}
+	return path, nil
+}
+
+/*
+Parses the snippets a site's config adds to its pages. Options that end in .html name a partial file, relative to the
+folder of the site's config and inside it, so longer snippets don't have to fit on one line of the ini. Snippets are
+templates like the default ones, with the same functions, so they can use {{t}} and {{asset}} and the page's data.
+*/
+func loadInjections(s *Site, configDir string) (map[string]*template.Template, error) {
+	injections := make(map[string]*template.Template)
+	for hook, snippet := range s.injectionOptions() {
+		snippet = strings.TrimSpace(snippet)
+		if snippet == "" {
+			continue
+		}
+
+		if strings.HasSuffix(snippet, ".html") && !strings.Contains(snippet, "<") {
+			path, err := partialPath(configDir, snippet)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid partial for %s. Error: %s", hook, err.Error())
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read the partial for %s. Error: %s", hook, err.Error())
+			}
+			snippet = string(data)
+		}
+
+		tmpl, err := template.New(hook).Funcs(templateFuncs).Parse(snippet)
+		if err != nil {
+			return nil, fmt.Errorf("The snippet for %s isn't a valid template. Error: %s", hook, err.Error())
+		}
+		injections[hook] = tmpl
+	}
+	return injections, nil
+}
+
+/*
+Renders the site's snippet for one of the injection hooks, or nothing if it has none. The head, grid and footer
+snippets get the page's data, photo overlays get the photo's PhotoView. A snippet that fails is left out, the page is
+still worth showing without it.
+*/
+func (v *SiteView) Inject(hook string, data interface{}) template.HTML {
+	if v.site == nil || v.site.injections[hook] == nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err := v.site.injections[hook].Execute(&buf, data); err != nil {
+		reportError("render "+hook+" snippet", err, siteErrorContext(v.site))
+		return ""
+	}
+	return template.HTML(buf.String())
+}
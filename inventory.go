@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// S3 makes inventory reports daily or weekly, checking for a new one once a day is plenty
+const INVENTORY_REFRESH_INTERVAL = 24 * time.Hour
+
+// Each report is in a folder named after when it was made, like 2024-05-01T01-00Z/
+var inventoryReportPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}-\d{2}Z/$`)
+
+type inventoryManifest struct {
+	FileFormat string `json:"fileFormat"`
+	FileSchema string `json:"fileSchema"`
+	Files      []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// The columns of Parquet reports we need, others are skipped and missing ones are left nil
+type inventoryParquetRow struct {
+	Key              string     `parquet:"key"`
+	Size             *int64     `parquet:"size,optional"`
+	LastModifiedDate *time.Time `parquet:"last_modified_date,optional"`
+	ETag             *string    `parquet:"e_tag,optional"`
+	StorageClass     *string    `parquet:"storage_class,optional"`
+	IsLatest         *bool      `parquet:"is_latest,optional"`
+	IsDeleteMarker   *bool      `parquet:"is_delete_marker,optional"`
+}
+
+type siteInventory struct {
+	manifestKey string
+	loaded      time.Time
+
+	// Objects by the folder they're in, everything up to the last slash of their key, like album listings
+	folders map[string][]*s3.Object
+}
+
+type inventoryCache struct {
+	mutex   sync.Mutex
+	current atomic.Pointer[siteInventory]
+}
+
+func (s *Site) HasInventory() bool {
+	return s.InventoryPrefix != ""
+}
+
+func (s *Site) GetInventoryBucket() string {
+	return firstNonEmpty(s.InventoryBucket, s.BucketName)
+}
+
+/*
+Returns the objects in a folder of the bucket from the latest S3 Inventory report, for sites with buckets too big to
+list. The report is read again once a day. If that fails, the last one is used until it works again.
+*/
+func (s *Site) GetInventoryObjects(ctx context.Context, prefix string) ([]*s3.Object, error) {
+	inventory := s.inventory.current.Load()
+	if inventory == nil || time.Since(inventory.loaded) >= INVENTORY_REFRESH_INTERVAL {
+		var err error
+		if inventory, err = s.refreshInventory(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return inventory.folders[prefix], nil
+}
+
+func (s *Site) refreshInventory(ctx context.Context) (*siteInventory, error) {
+	s.inventory.mutex.Lock()
+	defer s.inventory.mutex.Unlock()
+
+	// Another album may have got here first
+	current := s.inventory.current.Load()
+	if current != nil && time.Since(current.loaded) < INVENTORY_REFRESH_INTERVAL {
+		return current, nil
+	}
+
+	manifestKey, err := s.findLatestInventoryManifest(ctx)
+	if err == nil && current != nil && manifestKey == current.manifestKey {
+		inventory := &siteInventory{manifestKey, time.Now(), current.folders}
+		s.inventory.current.Store(inventory)
+		return inventory, nil
+	}
+
+	var inventory *siteInventory
+	if err == nil {
+		inventory, err = s.readInventory(ctx, manifestKey)
+	}
+	if err != nil {
+		if current != nil {
+			reportError("read S3 inventory", err, ErrorContext{"site": s.Domain})
+			return current, nil
+		}
+		return nil, err
+	}
+
+	s.inventory.current.Store(inventory)
+	return inventory, nil
+}
+
+func (s *Site) findLatestInventoryManifest(ctx context.Context) (string, error) {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return "", err
+	}
+
+	prefix := strings.TrimSuffix(s.InventoryPrefix, "/") + "/"
+	latest := ""
+	err = svc.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket:    aws.String(s.GetInventoryBucket()),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			if folder := aws.StringValue(p.Prefix); inventoryReportPattern.MatchString(folder) && folder > latest {
+				latest = folder
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if latest == "" {
+		return "", fmt.Errorf("No inventory reports found in s3://%s/%s", s.GetInventoryBucket(), prefix)
+	}
+	return latest + "manifest.json", nil
+}
+
+func (s *Site) getInventoryFile(ctx context.Context, key string) ([]byte, error) {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(s.GetInventoryBucket()), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return io.ReadAll(obj.Body)
+}
+
+func (s *Site) readInventory(ctx context.Context, manifestKey string) (*siteInventory, error) {
+	data, err := s.getInventoryFile(ctx, manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &inventoryManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Unable to read inventory manifest %s. Error: %s", manifestKey, err.Error())
+	}
+
+	inventory := &siteInventory{manifestKey: manifestKey, loaded: time.Now(), folders: make(map[string][]*s3.Object)}
+	add := func(obj *s3.Object) {
+		key := aws.StringValue(obj.Key)
+		folder := key[:strings.LastIndex(key, "/")+1]
+		inventory.folders[folder] = append(inventory.folders[folder], obj)
+	}
+
+	for _, file := range manifest.Files {
+		data, err := s.getInventoryFile(ctx, file.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToUpper(manifest.FileFormat) {
+		case "CSV":
+			err = readInventoryCSV(data, manifest.FileSchema, add)
+		case "PARQUET":
+			err = readInventoryParquet(data, add)
+		default:
+			return nil, fmt.Errorf("Inventory reports in %s can't be read, use CSV or Parquet", manifest.FileFormat)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read inventory file %s. Error: %s", file.Key, err.Error())
+		}
+	}
+
+	// Listings come sorted by key, and albums show photos in that order
+	for _, objects := range inventory.folders {
+		sort.Slice(objects, func(i, j int) bool { return *objects[i].Key < *objects[j].Key })
+	}
+	return inventory, nil
+}
+
+// CSV reports are gzipped, without a header. The manifest's fileSchema names the columns, like "Bucket, Key, Size".
+func readInventoryCSV(data []byte, schema string, add func(*s3.Object)) error {
+	columns := make(map[string]int)
+	for i, name := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	keyColumn, ok := columns["Key"]
+	if !ok {
+		return fmt.Errorf("The inventory has no Key column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = -1
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Old versions of objects and deleted ones are only in reports of versioned buckets
+		if field(record, "IsLatest") == "false" || field(record, "IsDeleteMarker") == "true" || keyColumn >= len(record) {
+			continue
+		}
+		// Keys are URL encoded, so commas and newlines in them don't get in the way
+		key, err := url.QueryUnescape(record[keyColumn])
+		if err != nil {
+			continue
+		}
+
+		obj := &s3.Object{Key: aws.String(key)}
+		if size, err := strconv.ParseInt(field(record, "Size"), 10, 64); err == nil {
+			obj.Size = aws.Int64(size)
+		}
+		if modified, err := time.Parse(time.RFC3339, field(record, "LastModifiedDate")); err == nil {
+			obj.LastModified = aws.Time(modified)
+		}
+		if etag := field(record, "ETag"); etag != "" {
+			obj.ETag = aws.String(`"` + etag + `"`)
+		}
+		if storageClass := field(record, "StorageClass"); storageClass != "" {
+			obj.StorageClass = aws.String(storageClass)
+		}
+		add(obj)
+	}
+}
+
+func readInventoryParquet(data []byte, add func(*s3.Object)) error {
+	rows, err := parquet.Read[inventoryParquetRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if (row.IsLatest != nil && !*row.IsLatest) || (row.IsDeleteMarker != nil && *row.IsDeleteMarker) {
+			continue
+		}
+
+		obj := &s3.Object{Key: aws.String(row.Key), Size: row.Size, LastModified: row.LastModifiedDate, StorageClass: row.StorageClass}
+		if row.ETag != nil {
+			obj.ETag = aws.String(`"` + *row.ETag + `"`)
+		}
+		add(obj)
+	}
+	return nil
+}
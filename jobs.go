@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const JOB_WORKERS = 4
+const JOB_MAX_ATTEMPTS = 3
+const JOB_RETRY_DELAY = 30 * time.Second
+const JOB_TIMEOUT = 2 * time.Minute
+
+// Refreshing a few huge albums at once could otherwise queue millions of derivatives. Dropped ones are made when they're needed.
+const JOB_QUEUE_MAX_JOBS = 10000
+
+type JobPriority int
+
+// Jobs a visitor's request is waiting for run first, then jobs for photos visitors see first, then everything else
+const (
+	PRIORITY_NOW JobPriority = iota
+	PRIORITY_HIGH
+	PRIORITY_LOW
+)
+
+var jobPriorityNames = []string{"now", "high", "low"}
+
+type Job struct {
+	Name     string
+	Priority JobPriority
+	Run      func(ctx context.Context) error
+	Timeout  time.Duration // JOB_TIMEOUT if zero
+
+	// Reported along with the error if the job keeps failing
+	ErrorContext ErrorContext
+	// Called once the job has failed for the last time
+	OnFailure func(err error)
+
+	attempts int
+	done     chan error // For jobs someone waits for, see Wait
+}
+
+/*
+Runs slow work, like reading EXIF data for newly uploaded photos, in the background with a fixed number of workers so
+it never piles up on visitors' requests. Jobs are named, and a job that is already waiting to run isn't queued again.
+Failed jobs are retried a few times with a growing delay before they're given up on.
+*/
+type JobQueue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	started bool
+	queues  [][]*Job
+	pending map[string]bool
+}
+
+var jobQueue = NewJobQueue()
+
+var errJobQueueFull = errors.New("the job queue is full")
+
+// Marks the contexts jobs run with, so work a job waits for runs in the job instead of queueing behind it
+type jobContextKey struct{}
+
+func init() {
+	metrics.RegisterGauge("fiftymm_jobs_queued", "Number of background jobs waiting to run, by priority.")
+	metrics.RegisterCounter("fiftymm_jobs_total", "Number of background job runs, by result.")
+}
+
+func NewJobQueue() *JobQueue {
+	q := &JobQueue{
+		queues:  make([][]*Job, len(jobPriorityNames)),
+		pending: make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Must be called with the mutex held
+func (q *JobQueue) updateMetrics() {
+	for priority, jobs := range q.queues {
+		metrics.Set("fiftymm_jobs_queued", float64(len(jobs)), "priority", jobPriorityNames[priority])
+	}
+}
+
+/*
+Queues a job. Jobs are dropped when the queue isn't running, like in commands other than serve, and when there are
+already JOB_QUEUE_MAX_JOBS of the same priority waiting, in which case they fail straight away.
+*/
+func (q *JobQueue) Enqueue(job *Job) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.started || q.pending[job.Name] {
+		return
+	}
+	if len(q.queues[job.Priority]) >= JOB_QUEUE_MAX_JOBS {
+		metrics.Add("fiftymm_jobs_total", 1, "result", "dropped")
+		if job.OnFailure != nil {
+			// Without the mutex, OnFailure may well queue something else
+			go job.OnFailure(errJobQueueFull)
+		}
+		return
+	}
+	q.pending[job.Name] = true
+	q.queues[job.Priority] = append(q.queues[job.Priority], job)
+	q.updateMetrics()
+	q.cond.Signal()
+}
+
+/*
+Runs a job ahead of the queued ones and waits for it, for work a request can't answer without. Jobs run straight away
+when the queue isn't running, or when they're waited for by another job, which would otherwise hold a worker while
+waiting for one. Jobs that are waited for aren't retried, the error goes to whoever waits for them. If the context is
+done first the job still runs, so its result is there for the next request.
+*/
+func (q *JobQueue) Wait(ctx context.Context, job *Job) error {
+	q.mutex.Lock()
+	if !q.started || ctx.Value(jobContextKey{}) != nil {
+		q.mutex.Unlock()
+		return runRecovering(ctx, job)
+	}
+	if len(q.queues[PRIORITY_NOW]) >= JOB_QUEUE_MAX_JOBS {
+		q.mutex.Unlock()
+		metrics.Add("fiftymm_jobs_total", 1, "result", "dropped")
+		return errJobQueueFull
+	}
+	job.Priority = PRIORITY_NOW
+	job.done = make(chan error, 1)
+	q.queues[PRIORITY_NOW] = append(q.queues[PRIORITY_NOW], job)
+	q.updateMetrics()
+	q.cond.Signal()
+	q.mutex.Unlock()
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the number of jobs waiting to run
+func (q *JobQueue) Depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	depth := 0
+	for _, jobs := range q.queues {
+		depth += len(jobs)
+	}
+	return depth
+}
+
+func (q *JobQueue) next() *Job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		for priority, jobs := range q.queues {
+			if len(jobs) > 0 {
+				job := jobs[0]
+				jobs[0] = nil
+				q.queues[priority] = jobs[1:]
+				// Jobs that are waited for share names with queued ones, but aren't pending themselves
+				if job.done == nil {
+					delete(q.pending, job.Name)
+				}
+				q.updateMetrics()
+				return job
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+// Jobs read whatever was uploaded, so a bug they trip over fails the job instead of taking the server down
+func runRecovering(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Printf("Panic running background job %s: %v\n%s", job.Name, p, debug.Stack())
+			err = fmt.Errorf("The job panicked: %v", p)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func (q *JobQueue) run(job *Job) {
+	timeout := job.Timeout
+	if timeout == 0 {
+		timeout = JOB_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), jobContextKey{}, job), timeout)
+	defer cancel()
+
+	job.attempts++
+	err := runRecovering(ctx, job)
+	if job.done != nil {
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		metrics.Add("fiftymm_jobs_total", 1, "result", result)
+		job.done <- err
+		return
+	}
+	if err == nil {
+		metrics.Add("fiftymm_jobs_total", 1, "result", "ok")
+		return
+	}
+
+	if job.attempts >= JOB_MAX_ATTEMPTS {
+		metrics.Add("fiftymm_jobs_total", 1, "result", "failed")
+		reportError("run background job "+job.Name, err, job.ErrorContext)
+		if job.OnFailure != nil {
+			job.OnFailure(err)
+		}
+		return
+	}
+
+	metrics.Add("fiftymm_jobs_total", 1, "result", "retry")
+	time.AfterFunc(time.Duration(job.attempts)*JOB_RETRY_DELAY, func() {
+		q.Enqueue(job)
+	})
+}
+
+func (q *JobQueue) Start(workers int) {
+	q.mutex.Lock()
+	q.started = true
+	q.mutex.Unlock()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				q.run(q.next())
+			}
+		}()
+	}
+}
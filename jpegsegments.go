@@ -0,0 +1,22 @@
+package main
+
+/*
+Calls fn with the marker and contents of each segment of a JPEG before its image data, until fn returns false. Segments
+follow the SOI marker as 0xFF, the marker, a 2 byte length that counts itself, and the contents. The walk stops at the
+first segment that's broken or cut short, as photos are often only partly downloaded. The contents are a slice of data,
+so changes to them change the JPEG.
+*/
+func eachJpegSegment(data []byte, fn func(marker byte, offset int, contents []byte) bool) {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(data[i+2])<<8 | int(data[i+3])
+		// Lengths count their own two bytes, anything less means the file is broken
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return
+		}
+		if !fn(marker, i, data[i+4:i+2+length]) {
+			return
+		}
+		i += 2 + length
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEachJpegSegment(t *testing.T) {
+	exif := append([]byte{0xFF, 0xE1, 0x00, 0x08}, []byte("Exif\x00\x00")...)
+	jpeg := append(append([]byte{0xFF, 0xD8}, exif...), 0xFF, 0xDA, 0x00, 0x02)
+
+	var markers []byte
+	eachJpegSegment(jpeg, func(marker byte, offset int, contents []byte) bool {
+		markers = append(markers, marker)
+		if offset != 2 || !bytes.Equal(contents, []byte("Exif\x00\x00")) {
+			t.Errorf("segment at %d = %q", offset, contents)
+		}
+		return true
+	})
+	if !bytes.Equal(markers, []byte{0xE1}) {
+		t.Errorf("markers = %x, want e1", markers)
+	}
+}
+
+// Crafted lengths must stop the walk instead of slicing out of range
+func TestJpegSegmentsBrokenLengths(t *testing.T) {
+	for _, data := range [][]byte{
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00},
+		{0xFF, 0xD8, 0xFF, 0xE2, 0x00, 0x01, 0x00},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x07, 'E', 'x', 'i', 'f', 0x00},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x0A, 'E', 'x', 'i', 'f', 0x00, 0x00, 'M', 'M'},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x40},
+	} {
+		readJpegIccProfile(data)
+		isPhotosphere(data)
+		copyExif(data, []byte{0xFF, 0xD8})
+		resetExifOrientation(data)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+Links that were typed by hand, or passed through messaging apps, often come back with different casing, or with accented
+letters made of different code points (é as one character, or as e and a combining accent). Sites with LenientUrls
+compare album paths and photo names in this folded form, and redirect to the exact URL.
+*/
+func foldUrlName(s string) string {
+	return strings.ToLower(norm.NFC.String(s))
+}
+
+// The slug of a photo whose slug or file name matches ignoring case and normalization, or "" if there isn't one
+func (a *Album) matchSlugLeniently(slug string) string {
+	folded := foldUrlName(slug)
+	for s, key := range a.slugKeys() {
+		if foldUrlName(s) == folded || foldUrlName(path.Base(key)) == folded {
+			return s
+		}
+	}
+	return ""
+}
+
+// Finds the album the path belongs to, with the longest matching path, and what comes after the album path
+func (s *Site) matchAlbumLeniently(urlPath string) (*Album, string) {
+	folded := foldUrlName(urlPath)
+	if !strings.HasSuffix(folded, "/") && !strings.Contains(path.Base(folded), ".") {
+		folded += "/"
+	}
+
+	var match *Album
+	for _, album := range s.Albums {
+		albumPath := foldUrlName(album.Path)
+		if strings.HasPrefix(folded, albumPath) && (match == nil || len(albumPath) > len(match.Path)) {
+			match = album
+		}
+	}
+	if match == nil {
+		return nil, ""
+	}
+
+	// Folding can change the length of a string, so the rest is found by dropping as many segments as the album path has
+	segments := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	albumSegments := strings.Count(strings.Trim(match.Path, "/"), "/") + 1
+	if match.Path == "/" {
+		albumSegments = 0
+	}
+	if albumSegments > len(segments) {
+		return match, ""
+	}
+	return match, strings.Join(segments[albumSegments:], "/")
+}
+
+// Redirects URLs of albums and photos that only match ignoring case and normalization to the exact URL
+func handleLenientUrl(site *Site, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+
+	album, rest := site.matchAlbumLeniently(r.URL.Path)
+	if album == nil || !album.IsPublished() {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "" {
+		redirectLeniently(w, r, album.pagePath())
+		return
+	}
+
+	// Fixed routes like download/ are lowercase, only the photo name at the end needs looking up
+	dir, slug := path.Split(rest)
+	if match := album.matchSlugLeniently(slug); match != "" {
+		redirectLeniently(w, r, album.Path+strings.ToLower(dir)+match)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func redirectLeniently(w http.ResponseWriter, r *http.Request, target string) {
+	u := *r.URL
+	u.Path, u.RawPath = target, ""
+	if u.Path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
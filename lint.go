@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+/*
+Options from before sites could have several albums. They still work, but only in the DEFAULT section, and have newer
+replacements.
+*/
+var DEPRECATED_SITE_OPTIONS = map[string]string{
+	"Region":     "use BucketRegion",
+	"Bucket":     "use BucketName",
+	"Prefix":     "move the album to a section of its own, with Path and BucketPrefix",
+	"AlbumTitle": "move the album to a section of its own, with Path and AlbumTitle",
+}
+
+var iniKeyLinePattern = regexp.MustCompile(`^\s*([^=:#;\s][^=:]*?)\s*[=:]`)
+var iniSectionLinePattern = regexp.MustCompile(`^\s*\[([^\]]+)\]`)
+
+// The bucket prefix of an album seen so far, with where it was configured
+type lintPrefix struct {
+	bucket  string
+	prefix  string
+	problem *ConfigProblem
+}
+
+// Something wrong with a config file, where go-ini would have quietly ignored it
+type ConfigProblem struct {
+	File    string
+	Line    int
+	Section string
+	Key     string
+	Message string
+}
+
+func (p *ConfigProblem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location += fmt.Sprintf(":%d", p.Line)
+	}
+	if p.Section != "" {
+		location += " [" + p.Section + "]"
+	}
+	if p.Key != "" {
+		location += " " + p.Key
+	}
+	return location + ": " + p.Message
+}
+
+func configOptions(v interface{}) map[string]bool {
+	options := make(map[string]bool)
+	for _, o := range configSchema(v) {
+		options[o.Name] = true
+	}
+	return options
+}
+
+func editDistance(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// The closest option to a misspelled one, if there's one close enough to be what was meant
+func suggestOption(key string, options map[string]bool) string {
+	best, bestDistance := "", 3
+	for option := range options {
+		if d := editDistance(key, option); d < bestDistance || (d == bestDistance && option < best) {
+			best, bestDistance = option, d
+		}
+	}
+	return best
+}
+
+// Finds the lines keys are on, go-ini doesn't keep them
+func configKeyLines(path string) map[string]int {
+	lines := make(map[string]int)
+	f, err := os.Open(path)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	section := ini.DEFAULT_SECTION
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if match := iniSectionLinePattern.FindStringSubmatch(scanner.Text()); match != nil {
+			section = strings.TrimSpace(match[1])
+		} else if match := iniKeyLinePattern.FindStringSubmatch(scanner.Text()); match != nil {
+			if _, ok := lines[section+"\x00"+match[1]]; !ok {
+				lines[section+"\x00"+match[1]] = n
+			}
+		}
+	}
+	return lines
+}
+
+/*
+Checks the config files in a folder for options that don't exist (usually typos, like AuthPasss, which MapTo ignores),
+deprecated options, sites configured twice, albums with the same path, and albums whose bucket prefixes overlap.
+*/
+func lintConfig(configDir string) []*ConfigProblem {
+	var problems []*ConfigProblem
+	siteOptions, albumOptions := configOptions(&Site{}), configOptions(&Album{})
+
+	paths, _ := filepath.Glob(filepath.Join(configDir, "*.ini"))
+	tenantPaths, _ := filepath.Glob(filepath.Join(configDir, TENANTS_DIR_NAME, "*", "*.ini"))
+	for _, path := range tenantPaths {
+		if filepath.Base(path) == TENANT_CONFIG_FILE {
+			problems = append(problems, lintTenantConfig(path)...)
+		} else {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	domains := make(map[string]string)
+	var prefixes []*lintPrefix
+	for _, path := range paths {
+		cfg, err := ini.Load(path)
+		if err != nil {
+			problems = append(problems, &ConfigProblem{File: path, Message: err.Error()})
+			continue
+		}
+		lines := configKeyLines(path)
+		problem := func(section, key, message string) *ConfigProblem {
+			return &ConfigProblem{File: path, Line: lines[section+"\x00"+key], Section: section, Key: key, Message: message}
+		}
+
+		defaultSection := cfg.Section(ini.DEFAULT_SECTION)
+		for _, key := range defaultSection.Keys() {
+			if siteOptions[key.Name()] {
+				continue
+			}
+			if replacement, ok := DEPRECATED_SITE_OPTIONS[key.Name()]; ok {
+				problems = append(problems, problem(ini.DEFAULT_SECTION, key.Name(), "Deprecated option, "+replacement))
+			} else if suggestion := suggestOption(key.Name(), siteOptions); suggestion != "" {
+				problems = append(problems, problem(ini.DEFAULT_SECTION, key.Name(), "Unknown option, did you mean "+suggestion+"?"))
+			} else {
+				problems = append(problems, problem(ini.DEFAULT_SECTION, key.Name(), "Unknown option"))
+			}
+		}
+
+		domain := defaultSection.Key("Domain").String()
+		if other, ok := domains[domain]; ok && domain != "" {
+			problems = append(problems, problem(ini.DEFAULT_SECTION, "Domain", "Site "+domain+" is also configured in "+other))
+		} else {
+			domains[domain] = path
+		}
+		bucket := firstNonEmpty(defaultSection.Key("BucketName").String(), defaultSection.Key("Bucket").String())
+
+		albumPaths := make(map[string]string)
+		addAlbum := func(section, albumPath, prefixKey, prefix string) {
+			if !strings.HasSuffix(albumPath, "/") {
+				albumPath += "/"
+			}
+			if other, ok := albumPaths[albumPath]; ok {
+				problems = append(problems, problem(section, "Path", fmt.Sprintf("Album %s is also configured in [%s]", albumPath, other)))
+			} else {
+				albumPaths[albumPath] = section
+			}
+
+			// A prefix inside another one, either way round, is usually a typo or a folder that ended up in two albums
+			for _, other := range prefixes {
+				if other.bucket != bucket {
+					continue
+				}
+				if other.prefix == prefix {
+					problems = append(problems, problem(section, prefixKey, fmt.Sprintf("Shows the same photos as [%s] in %s",
+						other.problem.Section, other.problem.File)))
+					return
+				}
+				if strings.HasPrefix(prefix, other.prefix) || strings.HasPrefix(other.prefix, prefix) {
+					problems = append(problems, problem(section, prefixKey, fmt.Sprintf("Overlaps with %q of [%s] in %s",
+						other.prefix, other.problem.Section, other.problem.File)))
+					return
+				}
+			}
+			prefixes = append(prefixes, &lintPrefix{bucket, prefix, problem(section, prefixKey, "")})
+		}
+
+		sections := 0
+		for _, section := range cfg.Sections() {
+			if section.Name() == ini.DEFAULT_SECTION {
+				continue
+			}
+			sections++
+			for _, key := range section.Keys() {
+				if albumOptions[key.Name()] {
+					continue
+				}
+				if suggestion := suggestOption(key.Name(), albumOptions); suggestion != "" {
+					problems = append(problems, problem(section.Name(), key.Name(), "Unknown album option, did you mean "+suggestion+"?"))
+				} else {
+					problems = append(problems, problem(section.Name(), key.Name(), "Unknown album option"))
+				}
+			}
+			if section.HasKey("Path") {
+				addAlbum(section.Name(), section.Key("Path").String(), "BucketPrefix", section.Key("BucketPrefix").String())
+			}
+		}
+		if sections == 0 {
+			addAlbum(ini.DEFAULT_SECTION, "/", "Prefix", defaultSection.Key("Prefix").String())
+		}
+	}
+	return problems
+}
+
+func lintTenantConfig(path string) []*ConfigProblem {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return []*ConfigProblem{{File: path, Message: err.Error()}}
+	}
+
+	var problems []*ConfigProblem
+	tenantOptions, lines := configOptions(&Tenant{}), configKeyLines(path)
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			message := ""
+			if section.Name() != ini.DEFAULT_SECTION {
+				message = "Tenant options go in the DEFAULT section"
+			} else if tenantOptions[key.Name()] {
+				continue
+			} else if suggestion := suggestOption(key.Name(), tenantOptions); suggestion != "" {
+				message = "Unknown tenant option, did you mean " + suggestion + "?"
+			} else {
+				message = "Unknown tenant option"
+			}
+			problems = append(problems, &ConfigProblem{File: path, Line: lines[section.Name()+"\x00"+key.Name()],
+				Section: section.Name(), Key: key.Name(), Message: message})
+		}
+	}
+	return problems
+}
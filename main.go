@@ -1,36 +1,59 @@
 package main
 
 import (
-	"crypto/subtle"
+	"bytes"
+	"flag"
 	"fmt"
 	"html/template"
-	"io"
 	"net/http"
-	"strings"
+	"os"
+	"path/filepath"
+	"time"
 )
 
-const DEBUG = true
-
 var app *App
 var templates *template.Template
 
 type AuthCredentialsProvider interface {
 	GetAuthUser() string
 	GetAuthPass() string
+	GetAuthRealm() string
+	GetSessionLifetime() time.Duration
+	GetAuthGracePeriod() time.Duration
+
+	// For the password page of cookie mode
+	authSite() *Site
+	authScope() string
+	GetAuthPrompt() string
+	GetAuthImage() string
 }
 
 type BasePageContext struct {
-	SiteUrl      string
+	SiteUrl string
+	// Where search engines and link previews are sent, which an album's CanonicalUrl can point somewhere else
 	CanonicalUrl string
+	// Where the page's links and forms go, the album's URL on this site, or the site's for pages of no album
+	AlbumUrl string
 
 	MetaTitle string
 	SiteTitle string
+
+	Nav   *Navigation
+	Lang  string
+	Theme *Theme
+
+	// Smaller photos for data saver mode
+	PhotoWidth int
+	Lite       bool
+
+	Site *SiteView
 }
 
 type IndexPageContext struct {
 	*BasePageContext
 
-	Albums []*Album
+	Albums  []*Album
+	OgAlbum *Album // The first album that isn't locked, for the link preview
 }
 
 type ImagePageContext struct {
@@ -39,6 +62,12 @@ type ImagePageContext struct {
 	Photo      Renderable
 	Slug       string
 	AlbumTitle string
+
+	PrintUrl  string
+	OEmbedUrl string
+
+	Album     *AlbumView
+	PhotoView *PhotoView
 }
 
 type AlbumPageContext struct {
@@ -48,35 +77,121 @@ type AlbumPageContext struct {
 
 	Photos                 []Renderable
 	NumImagesToLoadAtStart int
+	GridColumns            *GridColumns
+
+	ContactForm bool
+	ContactSent bool
+
+	ZipDownload bool
+	ZipEmail    bool // Visitors can have the link to their zip emailed to them
+
+	ContactSheetUrl string // Empty for albums without ContactSheet
+	Compare         bool
+
+	OEmbedUrl string
+
+	Visitors int // Unique visitors over the last 30 days, only for albums that show them
+
+	OgPhoto    Renderable // OpenGraph image meta tag
+	OgImageUrl string     // The generated preview with the album's title, used instead of OgPhoto if set
 
-	OgPhoto Renderable // OpenGraph image meta tag
+	Album *AlbumView
 }
 
-func executeTemplateHelper(w io.Writer, templateName string, ctx interface{}) {
-	if DEBUG {
-		tmpl := template.Must(template.ParseFiles(fmt.Sprintf("templates/%s", templateName)))
-		tmpl.Execute(w, ctx)
+func parseTemplates(pattern string) (*template.Template, error) {
+	tmpl, err := template.New("").Funcs(templateFuncs).ParseGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.ParseGlob(filepath.Join(templatesDir, "partials", "*.html"))
+}
+
+var devErrorTemplate = template.Must(template.New("dev-error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>Template error</title></head>
+<body style="font-family: monospace; padding: 20px;">
+    <h1>Unable to render {{.Template}}</h1>
+    <pre style="white-space: pre-wrap; background: #FFEEEE; padding: 10px;">{{.Error}}</pre>
+</body>
+</html>`))
+
+/*
+Templates are rendered to a buffer first, so a failing template results in a proper error response instead of half a
+page. In dev mode the templates are parsed again on every request, and errors are shown in the browser.
+*/
+func renderTemplate(templateName string, ctx interface{}) ([]byte, error) {
+	tmpl := templates
+	if app.devMode {
+		var err error
+		if tmpl, err = parseTemplates(filepath.Join(templatesDir, templateName)); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := renderBuffers.Get().(*bytes.Buffer)
+	defer renderBuffers.Put(buf)
+	buf.Reset()
+
+	if err := tmpl.ExecuteTemplate(buf, templateName, ctx); err != nil {
+		return nil, err
+	}
+	// The buffer goes back to the pool, while the page may be cached
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// Only the error is shown, the page's data has the site's config in it, secrets included
+func writeTemplateError(w http.ResponseWriter, templateName string, err error) {
+	fmt.Printf("Unable to render template %s. Error: %s\n", templateName, err.Error())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	if app.devMode {
+		devErrorTemplate.Execute(w, map[string]interface{}{"Template": templateName, "Error": err.Error()})
 	} else {
-		templates.ExecuteTemplate(w, templateName, ctx)
+		w.Write([]byte("Unable to render page\n"))
+	}
+}
+
+func executeTemplateHelper(w http.ResponseWriter, templateName string, ctx interface{}) {
+	done := serverTimingFromWriter(w).start(TIMING_RENDER)
+	body, err := renderTemplate(templateName, ctx)
+	done("")
+	if err != nil {
+		writeTemplateError(w, templateName, err)
+		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
 }
 
 func handleImagePage(slug string, album *Album, w http.ResponseWriter, r *http.Request) {
 	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
 		return
 	}
-	imgUrl := album.site.GetPhotoForKey(album.BucketPrefix + slug)
+	imgUrl := album.GetPhotoForKey(album.keyForSlug(slug))
+	lite := isLiteRequest(w, r)
 
 	ctx := &ImagePageContext{
 		&BasePageContext{
 			album.site.GetCanonicalUrl().String(),
 			album.GetCanonicalUrl().String(),
+			album.GetSiteUrl().String(),
 			album.MetaTitle,
 			album.site.SiteTitle,
+			album.GetPhotoNavigation(slug),
+			album.site.GetLanguage(),
+			album.GetTheme(),
+			album.site.GetPhotoWidth(lite),
+			lite,
+			newSiteView(album.site),
 		},
 		imgUrl,
 		slug,
 		album.AlbumTitle,
+		album.site.GetPrintUrl(album, slug),
+		album.GetOEmbedUrl(slug),
+		newAlbumView(album, nil, 0),
+		newPhotoView(album, imgUrl, album.site.GetPhotoWidth(lite)),
 	}
 	executeTemplateHelper(w, "photo.html", ctx)
 }
@@ -86,118 +201,254 @@ func handleAlbumPage(album *Album, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if imageUrls, err := album.GetAllPhotos(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
-	} else {
+	recordAlbumVisit(album, r)
+
+	lite, page := isLiteRequest(w, r), "album"
+	if lite {
+		page = "album-lite"
+	}
+
+	renderCachedPage(album, page, w, r, "album.html", func() (interface{}, error) {
+		imageUrls, view, err := album.GetPhotosAndView(r.Context(), album.site.GetPhotoWidth(lite))
+		if err != nil {
+			return nil, err
+		}
+
 		ctx := &AlbumPageContext{
 			&BasePageContext{
 				album.site.GetCanonicalUrl().String(),
 				album.GetCanonicalUrl().String(),
+				album.GetSiteUrl().String(),
 				album.MetaTitle,
 				album.site.SiteTitle,
+				album.GetNavigation(),
+				album.site.GetLanguage(),
+				album.GetTheme(),
+				album.site.GetPhotoWidth(lite),
+				lite,
+				newSiteView(album.site),
 			},
 			album.AlbumTitle,
 			imageUrls,
-			10,
+			album.site.GetEagerPhotos(lite),
+			album.GetGridColumns(),
+			album.HasContactForm(),
+			r.URL.Query().Get("contact") == "sent",
+			album.HasZipDownload(),
+			album.HasZipDownload() && album.site.HasSmtp(),
+			album.GetContactSheetUrl(),
+			album.HasCompare(),
+			album.GetOEmbedUrl(""),
+			album.GetPublicVisitorCount(),
 			nil,
+			"",
+			view,
 		}
-		if coverPhoto, err := album.GetCoverPhoto(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
+		if coverPhoto, err := album.GetCoverPhoto(r.Context()); err != nil {
+			return nil, err
 		} else {
-			ctx.OgPhoto = coverPhoto
+			ctx.OgPhoto, ctx.OgImageUrl = coverPhoto, album.GetOgImageUrl(coverPhoto)
 		}
-		executeTemplateHelper(w, "album.html", ctx)
-	}
+		return ctx, nil
+	})
 }
 
 func handleAlbumsIndex(site *Site, w http.ResponseWriter, r *http.Request) {
+	lite := isLiteRequest(w, r)
 	ctx := &IndexPageContext{
 		&BasePageContext{
+			site.GetCanonicalUrl().String(),
 			site.GetCanonicalUrl().String(),
 			site.GetCanonicalUrl().String(),
 			site.MetaTitle,
 			site.SiteTitle,
+			site.GetNavigation(),
+			site.GetLanguage(),
+			site.GetTheme(),
+			site.GetPhotoWidth(lite),
+			lite,
+			newSiteView(site),
 		},
 
-		site.GetAlbumsForIndex(),
+		site.GetAlbumsForIndexPage(),
+		nil,
+	}
+	if albums := site.GetAlbumsForIndex(); len(albums) > 0 {
+		ctx.OgAlbum = albums[0]
 	}
 
 	executeTemplateHelper(w, "index.html", ctx)
 }
 
 func siteHandler(w http.ResponseWriter, r *http.Request) {
-	domain := r.Host
-	path := r.URL.Path
-
-	if site, err := app.SiteForDomain(domain); err != nil {
+	if site, err := app.SiteForDomain(r.Host); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	} else {
-		if site.HasAlbumIndex && path == "/" {
-			if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
-				return
-			}
-
-			handleAlbumsIndex(site, w, r)
-			return
-		}
-
-		album, err := site.GetAlbumForPath(path)
-		if err != nil {
-			// path isn't an album; see if it's an album + image
-			i := strings.LastIndex(path, "/") + 1
-			albumPath := path[:i]
-			slug := path[i:]
-
-			album, err = site.GetAlbumForPath(albumPath)
-			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(err.Error()))
-				return
-			}
-
-			if album.ImageExists(slug) {
-				handleImagePage(slug, album, w, r)
-				return
-			}
-
-			// Couldn't find the image in this album...just redirect to album
-			http.Redirect(w, r, albumPath, http.StatusMovedPermanently)
-			return
-		}
-		// Redirect to canonical album page (with trailing slash) if necessary
-		if path[len(path)-1] != '/' {
-			http.Redirect(w, r, path+"/", http.StatusMovedPermanently)
-			return
-		}
-		handleAlbumPage(album, w, r)
+		site.router.ServeHTTP(w, r)
 	}
 }
 
 func checkAndRequireAuth(w http.ResponseWriter, r *http.Request, provider AuthCredentialsProvider) bool {
-	if u, p, ok := r.BasicAuth(); !ok || u != provider.GetAuthUser() || subtle.ConstantTimeCompare([]byte(p), []byte(provider.GetAuthPass())) != 1 {
-		w.Header().Set("WWW-Authenticate", `Basic realm="You need a username/password to access this page"`)
+	// Scripts can always use basic auth, even on sites whose visitors log in on the password page
+	cookieMode := provider.authSite().GetAuthMode() == AUTH_MODE_COOKIE
+	u, p, ok := r.BasicAuth()
+	if ok && !checkLoginRateLimit(provider.authSite(), w, r) {
+		return false
+	}
+	if !ok || !checkCredentials(provider, u, p) {
+		if ok {
+			loginRateLimiter.Allow(clientIP(r))
+			recordAuthFailure(r, "user "+u)
+		}
+		if cookieMode && !ok && hasAuthCookie(r, provider) {
+			w.Header().Set("Cache-Control", "private")
+			return true
+		}
+
+		if cookieMode {
+			renderLoginPage(w, r, provider, r.URL.RequestURI(), false)
+			return false
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", provider.GetAuthRealm()))
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Unauthorized\n"))
 		return false
 	}
+	// Keeps password protected pages out of shared caches, and out of the offline cache of sites with OfflineCache
+	w.Header().Set("Cache-Control", "private")
 	return true
 }
 
-func main() {
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	fixtures := flags.String("fixtures", "", "Serve photos from this local directory instead of S3, to preview sites offline")
+	strict := flags.Bool("strict", false, "Refuse to start if any config file has problems, like unknown or deprecated options")
+	flags.Parse(args)
+
+	if *fixtures != "" {
+		if bucket, err := startFixtureBucket(*fixtures); err != nil {
+			fmt.Printf("Unable to use fixtures directory %s. Error: %s\n", *fixtures, err.Error())
+			return 1
+		} else {
+			defer bucket.Close()
+			fixtureBucketUrl = bucket.URL
+			fmt.Printf("Serving photos from %s instead of S3\n", *fixtures)
+		}
+	}
+
+	if tracingEnabled() {
+		if shutdown, err := initTracing(); err != nil {
+			fmt.Printf("Unable to set up tracing. Error: %s\n", err.Error())
+		} else {
+			defer shutdown()
+		}
+	}
+
+	if err := initErrorReporting(); err != nil {
+		fmt.Printf("Unable to set up error reporting. Error: %s\n", err.Error())
+	}
+	defer flushErrorReports()
+
 	app = NewApp()
-	templates = template.Must(template.ParseFiles("templates/album.html"))
+	problems := lintConfig(app.configDir)
+	for _, problem := range problems {
+		fmt.Printf("Config problem: %s\n", problem)
+	}
+	if *strict && len(problems)+len(app.failedConfigs) > 0 {
+		fmt.Printf("Not starting in strict mode, %d config problems and %d config files that couldn't be loaded\n",
+			len(problems), len(app.failedConfigs))
+		return 1
+	}
+	if err := app.openStateDB(); err != nil {
+		fmt.Printf("Unable to open the state database. Error: %s\n", err.Error())
+		return 1
+	}
+	if app.stateDB != nil {
+		defer app.stateDB.Close()
+	}
+	recordAuditEvent(&AuditEvent{Action: AUDIT_CONFIG_LOAD, Detail: fmt.Sprintf("%d sites from %s", len(app.sites), app.configDir)})
+	if err := loadTranslations("translations"); err != nil {
+		fmt.Printf("Unable to load translations. Error: %s\n", err.Error())
+	}
+	// Before announcing, so albums waiting to be published aren't announced early
+	if err := scheduler.Load(); err != nil {
+		fmt.Printf("Unable to load the album schedule. Error: %s\n", err.Error())
+	}
+	go scheduler.RunEvery(SCHEDULE_TICK_INTERVAL)
+	go app.PollBucketChanges(CHANGE_POLL_TICK)
+	// Fixture albums aren't real, so they shouldn't be announced to anyone
+	if fixtureBucketUrl == "" {
+		go app.AnnounceNewAlbums()
+	}
+
+	jobQueue.Start(JOB_WORKERS)
+
+	if err := quotas.Load(); err != nil {
+		fmt.Printf("Unable to load quota usage. Error: %s\n", err.Error())
+	}
+	go quotas.SaveEvery(QUOTA_SAVE_INTERVAL)
+
+	if err := visitors.Load(); err != nil {
+		fmt.Printf("Unable to load visitor counts. Error: %s\n", err.Error())
+	}
+	go visitors.SaveEvery(VISITORS_SAVE_INTERVAL)
+
+	if err := guestUploads.Load(); err != nil {
+		fmt.Printf("Unable to load guest upload usage. Error: %s\n", err.Error())
+	}
+	go guestUploads.SaveEvery(GUEST_UPLOAD_SAVE_INTERVAL)
+
+	if err := downloads.Load(); err != nil {
+		fmt.Printf("Unable to load download counts. Error: %s\n", err.Error())
+	}
+	go downloads.SaveEvery(DOWNLOADS_SAVE_INTERVAL)
+
+	if err := restores.Load(); err != nil {
+		fmt.Printf("Unable to load restore requests. Error: %s\n", err.Error())
+	}
+
+	if err := sessionSecrets.Load(); err != nil {
+		fmt.Printf("Unable to load session keys. Error: %s\n", err.Error())
+	}
+
+	if addr := os.Getenv(METRICS_ADDR_ENV_VAR); addr != "" {
+		go serveMetrics(addr)
+	}
+	templatesDir = templatesDirFromEnv()
+	for _, warning := range checkTemplateAPIVersion(templatesDir) {
+		fmt.Printf("Template problem: %s\n", warning)
+	}
+	var err error
+	if templates, err = parseTemplates(filepath.Join(templatesDir, "*.html")); err != nil {
+		fmt.Printf("Unable to parse templates in %s. Error: %s\n", templatesDir, err.Error())
+		return 1
+	}
+	if auditLogTemplate, err = template.ParseFiles(filepath.Join(templatesDir, "admin", "audit.html")); err != nil {
+		fmt.Printf("Unable to parse the audit log template in %s. Error: %s\n", templatesDir, err.Error())
+		return 1
+	}
+	loadAssets()
+	if app.devMode {
+		fmt.Println("Running in dev mode. Templates are reloaded on every request and caches are disabled.")
+	}
 
 	http.HandleFunc("/", siteHandler)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
+	http.Handle(ADMIN_PATH_PREFIX, NewAdminHandler())
+	http.Handle(STATIC_PATH, assets.Handler(STATIC_DIR))
+
+	// Before listening, so the first visitors get warm albums
+	app.PrefetchAlbums(prefetchSettingsFromEnv())
 
 	fmt.Printf("Starting server at port %s\n", app.port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", app.port), nil); err != nil {
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", app.port), requestIDMiddleware(http.DefaultServeMux)); err != nil {
 		fmt.Printf("Unable to start server. Error: %s\n", err.Error())
+		return 1
 	}
+	return 0
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:]))
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Machine readable endpoints for scripts, which need the site's ApiToken
+const API_ALBUMS_PATH = "/api/v1/albums"
+const MANIFEST_SLUG = "manifest"
+
+// Long enough for a backup script to get through a big album
+const MANIFEST_URL_LIFETIME = 24 * time.Hour
+
+type ManifestObject struct {
+	Key          string    `json:"key"`
+	Slug         string    `json:"slug"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+	Url          string    `json:"url"`
+}
+
+type AlbumManifest struct {
+	Album      string            `json:"album"`
+	Generated  time.Time         `json:"generated"`
+	UrlsExpire time.Time         `json:"urls_expire"`
+	Objects    []*ManifestObject `json:"objects"`
+}
+
+// The path of an album's manifest, like /api/v1/albums/travel/2024/manifest
+func (a *Album) GetManifestPath() string {
+	return API_ALBUMS_PATH + a.Path + MANIFEST_SLUG
+}
+
+// Takes the token as a bearer token, or as the password of basic auth for tools that only do that
+func checkApiToken(r *http.Request, site *Site) bool {
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else if _, p, ok := r.BasicAuth(); ok {
+		token = p
+	}
+	return site.ApiToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(site.ApiToken)) == 1
+}
+
+/*
+Lists every file in the album, including Live Photo videos, RAW files and sidecars, with presigned URLs to download them
+from the bucket. Backup scripts can mirror an album with it, using the ETags to skip files they already have, without
+needing credentials for the bucket.
+*/
+func handleAlbumManifest(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !checkApiToken(r, album.site) {
+		if r.Header.Get("Authorization") != "" {
+			recordAuthFailure(r, "api")
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="50mm api"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized\n"))
+		return
+	}
+
+	objects, err := album.GetAllObjects(r.Context())
+	if err != nil {
+		reportError("list objects for manifest", err, albumErrorContext(album))
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Unable to list the album's objects\n"))
+		return
+	}
+
+	now := time.Now().UTC()
+	manifest := &AlbumManifest{Album: album.Path, Generated: now, UrlsExpire: now.Add(MANIFEST_URL_LIFETIME), Objects: []*ManifestObject{}}
+	for _, obj := range objects {
+		if strings.HasSuffix(*obj.Key, "/") {
+			continue
+		}
+
+		photo := &S3Photo{photoInfo{}, *obj.Key, album.site.BucketName, album.site.awsSession, MANIFEST_URL_LIFETIME}
+		manifest.Objects = append(manifest.Objects, &ManifestObject{
+			Key:          *obj.Key,
+			Slug:         fileSlug(*obj.Key),
+			Size:         aws.Int64Value(obj.Size),
+			ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+			LastModified: aws.TimeValue(obj.LastModified).UTC(),
+			Url:          photo.GetPhotoForWidth(0),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := json.NewEncoder(w).Encode(manifest); err != nil {
+		fmt.Printf("Unable to write album manifest. Error: %s\n", err.Error())
+	}
+}
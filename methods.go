@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Methods OPTIONS asks the router about. HEAD goes along with GET, which ServeMux does too.
+var routeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// Browsers may cache a preflight for this long, in seconds
+const PREFLIGHT_MAX_AGE = 86400
+
+/*
+Holds back the status of HEAD responses until the handler is done, counting the body it would have written instead of
+sending it. That way a HEAD gets the Content-Length of the GET, even for pages too big for net/http to work it out.
+Handlers that set a Content-Length themselves, like the photo proxy, keep theirs.
+*/
+type headResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *headResponseWriter) WriteHeader(status int) {
+	// Informational responses like 103 Early Hints go out straight away, they don't end the response
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.written += int64(len(b))
+	return len(b), nil
+}
+
+// Nothing is sent before the handler is done
+func (w *headResponseWriter) Flush() {}
+
+func (w *headResponseWriter) finish() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if w.written > 0 && h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		h.Set("Content-Length", strconv.FormatInt(w.written, 10))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *headResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// The methods the mux has a route for at the request's path. Catch-all routes without a method, like LenientUrls, don't count.
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); strings.HasPrefix(pattern, method+" ") {
+			allowed = append(allowed, method)
+			if method == http.MethodGet {
+				allowed = append(allowed, http.MethodHead)
+			}
+		}
+	}
+	if len(allowed) > 0 {
+		allowed = append(allowed, http.MethodOptions)
+	}
+	return allowed
+}
+
+/*
+Answers OPTIONS with the methods the path has routes for, and HEAD with the headers of a GET. CORS preflights are let
+through for reading only: they never carry credentials, and POSTs from other sites stay blocked. Whether the response
+can then be read is still up to the route, only a few, like oEmbed, allow any origin. OPTIONS is only answered once
+check, if there is one, lets the request through; it writes the response itself otherwise.
+*/
+func methodsMiddleware(mux *http.ServeMux, check func(w http.ResponseWriter, r *http.Request) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodOptions:
+				allowed := allowedMethods(mux, r)
+				if len(allowed) == 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if check != nil && !check(w, r) {
+					return
+				}
+				w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+				requested := r.Header.Get("Access-Control-Request-Method")
+				if r.Header.Get("Origin") != "" && (requested == http.MethodGet || requested == http.MethodHead) {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+					w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+					if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+						w.Header().Set("Access-Control-Allow-Headers", headers)
+					}
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(PREFLIGHT_MAX_AGE))
+				}
+				w.WriteHeader(http.StatusNoContent)
+
+			case http.MethodHead:
+				hw := &headResponseWriter{ResponseWriter: w}
+				defer hw.finish()
+				next.ServeHTTP(hw, r)
+
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const METRICS_ADDR_ENV_VAR = "FIFTYMM_METRICS_ADDR"
+
+/*
+A tiny metrics registry that writes the Prometheus text format. We only need counters and gauges with a handful of
+labels, which doesn't justify pulling in the full Prometheus client.
+*/
+type Metrics struct {
+	mutex  sync.Mutex
+	help   map[string]string
+	kinds  map[string]string
+	values map[string]map[string]float64
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		help:   make(map[string]string),
+		kinds:  make(map[string]string),
+		values: make(map[string]map[string]float64),
+	}
+}
+
+func (m *Metrics) register(name, kind, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.help[name] = help
+	m.kinds[name] = kind
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+}
+
+func (m *Metrics) RegisterCounter(name, help string) {
+	m.register(name, "counter", help)
+}
+
+func (m *Metrics) RegisterGauge(name, help string) {
+	m.register(name, "gauge", help)
+}
+
+// Labels are given as name/value pairs, e.g. metrics.Add("requests_total", 1, "site", "example.com")
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if series, ok := m.values[name]; ok {
+		series[formatLabels(labels)] += v
+	}
+}
+
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if series, ok := m.values[name]; ok {
+		series[formatLabels(labels)] = v
+	}
+}
+
+func (m *Metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help[name])
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kinds[name])
+
+		series := make([]string, 0, len(m.values[name]))
+		for labels := range m.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %v\n", name, labels, m.values[name][labels])
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
+
+// Metrics are served on their own listener, so they're never exposed on the public site domains by accident
+func serveMetrics(addr string) {
+	fmt.Printf("Serving metrics at %s\n", addr)
+	if err := http.ListenAndServe(addr, metrics); err != nil {
+		fmt.Printf("Unable to serve metrics. Error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DEFAULT_RATE_LIMIT = 600 // requests per minute per client
+
+/*
+Middleware that can be turned on per site with the Middleware option. Each constructor gets the site, so middleware can
+read its own settings from the site config.
+*/
+var middlewareRegistry = map[string]func(*Site) Middleware{
+	"logging":         loggingMiddleware,
+	"auth":            authMiddleware,
+	"ratelimit":       rateLimitMiddleware,
+	"compression":     compressionMiddleware,
+	"securityheaders": securityHeadersMiddleware,
+	"metrics":         metricsMiddleware,
+	"servertiming":    serverTimingMiddleware,
+}
+
+func init() {
+	metrics.RegisterCounter("fiftymm_http_requests_total", "Number of HTTP requests served, by site and status code.")
+	metrics.RegisterCounter("fiftymm_http_request_duration_seconds_total", "Total time spent serving HTTP requests, by site.")
+	metrics.RegisterCounter("fiftymm_http_rate_limited_total", "Number of HTTP requests rejected by the rate limiter, by site.")
+}
+
+func (s *Site) buildMiddleware() ([]Middleware, error) {
+	var chain []Middleware
+	for _, name := range s.Middleware {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if constructor, ok := middlewareRegistry[name]; !ok {
+			return nil, fmt.Errorf("Unknown middleware '%s'", name)
+		} else {
+			chain = append(chain, constructor(s))
+		}
+	}
+	return chain, nil
+}
+
+// Wraps a ResponseWriter to remember the status code and the number of bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func recordStatus(w http.ResponseWriter) *statusRecorder {
+	if rec, ok := w.(*statusRecorder); ok {
+		return rec
+	}
+	return &statusRecorder{ResponseWriter: w}
+}
+
+func loggingMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := recordStatus(w)
+			next.ServeHTTP(rec, r)
+
+			fmt.Printf("%s %s %s %s %d %d %s %s\n", clientIP(r), site.Domain, r.Method, r.URL.RequestURI(), rec.status, rec.bytes,
+				time.Now().Sub(start), firstNonEmpty(requestID(r), "-"))
+		})
+	}
+}
+
+// Requires the site credentials for every page, including ones that are normally public like oEmbed
+func authMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The password page's form has to get through to log in
+			isLogin := r.Method == http.MethodPost && r.URL.Path == LOGIN_PATH
+			if site.HasAuth() && !isLogin && !checkAndRequireAuth(w, r, site) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rateLimitMiddleware(site *Site) Middleware {
+	limit := site.RateLimit
+	if limit <= 0 {
+		limit = DEFAULT_RATE_LIMIT
+	}
+	limiter := NewRateLimiter(limit, 1*time.Minute)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Allow(clientIP(r)) {
+				metrics.Add("fiftymm_http_rate_limited_total", 1, site.metricLabels()...)
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("Too many requests\n"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func securityHeadersMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			// Pages that are meant to be embedded (like the album embed) remove this again
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+			if site.CanonicalSecure {
+				h.Set("Strict-Transport-Security", "max-age=31536000")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func metricsMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := recordStatus(w)
+			next.ServeHTTP(rec, r)
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			metrics.Add("fiftymm_http_requests_total", 1, site.metricLabels("code", fmt.Sprint(rec.status))...)
+			metrics.Add("fiftymm_http_request_duration_seconds_total", time.Now().Sub(start).Seconds(), site.metricLabels()...)
+		})
+	}
+}
+
+/*
+Gzips text responses (HTML, CSS, JS, JSON...) for clients that accept it. Images are already compressed, so they're
+passed through untouched. The decision is made when the handler writes the headers, once the content type is known.
+*/
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "javascript") || strings.Contains(contentType, "xml")
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	h := g.Header()
+	if h.Get("Content-Encoding") == "" && status != http.StatusNoContent && status != http.StatusNotModified && isCompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+func compressionMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.Close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	MIGRATE_FROM_PIWIGO      = "piwigo"
+	MIGRATE_FROM_LYCHEE      = "lychee"
+	MIGRATE_FROM_PHOTOPRISM  = "photoprism-export"
+	MIGRATE_ORDER_KEY_FORMAT = "%04d-%s"
+)
+
+var migrateSlugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// An album found in another gallery's export, with its photos in the order that gallery showed them
+type migratedAlbum struct {
+	Path        string
+	Title       string
+	Description string
+	Photos      []string // Local file paths
+
+	dir string // The album's folder, for exports where albums are folders
+}
+
+// PhotoPrism's album backups, from storage/albums/album/*.yml
+type photoprismAlbum struct {
+	UID         string `yaml:"UID"`
+	Title       string `yaml:"Title"`
+	Description string `yaml:"Description"`
+	Order       string `yaml:"Order"`
+	DeletedAt   string `yaml:"DeletedAt"`
+	Photos      []struct {
+		UID       string `yaml:"UID"`
+		DeletedAt string `yaml:"DeletedAt"`
+	} `yaml:"Photos"`
+}
+
+// PhotoPrism's sidecar files, from storage/sidecar, which sit at the same relative path as their originals
+type photoprismPhoto struct {
+	UID     string    `yaml:"UID"`
+	Title   string    `yaml:"Title"`
+	TakenAt time.Time `yaml:"TakenAt"`
+
+	original string
+}
+
+func migrateSlug(title string) string {
+	return strings.Trim(migrateSlugInvalidChars.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
+
+func isImageFile(path string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+	contentType, err := detectContentType(path)
+	return err == nil && strings.HasPrefix(contentType, "image/")
+}
+
+/*
+Reads a folder tree where every folder is an album named after the folder, and sub folders are nested albums. That's
+the layout of Piwigo's galleries folder and of Lychee's album downloads. Neither keeps descriptions or ordering in
+files, so photos keep their name order, unless they come from a dump of Piwigo's database, see applyPiwigoDump.
+*/
+func readFolderTreeExport(root string) ([]*migratedAlbum, error) {
+	var albums []*migratedAlbum
+	var walk func(dir, path string) error
+	walk = func(dir, path string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		album := &migratedAlbum{Path: path, Title: filepath.Base(dir), dir: dir}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			full := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				// Piwigo keeps its generated thumbnails in these
+				if entry.Name() == "thumbnail" || entry.Name() == "pwg_high" || entry.Name() == "pwg_representative" {
+					continue
+				}
+				if slug := migrateSlug(entry.Name()); slug != "" {
+					if err := walk(full, path+slug+"/"); err != nil {
+						return err
+					}
+				}
+			} else if isImageFile(full) {
+				album.Photos = append(album.Photos, full)
+			}
+		}
+
+		if len(album.Photos) > 0 {
+			albums = append(albums, album)
+		}
+		return nil
+	}
+
+	if err := walk(root, "/"); err != nil {
+		return nil, err
+	}
+	// Photos at the top level have no album to go in
+	for _, album := range albums {
+		if album.Path == "/" {
+			return nil, fmt.Errorf("Found photos directly in %s, they need to be in album folders", root)
+		}
+	}
+	return albums, nil
+}
+
+// Finds the original a sidecar file belongs to. Sidecars replace the original's extension with .yml.
+func findPhotoprismOriginal(originals, sidecar, sidecarDir string) string {
+	rel, err := filepath.Rel(sidecarDir, strings.TrimSuffix(sidecar, filepath.Ext(sidecar)))
+	if err != nil {
+		return ""
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(originals, rel) + ".*")
+	sort.Strings(matches)
+	for _, match := range matches {
+		if isImageFile(match) {
+			return match
+		}
+	}
+	return ""
+}
+
+/*
+Reads a PhotoPrism export: its originals and storage folders, side by side. Albums come from the album backups, and
+their photos are matched to the originals through the sidecar files.
+*/
+func readPhotoprismExport(root string) ([]*migratedAlbum, error) {
+	originals, sidecarDir := filepath.Join(root, "originals"), filepath.Join(root, "storage", "sidecar")
+
+	photos := make(map[string]*photoprismPhoto)
+	err := filepath.WalkDir(sidecarDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(path) != ".yml" {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		photo := &photoprismPhoto{}
+		if err := yaml.Unmarshal(data, photo); err != nil {
+			return fmt.Errorf("Unable to parse %s. Error: %s", path, err.Error())
+		}
+		if photo.UID == "" {
+			return nil
+		}
+		if photo.original = findPhotoprismOriginal(originals, path, sidecarDir); photo.original != "" {
+			photos[photo.UID] = photo
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := filepath.Glob(filepath.Join(root, "storage", "albums", "album", "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("No album backups found in %s", filepath.Join(root, "storage", "albums", "album"))
+	}
+	sort.Strings(backups)
+
+	var albums []*migratedAlbum
+	seenPaths := make(map[string]int)
+	for _, backup := range backups {
+		data, err := os.ReadFile(backup)
+		if err != nil {
+			return nil, err
+		}
+		pa := &photoprismAlbum{}
+		if err := yaml.Unmarshal(data, pa); err != nil {
+			return nil, fmt.Errorf("Unable to parse %s. Error: %s", backup, err.Error())
+		}
+		if pa.DeletedAt != "" {
+			continue
+		}
+
+		var albumPhotos []*photoprismPhoto
+		for _, p := range pa.Photos {
+			if photo, ok := photos[p.UID]; ok && p.DeletedAt == "" {
+				albumPhotos = append(albumPhotos, photo)
+			} else if !ok {
+				fmt.Printf("Skipping photo %s in album %s, its original wasn't found\n", p.UID, pa.Title)
+			}
+		}
+		if len(albumPhotos) == 0 {
+			continue
+		}
+
+		// Anything else, like "added" or "relevance", keeps the order of the backup
+		switch pa.Order {
+		case "oldest":
+			sort.SliceStable(albumPhotos, func(i, j int) bool { return albumPhotos[i].TakenAt.Before(albumPhotos[j].TakenAt) })
+		case "newest":
+			sort.SliceStable(albumPhotos, func(i, j int) bool { return albumPhotos[i].TakenAt.After(albumPhotos[j].TakenAt) })
+		case "name":
+			sort.SliceStable(albumPhotos, func(i, j int) bool { return albumPhotos[i].original < albumPhotos[j].original })
+		case "title":
+			sort.SliceStable(albumPhotos, func(i, j int) bool { return albumPhotos[i].Title < albumPhotos[j].Title })
+		}
+
+		slug := migrateSlug(pa.Title)
+		if slug == "" {
+			slug = strings.ToLower(pa.UID)
+		}
+		if seenPaths[slug]++; seenPaths[slug] > 1 {
+			slug = fmt.Sprintf("%s-%d", slug, seenPaths[slug])
+		}
+
+		album := &migratedAlbum{Path: "/" + slug + "/", Title: pa.Title, Description: pa.Description}
+		for _, photo := range albumPhotos {
+			album.Photos = append(album.Photos, photo.original)
+		}
+		albums = append(albums, album)
+	}
+	return albums, nil
+}
+
+/*
+Unpacks a zip file, like a Lychee album download, into a folder named after it in a temporary folder. That way photos
+at the top level of the zip still end up in an album.
+*/
+func extractZip(path string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	tmp, err := os.MkdirTemp("", "50mm-migrate-")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(tmp, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	for _, f := range r.File {
+		target := filepath.Join(dir, f.Name)
+		// Entries like ../../etc/passwd would be written outside the folder
+		if !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return tmp, fmt.Errorf("Invalid file name %s in %s", f.Name, path)
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return tmp, err
+		}
+
+		src, err := f.Open()
+		if err != nil {
+			return tmp, err
+		}
+		dst, err := os.Create(target)
+		if err != nil {
+			src.Close()
+			return tmp, err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		dst.Close()
+		if err != nil {
+			return tmp, err
+		}
+	}
+	return tmp, nil
+}
+
+func readMigrationExport(from, path string) ([]*migratedAlbum, error) {
+	switch from {
+	case MIGRATE_FROM_PIWIGO, MIGRATE_FROM_LYCHEE:
+		return readFolderTreeExport(path)
+	case MIGRATE_FROM_PHOTOPRISM:
+		return readPhotoprismExport(path)
+	}
+	return nil, fmt.Errorf("Unknown export format '%s', use %s, %s or %s", from, MIGRATE_FROM_PIWIGO, MIGRATE_FROM_LYCHEE,
+		MIGRATE_FROM_PHOTOPRISM)
+}
+
+/*
+Works out the bucket keys for an album's photos. Albums show photos in key order, so if the export's order isn't the
+name order (or names clash), every key gets a sequence number in front.
+*/
+func migratedAlbumFiles(album *Album, ma *migratedAlbum) []*importFile {
+	numbered := false
+	seen := make(map[string]bool)
+	for i, photo := range ma.Photos {
+		name := filepath.Base(photo)
+		if seen[name] || (i > 0 && name < filepath.Base(ma.Photos[i-1])) {
+			numbered = true
+		}
+		seen[name] = true
+	}
+
+	var files []*importFile
+	for i, photo := range ma.Photos {
+		name := filepath.Base(photo)
+		if numbered {
+			name = fmt.Sprintf(MIGRATE_ORDER_KEY_FORMAT, i+1, name)
+		}
+		contentType, _ := detectContentType(photo)
+		files = append(files, &importFile{photo, albumObjectKey(album, name), contentType})
+	}
+	return files
+}
+
+// Writes an album config section, in the same form as the README's examples
+func writeMigratedAlbumConfig(w io.Writer, album *Album, ma *migratedAlbum, sectionName string) {
+	fmt.Fprintf(w, "[%s]\n", sectionName)
+	fmt.Fprintf(w, "Path = %s\n", iniValue(album.Path))
+	fmt.Fprintf(w, "BucketPrefix = %s\n", iniValue(album.BucketPrefix))
+	fmt.Fprintf(w, "MetaTitle = %s\n", iniValue(album.MetaTitle))
+	fmt.Fprintf(w, "AlbumTitle = %s\n", iniValue(album.AlbumTitle))
+	if description := strings.TrimSpace(ma.Description); description != "" {
+		fmt.Fprintf(w, "Description = %s\n", iniValue(description))
+	}
+	fmt.Fprintln(w)
+}
+
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "Gallery the export comes from: piwigo, lychee or photoprism-export")
+	domain := flags.String("site", "", "Domain of the site to migrate to, if more than one site is configured")
+	out := flags.String("out", "", "Write the album config sections to this file instead of printing them")
+	dryRun := flags.Bool("dry-run", false, "Only show the config and what would be uploaded")
+	concurrency := flags.Int("concurrency", 4, "Number of photos to upload at the same time")
+	fixtures := flags.String("fixtures", "", "Upload to this local directory, as read by 'serve -fixtures', instead of S3")
+	piwigoDB := flags.String("piwigo-db", "", "mysqldump of Piwigo's database, for album titles, descriptions and photo order")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: 50mm migrate -from piwigo|lychee|photoprism-export <path> [flags]\n\n")
+		flags.PrintDefaults()
+	}
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) != 1 || *from == "" || *concurrency < 1 || (*piwigoDB != "" && *from != MIGRATE_FROM_PIWIGO) {
+		flags.Usage()
+		return 2
+	}
+
+	app = NewApp()
+	site, err := findSite(*domain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	exportPath := positional[0]
+	if *from == MIGRATE_FROM_LYCHEE && strings.EqualFold(filepath.Ext(exportPath), ".zip") {
+		tmp, err := extractZip(exportPath)
+		if tmp != "" {
+			defer os.RemoveAll(tmp)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to unzip %s. Error: %s\n", exportPath, err.Error())
+			return 1
+		}
+		exportPath = tmp
+	}
+
+	migrated, err := readMigrationExport(*from, exportPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s. Error: %s\n", positional[0], err.Error())
+		return 1
+	}
+	if *piwigoDB != "" {
+		if err := applyPiwigoDump(migrated, exportPath, *piwigoDB); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s. Error: %s\n", *piwigoDB, err.Error())
+			return 1
+		}
+	}
+	if len(migrated) == 0 {
+		fmt.Printf("No albums found in %s\n", positional[0])
+		return 0
+	}
+
+	type plannedAlbum struct {
+		album   *Album
+		storage AlbumStorage
+		uploads []*importFile
+	}
+	var planned []*plannedAlbum
+	var config bytes.Buffer
+	ctx, sections := context.Background(), make(map[string]bool)
+	for _, ma := range migrated {
+		if existing, _ := site.GetAlbumForPath(ma.Path); existing != nil {
+			fmt.Printf("Skipping %s, %s already has an album at %s\n", ma.Title, site.Domain, ma.Path)
+			continue
+		}
+
+		metaTitle := ma.Title
+		if site.SiteTitle != "" {
+			metaTitle = fmt.Sprintf("%s | %s", ma.Title, site.SiteTitle)
+		}
+		album, err := NewAlbum(site, ma.Path, strings.TrimPrefix(ma.Path, "/"), "", "", metaTitle, ma.Title)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to migrate %s. Error: %s\n", ma.Title, err.Error())
+			return 1
+		}
+
+		// Section names only need to be unique, titles can repeat in nested albums
+		sectionName := ma.Title
+		if sections[sectionName] || strings.ContainsAny(sectionName, "[]") {
+			sectionName = ma.Path
+		}
+		sections[sectionName] = true
+		writeMigratedAlbumConfig(&config, album, ma, sectionName)
+
+		storage, err := newAlbumStorage(album, *fixtures)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to use fixtures directory %s. Error: %s\n", *fixtures, err.Error())
+			return 1
+		}
+		uploads, _, err := planSync(ctx, storage, migratedAlbumFiles(album, ma))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		planned = append(planned, &plannedAlbum{album, storage, uploads})
+	}
+
+	status := 0
+	for _, p := range planned {
+		switch {
+		case len(p.uploads) == 0:
+			fmt.Printf("%s is up to date\n", p.storage.Location())
+		case *dryRun:
+			for _, file := range p.uploads {
+				fmt.Printf("Would upload %s\n", file.key)
+			}
+		default:
+			if failed := uploadImportFiles(p.storage, p.uploads, &importOptions{*concurrency, 0, site.GetColorProfile()}); failed > 0 {
+				fmt.Fprintf(os.Stderr, "%d of %d photos in %s failed to upload\n", failed, len(p.uploads), p.album.Path)
+				status = 1
+			}
+		}
+	}
+
+	// The server only knows about the albums once their config is added, so there's no album cache to refresh
+	if *out == "" {
+		fmt.Printf("\nAdd these albums to %s's config file and restart the server:\n\n%s", site.Domain, config.String())
+	} else if err := os.WriteFile(*out, config.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s. Error: %s\n", *out, err.Error())
+		return 1
+	} else {
+		fmt.Printf("Wrote %d album config sections to %s, add them to %s's config file and restart the server\n", len(planned), *out, site.Domain)
+	}
+	return status
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type NavLink struct {
+	Title string
+	Url   string
+}
+
+type Navigation struct {
+	// Link back to the album index, empty if the site doesn't have one
+	IndexUrl string
+
+	Breadcrumbs []*NavLink
+	Links       []*NavLink
+
+	// Only on pages behind a password
+	LogoutUrl string
+}
+
+/*
+Parses the NavLinks site option. Links are comma separated, and each link is a title and URL separated by a '|', e.g.
+`NavLinks = About|https://example.com/about, Prints|https://prints.example.com`
+*/
+func parseNavLinks(links []string) ([]*NavLink, error) {
+	var navLinks []*NavLink
+	for _, l := range links {
+		parts := strings.SplitN(l, "|", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid NavLinks entry '%s'. Links must be in the form Title|URL", l)
+		}
+
+		navLinks = append(navLinks, &NavLink{
+			strings.TrimSpace(parts[0]),
+			strings.TrimSpace(parts[1]),
+		})
+	}
+
+	return navLinks, nil
+}
+
+func (s *Site) GetNavigation(breadcrumbs ...*NavLink) *Navigation {
+	nav := &Navigation{
+		Breadcrumbs: append([]*NavLink{{s.SiteTitle, s.GetCanonicalUrl().String()}}, breadcrumbs...),
+		Links:       s.navLinks,
+	}
+
+	if s.HasAlbumIndex {
+		nav.IndexUrl = s.GetCanonicalUrl().String()
+	}
+	if s.HasAuth() {
+		nav.LogoutUrl = getLogoutUrl("/")
+	}
+
+	return nav
+}
+
+// Breadcrumbs for an album include any albums configured at parent paths, so /travel/2024/ is shown under /travel/
+func (a *Album) GetBreadcrumbs() []*NavLink {
+	var crumbs []*NavLink
+
+	parts := strings.Split(strings.Trim(a.Path, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		parentPath := "/" + strings.Join(parts[:i], "/") + "/"
+		if parent, err := a.site.GetAlbumForPath(parentPath); err == nil {
+			crumbs = append(crumbs, &NavLink{parent.AlbumTitle, parent.GetPageUrl()})
+		}
+	}
+
+	if a.Path != "/" {
+		crumbs = append(crumbs, &NavLink{a.AlbumTitle, a.GetPageUrl()})
+	}
+
+	return crumbs
+}
+
+func (a *Album) GetNavigation() *Navigation {
+	return a.withLogout(a.site.GetNavigation(a.GetBreadcrumbs()...))
+}
+
+func (a *Album) withLogout(nav *Navigation) *Navigation {
+	if a.HasAuth() {
+		nav.LogoutUrl = getLogoutUrl(a.pagePath())
+	}
+	return nav
+}
+
+func (a *Album) GetPhotoNavigation(slug string) *Navigation {
+	crumbs := a.GetBreadcrumbs()
+	if len(crumbs) == 0 {
+		// Albums at the site root don't get a crumb of their own, so link to the album from the site title instead
+		crumbs = append(crumbs, &NavLink{a.AlbumTitle, a.GetPageUrl()})
+	}
+
+	return a.withLogout(a.site.GetNavigation(append(crumbs, &NavLink{slug, a.GetSiteUrl().String() + slug})...))
+}
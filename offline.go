@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+// Service workers can only look after pages at or below their own URL, so this one lives at the root of the site
+const SERVICE_WORKER_PATH = "/sw.js"
+
+func handleServiceWorker(site *Site, w http.ResponseWriter, r *http.Request) {
+	// Browsers check for a new version on every visit anyway, but shouldn't keep an old one around for a day first
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	http.ServeFile(w, r, filepath.Join(STATIC_DIR, "sw.js"))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const OG_IMAGE_SLUG = "og.jpg"
+
+// The size Facebook, LinkedIn and most chat apps show link previews at, 1.91 to 1
+const OG_IMAGE_WIDTH = 1200
+const OG_IMAGE_HEIGHT = 630
+
+// Bumped whenever the layout changes, so previews are made again
+const DERIVATIVE_OG_IMAGE = "og-1200x630-v1"
+
+const OG_IMAGE_MARGIN = 64
+const OG_IMAGE_TITLE_SIZE = 64
+const OG_IMAGE_SITE_SIZE = 30
+const OG_IMAGE_TITLE_LINES = 2
+
+/*
+Previews are stored by the cover's ETag like other derivatives, and the text on them goes into the kind, so renaming the
+album or the site makes a new one.
+*/
+func (a *Album) ogImageKind() string {
+	h := fnv.New32a()
+	h.Write([]byte(a.AlbumTitle + "\x00" + a.site.SiteTitle))
+	return fmt.Sprintf("%s-%08x", DERIVATIVE_OG_IMAGE, h.Sum32())
+}
+
+// The URL of the album's generated link preview, or "" if it doesn't have one and link previews show the cover as is
+func (a *Album) GetOgImageUrl(cover Renderable) string {
+	if !a.OgImage || cover.Slug() == "" || !hasExtension(a.keyForSlug(cover.Slug()), downscalableExtensions) {
+		return ""
+	}
+	return a.GetSiteUrl().String() + OG_IMAGE_SLUG
+}
+
+// Scales and crops a photo to fill the preview, turned the right way up first
+func coverCrop(src image.Image, orientation int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	orientedW, orientedH := w, h
+	if orientation >= 5 && orientation <= 8 {
+		orientedW, orientedH = h, w
+	}
+
+	scale := max(float64(OG_IMAGE_WIDTH)/float64(orientedW), float64(OG_IMAGE_HEIGHT)/float64(orientedH))
+	scaled := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+	oriented := orientImage(scaled, orientation)
+
+	dst := image.NewRGBA(image.Rect(0, 0, OG_IMAGE_WIDTH, OG_IMAGE_HEIGHT))
+	offset := image.Pt((oriented.Bounds().Dx()-OG_IMAGE_WIDTH)/2, (oriented.Bounds().Dy()-OG_IMAGE_HEIGHT)/2)
+	draw.Draw(dst, dst.Bounds(), oriented, offset, draw.Src)
+	return dst
+}
+
+// Darkens the bottom of the preview, so white text stays readable on light photos
+func darkenBottom(img *image.RGBA, from int) {
+	height := img.Bounds().Dy()
+	for y := from; y < height; y++ {
+		// From no shade at all to 75% black at the bottom edge
+		shade := 0.75 * float64(y-from) / float64(height-from)
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			i := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				img.Pix[i+c] = uint8(float64(img.Pix[i+c]) * (1 - shade))
+			}
+		}
+	}
+}
+
+// Breaks text into lines that fit the width, with an ellipsis on the last line if it doesn't all fit
+func wrapText(face font.Face, text string, width fixed.Int26_6, maxLines int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := strings.TrimSpace(line + " " + word)
+		if line != "" && font.MeasureString(face, candidate) > width {
+			lines = append(lines, line)
+			line = word
+		} else {
+			line = candidate
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) <= maxLines {
+		return lines
+	}
+
+	lines = lines[:maxLines]
+	last := []rune(lines[maxLines-1])
+	for len(last) > 0 && font.MeasureString(face, string(last)+"…") > width {
+		last = last[:len(last)-1]
+	}
+	lines[maxLines-1] = strings.TrimSpace(string(last)) + "…"
+	return lines
+}
+
+func newFace(ttf []byte, size float64) (font.Face, error) {
+	f, err := opentype.Parse(ttf)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+/*
+Makes the album's link preview: its cover photo cropped to 1200×630, with the album's title and the site's name over a
+shade at the bottom. Previews have no color profile, so Display P3 covers are converted to sRGB. Covers that are too big
+or can't be decoded get an empty preview, which is stored like any other, so they aren't tried again on every request.
+*/
+func (a *Album) buildOgImage(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	var err error
+	if a.BlurFaces {
+		data, err = a.GetDerivative(ctx, DERIVATIVE_BLURRED_FACES, key, func(ctx context.Context) ([]byte, error) {
+			return a.buildBlurredPhoto(ctx, key)
+		})
+	} else {
+		data, err = a.getObjectData(ctx, key)
+	}
+	if err == errObjectTooLarge {
+		return []byte{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// A timeout may only mean the server was busy, so that one is tried again
+	src, format, err := decodeImage(data)
+	if err == errDecodeTimeout {
+		return nil, err
+	} else if err != nil {
+		return []byte{}, nil
+	}
+	orientation := 1
+	if x, err := exif.Decode(bytes.NewReader(data)); err == nil {
+		if tag, err := x.Get(exif.Orientation); err == nil {
+			orientation, _ = tag.Int(0)
+		}
+	}
+	img := coverCrop(src, orientation)
+
+	var profile []byte
+	if format == "png" {
+		_, profile = readPngIccChunk(data)
+	} else {
+		profile = readJpegIccProfile(data)
+	}
+	if isDisplayP3Profile(profile) {
+		convertDisplayP3ToSRGB(img)
+	}
+
+	titleFace, err := newFace(gobold.TTF, OG_IMAGE_TITLE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer titleFace.Close()
+	siteFace, err := newFace(goregular.TTF, OG_IMAGE_SITE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer siteFace.Close()
+
+	width := fixed.I(OG_IMAGE_WIDTH - 2*OG_IMAGE_MARGIN)
+	lines := wrapText(titleFace, firstNonEmpty(a.AlbumTitle, a.MetaTitle), width, OG_IMAGE_TITLE_LINES)
+	siteName := firstNonEmpty(a.site.SiteTitle, a.site.Domain)
+	lineHeight := titleFace.Metrics().Height.Ceil()
+
+	// Lines are laid out from the bottom up: the site's name, then the title above it
+	baseline := OG_IMAGE_HEIGHT - OG_IMAGE_MARGIN
+	top := baseline - siteFace.Metrics().Height.Ceil() - len(lines)*lineHeight
+	darkenBottom(img, max(0, top-OG_IMAGE_MARGIN*2))
+
+	drawer := &font.Drawer{Dst: img, Src: image.NewUniform(color.White), Face: siteFace}
+	drawer.Dot = fixed.P(OG_IMAGE_MARGIN, baseline)
+	drawer.DrawString(siteName)
+
+	drawer.Face = titleFace
+	for i, line := range lines {
+		drawer.Dot = fixed.P(OG_IMAGE_MARGIN, baseline-siteFace.Metrics().Height.Ceil()-(len(lines)-1-i)*lineHeight-lineHeight/4)
+		drawer.DrawString(line)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: IMPORT_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Serves the album's link preview, made once per cover photo and title and kept with the other derivatives. Covers that
+couldn't be made into a preview are linked to as they are instead.
+*/
+func handleAlbumOgImage(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	cover, err := album.GetCoverPhoto(r.Context())
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+	if album.GetOgImageUrl(cover) == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := album.keyForSlug(cover.Slug())
+	kind := album.ogImageKind()
+	etag := ""
+	if original := album.cachedETag(key); original != "" {
+		etag = strings.TrimSuffix(original, `"`) + "-" + kind + `"`
+	}
+	if checkNotModified(w, r, album, etag) {
+		return
+	}
+
+	data, err := album.GetDerivative(r.Context(), kind, key, func(ctx context.Context) ([]byte, error) {
+		return album.buildOgImage(ctx, key)
+	})
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+	if len(data) == 0 {
+		http.Redirect(w, r, cover.GetPhotoForWidth(OG_IMAGE_WIDTH), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits how many pages are cached per album, photo pages of big albums could otherwise fill up memory
+const PAGE_CACHE_MAX_ENTRIES_PER_ALBUM = 500
+
+// S3 photo URLs are presigned, so cached pages can't live longer than the signatures do
+const PAGE_CACHE_MAX_AGE = 2 * CACHE_INTERVAL
+
+type cachedPage struct {
+	album     *Album
+	key       string
+	body      []byte
+	createdAt time.Time
+	element   *list.Element // In its tenant's list, nil for sites without a tenant
+}
+
+/*
+Caches rendered HTML per album. Pages are keyed by the page name, the album's cache generation and whether the request
+carries credentials, so a page rendered for a visitor who's logged in is never served to one who isn't. All of an album's
+pages are dropped whenever its KeyCache is refreshed. Tenants' pages are also kept in a list per tenant, oldest first, so
+evicting them to fit the tenant's PageCacheMB doesn't have to look through the whole cache.
+*/
+type PageCache struct {
+	mutex       sync.Mutex
+	pages       map[*Album]map[string]*cachedPage
+	tenantPages map[*Tenant]*list.List
+	tenantBytes map[*Tenant]int
+}
+
+var pageCache = &PageCache{
+	pages:       make(map[*Album]map[string]*cachedPage),
+	tenantPages: make(map[*Tenant]*list.List),
+	tenantBytes: make(map[*Tenant]int),
+}
+
+func pageCacheKey(r *http.Request, page string, generation uint64) string {
+	return fmt.Sprintf("%s|%d|%t", page, generation, requestHasCredentials(r))
+}
+
+// Credentials are checked before a page is rendered, so it's enough to know the request has some
+func requestHasCredentials(r *http.Request) bool {
+	if _, _, ok := r.BasicAuth(); ok {
+		return true
+	}
+	for _, cookie := range r.Cookies() {
+		if strings.HasPrefix(cookie.Name, AUTH_COOKIE_PREFIX) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PageCache) Get(album *Album, key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	page, ok := c.pages[album][key]
+	if !ok || time.Now().Sub(page.createdAt) > PAGE_CACHE_MAX_AGE {
+		return nil, false
+	}
+	return page.body, true
+}
+
+func (c *PageCache) Set(album *Album, key string, body []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if page, ok := c.pages[album][key]; ok {
+		c.remove(page)
+	}
+	tenant := album.site.tenant
+	if tenant != nil && tenant.PageCacheMB > 0 && !c.makeRoom(tenant, len(body)) {
+		return
+	}
+
+	if len(c.pages[album]) >= PAGE_CACHE_MAX_ENTRIES_PER_ALBUM {
+		c.removeAlbum(album)
+	}
+	if c.pages[album] == nil {
+		c.pages[album] = make(map[string]*cachedPage)
+	}
+	page := &cachedPage{album: album, key: key, body: body, createdAt: time.Now()}
+	c.pages[album][key] = page
+
+	if tenant != nil {
+		if c.tenantPages[tenant] == nil {
+			c.tenantPages[tenant] = list.New()
+		}
+		page.element = c.tenantPages[tenant].PushBack(page)
+		c.tenantBytes[tenant] += len(body)
+		metrics.Set("fiftymm_tenant_page_cache_bytes", float64(c.tenantBytes[tenant]), "tenant", tenant.Name)
+	}
+}
+
+// Must be called with the mutex held
+func (c *PageCache) remove(page *cachedPage) {
+	delete(c.pages[page.album], page.key)
+	if page.element != nil {
+		tenant := page.album.site.tenant
+		c.tenantPages[tenant].Remove(page.element)
+		c.tenantBytes[tenant] -= len(page.body)
+		page.element = nil
+	}
+}
+
+// Must be called with the mutex held
+func (c *PageCache) removeAlbum(album *Album) {
+	for _, page := range c.pages[album] {
+		c.remove(page)
+	}
+	delete(c.pages, album)
+}
+
+/*
+Drops the tenant's oldest pages until a page of the given size fits in its PageCacheMB, so a busy tenant evicts its own
+pages rather than growing the cache for everyone. Returns false if the page is bigger than the whole budget. Must be
+called with the mutex held.
+*/
+func (c *PageCache) makeRoom(tenant *Tenant, size int) bool {
+	budget := tenant.GetPageCacheBytes()
+	if size > budget {
+		return false
+	}
+
+	for c.tenantBytes[tenant]+size > budget {
+		oldest := c.tenantPages[tenant].Front()
+		if oldest == nil {
+			break
+		}
+		c.remove(oldest.Value.(*cachedPage))
+	}
+	return true
+}
+
+// Returns the number of cached pages and their total size in KB
+func (c *PageCache) Size() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pages, bytes := 0, 0
+	for _, albumPages := range c.pages {
+		for _, page := range albumPages {
+			pages++
+			bytes += len(page.body)
+		}
+	}
+	return pages, bytes / 1024
+}
+
+func (c *PageCache) Invalidate(album *Album) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeAlbum(album)
+}
+
+/*
+Serves a page from the cache, or builds its context and renders it. Pages that depend on the query string (like the
+"message sent" notice of the contact form) aren't cached.
+*/
+func renderCachedPage(album *Album, page string, w http.ResponseWriter, r *http.Request, templateName string,
+	buildContext func() (interface{}, error)) {
+	cacheable := !app.devMode && r.URL.RawQuery == ""
+	key := pageCacheKey(r, page, album.CacheGeneration())
+
+	if cacheable {
+		done := startTiming(r.Context(), TIMING_CACHE)
+		body, ok := pageCache.Get(album, key)
+		if ok {
+			done("hit")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(body)
+			return
+		}
+		done("miss")
+	}
+
+	ctx, err := buildContext()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	done := startTiming(r.Context(), TIMING_RENDER)
+	body, err := renderTemplate(templateName, ctx)
+	done("")
+	if err != nil {
+		writeTemplateError(w, templateName, err)
+		return
+	}
+
+	if cacheable {
+		pageCache.Set(album, key, body)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
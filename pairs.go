@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The kinds of files that can be paired with a photo
+const PAIR_LIVE = "live"
+const PAIR_RAW = "raw"
+
+var pairStillExtensions = []string{".jpg", ".jpeg", ".heic", ".heif"}
+var pairLiveExtensions = []string{".mov", ".mp4"}
+var pairRawExtensions = []string{".cr2", ".cr3", ".nef", ".arw", ".dng", ".raf", ".orf", ".rw2", ".pef", ".srw"}
+
+type pairedKey struct {
+	kind string
+	key  string
+}
+
+func hasExtension(key string, extensions []string) bool {
+	ext := strings.ToLower(path.Ext(key))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Finds files that belong with a photo of the same name, like the video of an Apple Live Photo (IMG_1234.HEIC and
+IMG_1234.MOV) or the RAW file shot alongside a JPEG (IMG_1234.JPG and IMG_1234.CR2). Returns the objects without those
+files, so each photo shows up once, and the paired file of each photo that has one.
+*/
+func pairObjects(objects []*s3.Object) ([]*s3.Object, map[string]pairedKey) {
+	groups := make(map[string][]string)
+	for _, obj := range objects {
+		base := strings.TrimSuffix(*obj.Key, path.Ext(*obj.Key))
+		groups[base] = append(groups[base], *obj.Key)
+	}
+
+	pairs := make(map[string]pairedKey)
+	companions := make(map[string]bool)
+	for _, keys := range groups {
+		if len(keys) != 2 {
+			continue // Files on their own, or more than we can make sense of
+		}
+
+		for i, still := range keys {
+			other := keys[1-i]
+			if !hasExtension(still, pairStillExtensions) {
+				continue
+			}
+
+			if hasExtension(other, pairLiveExtensions) {
+				pairs[still] = pairedKey{PAIR_LIVE, other}
+				companions[other] = true
+			} else if hasExtension(other, pairRawExtensions) {
+				pairs[still] = pairedKey{PAIR_RAW, other}
+				companions[other] = true
+			}
+		}
+	}
+
+	var photos []*s3.Object
+	for _, obj := range objects {
+		if !companions[*obj.Key] {
+			photos = append(photos, obj)
+		}
+	}
+	return photos, pairs
+}
+
+// Returns the file paired with a photo, or nil if it doesn't have one. Albums with BlurFaces don't show them.
+func (a *Album) getPairedFile(key string) *PairedFile {
+	if a.BlurFaces {
+		return nil
+	}
+
+	pairs, _ := a.PairCache.Load().(map[string]pairedKey)
+	pair, ok := pairs[key]
+	if !ok {
+		return nil
+	}
+
+	// RAW files go through the download link so they're counted. Imgix only serves images, so videos come straight
+	// from the bucket unless the site proxies photos.
+	if pair.kind == PAIR_RAW {
+		return &PairedFile{pair.kind, a.GetDownloadUrl(pair.key)}
+	}
+	return &PairedFile{pair.kind, a.GetOriginalUrl(pair.key)}
+}
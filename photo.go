@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,42 +10,239 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// Photos at least this many times wider than they're tall are panoramas, which grids don't squeeze into a single column
+const PANORAMA_ASPECT_RATIO = 2.5
+
+/*
+The size of a photo as it's displayed, so with the EXIF orientation applied. Templates use it to give images a width
+and height, which keeps the grid from jumping around while photos load.
+*/
+type PhotoInfo struct {
+	Width       int
+	Height      int
+	Orientation int
+	Animated    bool
+	Photosphere bool
+	Caption     string
+}
+
+// Orientations 5 to 8 are rotated by 90 degrees one way or the other, so the stored width is the displayed height
+func NewPhotoInfo(photoExif *PhotoExif) *PhotoInfo {
+	if photoExif.Width <= 0 || photoExif.Height <= 0 {
+		return nil
+	}
+
+	info := &PhotoInfo{photoExif.Width, photoExif.Height, photoExif.Orientation, photoExif.Animated, photoExif.Photosphere,
+		photoExif.Caption}
+	if info.Orientation >= 5 && info.Orientation <= 8 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info
+}
+
+// A file that goes with a photo, like the video of a Live Photo (Kind "live") or a RAW file (Kind "raw")
+type PairedFile struct {
+	Kind string
+	Url  string
+}
+
+/*
+Photo types embed this to carry what's known about the photo besides its key. The PhotoInfo is nil until the photo's EXIF
+data has been read.
+*/
+type photoInfo struct {
+	info      *PhotoInfo
+	pair      *PairedFile
+	sensitive bool
+	alt       string
+	caption   string
+	tags      []string
+	title     string
+	date      time.Time
+	stack     *PhotoStack
+	metadata  map[string]string
+}
+
+func (p *photoInfo) Info() *PhotoInfo {
+	return p.info
+}
+
+func (p *photoInfo) Pair() *PairedFile {
+	return p.pair
+}
+
+// Animated GIFs, WebPs and PNGs, which templates badge
+func (p *photoInfo) IsAnimated() bool {
+	return p.info != nil && p.info.Animated
+}
+
+func (p *photoInfo) IsPanorama() bool {
+	return p.info != nil && float64(p.info.Width) >= PANORAMA_ASPECT_RATIO*float64(p.info.Height)
+}
+
+// 360° photos, which photo pages show in a viewer that can be looked around in
+func (p *photoInfo) IsPhotosphere() bool {
+	return p.info != nil && p.info.Photosphere
+}
+
+// Photos flagged as sensitive are blurred until clicked, and left out of link previews and feeds
+func (p *photoInfo) IsSensitive() bool {
+	return p.sensitive
+}
+
+// Describes the photo for screen readers, see alttext.go
+func (p *photoInfo) Alt() string {
+	return p.alt
+}
+
+// From a caption sidecar or the EXIF data, see captions.go
+func (p *photoInfo) Caption() string {
+	return p.caption
+}
+
+func (p *photoInfo) Tags() []string {
+	return p.tags
+}
+
+// Read from the file name by the album's FilenamePattern, see filenames.go. Empty for photos whose names don't match.
+func (p *photoInfo) Title() string {
+	return p.title
+}
+
+func (p *photoInfo) Date() time.Time {
+	return p.date
+}
+
+// Set on the photos of an album page that look like their neighbours, see stacks.go
+func (p *photoInfo) Stack() *PhotoStack {
+	return p.stack
+}
+
+func (p *photoInfo) IsArchived() bool {
+	return false
+}
+
+// Anything else known about the photo, by name, like its "blurhash" once it's made. Renderers can add their own.
+func (p *photoInfo) Metadata() map[string]string {
+	return p.metadata
+}
+
+func (p *photoInfo) setMetadata(name, value string) {
+	if p.metadata == nil {
+		p.metadata = make(map[string]string)
+	}
+	p.metadata[name] = value
+}
+
+func (p *photoInfo) Type() string {
+	return "photo"
+}
+
+func (p *photoInfo) Template() string {
+	return ""
+}
+
 type ImgixPhoto struct {
-	Key     string
-	BaseUrl *url.URL
+	photoInfo
+	Key         string
+	BaseUrl     *url.URL
+	formats     []*ImageFormat
+	jpegQuality int
+	toSRGB      bool
 }
 
 type S3Photo struct {
-	Key        string
-	BucketName string
-	awsSession *session.Session
+	photoInfo
+	Key         string
+	BucketName  string
+	awsSession  *session.Session
+	urlLifetime time.Duration
+}
+
+// A photo served through 50mm itself, for sites with ProxyPhotos
+type ProxyPhoto struct {
+	photoInfo
+	Key string
+	Url *url.URL
 }
 
+/*
+Anything an album can show. GetPhotoForWidth and GetThumbnailForWidthAndHeight are its URLs, Info and Pair what's known
+about it, Metadata anything else templates can use, Type what kind of thing it is ("photo" for photos), and Template the
+name of the template that shows it, or empty for an image. See renderer.go for adding types.
+*/
 type Renderable interface {
+	Type() string
+	Template() string
 	Slug() string
 	GetPhotoForWidth(int) string
 	GetThumbnailForWidthAndHeight(int, int) string
+	Info() *PhotoInfo
+	IsAnimated() bool
+	IsPanorama() bool
+	IsPhotosphere() bool
+	Pair() *PairedFile
+	IsSensitive() bool
+	IsArchived() bool
+	Alt() string
+	Caption() string
+	Tags() []string
+	Title() string
+	Date() time.Time
+	Stack() *PhotoStack
+	Metadata() map[string]string
+	GetSourcesForWidth(int) []*PhotoSource
 }
 
 func (p *ImgixPhoto) Slug() string {
-	parts := strings.Split(p.Key, "/")
-	return parts[len(parts)-1]
+	return fileSlug(p.Key)
 }
 
+// Imgix applies the EXIF orientation itself, so its photos and thumbnails are already the right way up
 func (p *ImgixPhoto) GetPhotoForWidth(w int) string {
+	return p.getUrlForWidthAndFormat(w, "", p.jpegQuality)
+}
+
+func (p *ImgixPhoto) getUrlForWidthAndFormat(w int, format string, quality int) string {
 	keyPathUrl, err := url.Parse(p.Key)
 	if err != nil {
 		return ""
 	}
 
 	fullUrl := p.BaseUrl.ResolveReference(keyPathUrl)
+	// Resizing animations re-encodes every frame, or turns them into a still, so they're served as they are
+	if p.IsAnimated() {
+		return fullUrl.String()
+	}
 	queryValues := fullUrl.Query()
 	queryValues.Add("w", fmt.Sprint(w))
+	if format != "" {
+		queryValues.Add("fm", format)
+	}
+	if quality > 0 {
+		queryValues.Add("q", fmt.Sprint(quality))
+	}
+	if p.toSRGB {
+		queryValues.Add("cs", "srgb")
+	}
 	fullUrl.RawQuery = queryValues.Encode()
 
 	return fullUrl.String()
 }
 
+// AVIF and WebP versions of the photo, made by Imgix, for <picture> elements to offer before the JPEG
+func (p *ImgixPhoto) GetSourcesForWidth(w int) []*PhotoSource {
+	if p.IsAnimated() {
+		return nil
+	}
+
+	var sources []*PhotoSource
+	for _, format := range p.formats {
+		sources = append(sources, &PhotoSource{format.Type, p.getUrlForWidthAndFormat(w, format.Name, format.Quality)})
+	}
+	return sources
+}
+
 func (p *ImgixPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	keyPathUrl, err := url.Parse(p.Key)
 	if err != nil {
@@ -54,6 +250,9 @@ func (p *ImgixPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	}
 
 	fullUrl := p.BaseUrl.ResolveReference(keyPathUrl)
+	if p.IsAnimated() {
+		return fullUrl.String()
+	}
 	queryValues := fullUrl.Query()
 	queryValues.Add("w", fmt.Sprint(w))
 	queryValues.Add("max-h", fmt.Sprint(h))
@@ -66,8 +265,7 @@ func (p *ImgixPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 }
 
 func (p *S3Photo) Slug() string {
-	parts := strings.Split(p.Key, "/")
-	return parts[len(parts)-1]
+	return fileSlug(p.Key)
 }
 
 func (p *S3Photo) GetPhotoForWidth(w int) string {
@@ -76,9 +274,9 @@ func (p *S3Photo) GetPhotoForWidth(w int) string {
 		Key:    aws.String(p.Key),
 	})
 
-	signedUrl, err := req.Presign(24 * time.Hour)
+	signedUrl, err := req.Presign(p.urlLifetime)
 	if err != nil {
-		fmt.Printf("Unable to sign URL for S3Photo. Error: %s\n", err.Error())
+		reportError("sign URL for S3Photo", err, ErrorContext{"bucket": p.BucketName})
 		return ""
 	}
 
@@ -89,6 +287,56 @@ func (p *S3Photo) GetThumbnailForWidthAndHeight(w, h int) string {
 	return p.GetPhotoForWidth(w)
 }
 
+// Photos straight from the bucket only come in their original format
+func (p *S3Photo) GetSourcesForWidth(w int) []*PhotoSource {
+	return nil
+}
+
+func (p *ProxyPhoto) Slug() string {
+	return fileSlug(p.Key)
+}
+
+func (p *ProxyPhoto) GetPhotoForWidth(w int) string {
+	return p.Url.String()
+}
+
+func (p *ProxyPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
+	return p.GetPhotoForWidth(w)
+}
+
+func (p *ProxyPhoto) GetSourcesForWidth(w int) []*PhotoSource {
+	return nil
+}
+
+/*
+A photo in archive storage, like Glacier, which can't be downloaded until it's restored. Templates get a placeholder
+instead of an image that doesn't load.
+*/
+type ArchivedPhoto struct {
+	photoInfo
+	Key string
+}
+
+func (p *ArchivedPhoto) Slug() string {
+	return fileSlug(p.Key)
+}
+
+func (p *ArchivedPhoto) GetPhotoForWidth(w int) string {
+	return ARCHIVED_PLACEHOLDER
+}
+
+func (p *ArchivedPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
+	return ARCHIVED_PLACEHOLDER
+}
+
+func (p *ArchivedPhoto) GetSourcesForWidth(w int) []*PhotoSource {
+	return nil
+}
+
+func (p *ArchivedPhoto) IsArchived() bool {
+	return true
+}
+
 /*
 Used when we can't get the photo required, and have to return something, for example in methods used by templates
 */
@@ -106,3 +354,71 @@ func (p *ErrorPhoto) GetPhotoForWidth(w int) string {
 func (p *ErrorPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	return ""
 }
+
+func (p *ErrorPhoto) Info() *PhotoInfo {
+	return nil
+}
+
+func (p *ErrorPhoto) IsAnimated() bool {
+	return false
+}
+
+func (p *ErrorPhoto) IsPanorama() bool {
+	return false
+}
+
+func (p *ErrorPhoto) IsPhotosphere() bool {
+	return false
+}
+
+func (p *ErrorPhoto) Pair() *PairedFile {
+	return nil
+}
+
+func (p *ErrorPhoto) GetSourcesForWidth(w int) []*PhotoSource {
+	return nil
+}
+
+func (p *ErrorPhoto) IsSensitive() bool {
+	return false
+}
+
+func (p *ErrorPhoto) Alt() string {
+	return ""
+}
+
+func (p *ErrorPhoto) Caption() string {
+	return ""
+}
+
+func (p *ErrorPhoto) Tags() []string {
+	return nil
+}
+
+func (p *ErrorPhoto) Title() string {
+	return ""
+}
+
+func (p *ErrorPhoto) Date() time.Time {
+	return time.Time{}
+}
+
+func (p *ErrorPhoto) Stack() *PhotoStack {
+	return nil
+}
+
+func (p *ErrorPhoto) IsArchived() bool {
+	return false
+}
+
+func (p *ErrorPhoto) Metadata() map[string]string {
+	return nil
+}
+
+func (p *ErrorPhoto) Type() string {
+	return "photo"
+}
+
+func (p *ErrorPhoto) Template() string {
+	return ""
+}
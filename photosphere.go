@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// XMP metadata is stored in an APP1 segment that starts with this, next to the EXIF one
+var xmpJpegPrefix = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// Cameras and apps that make photospheres set the Google Photo Sphere XMP metadata, as an attribute or an element
+var gpanoEquirectangularPattern = regexp.MustCompile(`GPano:ProjectionType(?:\s*=\s*["']|>)\s*equirectangular`)
+
+/*
+Checks whether a JPEG is an equirectangular photosphere from its XMP metadata. The data can be cut short, as only the
+first part of photos is downloaded, but XMP comes before the image data.
+*/
+func isPhotosphere(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return false
+	}
+
+	photosphere := false
+	eachJpegSegment(data, func(marker byte, _ int, segment []byte) bool {
+		if marker == 0xE1 && bytes.HasPrefix(segment, xmpJpegPrefix) {
+			photosphere = gpanoEquirectangularPattern.Match(segment[len(xmpJpegPrefix):])
+			return false
+		}
+		return true
+	})
+	return photosphere
+}
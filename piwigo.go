@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Piwigo's tables have this prefix unless it was changed when Piwigo was installed
+const PIWIGO_DEFAULT_TABLE_PREFIX = "piwigo_"
+
+var piwigoCreateTable = regexp.MustCompile("(?i)^CREATE TABLE (?:IF NOT EXISTS )?`?([A-Za-z0-9_]+)`?")
+var piwigoColumn = regexp.MustCompile("^\\s*`([A-Za-z0-9_]+)`")
+var piwigoInsert = regexp.MustCompile("(?i)^INSERT INTO `?([A-Za-z0-9_]+)`?\\s*(?:\\(([^)]*)\\))?\\s*VALUES\\s*")
+var piwigoHTMLTag = regexp.MustCompile(`<[^>]*>`)
+
+// A table from a mysqldump, with its rows by column name. Values that were NULL are missing from their row.
+type piwigoTable []map[string]string
+
+/*
+Reads the tables of a mysqldump of Piwigo's database. Only what mysqldump writes is understood: a CREATE TABLE with one
+column per line, and INSERT statements on one line each, with or without their column names.
+*/
+func readPiwigoDump(path string) (map[string]piwigoTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]piwigoTable)
+	columns := make(map[string][]string)
+	creating := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := piwigoCreateTable.FindStringSubmatch(line); m != nil {
+			creating, columns[m[1]] = m[1], nil
+			continue
+		}
+		if creating != "" {
+			if m := piwigoColumn.FindStringSubmatch(line); m != nil {
+				columns[creating] = append(columns[creating], m[1])
+			} else if strings.HasPrefix(line, ")") {
+				creating = ""
+			}
+			continue
+		}
+
+		m := piwigoInsert.FindStringSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		table := line[m[2]:m[3]]
+		names := columns[table]
+		if m[4] >= 0 {
+			names = nil
+			for _, name := range strings.Split(line[m[4]:m[5]], ",") {
+				names = append(names, strings.Trim(strings.TrimSpace(name), "`"))
+			}
+		}
+		rows, err := parseSQLValues(line[m[1]:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the rows of %s in %s. Error: %s", table, path, err.Error())
+		}
+		for _, values := range rows {
+			if len(values) != len(names) {
+				return nil, fmt.Errorf("A row of %s in %s has %d values for %d columns", table, path, len(values), len(names))
+			}
+			row := make(map[string]string)
+			for i, value := range values {
+				if value != nil {
+					row[names[i]] = *value
+				}
+			}
+			tables[table] = append(tables[table], row)
+		}
+	}
+	return tables, nil
+}
+
+// Parses the tuples of an INSERT statement, like (1,'a',NULL),(2,'b\'c',3); NULLs are nil.
+func parseSQLValues(s string) ([][]*string, error) {
+	var rows [][]*string
+	var row []*string
+	inRow := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '(' && !inRow:
+			inRow, row = true, nil
+		case c == ')' && inRow:
+			inRow = false
+			rows = append(rows, row)
+		case !inRow || c == ',' || unicode.IsSpace(rune(c)):
+			if !inRow && c == ';' {
+				return rows, nil
+			}
+		case c == '\'':
+			var value strings.Builder
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					switch s[i] {
+					case 'n':
+						value.WriteByte('\n')
+					case 'r':
+						value.WriteByte('\r')
+					case 't':
+						value.WriteByte('\t')
+					case '0':
+						value.WriteByte(0)
+					default:
+						value.WriteByte(s[i])
+					}
+				} else if s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+					value.WriteByte('\'')
+					i++
+				} else if s[i] == '\'' {
+					break
+				} else {
+					value.WriteByte(s[i])
+				}
+			}
+			v := value.String()
+			row = append(row, &v)
+		default:
+			end := i
+			for end < len(s) && s[end] != ',' && s[end] != ')' {
+				end++
+			}
+			if v := strings.TrimSpace(s[i:end]); strings.EqualFold(v, "NULL") {
+				row = append(row, nil)
+			} else {
+				row = append(row, &v)
+			}
+			i = end - 1
+		}
+	}
+	if inRow {
+		return nil, fmt.Errorf("unterminated row")
+	}
+	return rows, nil
+}
+
+// Piwigo's tables end in these, after whatever prefix the install uses
+func piwigoTableNamed(tables map[string]piwigoTable, name string) piwigoTable {
+	if table, ok := tables[PIWIGO_DEFAULT_TABLE_PREFIX+name]; ok {
+		return table
+	}
+	for tableName, table := range tables {
+		if strings.HasSuffix(tableName, "_"+name) {
+			return table
+		}
+	}
+	return nil
+}
+
+// Album descriptions in Piwigo can have HTML in them, which 50mm shows as text
+func piwigoText(s string) string {
+	return strings.TrimSpace(piwigoHTMLTag.ReplaceAllString(s, ""))
+}
+
+/*
+Sorts an album's photos by a category's image_order, like "date_creation DESC, file ASC". Piwigo sorts by its global
+order when a category doesn't have one, which the dump doesn't have, so those keep their name order.
+*/
+func sortPiwigoImages(images []map[string]string, order string) {
+	type sortField struct {
+		column string
+		desc   bool
+	}
+	var fields []sortField
+	for _, part := range strings.Split(order, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 {
+			continue
+		}
+		fields = append(fields, sortField{strings.Trim(words[0], "`"), len(words) > 1 && strings.EqualFold(words[1], "DESC")})
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		for _, field := range fields {
+			a, b := images[i][field.column], images[j][field.column]
+			if a == b {
+				continue
+			}
+			less := a < b
+			if x, err := strconv.ParseFloat(a, 64); err == nil {
+				if y, err := strconv.ParseFloat(b, 64); err == nil {
+					less = x < y
+				}
+			}
+			return less != field.desc
+		}
+		return false
+	})
+}
+
+/*
+Gives the albums read from Piwigo's galleries folder the titles, descriptions and photo order they have in Piwigo's
+database. Albums are matched to Piwigo's categories by their folder, and photos by their file name. Photos sorted by
+hand in Piwigo keep that order, the others follow their category's sort order.
+*/
+func applyPiwigoDump(albums []*migratedAlbum, root, dump string) error {
+	tables, err := readPiwigoDump(dump)
+	if err != nil {
+		return err
+	}
+	categories, images, imageCategories := piwigoTableNamed(tables, "categories"), piwigoTableNamed(tables, "images"),
+		piwigoTableNamed(tables, "image_category")
+	if categories == nil || images == nil {
+		return fmt.Errorf("No Piwigo categories and images tables found in %s", dump)
+	}
+
+	categoriesByID := make(map[string]map[string]string)
+	for _, category := range categories {
+		categoriesByID[category["id"]] = category
+	}
+	// Categories that are folders, by their folder relative to the galleries folder
+	categoryDirs := make(map[string]map[string]string)
+	for _, category := range categories {
+		var dirs []string
+		for c := category; c != nil && c["dir"] != ""; c = categoriesByID[c["id_uppercat"]] {
+			dirs = append([]string{c["dir"]}, dirs...)
+		}
+		if len(dirs) > 0 && category["dir"] != "" {
+			categoryDirs[strings.Join(dirs, "/")] = category
+		}
+	}
+	ranks := make(map[string]string)
+	for _, ic := range imageCategories {
+		if ic["rank"] != "" {
+			ranks[ic["category_id"]+"/"+ic["image_id"]] = ic["rank"]
+		}
+	}
+	imagesByFile := make(map[string]map[string]string)
+	for _, image := range images {
+		imagesByFile[image["storage_category_id"]+"/"+image["file"]] = image
+	}
+
+	for _, album := range albums {
+		rel, err := filepath.Rel(root, album.dir)
+		if err != nil {
+			continue
+		}
+		category, ok := categoryDirs[filepath.ToSlash(rel)]
+		if !ok {
+			fmt.Printf("Keeping the folder name and name order of %s, Piwigo's database doesn't have it\n", album.dir)
+			continue
+		}
+		if name := piwigoText(category["name"]); name != "" {
+			album.Title = name
+		}
+		album.Description = piwigoText(category["comment"])
+
+		var albumImages []map[string]string
+		photos := make(map[string]string)
+		for _, photo := range album.Photos {
+			image := imagesByFile[category["id"]+"/"+filepath.Base(photo)]
+			if image == nil {
+				image = map[string]string{"file": filepath.Base(photo)}
+			}
+			image = maps.Clone(image)
+			image["rank"] = ranks[category["id"]+"/"+image["id"]]
+			photos[image["file"]] = photo
+			albumImages = append(albumImages, image)
+		}
+
+		order := category["image_order"]
+		for _, image := range albumImages {
+			if image["rank"] != "" {
+				order = "rank ASC"
+				break
+			}
+		}
+		sortPiwigoImages(albumImages, order)
+		album.Photos = album.Photos[:0]
+		for _, image := range albumImages {
+			album.Photos = append(album.Photos, photos[image["file"]])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PREFETCH_TIMEOUT_ENV_VAR = "FIFTYMM_PREFETCH_TIMEOUT"
+const PREFETCH_CONCURRENCY_ENV_VAR = "FIFTYMM_PREFETCH_CONCURRENCY"
+
+const PREFETCH_ALL = "all"
+const DEFAULT_PREFETCH_TIMEOUT = 60 * time.Second
+const DEFAULT_PREFETCH_CONCURRENCY = 4
+
+func validatePrefetchAlbums(s *Site) error {
+	for _, path := range s.PrefetchAlbums {
+		path = strings.TrimSpace(path)
+		if strings.EqualFold(path, PREFETCH_ALL) {
+			continue
+		}
+		if path == "" {
+			return fmt.Errorf("PrefetchAlbums must be album paths or %s", PREFETCH_ALL)
+		}
+		if _, err := s.GetAlbumForPath(path); err != nil {
+			return fmt.Errorf("PrefetchAlbums has %s, which isn't an album of the site", path)
+		}
+	}
+	return nil
+}
+
+func (s *Site) GetPrefetchAlbums() []*Album {
+	var albums []*Album
+	seen := make(map[*Album]bool)
+	for _, path := range s.PrefetchAlbums {
+		path = strings.TrimSpace(path)
+		if strings.EqualFold(path, PREFETCH_ALL) {
+			return s.Albums
+		}
+		if album, err := s.GetAlbumForPath(path); err == nil && !seen[album] {
+			seen[album] = true
+			albums = append(albums, album)
+		}
+	}
+	return albums
+}
+
+func prefetchSettingsFromEnv() (time.Duration, int) {
+	timeout := DEFAULT_PREFETCH_TIMEOUT
+	if seconds, err := strconv.Atoi(os.Getenv(PREFETCH_TIMEOUT_ENV_VAR)); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	concurrency := DEFAULT_PREFETCH_CONCURRENCY
+	if n, err := strconv.Atoi(os.Getenv(PREFETCH_CONCURRENCY_ENV_VAR)); err == nil && n > 0 {
+		concurrency = n
+	}
+	return timeout, concurrency
+}
+
+/*
+Lists the PrefetchAlbums of every site and builds their photos before the server takes requests, so the first visitors
+after a deploy don't wait for S3. A few albums are loaded at once. Whatever isn't done after the timeout is left for the
+first visitor, a slow bucket shouldn't keep the site down.
+*/
+func (a *App) PrefetchAlbums(timeout time.Duration, concurrency int) {
+	var albums []*Album
+	for _, site := range a.sites {
+		albums = append(albums, site.GetPrefetchAlbums()...)
+	}
+	if len(albums) == 0 || a.devMode {
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	loaded := 0
+	slots := make(chan struct{}, concurrency)
+	for _, album := range albums {
+		wg.Add(1)
+		go func(album *Album) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+
+			if err := album.RefreshCache(ctx); err != nil {
+				if ctx.Err() == nil {
+					reportError("prefetch album", err, albumErrorContext(album))
+				}
+				return
+			}
+			if _, err := album.currentPhotos(ctx); err != nil {
+				return
+			}
+			mutex.Lock()
+			loaded++
+			mutex.Unlock()
+		}(album)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	fmt.Printf("Prefetched %d of %d albums in %s\n", loaded, len(albums), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+/*
+Builds the "Order print" link for a photo from the site's PrintStoreUrl template. The template can use the placeholders
+{key} (full bucket key), {slug} (file name) and {album} (album path), which are substituted URL-escaped.
+*/
+func (s *Site) GetPrintUrl(album *Album, slug string) string {
+	if s.PrintStoreUrl == "" {
+		return ""
+	}
+
+	replacer := strings.NewReplacer(
+		"{key}", escapePrintUrlValue(album.keyForSlug(slug)),
+		"{slug}", escapePrintUrlValue(slug),
+		"{album}", escapePrintUrlValue(album.Path),
+	)
+
+	return replacer.Replace(s.PrintStoreUrl)
+}
+
+func escapePrintUrlValue(v string) string {
+	return strings.Replace(url.QueryEscape(v), "+", "%20", -1)
+}
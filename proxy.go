@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Photos of sites with ProxyPhotos are served by 50mm at <album path>/media/<slug>
+const MEDIA_SLUG = "media/"
+
+/*
+Whether the album's photos are served through 50mm: for sites with ProxyPhotos, unless the site uses Imgix, and always
+for albums with BlurFaces, which can't let visitors see the originals
+*/
+func (a *Album) ProxiesPhotos() bool {
+	return a.BlurFaces || (a.site.ProxyPhotos && !a.site.UseImgix)
+}
+
+// Requests for more ranges than this get the whole object, each range costs an S3 request
+const PROXY_MAX_RANGES = 10
+
+var errS3Busy = errors.New("Too many S3 calls at once")
+
+type proxyObject struct {
+	contentType   *string
+	contentLength *int64
+	contentRange  *string
+	etag          *string
+	lastModified  *time.Time
+	cacheControl  *string
+}
+
+// Copies the headers browsers and video players need for caching, conditional requests and seeking from the S3 object
+func writeProxyHeaders(w http.ResponseWriter, album *Album, obj *proxyObject) {
+	h := w.Header()
+	if obj.contentType != nil {
+		h.Set("Content-Type", *obj.contentType)
+	}
+	if obj.contentLength != nil {
+		h.Set("Content-Length", fmt.Sprint(*obj.contentLength))
+	}
+	if obj.contentRange != nil {
+		h.Set("Content-Range", *obj.contentRange)
+	}
+	if obj.etag != nil {
+		h.Set("ETag", *obj.etag)
+	}
+	if obj.lastModified != nil {
+		h.Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+	}
+	h.Set("Accept-Ranges", "bytes")
+
+	// Shared caches mustn't keep photos of albums that need a password
+	if album.HasAuth() {
+		h.Set("Cache-Control", "private")
+	} else if obj.cacheControl != nil {
+		h.Set("Cache-Control", *obj.cacheControl)
+	}
+}
+
+func parseHTTPTime(value string) *time.Time {
+	if t, err := http.ParseTime(value); err == nil {
+		return &t
+	}
+	return nil
+}
+
+func optionalHeader(r *http.Request, name string) *string {
+	if v := r.Header.Get(name); v != "" {
+		return aws.String(v)
+	}
+	return nil
+}
+
+/*
+Turns S3 errors into the matching response. S3 answers conditional requests that don't match with errors, which are
+passed on to the browser as they are.
+*/
+func writeProxyError(w http.ResponseWriter, r *http.Request, album *Album, err error) {
+	// Waiting for an S3 slot can outlast the server's timeouts while the visitor is still there
+	if err == errS3Busy {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Too busy to load the photo, please try again\n"))
+		return
+	}
+	if r.Context().Err() != nil {
+		return // The visitor went away, there's no one to tell
+	}
+
+	if err == errObjectTooLarge {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This file is too big to be shown\n"))
+		return
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotModified, http.StatusPreconditionFailed:
+			w.WriteHeader(reqErr.StatusCode())
+			return
+		case http.StatusNotFound, http.StatusForbidden:
+			http.NotFound(w, r)
+			return
+		case http.StatusRequestedRangeNotSatisfiable:
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	reportError("proxy photo from S3", err, requestErrorContext(r, albumErrorContext(album)))
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write([]byte("Unable to load photo\n"))
+}
+
+// Whether the ETag is one of those in an If-None-Match header. ETags are compared weakly, as RFC 7232 asks for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// A 304 has to repeat the ETag and caching headers, or browsers may forget how long their copy is good for
+func writeNotModified(w http.ResponseWriter, album *Album, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+/*
+Answers a browser revalidating its copy of a photo that hasn't changed since the album was last refreshed, without
+asking S3. Photos changed since then are caught by S3 at the next refresh at the latest, like new photos are.
+*/
+func checkNotModified(w http.ResponseWriter, r *http.Request, album *Album, etag string) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		writeNotModified(w, album, etag)
+		return true
+	}
+	return false
+}
+
+/*
+Like writeProxyError, but S3's 304s, which come without headers, get the ETag the album knows, and its 416s get the
+Content-Range with the object's size that RFC 9110 asks for, which S3 doesn't send either.
+*/
+func (p *proxyRequest) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotModified:
+			etag := p.etag
+			// S3 matched the one ETag the browser sent
+			if etag == "" && p.ifNoneMatch != nil && !strings.Contains(*p.ifNoneMatch, ",") {
+				etag = *p.ifNoneMatch
+			}
+			writeNotModified(w, p.album, etag)
+			return
+		case http.StatusRequestedRangeNotSatisfiable:
+			if head, err := p.head(r); err == nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", aws.Int64Value(head.ContentLength)))
+			}
+		}
+	}
+	writeProxyError(w, r, p.album, err)
+}
+
+type byteRange struct {
+	start int64 // -1 for suffix ranges like "-500", which are the last 500 bytes
+	end   int64 // -1 for open ended ranges like "500-"
+}
+
+/*
+Parses a Range header like "bytes=0-499, 1000-". Returns nil for requests without one. Ranges with a syntax error are
+an error, and get the whole object as RFC 7233 allows.
+*/
+func parseByteRanges(header string) ([]*byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, errors.New("Only byte ranges are supported")
+	}
+
+	var ranges []*byteRange
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		startText, endText, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok || (startText == "" && endText == "") {
+			return nil, fmt.Errorf("Invalid range '%s'", spec)
+		}
+
+		br := &byteRange{-1, -1}
+		var err error
+		if startText != "" {
+			if br.start, err = strconv.ParseInt(startText, 10, 64); err != nil || br.start < 0 {
+				return nil, fmt.Errorf("Invalid range '%s'", spec)
+			}
+		}
+		if endText != "" {
+			if br.end, err = strconv.ParseInt(endText, 10, 64); err != nil || br.end < 0 || (br.start >= 0 && br.end < br.start) {
+				return nil, fmt.Errorf("Invalid range '%s'", spec)
+			}
+		}
+		ranges = append(ranges, br)
+	}
+	return ranges, nil
+}
+
+// Returns the range in the form S3 understands, which is the same as the HTTP header
+func (br *byteRange) header() string {
+	switch {
+	case br.start < 0:
+		return fmt.Sprintf("bytes=-%d", br.end)
+	case br.end < 0:
+		return fmt.Sprintf("bytes=%d-", br.start)
+	default:
+		return fmt.Sprintf("bytes=%d-%d", br.start, br.end)
+	}
+}
+
+// Returns the first and last byte of the range for an object of the given size, or false if none of it is in the object
+func (br *byteRange) resolve(size int64) (int64, int64, bool) {
+	start, end := br.start, br.end
+	if start < 0 {
+		if end == 0 {
+			return 0, 0, false
+		}
+		start, end = size-end, size-1
+		if start < 0 {
+			start = 0
+		}
+	} else if end < 0 || end >= size {
+		end = size - 1
+	}
+	return start, end, start < size
+}
+
+// If-Range asks for the range only if the object hasn't changed, and for the whole object otherwise
+func ifRangeMatches(ifRange string, etag *string, lastModified *time.Time) bool {
+	if t := parseHTTPTime(ifRange); t != nil {
+		return lastModified != nil && !lastModified.After(*t)
+	}
+	return etag != nil && ifRange == *etag && !strings.HasPrefix(ifRange, "W/")
+}
+
+type proxyRequest struct {
+	album  *Album
+	svc    *s3.S3
+	bucket *string
+	key    *string
+	etag   string // As of the album's last refresh, empty if it isn't known
+
+	ifNoneMatch       *string
+	ifMatch           *string
+	ifModifiedSince   *time.Time
+	ifUnmodifiedSince *time.Time
+}
+
+func newProxyRequest(album *Album, svc *s3.S3, r *http.Request) *proxyRequest {
+	key := album.keyForSlug(r.PathValue("slug"))
+	return &proxyRequest{
+		album, svc,
+		aws.String(album.site.BucketName), aws.String(key), album.cachedETag(key),
+		optionalHeader(r, "If-None-Match"), optionalHeader(r, "If-Match"),
+		parseHTTPTime(r.Header.Get("If-Modified-Since")), parseHTTPTime(r.Header.Get("If-Unmodified-Since")),
+	}
+}
+
+func (p *proxyRequest) head(r *http.Request) (*s3.HeadObjectOutput, error) {
+	// The slot is only held until S3 answers, a long video download shouldn't block other S3 calls
+	release, err := p.album.acquireS3(r.Context())
+	if err != nil {
+		return nil, errS3Busy
+	}
+	defer release()
+
+	return p.svc.HeadObjectWithContext(r.Context(), &s3.HeadObjectInput{
+		Bucket: p.bucket, Key: p.key,
+		IfNoneMatch: p.ifNoneMatch, IfMatch: p.ifMatch, IfModifiedSince: p.ifModifiedSince, IfUnmodifiedSince: p.ifUnmodifiedSince,
+	})
+}
+
+func (p *proxyRequest) get(r *http.Request, objectRange *string) (*s3.GetObjectOutput, error) {
+	release, err := p.album.acquireS3(r.Context())
+	if err != nil {
+		return nil, errS3Busy
+	}
+	defer release()
+
+	return p.svc.GetObjectWithContext(r.Context(), &s3.GetObjectInput{
+		Bucket: p.bucket, Key: p.key, Range: objectRange,
+		IfNoneMatch: p.ifNoneMatch, IfMatch: p.ifMatch, IfModifiedSince: p.ifModifiedSince, IfUnmodifiedSince: p.ifUnmodifiedSince,
+	})
+}
+
+/*
+S3 only returns one range per request, so requests for several ranges are answered with a multipart/byteranges response
+made of one S3 request per range.
+*/
+func serveProxyRanges(w http.ResponseWriter, r *http.Request, p *proxyRequest, head *s3.HeadObjectOutput, ranges []*byteRange) {
+	size := aws.Int64Value(head.ContentLength)
+
+	var resolved [][2]int64
+	for _, br := range ranges {
+		if start, end, ok := br.resolve(size); ok {
+			resolved = append(resolved, [2]int64{start, end})
+		}
+	}
+	if len(resolved) == 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	writeProxyHeaders(w, p.album, &proxyObject{nil, nil, nil, head.ETag, head.LastModified, head.CacheControl})
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+
+	for _, rng := range resolved {
+		out, err := p.get(r, aws.String(fmt.Sprintf("bytes=%d-%d", rng[0], rng[1])))
+		if err != nil {
+			// The status is already sent, all that's left to do is to cut the response short
+			reportError("proxy photo range from S3", err, albumErrorContext(p.album))
+			return
+		}
+
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {aws.StringValue(head.ContentType)},
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", rng[0], rng[1], size)},
+		})
+		if err == nil {
+			_, err = io.Copy(part, out.Body)
+		}
+		out.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+	mw.Close()
+}
+
+/*
+Serves a photo (or video) from the bucket through 50mm, for sites with ProxyPhotos. Conditional and range requests are
+passed on to S3, so browsers can revalidate their cached copies and video players can seek without downloading
+everything. If-None-Match is answered straight away when it has the ETag from the album's last refresh.
+*/
+func handleProxyPhoto(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	if !checkHotlink(w, r, album.site) {
+		return
+	}
+	if album.BlurFaces {
+		serveBlurredPhoto(album, w, r)
+		return
+	}
+	if album.site.GetQuotaExceeded() == QUOTA_THUMBNAILS && album.site.OverQuota() {
+		serveQuotaThumbnail(album, w, r)
+		return
+	}
+	if album.needsDownscaling(r.Context(), album.keyForSlug(r.PathValue("slug"))) {
+		serveDownscaledPhoto(album, w, r)
+		return
+	}
+
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+	p := newProxyRequest(album, svc, r)
+	if checkNotModified(w, r, album, p.etag) {
+		return
+	}
+
+	ranges, err := parseByteRanges(r.Header.Get("Range"))
+	if err != nil || len(ranges) > PROXY_MAX_RANGES {
+		ranges = nil
+	}
+
+	// HEAD requests, and range requests that need the object's size or validators first
+	var head *s3.HeadObjectOutput
+	if r.Method == http.MethodHead || len(ranges) > 1 || (len(ranges) > 0 && r.Header.Get("If-Range") != "") {
+		if head, err = p.head(r); err != nil {
+			p.writeError(w, r, err)
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			writeProxyHeaders(w, album, &proxyObject{head.ContentType, head.ContentLength, nil, head.ETag, head.LastModified, head.CacheControl})
+			return
+		}
+		if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, head.ETag, head.LastModified) {
+			ranges = nil
+		}
+	}
+
+	if len(ranges) > 1 {
+		serveProxyRanges(w, r, p, head, ranges)
+		return
+	}
+
+	var objectRange *string
+	if len(ranges) == 1 {
+		objectRange = aws.String(ranges[0].header())
+	}
+	out, err := p.get(r, objectRange)
+	if err != nil {
+		p.writeError(w, r, err)
+		return
+	}
+	defer out.Body.Close()
+
+	writeProxyHeaders(w, album, &proxyObject{out.ContentType, out.ContentLength, out.ContentRange, out.ETag, out.LastModified, out.CacheControl})
+	if out.ContentRange != nil {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	io.Copy(w, out.Body)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestParseByteRanges(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    []*byteRange
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"bytes=0-499", []*byteRange{{0, 499}}, false},
+		{"bytes=500-", []*byteRange{{500, -1}}, false},
+		{"bytes=-500", []*byteRange{{-1, 500}}, false},
+		{"bytes=0-0, 10-19,-5", []*byteRange{{0, 0}, {10, 19}, {-1, 5}}, false},
+		{"bytes= 0-9 , 20-29 ", []*byteRange{{0, 9}, {20, 29}}, false},
+		{"items=0-9", nil, true},
+		{"bytes=", nil, true},
+		{"bytes=-", nil, true},
+		{"bytes=9-0", nil, true},
+		{"bytes=a-9", nil, true},
+		{"bytes=0-b", nil, true},
+		{"bytes=-1-2", nil, true},
+		{"bytes=0-9,", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseByteRanges(test.header)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseByteRanges(%q) error = %v, want error %v", test.header, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseByteRanges(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestByteRangeResolve(t *testing.T) {
+	tests := []struct {
+		br         byteRange
+		start, end int64
+		ok         bool
+	}{
+		{byteRange{0, 9}, 0, 9, true},
+		{byteRange{90, 200}, 90, 99, true},
+		{byteRange{50, -1}, 50, 99, true},
+		{byteRange{-1, 10}, 90, 99, true},
+		{byteRange{-1, 500}, 0, 99, true},
+		{byteRange{-1, 0}, 0, 0, false},
+		{byteRange{100, -1}, 100, 99, false},
+	}
+	for _, test := range tests {
+		start, end, ok := test.br.resolve(100)
+		if start != test.start || end != test.end || ok != test.ok {
+			t.Errorf("%v.resolve(100) = %d, %d, %v, want %d, %d, %v", test.br, start, end, ok, test.start, test.end, test.ok)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	modified := time.Date(2024, 6, 12, 14, 32, 0, 0, time.UTC)
+	etag := `"abc"`
+	tests := []struct {
+		ifRange      string
+		etag         *string
+		lastModified *time.Time
+		want         bool
+	}{
+		{`"abc"`, &etag, &modified, true},
+		{`"def"`, &etag, &modified, false},
+		{`W/"abc"`, &etag, &modified, false},
+		{`"abc"`, nil, &modified, false},
+		{modified.Format(http.TimeFormat), &etag, &modified, true},
+		{modified.Add(time.Hour).Format(http.TimeFormat), &etag, &modified, true},
+		{modified.Add(-time.Hour).Format(http.TimeFormat), &etag, &modified, false},
+		{modified.Format(http.TimeFormat), &etag, nil, false},
+	}
+	for _, test := range tests {
+		if got := ifRangeMatches(test.ifRange, test.etag, test.lastModified); got != test.want {
+			t.Errorf("ifRangeMatches(%q) = %v, want %v", test.ifRange, got, test.want)
+		}
+	}
+}
+
+// An album with ProxyPhotos whose bucket is a fixture bucket with one 1000 byte video in it
+func newProxyTestAlbum(t *testing.T) (*Album, []byte) {
+	root := t.TempDir()
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "trip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "trip", "clip.mp4"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := startFixtureBucket(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bucket.Close)
+
+	app = &App{dataDir: t.TempDir(), sites: make(map[string]*Site)}
+	s := &Site{Domain: "photos.example.com", BucketName: FIXTURE_BUCKET, BucketRegion: FIXTURE_REGION, ProxyPhotos: true}
+	if s.awsSession, err = session.NewSession(&aws.Config{
+		Region:           aws.String(FIXTURE_REGION),
+		Endpoint:         aws.String(bucket.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials(FIXTURE_CREDENTIAL, FIXTURE_CREDENTIAL, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	album, err := NewAlbum(s, "/trip/", "trip/", "", "", "Trip", "Trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return album, content
+}
+
+func proxyTestRequest(album *Album, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/trip/media/clip.mp4", nil)
+	r.SetPathValue("slug", "clip.mp4")
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handleProxyPhoto(album, w, r)
+	return w
+}
+
+func TestProxyRanges(t *testing.T) {
+	album, content := newProxyTestAlbum(t)
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		status       int
+		body         []byte
+		contentRange string
+	}{
+		{"whole", "", http.StatusOK, content, ""},
+		{"single", "bytes=10-19", http.StatusPartialContent, content[10:20], "bytes 10-19/1000"},
+		{"open ended", "bytes=990-", http.StatusPartialContent, content[990:], "bytes 990-999/1000"},
+		{"suffix", "bytes=-5", http.StatusPartialContent, content[995:], "bytes 995-999/1000"},
+		{"invalid", "bytes=9-0", http.StatusOK, content, ""},
+		{"unsatisfiable", "bytes=5000-", http.StatusRequestedRangeNotSatisfiable, nil, "bytes */1000"},
+		{"just past the end", "bytes=1000-1009", http.StatusRequestedRangeNotSatisfiable, nil, "bytes */1000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.rangeHeader != "" {
+				header.Set("Range", test.rangeHeader)
+			}
+			w := proxyTestRequest(album, header)
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.body != nil && !bytes.Equal(w.Body.Bytes(), test.body) {
+				t.Errorf("body = %q, want %q", w.Body.Bytes(), test.body)
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, test.contentRange)
+			}
+		})
+	}
+}
+
+func TestProxyMultipleRanges(t *testing.T) {
+	album, content := newProxyTestAlbum(t)
+
+	w := proxyTestRequest(album, http.Header{"Range": {"bytes=0-4, 500-509, -3"}})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", w.Header().Get("Content-Type"))
+	}
+
+	want := []struct {
+		contentRange string
+		body         []byte
+	}{
+		{"bytes 0-4/1000", content[0:5]},
+		{"bytes 500-509/1000", content[500:510]},
+		{"bytes 997-999/1000", content[997:]},
+	}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for i, part := range want {
+		p, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if got := p.Header.Get("Content-Range"); got != part.contentRange {
+			t.Errorf("part %d Content-Range = %q, want %q", i, got, part.contentRange)
+		}
+		body, _ := io.ReadAll(p)
+		if !bytes.Equal(body, part.body) {
+			t.Errorf("part %d body = %q, want %q", i, body, part.body)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected %d parts, got more (%v)", len(want), err)
+	}
+}
+
+func TestProxyIfRange(t *testing.T) {
+	album, content := newProxyTestAlbum(t)
+	etag := proxyTestRequest(album, nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("the proxied video has no ETag")
+	}
+
+	w := proxyTestRequest(album, http.Header{"Range": {"bytes=0-9"}, "If-Range": {etag}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[:10]) {
+		t.Errorf("matching If-Range: status = %d, body = %q, want the range", w.Code, w.Body.Bytes())
+	}
+
+	w = proxyTestRequest(album, http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"changed"`}})
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("stale If-Range: status = %d, body is %d bytes, want the whole video", w.Code, w.Body.Len())
+	}
+}
+
+func TestProxyS3Busy(t *testing.T) {
+	album, _ := newProxyTestAlbum(t)
+
+	// Every S3 slot of the album is taken, and the request gives up waiting for one
+	for i := 0; i < album.GetS3Concurrency(); i++ {
+		release, err := album.acquireS3(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	r := httptest.NewRequest(http.MethodGet, "/trip/media/clip.mp4", nil).WithContext(ctx)
+	r.SetPathValue("slug", "clip.mp4")
+	w := httptest.NewRecorder()
+	handleProxyPhoto(album, w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
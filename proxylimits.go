@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const DEFAULT_MAX_OBJECT_MB = 200
+
+// Not a limit on the photos themselves, just on downscaled copies of them, which are kept with the other derivatives
+const MIN_MAX_PROXY_DIMENSION = 200
+
+var downscalableExtensions = []string{".jpg", ".jpeg", ".png"}
+
+var errObjectTooLarge = errors.New("The file is bigger than the site's MaxObjectMB")
+
+func (s *Site) GetMaxObjectBytes() int64 {
+	if s.MaxObjectMB > 0 {
+		return int64(s.MaxObjectMB) * 1024 * 1024
+	}
+	return DEFAULT_MAX_OBJECT_MB * 1024 * 1024
+}
+
+func validateProxyLimits(s *Site) error {
+	if s.MaxObjectMB < 0 {
+		return errors.New("MaxObjectMB can't be negative")
+	}
+	if s.MaxProxyDimension != 0 && s.MaxProxyDimension < MIN_MAX_PROXY_DIMENSION {
+		return fmt.Errorf("MaxProxyDimension must be 0 (off) or at least %d", MIN_MAX_PROXY_DIMENSION)
+	}
+	return nil
+}
+
+/*
+Reads an object like io.ReadAll, unless it's bigger than the limit, usually the site's MaxObjectMB. S3 says how big the
+object is up front, but the body is cut off at the limit anyway, in case it's bigger than S3 said. A limit of 0 reads
+objects of any size.
+*/
+func readObjectBody(body io.Reader, contentLength *int64, limit int64) ([]byte, error) {
+	if limit == 0 {
+		return io.ReadAll(body)
+	}
+	if contentLength != nil && *contentLength > limit {
+		return nil, errObjectTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errObjectTooLarge
+	}
+	return data, nil
+}
+
+func (s *Site) downscaledPhotoKind() string {
+	return fmt.Sprintf("proxy-%d-v1", s.MaxProxyDimension)
+}
+
+// Whether a photo is too big to be proxied as is. Photos 50mm couldn't read the size of are served as they are.
+func (a *Album) needsDownscaling(ctx context.Context, key string) bool {
+	if a.site.MaxProxyDimension <= 0 || !hasExtension(key, downscalableExtensions) {
+		return false
+	}
+	photoExif, err := a.GetPhotoExif(ctx, key)
+	if err != nil {
+		return false
+	}
+	return max(photoExif.Width, photoExif.Height) > a.site.MaxProxyDimension
+}
+
+func (a *Album) buildDownscaledPhoto(ctx context.Context, key string) ([]byte, error) {
+	data, err := a.getObjectData(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return resizeImage(data, http.DetectContentType(data), a.site.MaxProxyDimension, a.site.GetColorProfile())
+}
+
+/*
+Serves a copy of a photo no bigger than the site's MaxProxyDimension, for sites where someone might upload a 100
+megapixel scan that would take phones ages to download and decode. Copies are made once and kept with the other
+derivatives. Photos too big to even read (see MaxObjectMB) aren't served at all.
+*/
+func serveDownscaledPhoto(album *Album, w http.ResponseWriter, r *http.Request) {
+	key := album.keyForSlug(r.PathValue("slug"))
+	kind := album.site.downscaledPhotoKind()
+	etag := ""
+	if original := album.cachedETag(key); original != "" {
+		etag = strings.TrimSuffix(original, `"`) + "-" + kind + `"`
+	}
+	if checkNotModified(w, r, album, etag) {
+		return
+	}
+
+	data, err := album.GetDerivative(r.Context(), kind, key, func(ctx context.Context) ([]byte, error) {
+		return album.buildDownscaledPhoto(ctx, key)
+	})
+	if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	}
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
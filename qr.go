@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const QR_SLUG = "qr.png"
+
+const DEFAULT_QR_SIZE = 512
+const MAX_QR_SIZE = 2048
+
+// Serves a PNG QR code of the album URL, handy for printing on event signage
+func handleAlbumQRCode(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	size := DEFAULT_QR_SIZE
+	if s, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil && s > 0 && s <= MAX_QR_SIZE {
+		size = s
+	}
+
+	png, err := qrcode.Encode(album.GetPageUrl(), qrcode.Medium, size)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(png)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const QUOTA_STATE_FILE = "quota.json"
+const QUOTA_SAVE_INTERVAL = 1 * time.Minute
+
+// What a site does once it's over its monthly quota
+const QUOTA_UNAVAILABLE = "unavailable"
+const QUOTA_AUTH = "auth"
+const QUOTA_THUMBNAILS = "thumbnails"
+
+var QUOTA_BEHAVIOURS = []string{QUOTA_UNAVAILABLE, QUOTA_AUTH, QUOTA_THUMBNAILS}
+
+// Sites over their quota in thumbnails mode serve proxied photos at this size, made once and kept as derivatives
+const QUOTA_THUMBNAIL_SIZE = 800
+const DERIVATIVE_QUOTA_THUMBNAIL = "thumb-800-v2"
+
+type QuotaUsage struct {
+	Month    string // Like 2024-05, usage starts from zero every month
+	Bytes    int64
+	Requests int64
+	Notified bool
+}
+
+type QuotaTracker struct {
+	mutex sync.Mutex
+	usage map[string]*QuotaUsage
+	dirty bool
+}
+
+var quotas = &QuotaTracker{usage: make(map[string]*QuotaUsage)}
+
+func currentQuotaMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// Loads the usage saved by the last run, so restarting the server doesn't reset the month's budget
+func (q *QuotaTracker) Load() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return loadJSONState(QUOTA_STATE_FILE, &q.usage)
+}
+
+func (q *QuotaTracker) Save() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.dirty {
+		return nil
+	}
+	if err := saveJSONState(QUOTA_STATE_FILE, q.usage); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+// Saves the usage every now and then. A crash loses at most QUOTA_SAVE_INTERVAL of it.
+func (q *QuotaTracker) SaveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := q.Save(); err != nil {
+			fmt.Printf("Unable to save quota usage. Error: %s\n", err.Error())
+		}
+	}
+}
+
+// Must be called with the mutex held
+func (q *QuotaTracker) siteUsage(domain string) *QuotaUsage {
+	month := currentQuotaMonth()
+	usage, ok := q.usage[domain]
+	if !ok || usage.Month != month {
+		usage = &QuotaUsage{Month: month}
+		q.usage[domain] = usage
+	}
+	return usage
+}
+
+func (q *QuotaTracker) Add(domain string, bytes int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	usage := q.siteUsage(domain)
+	usage.Bytes += bytes
+	usage.Requests++
+	q.dirty = true
+}
+
+func (s *Site) HasQuota() bool {
+	return s.MonthlyBandwidthMB > 0 || s.MonthlyRequests > 0
+}
+
+func (s *Site) GetQuotaExceeded() string {
+	return firstNonEmpty(s.QuotaExceeded, QUOTA_UNAVAILABLE)
+}
+
+func validateQuota(s *Site) error {
+	if s.MonthlyBandwidthMB < 0 || s.MonthlyRequests < 0 {
+		return fmt.Errorf("MonthlyBandwidthMB and MonthlyRequests can't be negative")
+	}
+
+	known := false
+	for _, b := range QUOTA_BEHAVIOURS {
+		known = known || s.GetQuotaExceeded() == b
+	}
+	if !known {
+		return fmt.Errorf("QuotaExceeded must be one of %s", strings.Join(QUOTA_BEHAVIOURS, ", "))
+	}
+	if s.GetQuotaExceeded() == QUOTA_AUTH && !s.HasAuth() {
+		return fmt.Errorf("QuotaExceeded = %s needs the site's AuthUser and AuthPass", QUOTA_AUTH)
+	}
+	return nil
+}
+
+// Whether the site has used up its bandwidth or request budget for the month
+func (s *Site) OverQuota() bool {
+	if !s.HasQuota() {
+		return false
+	}
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	usage := quotas.siteUsage(s.Domain)
+	over := (s.MonthlyBandwidthMB > 0 && usage.Bytes >= int64(s.MonthlyBandwidthMB)*1024*1024) ||
+		(s.MonthlyRequests > 0 && usage.Requests >= int64(s.MonthlyRequests))
+	if over && !usage.Notified {
+		usage.Notified = true
+		quotas.dirty = true
+		fmt.Printf("Site %s is over its quota for %s, %d requests and %d MB so far\n", s.Domain, usage.Month, usage.Requests,
+			usage.Bytes/1024/1024)
+	}
+	return over
+}
+
+func secondsUntilNextMonth() int {
+	now := time.Now().UTC()
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return int(next.Sub(now).Seconds()) + 1
+}
+
+/*
+Counts every request and the bytes sent against the site's monthly quota, and once it's used up, either turns visitors
+away, asks them for the site's password, or lets the photo proxy serve thumbnails instead of the originals. Only traffic
+that goes through 50mm is counted, photos served by S3 or Imgix directly don't show up here.
+*/
+func quotaMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := recordStatus(w)
+			before := rec.bytes
+			defer func() {
+				quotas.Add(site.Domain, int64(rec.bytes-before))
+			}()
+
+			if site.OverQuota() {
+				switch site.GetQuotaExceeded() {
+				case QUOTA_UNAVAILABLE:
+					rec.Header().Set("Retry-After", fmt.Sprint(secondsUntilNextMonth()))
+					renderErrorPage(site, rec, http.StatusServiceUnavailable, "This site has used up its bandwidth for the month.")
+					return
+				case QUOTA_AUTH:
+					if !checkAndRequireAuth(rec, r, site) {
+						return
+					}
+				}
+			}
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+var errNoQuotaThumbnail = errors.New("Only JPEGs and PNGs can be shrunk")
+
+// Reads a whole object from the bucket, for derivatives that need all of it, if it's no bigger than MaxObjectMB
+func (a *Album) getObjectData(ctx context.Context, key string) ([]byte, error) {
+	return a.getObjectDataUpTo(ctx, key, a.site.GetMaxObjectBytes())
+}
+
+// Like getObjectData, with a limit in bytes of its own, where 0 is no limit
+func (a *Album) getObjectDataUpTo(ctx context.Context, key string, limit int64) ([]byte, error) {
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(a.site.BucketName), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	return readObjectBody(obj.Body, obj.ContentLength, limit)
+}
+
+// Makes a small copy of a photo for sites over their quota. Videos and other files that can't be shrunk return an error.
+func (a *Album) buildQuotaThumbnail(ctx context.Context, key string) ([]byte, error) {
+	data, err := a.getObjectData(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, errNoQuotaThumbnail
+	}
+	return resizeImage(data, contentType, QUOTA_THUMBNAIL_SIZE, a.site.GetColorProfile())
+}
+
+func serveQuotaThumbnail(album *Album, w http.ResponseWriter, r *http.Request) {
+	key := album.keyForSlug(r.PathValue("slug"))
+	data, err := album.GetDerivative(r.Context(), DERIVATIVE_QUOTA_THUMBNAIL, key, func(ctx context.Context) ([]byte, error) {
+		return album.buildQuotaThumbnail(ctx, key)
+	})
+	if err == errNoQuotaThumbnail {
+		renderErrorPage(album.site, w, http.StatusServiceUnavailable, "This site has used up its bandwidth for the month.")
+		return
+	} else if err != nil {
+		writeProxyError(w, r, album, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A simple in-memory sliding window rate limiter. Each key (usually a client IP) can make `limit` requests in any `window`
+long period.
+*/
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mutex     sync.Mutex
+	hits      map[string][]time.Time
+	lastPrune time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string][]time.Time),
+	}
+}
+
+func (l *RateLimiter) Allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+
+	recent := l.recent(key, cutoff)
+	if len(recent) >= l.limit {
+		return false
+	}
+
+	l.hits[key] = append(recent, now)
+	if now.Sub(l.lastPrune) > l.window {
+		l.prune(cutoff)
+		l.lastPrune = now
+	}
+	return true
+}
+
+// Tells whether the key has used up its requests, without counting this as one
+func (l *RateLimiter) Exceeded(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.recent(key, time.Now().Add(-l.window))) >= l.limit
+}
+
+// Forgets the key's requests from before the cutoff and returns the rest
+func (l *RateLimiter) recent(key string, cutoff time.Time) []time.Time {
+	if len(l.hits[key]) == 0 {
+		return nil
+	}
+	recent := l.hits[key][:0]
+	for _, t := range l.hits[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	l.hits[key] = recent
+	return recent
+}
+
+// Drops keys that haven't been seen in a while so the map doesn't grow forever
+func (l *RateLimiter) prune(cutoff time.Time) {
+	for key, times := range l.hits {
+		if len(times) == 0 || times[len(times)-1].Before(cutoff) {
+			delete(l.hits, key)
+		}
+	}
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 50mm is usually deployed behind a reverse proxy on the same machine, so requests from a loopback address are trusted
+func fromTrustedProxy(r *http.Request) bool {
+	ip := net.ParseIP(remoteHost(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+Returns the IP address of the client making the request. Behind a trusted proxy that's the last entry of the
+X-Forwarded-For header, which is the one added by the proxy itself.
+*/
+func clientIP(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+
+	return remoteHost(r)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+type ErrorPageContext struct {
+	*BasePageContext
+
+	Status    int
+	Message   string
+	RequestID string
+}
+
+/*
+Renders the themed error page, falling back to plain text if the error template itself is broken. The request's ID is
+already in the response headers, so the page can show it without every caller passing the request.
+*/
+func renderErrorPage(site *Site, w http.ResponseWriter, status int, message string) {
+	requestID := w.Header().Get(REQUEST_ID_HEADER)
+	ctx := &ErrorPageContext{
+		&BasePageContext{
+			site.GetCanonicalUrl().String(),
+			site.GetCanonicalUrl().String(),
+			site.GetCanonicalUrl().String(),
+			fmt.Sprintf("%s | %s", http.StatusText(status), site.SiteTitle),
+			site.SiteTitle,
+			site.GetNavigation(),
+			site.GetLanguage(),
+			site.GetTheme(),
+			site.GetPhotoWidth(false),
+			false,
+			newSiteView(site),
+		},
+		status,
+		message,
+		requestID,
+	}
+
+	body, err := renderTemplate("error.html", ctx)
+	if err != nil {
+		fmt.Printf("Unable to render error page. Error: %s\n", err.Error())
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(message + "\n"))
+		if requestID != "" {
+			w.Write([]byte("Request " + requestID + "\n"))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+/*
+Catches panics in handlers so a bug in one page shows the visitor an error page instead of a dropped connection. Every
+site router starts with this middleware.
+*/
+func recoveryMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := recordStatus(w)
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					// Handlers use this to abort responses on purpose, net/http knows what to do with it
+					panic(p)
+				}
+
+				fmt.Printf("Panic serving %s %s%s for %s (request %s): %v\n%s", r.Method, r.Host, r.URL.RequestURI(), clientIP(r),
+					requestID(r), p, debug.Stack())
+				reportPanic(p, r)
+
+				// If the handler already started writing the response, all we can do is stop
+				if rec.status == 0 {
+					renderErrorPage(site, rec, http.StatusInternalServerError, "Something went wrong while loading this page.")
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+/*
+Renderers let files that aren't photos, like videos, PDFs or 360° photos, be shown in albums with their own type, without
+changes to how albums pick photo types. A renderer claims keys with Matches and makes a Renderable for each of them.
+Register them from an init function:
+
+	func init() {
+		RegisterRenderer(&Renderer{
+			Type:    "pdf",
+			Matches: func(key string) bool { return strings.HasSuffix(strings.ToLower(key), ".pdf") },
+			New:     func(a *Album, key string) Renderable { return &PdfDocument{Key: key, Url: a.GetMediaUrl(key)} },
+		})
+	}
+
+Renderables that embed photoInfo get their size, paired file, sensitive flag and metadata filled in like photos, New
+can add metadata of its own with setMetadata, and templates read it as {{$photo.Metadata.name}}. Ones with a
+Template are shown with that template, in the album grid and on their own page, instead of an image. Define it in a
+file in templates/partials, like {{define "pdf"}}...{{end}}.
+*/
+type Renderer struct {
+	Type    string
+	Matches func(key string) bool
+	New     func(a *Album, key string) Renderable
+}
+
+// In the order they were registered, the first one that matches a key wins
+var rendererRegistry []*Renderer
+
+func RegisterRenderer(r *Renderer) {
+	for _, existing := range rendererRegistry {
+		if existing.Type == r.Type {
+			panic(fmt.Sprintf("A renderer for %s is already registered", r.Type))
+		}
+	}
+	rendererRegistry = append(rendererRegistry, r)
+}
+
+func rendererForKey(key string) *Renderer {
+	for _, r := range rendererRegistry {
+		if r.Matches(key) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Implemented by everything that embeds photoInfo, so albums can fill it in whatever the type
+type photoDetails interface {
+	details() *photoInfo
+}
+
+func (p *photoInfo) details() *photoInfo {
+	return p
+}
+
+// What a Renderable's template gets: the Renderable, and the page it's on for things like .Page.Lang
+type RenderableTemplateContext struct {
+	Photo     Renderable
+	Page      interface{}
+	PhotoPage bool // On its own page rather than in the album grid
+}
+
+// Runs a Renderable's template, for {{renderTemplate $photo $}} in album and photo pages
+func renderRenderableTemplate(photo Renderable, page interface{}) (template.HTML, error) {
+	var buf bytes.Buffer
+	_, photoPage := page.(*ImagePageContext)
+	if err := templates.ExecuteTemplate(&buf, photo.Template(), &RenderableTemplateContext{photo, page, photoPage}); err != nil {
+		return "", err
+	}
+	return template.HTML(strings.TrimSpace(buf.String())), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// Longer IDs from proxies are replaced, they'd only bloat the logs
+const MAX_REQUEST_ID_LENGTH = 128
+
+type requestIDKey struct{}
+
+// Counts the IDs made without the random source, so they're still unique within this process
+var fallbackRequestIDs uint64
+
+/*
+IDs are random, so they can't be guessed or collide across servers. Without a random source they're made of the time and
+a counter instead, a request shouldn't fail over its ID.
+*/
+func newRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&fallbackRequestIDs, 1))
+	}
+	return hex.EncodeToString(b)
+}
+
+// IDs end up in logs and headers, so anything but letters, digits and a few separators is refused
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+/*
+Gives every request an ID, sent back in the X-Request-ID header and shown on error pages, so a visitor reporting a
+problem can give operators something to find in the logs. Proxies we trust (the same ones clientIP trusts) can pass
+their own ID along, so one ID follows the request through both logs. The ID is also in Server-Timing, where browser dev
+tools show it next to the timings.
+*/
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		if fromTrustedProxy(r) && isValidRequestID(r.Header.Get(REQUEST_ID_HEADER)) {
+			id = r.Header.Get(REQUEST_ID_HEADER)
+		} else {
+			id = newRequestID()
+		}
+
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		w.Header().Add("Server-Timing", `request;desc="`+id+`"`)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Adds the request's ID to the context of an error report, so the report can be matched with the visitor's
+func requestErrorContext(r *http.Request, ctx ErrorContext) ErrorContext {
+	if id := requestID(r); id != "" {
+		ctx["request_id"] = id
+	}
+	return ctx
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const ROBOTS_PATH = "/robots.txt"
+
+/*
+Tells crawlers what not to look at: albums that aren't Crawlable, the site's RobotsDisallow paths, and paths no crawler
+has any business with, like zips and downloads. Every album listed here is given away to anyone reading the file, so
+albums that are only meant to be found through their link are better off with a password.
+*/
+func (s *Site) robotsTxt() string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+
+	var disallowed []string
+	for _, a := range s.Albums {
+		if !a.Crawlable {
+			disallowed = append(disallowed, a.Path)
+			// Without the slash the page is its own path, which mustn't match other albums starting with the same name
+			if a.pagePath() != a.Path {
+				disallowed = append(disallowed, a.pagePath()+"$")
+			}
+			continue
+		}
+		disallowed = append(disallowed, a.Path+DOWNLOAD_SLUG)
+		if a.HasZipDownload() {
+			disallowed = append(disallowed, a.Path+ZIP_SLUG)
+		}
+		if a.HasGuestUpload() {
+			disallowed = append(disallowed, a.Path+GUEST_UPLOAD_SLUG+"/")
+		}
+	}
+	disallowed = append(disallowed, s.RobotsDisallow...)
+
+	if len(disallowed) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+	for _, p := range disallowed {
+		fmt.Fprintf(&b, "Disallow: %s\n", p)
+	}
+	if s.RobotsCrawlDelay > 0 {
+		fmt.Fprintf(&b, "Crawl-delay: %d\n", s.RobotsCrawlDelay)
+	}
+	if s.SitemapUrl != "" {
+		fmt.Fprintf(&b, "\nSitemap: %s\n", s.SitemapUrl)
+	}
+	return b.String()
+}
+
+func validateRobots(s *Site) error {
+	if s.RobotsCrawlDelay < 0 {
+		return errors.New("RobotsCrawlDelay can't be negative")
+	}
+	for _, p := range s.RobotsDisallow {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, " \n") {
+			return fmt.Errorf("RobotsDisallow must be paths starting with /, not %q", p)
+		}
+	}
+	if s.SitemapUrl != "" {
+		if u, err := url.Parse(s.SitemapUrl); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("SitemapUrl must be a full URL, like https://photos.example.com/sitemap.xml")
+		}
+	}
+	return nil
+}
+
+func handleRobotsTxt(site *Site, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	fmt.Fprint(w, site.robotsTxt())
+}
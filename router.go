@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+type AlbumHandlerFunc func(album *Album, w http.ResponseWriter, r *http.Request)
+type SiteHandlerFunc func(site *Site, w http.ResponseWriter, r *http.Request)
+
+/*
+Every site gets its own router, built once when the config is loaded. Albums are registered on their configured paths,
+so adding a route for an album is a matter of adding a line to registerAlbumRoutes.
+*/
+type Router struct {
+	site *Site
+	mux  *http.ServeMux
+
+	middleware []Middleware
+	handler    http.Handler
+}
+
+func NewRouter(site *Site) (router *Router, err error) {
+	router = &Router{
+		site: site,
+		mux:  http.NewServeMux(),
+	}
+
+	// ServeMux panics on conflicting patterns, which for us means two albums configured with clashing paths
+	defer func() {
+		if r := recover(); r != nil {
+			router, err = nil, fmt.Errorf("Unable to configure routes for site %s. Error: %v", site.Domain, r)
+		}
+	}()
+
+	router.registerSiteRoutes()
+	for _, album := range site.Albums {
+		router.registerAlbumRoutes(album)
+	}
+
+	router.handler = router.mux
+	router.Use(methodsMiddleware(router.mux, router.checkOptions), recoveryMiddleware(site), canonicalPathMiddleware(site))
+	return router, nil
+}
+
+// Adds middleware around every route of the site. Middleware added first runs first.
+func (rt *Router) Use(middleware ...Middleware) {
+	rt.middleware = append(rt.middleware, middleware...)
+
+	rt.handler = rt.mux
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		rt.handler = rt.middleware[i](rt.handler)
+	}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler.ServeHTTP(w, r)
+}
+
+func (rt *Router) handleSite(pattern string, handler SiteHandlerFunc) {
+	rt.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		handler(rt.site, w, r)
+	})
+}
+
+// Like handleSite, but asks for the site credentials first if the site has auth
+func (rt *Router) handleSiteWithAuth(pattern string, handler SiteHandlerFunc) {
+	rt.handleSite(pattern, func(site *Site, w http.ResponseWriter, r *http.Request) {
+		if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
+			return
+		}
+		handler(site, w, r)
+	})
+}
+
+func (rt *Router) handleAlbum(method string, album *Album, route string, handler AlbumHandlerFunc) {
+	rt.mux.HandleFunc(method+" "+escapePatternPath(album.Path)+route, func(w http.ResponseWriter, r *http.Request) {
+		if !requirePublished(album, w) {
+			return
+		}
+		handler(album, w, r)
+	})
+}
+
+/*
+OPTIONS tells which routes an album has, so it's only answered for albums the request could see: published ones, and
+with the album's credentials for albums with auth. Paths outside of albums are answered as they are.
+*/
+func (rt *Router) checkOptions(w http.ResponseWriter, r *http.Request) bool {
+	var album *Album
+	for _, a := range rt.site.Albums {
+		if strings.HasPrefix(r.URL.Path, a.Path) && (album == nil || len(a.Path) > len(album.Path)) {
+			album = a
+		}
+	}
+	if album == nil {
+		return true
+	}
+	if !requirePublished(album, w) {
+		return false
+	}
+	return !album.HasAuth() || checkAndRequireAuth(w, r, album)
+}
+
+func (rt *Router) registerSiteRoutes() {
+	site := rt.site
+
+	rt.handleSite("GET "+OEMBED_PATH, handleOEmbed)
+	if site.GetAuthMode() == AUTH_MODE_COOKIE {
+		rt.handleSite("POST "+LOGIN_PATH, handleLogin)
+	}
+	// A POST, so links and prefetching browsers can't log visitors out
+	rt.handleSite("POST "+LOGOUT_PATH, handleLogout)
+	rt.handleSiteWithAuth("GET "+CALENDAR_PATH, handleCalendar)
+
+	if site.HasAlbumIndex {
+		rt.handleSiteWithAuth("GET /{$}", handleAlbumsIndex)
+	}
+
+	if site.AppManifest {
+		rt.handleSite("GET "+APP_MANIFEST_PATH, handleAppManifest)
+		rt.handleSite("GET "+APP_ICON_PATH+"{name}", handleAppIcon)
+	}
+
+	if site.RobotsTxt {
+		rt.handleSite("GET "+ROBOTS_PATH, handleRobotsTxt)
+	}
+
+	if site.OfflineCache {
+		rt.handleSite("GET "+SERVICE_WORKER_PATH, handleServiceWorker)
+	}
+
+	if site.BucketWebhookSecret != "" {
+		rt.handleSite("POST "+BUCKET_WEBHOOK_PATH, handleBucketWebhook)
+	}
+
+	// Whatever no other route matches, so exact URLs never pay for the lenient lookup
+	if site.LenientUrls || site.hasFormerPrefixes() {
+		rt.handleSite("/", handleUnmatchedUrl)
+	}
+
+	if site.ActivityPub {
+		rt.handleSite("GET "+WEBFINGER_PATH, handleWebfinger)
+		rt.handleSite("GET "+ACTIVITYPUB_ACTOR_PATH, handleActivityPubActor)
+		rt.handleSite("POST "+ACTIVITYPUB_INBOX_PATH, handleActivityPubInbox)
+		rt.handleSite("GET "+ACTIVITYPUB_OUTBOX_PATH, handleActivityPubOutbox)
+	}
+}
+
+func (rt *Router) registerAlbumRoutes(album *Album) {
+	rt.handleAlbum("GET", album, "{$}", handleAlbumPage)
+	rt.handleAlbum("GET", album, EMBED_SLUG, handleAlbumEmbed)
+	rt.handleAlbum("GET", album, QR_SLUG, handleAlbumQRCode)
+	if album.OgImage {
+		rt.handleAlbum("GET", album, OG_IMAGE_SLUG, handleAlbumOgImage)
+	}
+	rt.handleAlbum("POST", album, CONTACT_SLUG, handleContactForm)
+	if album.HasContactSheet() {
+		rt.handleAlbum("GET", album, CONTACT_SHEET_SLUG, handleContactSheet)
+		rt.handleAlbum("GET", album, CONTACT_SHEET_SLUG+"/{slug}", handleContactSheetThumbnail)
+	}
+	if album.HasCompare() {
+		rt.handleAlbum("GET", album, COMPARE_SLUG, handleComparePage)
+	}
+	rt.handleAlbum("GET", album, IIIF_MANIFEST_SLUG, handleIIIFManifest)
+	if album.DeepZoom {
+		rt.handleAlbum("GET", album, IIIF_SLUG+"{slug}/info.json", handleIIIFInfo)
+		rt.handleAlbum("GET", album, IIIF_SLUG+"{slug}/{region}/{size}/{rotation}/{quality}", handleIIIFTile)
+	}
+	if album.HasZipDownload() {
+		rt.handleAlbum("POST", album, ZIP_SLUG, handleZipStart)
+		rt.handleAlbum("GET", album, ZIP_SLUG+"/{id}", handleZipStatus)
+		rt.handleAlbum("GET", album, ZIP_SLUG+"/{id}/file", handleZipFile)
+	}
+	if album.HasGuestUpload() {
+		rt.handleAlbum("GET", album, GUEST_UPLOAD_SLUG+"/{token}", handleGuestUploadPage)
+		rt.handleAlbum("POST", album, GUEST_UPLOAD_SLUG+"/{token}", handleGuestUpload)
+	}
+	if album.ProxiesPhotos() {
+		rt.handleAlbum("GET", album, MEDIA_SLUG+"{slug}", handleProxyPhoto)
+	}
+	rt.handleAlbum("GET", album, DOCUMENT_PREVIEW_SLUG+"{slug}", handleDocumentPreview)
+	rt.handleAlbum("GET", album, DOWNLOAD_SLUG+"{slug}", handleDownload)
+	rt.handleAlbum("GET", album, "{slug}", handlePhotoRoute)
+
+	if rt.site.ApiToken != "" {
+		rt.mux.HandleFunc("GET "+escapePatternPath(album.GetManifestPath()), func(w http.ResponseWriter, r *http.Request) {
+			handleAlbumManifest(album, w, r)
+		})
+	}
+}
+
+func handlePhotoRoute(album *Album, w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if album.ImageExists(r.Context(), slug) {
+		handleImagePage(slug, album, w, r)
+		return
+	}
+
+	if album.site.LenientUrls {
+		if match := album.matchSlugLeniently(slug); match != "" {
+			redirectLeniently(w, r, album.Path+match)
+			return
+		}
+	}
+
+	// Couldn't find the image in this album...just redirect to album
+	http.Redirect(w, r, album.Path, http.StatusMovedPermanently)
+}
+
+// Album paths come from config files and can contain anything, including characters that mean something in patterns
+func escapePatternPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
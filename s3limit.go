@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const S3_CONCURRENCY_ENV_VAR = "FIFTYMM_S3_CONCURRENCY"
+const DEFAULT_S3_CONCURRENCY = 64
+const DEFAULT_ALBUM_S3_CONCURRENCY = 4
+
+type albumS3Limit struct {
+	once      sync.Once
+	semaphore *Semaphore
+}
+
+// Limits how many things happen at once. A nil Semaphore doesn't limit anything.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+func init() {
+	metrics.RegisterGauge("fiftymm_s3_calls_in_flight", "Number of S3 API calls in progress.")
+}
+
+func NewSemaphore(n int) *Semaphore {
+	return &Semaphore{make(chan struct{}, n)}
+}
+
+// Waits for a free slot, or until the context is done
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Semaphore) Release() {
+	if s != nil {
+		<-s.slots
+	}
+}
+
+/*
+Waits until an S3 call can be made without going over the server wide limit. A burst of traffic to many albums with cold
+caches could otherwise run into S3's request rate limits, or run out of sockets. The returned function must be called
+once the call is done.
+*/
+func (s *Site) acquireS3(ctx context.Context) (func(), error) {
+	// Sites of a tenant share its slots first, so one tenant can't take all of the server wide ones
+	var tenantSemaphore *Semaphore
+	if s.tenant != nil {
+		tenantSemaphore = s.tenant.s3Semaphore
+	}
+	if err := tenantSemaphore.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := app.s3Semaphore.Acquire(ctx); err != nil {
+		tenantSemaphore.Release()
+		return nil, err
+	}
+
+	metrics.Add("fiftymm_s3_calls_in_flight", 1)
+	return func() {
+		metrics.Add("fiftymm_s3_calls_in_flight", -1)
+		app.s3Semaphore.Release()
+		tenantSemaphore.Release()
+	}, nil
+}
+
+// Like Site.acquireS3, but also keeps a single album from taking all of the server wide slots
+func (a *Album) acquireS3(ctx context.Context) (func(), error) {
+	a.s3Limit.once.Do(func() {
+		a.s3Limit.semaphore = NewSemaphore(a.GetS3Concurrency())
+	})
+
+	if err := a.s3Limit.semaphore.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	release, err := a.site.acquireS3(ctx)
+	if err != nil {
+		a.s3Limit.semaphore.Release()
+		return nil, err
+	}
+
+	return func() {
+		release()
+		a.s3Limit.semaphore.Release()
+	}, nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SCHEDULE_STATE_FILE = "schedule.json"
+const SCHEDULE_TICK_INTERVAL = 1 * time.Minute
+
+// Cron expressions that don't match any time within this long are treated as never firing, like 0 0 31 2 *
+const CRON_MAX_LOOKAHEAD = 5 * 366 * 24 * time.Hour
+
+// What a PublishSchedule entry can do to its album
+const SCHEDULE_PUBLISH = "publish"
+const SCHEDULE_UNPUBLISH = "unpublish"
+const SCHEDULE_REFRESH = "refresh"
+const SCHEDULE_ROTATE_COVER = "rotate-cover"
+
+var SCHEDULE_ACTIONS = []string{SCHEDULE_PUBLISH, SCHEDULE_UNPUBLISH, SCHEDULE_REFRESH, SCHEDULE_ROTATE_COVER}
+
+var cronShortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// A standard five field cron expression: minute, hour, day of month, month and day of week. Each field is a bit set.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Like cron, when both days are restricted a time matches if either of them does
+	domAny, dowAny bool
+}
+
+// Parses a field like *, */15, 1-5, 1,15 or 9-17/2 into a bit set of the values it matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			rangePart = part[:i]
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", part)
+				}
+			} else if step > 1 {
+				hi = max // 5/15 means every 15 starting at 5
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(expr string) (*CronSchedule, error) {
+	if shortcut, ok := cronShortcuts[expr]; ok {
+		expr = shortcut
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("'%s' needs 5 fields (minute hour day month weekday)", expr)
+	}
+
+	c := &CronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}} {
+		if *f.bits, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("'%s': %s", expr, err.Error())
+		}
+	}
+
+	// Sunday can be 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dowMatch
+	case c.dowAny:
+		return domMatch
+	}
+	return domMatch || dowMatch
+}
+
+// The first time after the given one that matches, or the zero time if there isn't one within CRON_MAX_LOOKAHEAD
+func (c *CronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(CRON_MAX_LOOKAHEAD)
+
+	// Whole months, days and hours that don't match are skipped at once
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			// Truncate works in UTC, which would skip whole hours in zones like +05:30
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// The last time in (after, until] that matches, or the zero time if none does
+func (c *CronSchedule) Last(after, until time.Time) time.Time {
+	var last time.Time
+	for t := c.Next(after); !t.IsZero() && !t.After(until); t = c.Next(t) {
+		last = t
+	}
+	return last
+}
+
+type ScheduleEntry struct {
+	Cron   *CronSchedule
+	Spec   string
+	Action string
+}
+
+/*
+Parses a PublishSchedule: entries separated by |, each a cron expression followed by an action, like
+"0 9 1 6 * publish | 0 0 * * 1 rotate-cover". Times are in the server's time zone.
+*/
+func parseSchedule(schedule string) ([]*ScheduleEntry, error) {
+	var entries []*ScheduleEntry
+	for _, part := range strings.Split(schedule, "|") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		i := strings.LastIndex(part, " ")
+		if i < 0 {
+			return nil, fmt.Errorf("PublishSchedule entry '%s' needs a cron expression and an action", part)
+		}
+		spec, action := strings.TrimSpace(part[:i]), part[i+1:]
+
+		known := false
+		for _, a := range SCHEDULE_ACTIONS {
+			known = known || action == a
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown PublishSchedule action '%s', use one of %s", action, strings.Join(SCHEDULE_ACTIONS, ", "))
+		}
+
+		cron, err := parseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PublishSchedule cron expression %s", err.Error())
+		}
+		entries = append(entries, &ScheduleEntry{cron, spec, action})
+	}
+	return entries, nil
+}
+
+func validatePublishSchedule(a *Album) error {
+	_, err := parseSchedule(a.PublishSchedule)
+	return err
+}
+
+// The album's schedule, already checked when the config was loaded
+func (a *Album) GetSchedule() []*ScheduleEntry {
+	entries, _ := parseSchedule(a.PublishSchedule)
+	return entries
+}
+
+type AlbumScheduleState struct {
+	Unpublished bool
+	CoverOffset int       // How many times the cover has been rotated
+	LastRun     time.Time // Entries due since then run on the next tick, including ones missed while the server was down
+}
+
+type Scheduler struct {
+	mutex  sync.Mutex
+	albums map[string]*AlbumScheduleState // By domain and album path
+}
+
+var scheduler = &Scheduler{albums: make(map[string]*AlbumScheduleState)}
+
+func scheduleAlbumKey(album *Album) string {
+	return album.site.Domain + album.Path
+}
+
+/*
+Albums new to the scheduler start unpublished if the next publish or unpublish in their schedule is a publish, so an
+album scheduled to go live in June stays hidden until then.
+*/
+func initialScheduleState(album *Album, now time.Time) *AlbumScheduleState {
+	state := &AlbumScheduleState{LastRun: now}
+
+	var next time.Time
+	for _, entry := range album.GetSchedule() {
+		if entry.Action != SCHEDULE_PUBLISH && entry.Action != SCHEDULE_UNPUBLISH {
+			continue
+		}
+		if t := entry.Cron.Next(now); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next, state.Unpublished = t, entry.Action == SCHEDULE_PUBLISH
+		}
+	}
+	return state
+}
+
+// Loads the saved state and sets up albums that were just given a schedule. Must be called after the config is loaded.
+func (s *Scheduler) Load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := loadJSONState(SCHEDULE_STATE_FILE, &s.albums); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	scheduled := make(map[string]*AlbumScheduleState)
+	for _, site := range app.sites {
+		for _, album := range site.Albums {
+			if album.PublishSchedule == "" {
+				continue
+			}
+			state, ok := s.albums[scheduleAlbumKey(album)]
+			if !ok {
+				state = initialScheduleState(album, now)
+			}
+			scheduled[scheduleAlbumKey(album)] = state
+		}
+	}
+	// Albums that lost their schedule go back to normal
+	s.albums = scheduled
+	return saveJSONState(SCHEDULE_STATE_FILE, s.albums)
+}
+
+func (s *Scheduler) state(album *Album) *AlbumScheduleState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if state, ok := s.albums[scheduleAlbumKey(album)]; ok {
+		snapshot := *state
+		return &snapshot
+	}
+	return &AlbumScheduleState{}
+}
+
+func (s *Scheduler) run(album *Album, action string) {
+	s.mutex.Lock()
+	state := s.albums[scheduleAlbumKey(album)]
+	switch action {
+	case SCHEDULE_PUBLISH:
+		state.Unpublished = false
+	case SCHEDULE_UNPUBLISH:
+		state.Unpublished = true
+	case SCHEDULE_ROTATE_COVER:
+		state.CoverOffset++
+	}
+	s.mutex.Unlock()
+
+	if action == SCHEDULE_REFRESH {
+		if err := album.RefreshCache(context.Background()); err != nil {
+			reportError("refresh album cache on schedule", err, albumErrorContext(album))
+		}
+	} else {
+		pageCache.Invalidate(album)
+	}
+
+	fmt.Printf("Scheduled %s of album %s on %s\n", action, album.Path, album.site.Domain)
+	recordAuditEvent(&AuditEvent{Action: AUDIT_SCHEDULE, Site: album.site.Domain, Album: album.Path, Detail: action})
+}
+
+// Runs the entries due since the last tick, in the order they were due
+func (s *Scheduler) Tick(now time.Time) {
+	type due struct {
+		at    time.Time
+		album *Album
+		entry *ScheduleEntry
+	}
+
+	var pending []*due
+	s.mutex.Lock()
+	for _, site := range app.sites {
+		for _, album := range site.Albums {
+			state, ok := s.albums[scheduleAlbumKey(album)]
+			if !ok {
+				continue
+			}
+			for _, entry := range album.GetSchedule() {
+				if t := entry.Cron.Last(state.LastRun, now); !t.IsZero() {
+					pending = append(pending, &due{t, album, entry})
+				}
+			}
+			state.LastRun = now
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].at.Before(pending[j].at) })
+	for _, d := range pending {
+		s.run(d.album, d.entry.Action)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := saveJSONState(SCHEDULE_STATE_FILE, s.albums); err != nil {
+		fmt.Printf("Unable to save the album schedule. Error: %s\n", err.Error())
+	}
+}
+
+func (s *Scheduler) RunEvery(interval time.Duration) {
+	if len(s.albums) == 0 {
+		return
+	}
+	for now := range time.Tick(interval) {
+		s.Tick(now)
+	}
+}
+
+// Whether the album's schedule has it published. Albums without a schedule always are.
+func (a *Album) IsPublished() bool {
+	return !scheduler.state(a).Unpublished
+}
+
+// Rotates the album's photos so the cover is the one the schedule has got to
+func (a *Album) rotateForCover(photos []Renderable) []Renderable {
+	offset := scheduler.state(a).CoverOffset
+	if len(photos) < 2 || offset == 0 {
+		return photos
+	}
+	offset %= len(photos)
+	return append(append([]Renderable{}, photos[offset:]...), photos[:offset]...)
+}
+
+func requirePublished(album *Album, w http.ResponseWriter) bool {
+	if !album.IsPublished() {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return false
+	}
+	return true
+}
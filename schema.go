@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// An option of the config files, described by the desc and default tags of its field
+type ConfigOption struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Default     string `json:"default,omitempty"`
+	Description string `json:"description"`
+}
+
+type ConfigSchema struct {
+	Site   []*ConfigOption `json:"site"`
+	Album  []*ConfigOption `json:"album"`
+	Tenant []*ConfigOption `json:"tenant"`
+}
+
+/*
+The options MapTo fills in from a section: exported fields with simple types, named after the field or its ini tag. Lists
+are comma separated.
+*/
+func configSchema(v interface{}) []*ConfigOption {
+	var options []*ConfigOption
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		typeName := ""
+		kind, list := f.Type.Kind(), false
+		if kind == reflect.Slice {
+			kind, list = f.Type.Elem().Kind(), true
+		}
+		switch kind {
+		case reflect.String:
+			typeName = "string"
+		case reflect.Bool:
+			typeName = "bool"
+		case reflect.Int, reflect.Int64:
+			typeName = "int"
+		case reflect.Float64:
+			typeName = "float"
+		default:
+			continue
+		}
+		if list {
+			typeName = "list of " + typeName + "s"
+		}
+
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("ini"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if name == "-" {
+			continue
+		}
+		options = append(options, &ConfigOption{name, typeName, f.Tag.Get("default"), f.Tag.Get("desc")})
+	}
+	return options
+}
+
+func printConfigOptions(title string, options []*ConfigOption) {
+	fmt.Printf("%s\n\n", title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, o := range options {
+		description := o.Description
+		if o.Default != "" {
+			description += " (default " + o.Default + ")"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", o.Name, o.Type, description)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// Prints every option of site and album sections, so they can be looked up without reading the source
+func runConfigSchema(args []string) int {
+	flags := flag.NewFlagSet("config-schema", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the options as JSON, for editors and tools")
+	flags.Parse(args)
+
+	schema := &ConfigSchema{configSchema(&Site{}), configSchema(&Album{}), configSchema(&Tenant{})}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(schema); err != nil {
+			fmt.Printf("Unable to write config schema. Error: %s\n", err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	printConfigOptions("Site options, in the DEFAULT section:", schema.Site)
+	printConfigOptions("Album options, in a section for each album:", schema.Album)
+	printConfigOptions("Tenant options, in the DEFAULT section of "+TENANTS_DIR_NAME+"/<name>/"+TENANT_CONFIG_FILE+":", schema.Tenant)
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+A photo is sensitive if there's an empty file next to it with this added to its name, like IMG_1234.JPG.sensitive, or if
+it has the x-amz-meta-sensitive metadata set to true.
+*/
+const SENSITIVE_SIDECAR_EXT = ".sensitive"
+const SENSITIVE_METADATA = "Sensitive"
+
+// Takes the sensitive sidecar files out of the objects, and returns the keys of the photos they're for
+func sensitiveObjects(objects []*s3.Object) ([]*s3.Object, map[string]bool) {
+	sensitive := make(map[string]bool)
+	var photos []*s3.Object
+	for _, obj := range objects {
+		if strings.HasSuffix(strings.ToLower(*obj.Key), SENSITIVE_SIDECAR_EXT) {
+			sensitive[(*obj.Key)[:len(*obj.Key)-len(SENSITIVE_SIDECAR_EXT)]] = true
+		} else {
+			photos = append(photos, obj)
+		}
+	}
+	return photos, sensitive
+}
+
+func isSensitiveMetadata(metadata map[string]*string) bool {
+	value, ok := metadata[SENSITIVE_METADATA]
+	if !ok || value == nil {
+		return false
+	}
+	sensitive, _ := strconv.ParseBool(strings.TrimSpace(*value))
+	return sensitive
+}
+
+func (a *Album) isSensitive(key string) bool {
+	if sidecars, _ := a.SensitiveCache.Load().(map[string]bool); sidecars[key] {
+		return true
+	}
+	_, ok := a.sensitiveMetadata.Load(key)
+	return ok
+}
+
+// Remembers a photo flagged in its metadata. Cached photos and pages show it like any other, so they're dropped.
+func (a *Album) setSensitive(key string) {
+	if _, loaded := a.sensitiveMetadata.Swap(key, true); !loaded {
+		a.photosChanged()
+	}
+}
+
+/*
+Leaves out sensitive photos, for places that can't hide them behind a click, like link previews and the index page, and
+archived ones, which would only be a placeholder there
+*/
+func previewable(photos []Renderable) []Renderable {
+	var result []Renderable
+	for _, p := range photos {
+		if !p.IsSensitive() && !p.IsArchived() {
+			result = append(result, p)
+		}
+	}
+	return result
+}
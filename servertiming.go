@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a page's Server-Timing header can have, in the order they're listed
+const TIMING_CACHE = "cache"
+const TIMING_S3_LIST = "s3-list"
+const TIMING_DERIVATIVE = "derivative"
+const TIMING_RENDER = "render"
+
+var timingDescriptions = map[string]string{
+	TIMING_CACHE:      "Page cache lookup",
+	TIMING_S3_LIST:    "S3 listing",
+	TIMING_DERIVATIVE: "Derivative fetch",
+	TIMING_RENDER:     "Template render",
+}
+
+type serverTimingKey struct{}
+
+type timingEntry struct {
+	name     string
+	detail   string // Like hit or miss
+	duration time.Duration
+	count    int
+}
+
+/*
+How long the steps of a request took. Steps that happen more than once, like fetching a derivative for every photo, add
+up to one entry. Refreshes can finish after the page was sent, what they take then isn't in the header anymore.
+*/
+type serverTiming struct {
+	mutex   sync.Mutex
+	entries []*timingEntry
+	sent    bool
+}
+
+func serverTimingFromContext(ctx context.Context) *serverTiming {
+	t, _ := ctx.Value(serverTimingKey{}).(*serverTiming)
+	return t
+}
+
+// Handlers that only have the response, like executeTemplateHelper, find the timings through the writer
+func serverTimingFromWriter(w http.ResponseWriter) *serverTiming {
+	for {
+		if tw, ok := w.(*serverTimingWriter); ok {
+			return tw.timing
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Starts timing a step, call the returned function when it's done. Does nothing without the servertiming middleware.
+func (t *serverTiming) start(name string) func(detail string) {
+	if t == nil {
+		return func(string) {}
+	}
+	started := time.Now()
+	return func(detail string) {
+		t.add(name, detail, time.Since(started))
+	}
+}
+
+func (t *serverTiming) add(name, detail string, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.sent {
+		return
+	}
+	for _, e := range t.entries {
+		if e.name == name {
+			e.duration += d
+			e.count++
+			e.detail = detail
+			return
+		}
+	}
+	t.entries = append(t.entries, &timingEntry{name, detail, d, 1})
+}
+
+func startTiming(ctx context.Context, name string) func(detail string) {
+	return serverTimingFromContext(ctx).start(name)
+}
+
+func (t *serverTiming) header() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sent = true
+
+	var values []string
+	for _, e := range t.entries {
+		desc := timingDescriptions[e.name]
+		if e.detail != "" {
+			desc += " " + e.detail
+		}
+		if e.count > 1 {
+			desc += fmt.Sprintf(" (%d)", e.count)
+		}
+		values = append(values, fmt.Sprintf(`%s;desc="%s";dur=%.2f`, e.name, desc, float64(e.duration)/float64(time.Millisecond)))
+	}
+	return values
+}
+
+// Adds the timings to HTML responses just before their headers go out
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			for _, value := range w.timing.header() {
+				w.Header().Add("Server-Timing", value)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+/*
+Tells browsers how long a page spent in the page cache, listing the album in S3, fetching derivatives and rendering its
+template, so dev tools can show where a slow page's time went. Only pages get the header, photos and other files don't.
+The timings tell visitors a bit about how the site works, like whether a page was cached, so it's off unless listed
+in the site's Middleware.
+*/
+func serverTimingMiddleware(site *Site) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timing := &serverTiming{}
+			tw := &serverTimingWriter{ResponseWriter: w, timing: timing}
+			next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, timing)))
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const SESSIONS_STATE_FILE = "sessions.json"
+const ADMIN_SESSIONS_REVOKE_PATH = "/admin/sessions/revoke"
+const AUDIT_SESSIONS_REVOKE = "sessions_revoke"
+
+// A session key that still signs valid cookies after the password changed, until the AuthGraceHours are over
+type PreviousSessionKey struct {
+	Key   string
+	Until time.Time
+}
+
+/*
+The session keys of a site or album with a password. Keys are made from the credentials and a generation, which revoking
+all sessions bumps, so the same password signs different cookies afterwards. The current key is kept to notice when the
+password changed, and to keep it working for the grace period. Keys can't be turned back into passwords, but they do
+sign cookies, so the state is as secret as the config.
+*/
+type SessionSecrets struct {
+	Generation int
+	Key        string
+	Previous   []*PreviousSessionKey `json:",omitempty"`
+}
+
+type SessionSecretStore struct {
+	mutex   sync.Mutex
+	secrets map[string]*SessionSecrets // By domain and auth scope
+}
+
+var sessionSecrets = &SessionSecretStore{secrets: make(map[string]*SessionSecrets)}
+
+func (s *SessionSecretStore) Load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return loadJSONState(SESSIONS_STATE_FILE, &s.secrets)
+}
+
+// Must be called with the mutex held
+func (s *SessionSecretStore) save() {
+	if err := saveJSONState(SESSIONS_STATE_FILE, s.secrets); err != nil {
+		fmt.Printf("Unable to save session keys. Error: %s\n", err.Error())
+	}
+}
+
+func sessionSecretsId(provider AuthCredentialsProvider) string {
+	return provider.authSite().Domain + provider.authScope()
+}
+
+func sessionKey(provider AuthCredentialsProvider, generation int) string {
+	mac := hmac.New(sha256.New, []byte(provider.GetAuthUser()+"\x00"+provider.GetAuthPass()))
+	mac.Write([]byte("session|" + strconv.Itoa(generation)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Must be called with the mutex held
+func (s *SessionSecretStore) secretsFor(provider AuthCredentialsProvider) *SessionSecrets {
+	id := sessionSecretsId(provider)
+	if s.secrets[id] == nil {
+		s.secrets[id] = &SessionSecrets{}
+	}
+	return s.secrets[id]
+}
+
+/*
+The keys cookies of a site or album can be signed with, the current one first. When the password changed since the last
+time, the old key keeps working for the AuthGraceHours there are at that moment. Until sessions are first revoked,
+cookies signed with the credentials themselves, like they were before session keys, work too.
+*/
+func (s *SessionSecretStore) Keys(provider AuthCredentialsProvider) [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	secrets := s.secretsFor(provider)
+	now := time.Now()
+	changed := false
+
+	current := sessionKey(provider, secrets.Generation)
+	if secrets.Key != current {
+		if grace := provider.GetAuthGracePeriod(); grace > 0 && secrets.Key != "" {
+			secrets.Previous = append(secrets.Previous, &PreviousSessionKey{secrets.Key, now.Add(grace)})
+		}
+		secrets.Key = current
+		changed = true
+	}
+
+	keys := [][]byte{[]byte(current)}
+	previous := secrets.Previous[:0]
+	for _, p := range secrets.Previous {
+		if now.After(p.Until) {
+			changed = true
+			continue
+		}
+		keys = append(keys, []byte(p.Key))
+		previous = append(previous, p)
+	}
+	secrets.Previous = previous
+	if secrets.Generation == 0 {
+		keys = append(keys, []byte(provider.GetAuthUser()+"\x00"+provider.GetAuthPass()))
+	}
+
+	if changed {
+		s.save()
+	}
+	return keys
+}
+
+// Logs everyone out of the site or album, including visitors still in a grace period
+func (s *SessionSecretStore) Revoke(provider AuthCredentialsProvider) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	secrets := s.secretsFor(provider)
+	secrets.Generation++
+	secrets.Key = sessionKey(provider, secrets.Generation)
+	secrets.Previous = nil
+	s.save()
+}
+
+/*
+Revokes all cookie sessions of a site straight away, for when a password leaked, or of just one album with a password of
+its own. Without an album the site's sessions and those of all of its albums are revoked. Visitors with basic auth send
+the password with every request, so only changing it locks them out.
+*/
+func handleAdminSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	site, err := app.SiteForDomain(r.FormValue("site"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var providers []AuthCredentialsProvider
+	if path := r.FormValue("album"); path != "" {
+		album, err := site.GetAlbumForPath(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if !album.HasOwnAuth() {
+			http.Error(w, "The album uses the site's password, revoke the site's sessions instead", http.StatusBadRequest)
+			return
+		}
+		providers = append(providers, album)
+	} else {
+		if site.HasAuth() {
+			providers = append(providers, site)
+		}
+		for _, album := range site.Albums {
+			if album.HasOwnAuth() {
+				providers = append(providers, album)
+			}
+		}
+	}
+
+	for _, provider := range providers {
+		sessionSecrets.Revoke(provider)
+		album := ""
+		if a, ok := provider.(*Album); ok {
+			album = a.Path
+		}
+		recordAuditEvent(&AuditEvent{Action: AUDIT_SESSIONS_REVOKE, Site: site.Domain, Album: album, Remote: clientIP(r)})
+	}
+	fmt.Fprintf(w, "Revoked the sessions of %d passwords\n", len(providers))
+}
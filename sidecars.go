@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Text files next to photos, named like the photo with one of these added. See alttext.go and captions.go.
+var TEXT_SIDECAR_EXTS = []string{ALT_TEXT_SIDECAR_EXT, CAPTION_SIDECAR_EXT, TAGS_SIDECAR_EXT}
+
+// Longer than anyone should write for a caption, but keeps a stray big file from ending up in every page
+const MAX_TEXT_SIDECAR_BYTES = 2000
+
+type textSidecar struct {
+	ETag string
+	Text string
+}
+
+func textSidecarExt(key string) string {
+	lower := strings.ToLower(key)
+	for _, ext := range TEXT_SIDECAR_EXTS {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+/*
+Takes the text sidecars out of the objects and reads them. Only sidecars that are new or changed since the last refresh
+are downloaded.
+*/
+func (a *Album) textSidecarObjects(ctx context.Context, objects []*s3.Object) []*s3.Object {
+	previous, _ := a.TextSidecarCache.Load().(map[string]*textSidecar)
+	sidecars := make(map[string]*textSidecar)
+
+	var photos []*s3.Object
+	for _, obj := range objects {
+		ext := textSidecarExt(*obj.Key)
+		if ext == "" {
+			photos = append(photos, obj)
+			continue
+		}
+
+		// Photos' extensions can be in any case, the sidecar's is looked up in lower case
+		key, etag := (*obj.Key)[:len(*obj.Key)-len(ext)]+ext, aws.StringValue(obj.ETag)
+		if before, ok := previous[key]; ok && before.ETag == etag {
+			sidecars[key] = before
+			continue
+		}
+		text, err := a.readTextSidecar(ctx, *obj.Key)
+		if err != nil {
+			reportError("read text sidecar", err, albumErrorContext(a))
+			continue
+		}
+		sidecars[key] = &textSidecar{etag, text}
+	}
+
+	a.TextSidecarCache.Store(sidecars)
+	return photos
+}
+
+func (a *Album) readTextSidecar(ctx context.Context, key string) (string, error) {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return "", err
+	}
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(a.site.BucketName), Key: aws.String(key)})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj.Body, MAX_TEXT_SIDECAR_BYTES))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+// The text of a photo's sidecar with the extension, empty if there's none
+func (a *Album) sidecarText(key, ext string) string {
+	sidecars, _ := a.TextSidecarCache.Load().(map[string]*textSidecar)
+	if sidecar := sidecars[key+ext]; sidecar != nil {
+		return sidecar.Text
+	}
+	return ""
+}
+
+/*
+Uploads a photo's sidecar, or deletes it if the text is empty. The site's AWS key needs write access to the bucket.
+Photos only pick up the new text with the next refresh of the album.
+*/
+func (a *Album) writeTextSidecar(ctx context.Context, key, ext, text string) error {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if text == "" {
+		_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(a.site.BucketName),
+			Key: aws.String(key + ext)})
+		return err
+	}
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.site.BucketName),
+		Key:         aws.String(key + ext),
+		Body:        strings.NewReader(text),
+		ContentType: aws.String("text/plain; charset=utf-8"),
+	})
+	return err
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"html/template"
 	"net/url"
+	"path/filepath"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -12,33 +15,176 @@ import (
 	"github.com/go-ini/ini"
 )
 
+/*
+Number options where 0 means something start out as UNSET, since MapTo leaves options that aren't in the config alone.
+That way leaving one out gets the default, and setting it to 0 gets 0.
+*/
+const UNSET = -1
+
 type Site struct {
-	Domain          string
-	CanonicalSecure bool
+	Domain          string `desc:"The domain the site is served on"`
+	CanonicalSecure bool   `default:"false" desc:"Make https URLs, for sites behind a proxy that handles SSL"`
+
+	AuthUser string `desc:"Username for HTTP basic auth on the whole site"`
+	AuthPass string `desc:"Password for HTTP basic auth on the whole site"`
+
+	AuthMode   string `default:"basic" desc:"How visitors log in: basic (the browser's prompt) or cookie (a password page)"`
+	AuthRealm  string `default:"You need a username/password to access this page" desc:"Text of the browser's login prompt"`
+	AuthPrompt string `desc:"Text on the password page in cookie mode, like Enter the password from your email"`
+	AuthImage  string `desc:"Key of a photo in the bucket shown on the password page in cookie mode"`
+
+	SessionHours   int `default:"720" desc:"Hours visitors stay logged in with the cookie AuthMode"`
+	AuthGraceHours int `desc:"Hours sessions from before the AuthPass changed keep working"`
+
+	S3Host       string `desc:"Endpoint of an S3 compatible object store other than AWS"`
+	BucketRegion string `desc:"Region of the photos bucket"`
+	BucketName   string `desc:"Name of the photos bucket"`
+
+	UseImgix    bool   `default:"false" desc:"Serve resized photos through Imgix"`
+	BaseUrl     string `desc:"Base URL of the Imgix source"`
+	ProxyPhotos bool   `default:"false" desc:"Serve photos through 50mm instead of presigned S3 URLs"`
+
+	MaxObjectMB       int `default:"200" desc:"Biggest file 50mm reads whole, for thumbnails and other derivatives other than DeepZoom tiles"`
+	MaxProxyDimension int `desc:"Longest side of proxied JPEGs and PNGs in pixels, bigger ones are downscaled"`
+
+	AWS_SECRET_KEY_ID string `ini:"AWSKeyId" desc:"AWS access key with read access to the bucket"`
+	AWS_SECRET_KEY    string `ini:"AWSKey" desc:"AWS secret key"`
+
+	SiteTitle string `desc:"Name of the site, shown at the top of every page"`
+	MetaTitle string `desc:"Page title of the index page"`
+	Language  string `default:"en" desc:"Language of the text 50mm adds to pages"`
+
+	HasAlbumIndex     bool `default:"false" desc:"Show an index page listing the albums"`
+	ShowLockedInIndex bool `default:"false" desc:"List password protected albums in the index as locked tiles"`
+	Albums            []*Album
+
+	IndexThumbnails int   `default:"5" desc:"Thumbnails shown below each album's cover in the index (0 is none)"`
+	GridColumns     []int `default:"1, 1, 1" desc:"Photo columns on small, medium and large screens"`
+
+	NavLinks []string `desc:"Extra navigation links, like About|https://example.com/about"`
+	navLinks []*NavLink
+
+	Theme           string `default:"light" desc:"Color theme, light or dark"`
+	BackgroundColor string `desc:"Background color override, like #FAFAFA"`
+	TextColor       string `desc:"Text color override, like #222222"`
+	GridGap         int    `default:"10" desc:"Space between photos in grids, in pixels (0 is no gap)"`
+
+	PrintStoreUrl string `desc:"Print store URL for the Order print button"`
+
+	SmtpHost     string `desc:"SMTP server for contact form messages"`
+	SmtpPort     int    `default:"587" desc:"SMTP server port"`
+	SmtpUser     string `desc:"SMTP username"`
+	SmtpPass     string `desc:"SMTP password"`
+	ContactEmail string `desc:"Address contact form messages are sent to"`
+	ContactFrom  string `default:"ContactEmail" desc:"Sender address of contact form messages"`
+
+	ZipMaxMB int `default:"2048" desc:"Largest zip visitors can download at once, in MB"`
+
+	GuestUploadMaxMB   int `default:"25" desc:"Largest photo guests can upload to albums with a GuestUploadToken, in MB"`
+	GuestUploadTotalMB int `default:"5120" desc:"Most guests can upload with one GuestUploadToken altogether, in MB"`
+
+	Middleware []string `desc:"Middleware to turn on, like logging, ratelimit, compression"`
+	RateLimit  int      `default:"600" desc:"Requests per minute per client with the ratelimit middleware"`
+
+	MonthlyBandwidthMB int    `desc:"Monthly bandwidth quota in megabytes"`
+	MonthlyRequests    int    `desc:"Monthly request quota"`
+	QuotaExceeded      string `default:"unavailable" desc:"What happens over quota: unavailable, auth or thumbnails"`
+
+	WebmentionTargets []string `desc:"URLs to send a Webmention to for new albums"`
+	ActivityPub       bool     `default:"false" desc:"Give the site an ActivityPub actor that posts new albums"`
+	ActivityPubUser   string   `default:"gallery" desc:"Username of the ActivityPub actor"`
+
+	OfflineCache bool `default:"false" desc:"Install a service worker that keeps visited albums browsable offline"`
+
+	AppManifest bool   `default:"false" desc:"Let phones install the site as an app"`
+	AppName     string `default:"SiteTitle" desc:"Name of the app on the home screen"`
+	ThemeColor  string `default:"BackgroundColor" desc:"Color of the browser toolbar and app splash screen"`
+	Logo        string `desc:"Key of the site's logo in the bucket, app icons are made from it"`
+
+	DerivativesPrefix string `desc:"Store derivatives in the bucket under this prefix instead of locally"`
+	S3Concurrency     int    `default:"4" desc:"S3 calls an album can make at once"`
+
+	PrefetchAlbums []string `desc:"Albums loaded before the server takes requests, by Path, or all"`
+
+	HotlinkProtection bool     `default:"false" desc:"Stop other sites from showing the photos"`
+	HotlinkAllowlist  []string `desc:"Other domains allowed to show proxied photos"`
+	HotlinkSecret     string   `desc:"Secret proxied photo URLs are signed with"`
+
+	LitePhotoWidth  int `default:"400" desc:"Photo width in data saver mode"`
+	LiteEagerPhotos int `default:"2" desc:"Photos loaded straight away in data saver mode"`
+
+	ImageFormats []string `default:"avif, webp" desc:"Formats Imgix sites offer besides JPEG, or none"`
+	AvifQuality  int      `desc:"Imgix AVIF quality, 1 to 100"`
+	WebpQuality  int      `desc:"Imgix WebP quality, 1 to 100"`
+	JpegQuality  int      `desc:"Imgix JPEG quality, 1 to 100"`
+	ColorProfile string   `default:"preserve" desc:"Color profile of resized photos, preserve or srgb"`
+
+	ApiToken string `desc:"Token scripts use for the API"`
+
+	InventoryBucket string `default:"BucketName" desc:"Bucket the S3 Inventory reports are in"`
+	InventoryPrefix string `desc:"Prefix of S3 Inventory reports, to list albums from them"`
+
+	ChangePollSeconds   int    `desc:"Seconds between checks of album listings for changes, for buckets without events"`
+	BucketWebhookSecret string `desc:"Secret of bucket event webhooks, signing them or sent as a bearer token"`
+
+	ArchivedPhotos string `default:"hide" desc:"What to do with photos in Glacier: hide or badge"`
+
+	AltTextTemplate string `default:"{album}, {name}" desc:"Alt text of photos without a caption or .alt file"`
+
+	CaptionCommand  string `desc:"Command that describes photos of albums with AutoCaption, given the photo on stdin"`
+	CaptionEndpoint string `desc:"URL photos of albums with AutoCaption are POSTed to, to be described"`
+	CaptionToken    string `desc:"Bearer token sent to the CaptionEndpoint"`
 
-	AuthUser string
-	AuthPass string
+	DeepZoomMegapixels int `default:"40" desc:"Photos this big or bigger are tiled for zooming in albums with DeepZoom"`
 
-	S3Host       string
-	BucketRegion string
-	BucketName   string
+	FilenamePattern string `desc:"Reads photo titles and dates from file names, like %Y-%m-%d_%H%M_%t_*"`
 
-	UseImgix bool
-	BaseUrl  string
+	RobotsTxt        bool     `default:"true" desc:"Serve a /robots.txt made from the site's albums"`
+	RobotsCrawlDelay int      `desc:"Seconds crawlers are asked to wait between requests"`
+	RobotsDisallow   []string `desc:"More paths crawlers are asked to stay out of, like /drafts/"`
+	SitemapUrl       string   `desc:"Full URL of a sitemap to point crawlers to"`
 
-	AWS_SECRET_KEY_ID string `ini:"AWSKeyId"`
-	AWS_SECRET_KEY    string `ini:"AWSKey"`
+	LenientUrls   bool   `default:"false" desc:"Match album paths and photo names ignoring case and Unicode normalization"`
+	TrailingSlash string `default:"add" desc:"Serve album pages at /album/ (add) or /album (remove)"`
 
-	SiteTitle string
-	MetaTitle string
+	HeadExtra    string `desc:"HTML, or a partial .html file, added to the head of every page"`
+	BeforeGrid   string `desc:"HTML, or a partial .html file, shown above the photos of album pages and the index"`
+	PhotoOverlay string `desc:"HTML, or a partial .html file, shown over every photo of album pages"`
+	Footer       string `desc:"HTML, or a partial .html file, added to the footer of every page"`
 
-	HasAlbumIndex bool
-	Albums        []*Album
+	GoogleSiteVerification string   `desc:"Token of Google Search Console's google-site-verification meta tag"`
+	BingSiteVerification   string   `desc:"Token of Bing Webmaster Tools' msvalidate.01 meta tag"`
+	MetaTags               []string `desc:"More meta tags for every page, like description|Wedding photos, og:site_name|Ada & Ben"`
+	StructuredData         bool     `default:"true" desc:"Describe album pages as schema.org ImageGalleries in JSON-LD"`
 
 	awsSession *session.Session
+	router     *Router
+	inventory  inventoryCache
+	appIcons   appIconCache
+	tenant     *Tenant // Set for sites in a tenant's folder
+	injections map[string]*template.Template
+	metaTags   []*MetaTag
+}
+
+/*
+Quotes a value for a config file, so that characters like ; and #, which would start a comment, are kept. Values with
+line breaks go in triple quotes, which go-ini reads across lines; values that can't be quoted have their quotes dropped.
+*/
+func iniValue(value string) string {
+	if strings.Contains(value, "\n") {
+		return `"""` + strings.ReplaceAll(value, `"""`, `"`) + `"""`
+	}
+	if !strings.ContainsAny(value, ";#\"'`\\") && strings.TrimSpace(value) == value {
+		return value
+	}
+	return "`" + value + "`"
 }
 
 func LoadSiteFromFile(path string) (*Site, error) {
+	return loadSite(path, nil)
+}
+
+func loadSite(path string, tenant *Tenant) (*Site, error) {
 	cfg, err := ini.Load(path)
 	if err != nil {
 		return nil, err
@@ -49,16 +195,32 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		return nil, err
 	}
 
-	s := &Site{}
+	s := &Site{tenant: tenant, RobotsTxt: true, StructuredData: true, GridGap: UNSET, IndexThumbnails: UNSET}
 	if err := defaultSection.MapTo(s); err != nil {
 		return nil, err
 	}
 
+	if s.navLinks, err = parseNavLinks(s.NavLinks); err != nil {
+		return nil, err
+	}
+
+	if s.injections, err = loadInjections(s, filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if s.metaTags, err = parseMetaTags(s.MetaTags); err != nil {
+		return nil, err
+	}
+
 	if s.BucketRegion == "" && s.BucketName == "" {
 		s.BucketRegion = defaultSection.Key("Region").String()
 		s.BucketName = defaultSection.Key("Bucket").String()
 	}
 
+	if fixtureBucketUrl != "" {
+		s.useFixtureBucket()
+	}
+
 	for _, section := range cfg.Sections() {
 		if section.Name() == "DEFAULT" {
 			continue
@@ -92,15 +254,35 @@ func LoadSiteFromFile(path string) (*Site, error) {
 	if s.S3Host != "" {
 		sess_config.Endpoint = aws.String(s.S3Host)
 	}
+	if fixtureBucketUrl != "" {
+		sess_config.S3ForcePathStyle = aws.Bool(true)
+	}
 
 	if sess, err := session.NewSession(sess_config); err != nil {
 		return nil, err
 	} else {
+		instrumentAWSSession(sess, s)
 		s.awsSession = sess
 	}
 
-	if err != nil {
+	if s.router, err = NewRouter(s); err != nil {
+		return nil, err
+	}
+
+	if tracingEnabled() {
+		s.router.Use(tracingMiddleware(s))
+	}
+	if s.tenant != nil {
+		s.router.Use(tenantMiddleware(s))
+	}
+	if s.HasQuota() {
+		s.router.Use(quotaMiddleware(s))
+	}
+
+	if middleware, err := s.buildMiddleware(); err != nil {
 		return nil, err
+	} else {
+		s.router.Use(middleware...)
 	}
 
 	return s, nil
@@ -115,6 +297,104 @@ func (s *Site) IsValid() error {
 		return errors.New("Can't have a site with 0 albums")
 	}
 
+	if s.IndexThumbnails < 0 && s.IndexThumbnails != UNSET {
+		return errors.New("IndexThumbnails can't be negative")
+	}
+
+	if s.S3Concurrency < 0 {
+		return errors.New("S3Concurrency can't be negative")
+	}
+
+	if s.ZipMaxMB < 0 {
+		return errors.New("ZipMaxMB can't be negative")
+	}
+
+	if s.GuestUploadMaxMB < 0 || s.GuestUploadTotalMB < 0 {
+		return errors.New("GuestUploadMaxMB and GuestUploadTotalMB can't be negative")
+	}
+
+	if err := validateGridColumns(s.GridColumns); err != nil {
+		return err
+	}
+
+	if err := validateTheme(s.Theme, s.BackgroundColor, s.TextColor, s.GridGap); err != nil {
+		return err
+	}
+
+	if err := validateQuota(s); err != nil {
+		return err
+	}
+
+	if err := validateDataSaver(s); err != nil {
+		return err
+	}
+
+	if err := validateImageFormats(s); err != nil {
+		return err
+	}
+
+	if err := validateColorProfile(s); err != nil {
+		return err
+	}
+
+	if err := validateArchivedPhotos(s); err != nil {
+		return err
+	}
+
+	if err := validateTrailingSlash(s); err != nil {
+		return err
+	}
+
+	if err := validateAppManifest(s); err != nil {
+		return err
+	}
+
+	if err := validateAuthMode(s); err != nil {
+		return err
+	}
+
+	if err := validateFilenamePattern(s); err != nil {
+		return err
+	}
+
+	if err := validateCaptionProvider(s); err != nil {
+		return err
+	}
+
+	if err := validateRobots(s); err != nil {
+		return err
+	}
+
+	if err := validateSessionHours(s); err != nil {
+		return err
+	}
+
+	if err := validateChangeDetection(s); err != nil {
+		return err
+	}
+
+	if err := validatePrefetchAlbums(s); err != nil {
+		return err
+	}
+
+	if err := validateFormerPrefixes(s); err != nil {
+		return err
+	}
+
+	if err := validateProxyLimits(s); err != nil {
+		return err
+	}
+
+	if err := validateSiteVerification(s); err != nil {
+		return err
+	}
+
+	if s.PrintStoreUrl != "" {
+		if _, err := url.Parse(s.GetPrintUrl(s.Albums[0], "photo.jpg")); err != nil {
+			return fmt.Errorf("PrintStoreUrl is not a valid URL template. Error: %s", err.Error())
+		}
+	}
+
 	if s.HasAlbumIndex {
 		for _, a := range s.Albums {
 			if a.Path == "/" {
@@ -150,11 +430,53 @@ func (s *Site) GetCanonicalUrl() *url.URL {
 	}
 }
 
+func (s *Site) GetLanguage() string {
+	if s.Language != "" {
+		return s.Language
+	}
+	return DEFAULT_LANGUAGE
+}
+
+func (s *Site) GetIndexThumbnails() int {
+	if s.IndexThumbnails != UNSET {
+		return s.IndexThumbnails
+	}
+	return DEFAULT_INDEX_THUMBNAILS
+}
+
+func (s *Site) GetGridColumns() *GridColumns {
+	if len(s.GridColumns) > 0 {
+		return NewGridColumns(s.GridColumns)
+	}
+	return NewGridColumns(DEFAULT_GRID_COLUMNS)
+}
+
+func (s *Site) GetS3Concurrency() int {
+	if s.S3Concurrency > 0 {
+		return s.S3Concurrency
+	}
+	return DEFAULT_ALBUM_S3_CONCURRENCY
+}
+
+// Albums anyone can see, for the index page's cover photos, feeds and announcements
 func (s *Site) GetAlbumsForIndex() []*Album {
 	indexAlbums := make([]*Album, 0)
 
 	for _, a := range s.Albums {
-		if a.InIndex {
+		if a.InIndex && !a.IsLocked() && a.IsPublished() {
+			indexAlbums = append(indexAlbums, a)
+		}
+	}
+
+	return indexAlbums
+}
+
+// The albums listed on the index page, including locked ones if the site shows them
+func (s *Site) GetAlbumsForIndexPage() []*Album {
+	indexAlbums := make([]*Album, 0)
+
+	for _, a := range s.Albums {
+		if a.InIndex && (!a.IsLocked() || s.ShowLockedInIndex) && a.IsPublished() {
 			indexAlbums = append(indexAlbums, a)
 		}
 	}
@@ -176,9 +498,11 @@ func (s *Site) GetPhotoForKey(key string) Renderable {
 
 func (s *Site) GetS3Photo(key string) *S3Photo {
 	return &S3Photo{
+		photoInfo{},
 		key,
 		s.BucketName,
 		s.awsSession,
+		s.GetPhotoUrlLifetime(),
 	}
 }
 
@@ -188,8 +512,12 @@ func (s *Site) GetImgixPhoto(key string) *ImgixPhoto {
 		return nil
 	} else {
 		return &ImgixPhoto{
+			photoInfo{},
 			key,
 			baseUrl,
+			s.GetImageFormats(),
+			s.JpegQuality,
+			s.GetColorProfile() == COLOR_PROFILE_SRGB,
 		}
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Length of the hash that keeps the slugs of names with the same URL-safe version apart
+const SLUG_HASH_LENGTH = 8
+
+type albumSlugCache struct {
+	mutex      sync.Mutex
+	keys       map[string]string // Slug to key
+	generation uint64
+}
+
+func isSafeSlugRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' || r == '~'
+}
+
+func isSafeSlug(name string) bool {
+	for _, r := range name {
+		if !isSafeSlugRune(r) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func safeSlugPart(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range s {
+		if isSafeSlugRune(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+/*
+The name a file goes by in the album's URLs. Most file names can be used as they are, but names with spaces, unicode or
+characters like '+' (which some clients decode to a space) get a URL-safe version with a short hash of the name, like
+"summer-in-malmo-1a2b3c4d.jpg", so two names never end up with the same slug.
+*/
+func fileSlug(key string) string {
+	name := path.Base(key)
+	if isSafeSlug(name) {
+		return name
+	}
+
+	hash := sha1.Sum([]byte(name))
+	ext := path.Ext(name)
+	slug := safeSlugPart(strings.TrimSuffix(name, ext))
+	if slug != "" {
+		slug += "-"
+	}
+	slug += hex.EncodeToString(hash[:])[:SLUG_HASH_LENGTH]
+	if ext = safeSlugPart(strings.TrimPrefix(ext, ".")); ext != "" {
+		slug += "." + ext
+	}
+	return slug
+}
+
+/*
+Finds the key a slug from a URL stands for. Slugs are looked up among the album's cached keys, which are mapped again
+after every cache refresh. Anything else is taken as a file name, so links made before slugs were URL-safe keep working,
+and so do files the cache doesn't list.
+*/
+func (a *Album) keyForSlug(slug string) string {
+	if key, ok := a.slugKeys()[slug]; ok {
+		return key
+	}
+	return albumObjectKey(a, slug)
+}
+
+func (a *Album) slugKeys() map[string]string {
+	a.slugCache.mutex.Lock()
+	defer a.slugCache.mutex.Unlock()
+
+	generation := a.CacheGeneration()
+	if a.slugCache.keys != nil && a.slugCache.generation == generation {
+		return a.slugCache.keys
+	}
+
+	keys := make(map[string]string)
+	cached, _ := a.KeyCache.Load().([]string)
+	for _, key := range cached {
+		keys[fileSlug(key)] = key
+	}
+	pairs, _ := a.PairCache.Load().(map[string]pairedKey)
+	for _, pair := range pairs {
+		keys[fileSlug(pair.key)] = pair.key
+	}
+
+	a.slugCache.keys, a.slugCache.generation = keys, generation
+	return keys
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+// The version is bumped whenever photoHash changes, so photos are hashed again
+const DERIVATIVE_PHOTO_HASH = "phash-v1"
+
+// Differing in more bits than this, photos don't look alike anymore
+const MAX_STACK_THRESHOLD = 32
+
+// Formats photoHash can decode
+var stackableExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+
+/*
+Near-identical photos next to each other in an album, like a burst, which the grid shows as one photo that expands to
+the rest on click. ID is the slug of the first photo, Index the photo's place in the stack.
+*/
+type PhotoStack struct {
+	ID    string
+	Size  int
+	Index int
+}
+
+// The rest of the stack, for the badge on its first photo
+func (s *PhotoStack) Hidden() int {
+	return s.Size - 1
+}
+
+func validateStackThreshold(threshold int) error {
+	if threshold < 0 || threshold > MAX_STACK_THRESHOLD {
+		return errors.New("StackThreshold must be between 0 and 32")
+	}
+	return nil
+}
+
+/*
+A difference hash of the photo: it's shrunk to 9x8 gray pixels, and each bit says whether a pixel is brighter than the
+one to its right. Shots of the same scene get hashes that differ in a few bits, regardless of their size and quality.
+Photos are hashed as stored, before their EXIF orientation, as photos of a burst are all turned the same way.
+*/
+func photoHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	bounds := img.Bounds()
+	if bounds.Dx() < w || bounds.Dy() < h {
+		return 0
+	}
+
+	var sums [w * h]uint64
+	var counts [w * h]uint64
+	add := func(x, y int, gray uint8) {
+		cell := (y-bounds.Min.Y)*h/bounds.Dy()*w + (x-bounds.Min.X)*w/bounds.Dx()
+		sums[cell] += uint64(gray)
+		counts[cell]++
+	}
+	// JPEGs decode to YCbCr, whose Y is already the brightness, going through color.Color for every pixel is slow
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				add(x, y, ycbcr.Y[ycbcr.YOffset(x, y)])
+			}
+		}
+	} else {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				add(x, y, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			left, right := sums[y*w+x]/counts[y*w+x], sums[y*w+x+1]/counts[y*w+x+1]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+/*
+Hashes one of the album's photos, see photoHash. Photos that can't be decoded or are too big to read get an empty
+derivative, so they aren't downloaded again, and no hash.
+*/
+func (a *Album) GetPhotoHash(ctx context.Context, key string) (uint64, bool, error) {
+	data, err := a.GetDerivative(ctx, DERIVATIVE_PHOTO_HASH, key, func(ctx context.Context) ([]byte, error) {
+		data, err := a.getObjectData(ctx, key)
+		if err == errObjectTooLarge {
+			return []byte{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		img, _, err := decodeImage(data)
+		if err != nil {
+			return []byte{}, nil
+		}
+		return binary.BigEndian.AppendUint64(nil, photoHash(img)), nil
+	})
+	if err != nil || len(data) != 8 {
+		return 0, false, err
+	}
+
+	hash := binary.BigEndian.Uint64(data)
+	if _, loaded := a.photoHashCache.Swap(key, hash); !loaded {
+		a.photosChanged()
+	}
+	return hash, true, nil
+}
+
+func (a *Album) isStackable(key string) bool {
+	return a.StackThreshold > 0 && !a.isArchived(key) && rendererForKey(key) == nil && hasExtension(key, stackableExtensions)
+}
+
+/*
+Puts photos next to each other whose hashes differ in at most StackThreshold bits in a stack. Each photo is compared to
+the one before it, so a burst of a slowly moving scene stays together. Photos that haven't been hashed yet are left
+out of stacks, the photos are built again once they are.
+*/
+func (a *Album) stackPhotos(keys []string, photos []Renderable) {
+	if a.StackThreshold <= 0 {
+		return
+	}
+
+	var stacks [][]int
+	var previous uint64
+	hasPrevious := false
+	for i, key := range keys {
+		value, ok := a.photoHashCache.Load(key)
+		if !ok || !a.isStackable(key) {
+			hasPrevious = false
+			continue
+		}
+		hash := value.(uint64)
+		if hasPrevious && bits.OnesCount64(hash^previous) <= a.StackThreshold {
+			stacks[len(stacks)-1] = append(stacks[len(stacks)-1], i)
+		} else {
+			stacks = append(stacks, []int{i})
+		}
+		previous, hasPrevious = hash, true
+	}
+
+	for _, stack := range stacks {
+		if len(stack) < 2 {
+			continue
+		}
+		id := photos[stack[0]].Slug()
+		for index, i := range stack {
+			if d, ok := photos[i].(photoDetails); ok {
+				d.details().stack = &PhotoStack{id, len(stack), index}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Small helpers to persist bits of state (like which albums have been announced) in the state database, or as JSON files
+in the data dir if FIFTYMM_STATE_DB is off. Missing state isn't an error, it just means there's nothing saved yet.
+*/
+func loadJSONState(name string, v interface{}) error {
+	if app.stateDB != nil {
+		return app.stateDB.Load(name, v)
+	}
+	return loadJSONFile(name, v)
+}
+
+func saveJSONState(name string, v interface{}) error {
+	if app.stateDB != nil {
+		return app.stateDB.Save(name, v)
+	}
+	return saveJSONFile(name, v)
+}
+
+func loadJSONFile(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(app.dataDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func saveJSONFile(name string, v interface{}) error {
+	if err := os.MkdirAll(app.dataDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a crash doesn't leave a half written state file behind
+	path := filepath.Join(app.dataDir, name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+/*
+Path of the SQLite database the server keeps its state in. Relative paths are inside FIFTYMM_DATA_DIR. Local derivatives
+go in it as well, sites with a DerivativesPrefix keep theirs in the bucket. Set it to off to keep a JSON file per feature
+in the data dir, and derivatives in a folder, instead.
+*/
+const STATE_DB_ENV_VAR = "FIFTYMM_STATE_DB"
+const DEFAULT_STATE_DB = "state.db"
+const STATE_DB_OFF = "off"
+
+// With WAL, readers don't wait for the writer or each other, so pages reading derivatives aren't held up by saves
+const STATE_DB_READERS = 4
+
+/*
+Each entry upgrades the database by one version, which is kept in SQLite's user_version. Entries are only ever added, as
+databases out there have run the ones before.
+*/
+var STATE_DB_MIGRATIONS = []string{
+	`CREATE TABLE state (
+		name       TEXT PRIMARY KEY,
+		data       BLOB NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE derivatives (
+		kind       TEXT NOT NULL,
+		etag       TEXT NOT NULL,
+		data       BLOB NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (kind, etag)
+	)`,
+}
+
+type StateDB struct {
+	db     *sql.DB // The only connection that writes, SQLite takes one writer at a time
+	reader *sql.DB // A pool of read only connections
+}
+
+// Keeps derivatives in the state database, like LocalDerivativeStore does in a folder
+type StateDBDerivativeStore struct {
+	db *StateDB
+}
+
+func OpenStateDB(path string) (*StateDB, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(app.dataDir, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Waiting for the writer connection on our side is cheaper than retrying SQLite's busy errors
+	db.SetMaxOpenConns(1)
+
+	s := &StateDB{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to migrate %s: %s", path, err.Error())
+	}
+
+	// Opened after migrating, so readers never see a half upgraded database
+	if s.reader, err = sql.Open("sqlite", dsn+"&_pragma=query_only(1)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.reader.SetMaxOpenConns(STATE_DB_READERS)
+	return s, nil
+}
+
+func (s *StateDB) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(STATE_DB_MIGRATIONS) {
+		return fmt.Errorf("the database is at version %d, this 50mm only knows up to %d", version, len(STATE_DB_MIGRATIONS))
+	}
+
+	for ; version < len(STATE_DB_MIGRATIONS); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(STATE_DB_MIGRATIONS[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", version+1, err.Error())
+		}
+		// PRAGMA doesn't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("Migrated the state database to version %d\n", version+1)
+	}
+	return nil
+}
+
+func (s *StateDB) Close() error {
+	if err := s.reader.Close(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+/*
+Loads a piece of state saved under the name of its JSON file. State that was saved before the database was set up is
+read from the file, and moves into the database the next time it's saved.
+*/
+func (s *StateDB) Load(name string, v interface{}) error {
+	var data []byte
+	err := s.reader.QueryRow("SELECT data FROM state WHERE name = ?", name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return loadJSONFile(name, v)
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *StateDB) Save(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO state (name, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`, name, data, time.Now().UTC())
+	return err
+}
+
+func (s *StateDBDerivativeStore) Get(ctx context.Context, kind, etag string) ([]byte, bool, error) {
+	var data []byte
+	err := s.db.reader.QueryRowContext(ctx, "SELECT data FROM derivatives WHERE kind = ? AND etag = ?", kind,
+		derivativeName(etag)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *StateDBDerivativeStore) Put(ctx context.Context, kind, etag string, data []byte) error {
+	_, err := s.db.db.ExecContext(ctx, `INSERT INTO derivatives (kind, etag, data, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind, etag) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`,
+		kind, derivativeName(etag), data, time.Now().UTC())
+	return err
+}
+
+func (s *StateDB) eachDerivative(fn func(kind, name string, data []byte) error) error {
+	rows, err := s.reader.Query("SELECT kind, etag, data FROM derivatives ORDER BY kind, etag")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, name string
+		var data []byte
+		if err := rows.Scan(&kind, &name, &data); err != nil {
+			return err
+		}
+		if err := fn(kind, name, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Opens the state database, unless FIFTYMM_STATE_DB turns it off, before anything loads its state
+func (a *App) openStateDB() error {
+	path := firstNonEmpty(os.Getenv(STATE_DB_ENV_VAR), DEFAULT_STATE_DB)
+	if path == STATE_DB_OFF {
+		return nil
+	}
+
+	db, err := OpenStateDB(path)
+	if err != nil {
+		return err
+	}
+	a.stateDB = db
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Bumped when the layout of exports changes, so an older 50mm doesn't import what it can't read
+const STATE_EXPORT_VERSION = 1
+const STATE_EXPORT_MANIFEST = "manifest.json"
+
+// Everything 50mm saves with loadJSONState and saveJSONState
+var STATE_FILES = []string{
+	ACTIVITYPUB_FOLLOWERS_STATE_FILE,
+	ANNOUNCEMENTS_STATE_FILE,
+	DOWNLOADS_STATE_FILE,
+	GUEST_UPLOAD_STATE_FILE,
+	QUOTA_STATE_FILE,
+	RESTORE_STATE_FILE,
+	SCHEDULE_STATE_FILE,
+	SESSIONS_STATE_FILE,
+	VISITORS_STATE_FILE,
+}
+
+// The first file of an export
+type StateExportManifest struct {
+	Version  int
+	Exported time.Time
+	Host     string
+}
+
+// What an export or import went through
+type StateExportSummary struct {
+	State       []string // Names of the saved state
+	Keys        int
+	AuditLog    bool
+	Derivatives int
+}
+
+func (s *StateExportSummary) String() string {
+	return fmt.Sprintf("%d pieces of state, %d ActivityPub keys and %d derivatives", len(s.State), s.Keys, s.Derivatives)
+}
+
+func runExportState(args []string) int {
+	flags := flag.NewFlagSet("export-state", flag.ExitOnError)
+	output := flags.String("o", "", "Write the archive to this file instead of standard output")
+	derivatives := flags.Bool("derivatives", false, "Include the local derivatives, which can be worked out again but take a while for big albums")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	app = NewApp()
+	if err := app.openStateDB(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open the state database. Error: %s\n", err.Error())
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	summary, err := exportState(w, *derivatives)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to export state. Error: %s\n", err.Error())
+		return 1
+	}
+	// Standard output may be the archive
+	fmt.Fprintf(os.Stderr, "Exported %s\n", summary)
+	return 0
+}
+
+func runImportState(args []string) int {
+	flags := flag.NewFlagSet("import-state", flag.ExitOnError)
+	force := flags.Bool("force", false, "Replace state this server already has")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: 50mm import-state [-force] <archive>\n")
+		return 2
+	}
+
+	app = NewApp()
+	if err := app.openStateDB(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open the state database. Error: %s\n", err.Error())
+		return 1
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer f.Close()
+
+	manifest, summary, err := importState(f, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to import state. Error: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Imported %s exported from %s at %s\n", summary, manifest.Host, manifest.Exported.Format(time.RFC3339))
+	return 0
+}
+
+/*
+Writes a gzipped tar with the manifest, the saved state as JSON under state/, the ActivityPub keys under activitypub/,
+the audit log, and optionally the local derivatives under derivatives/<kind>/.
+*/
+func exportState(w io.Writer, withDerivatives bool) (*StateExportSummary, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	summary := &StateExportSummary{}
+
+	host, _ := os.Hostname()
+	data, err := json.MarshalIndent(&StateExportManifest{STATE_EXPORT_VERSION, time.Now().UTC(), host}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, STATE_EXPORT_MANIFEST, data); err != nil {
+		return nil, err
+	}
+
+	for _, name := range STATE_FILES {
+		var data json.RawMessage
+		if err := loadJSONState(name, &data); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		if data == nil {
+			continue
+		}
+		if err := writeTarFile(tw, path.Join("state", name), data); err != nil {
+			return nil, err
+		}
+		summary.State = append(summary.State, name)
+	}
+
+	keys, _ := filepath.Glob(filepath.Join(app.dataDir, ACTIVITYPUB_KEYS_DIR_NAME, "*.pem"))
+	for _, key := range keys {
+		data, err := ioutil.ReadFile(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeTarFile(tw, path.Join(ACTIVITYPUB_KEYS_DIR_NAME, filepath.Base(key)), data); err != nil {
+			return nil, err
+		}
+		summary.Keys++
+	}
+
+	for _, name := range []string{AUDIT_LOG_FILE + ".1", AUDIT_LOG_FILE} {
+		data, err := ioutil.ReadFile(filepath.Join(app.dataDir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := writeTarFile(tw, name, data); err != nil {
+			return nil, err
+		}
+		summary.AuditLog = true
+	}
+
+	if withDerivatives {
+		err := eachLocalDerivative(func(kind, name string, data []byte) error {
+			summary.Derivatives++
+			return writeTarFile(tw, path.Join(DEFAULT_DERIVATIVES_DIR_NAME, kind, name), data)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return summary, gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+/*
+Restores an export into this server's data dir, or its state database. It's meant for a new host, so it refuses to run
+on a server that already saved some state unless force is set, which replaces that state. The server shouldn't be
+running, it would overwrite the imported state with its own the next time it saves.
+*/
+func importState(r io.Reader, force bool) (*StateExportManifest, *StateExportSummary, error) {
+	if !force {
+		for _, name := range STATE_FILES {
+			var existing json.RawMessage
+			if err := loadJSONState(name, &existing); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", name, err.Error())
+			} else if existing != nil {
+				return nil, nil, fmt.Errorf("this server already has %s, use -force to replace its state", name)
+			}
+		}
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != STATE_EXPORT_MANIFEST {
+		return nil, nil, fmt.Errorf("not a 50mm state export, it doesn't start with %s", STATE_EXPORT_MANIFEST)
+	}
+	manifest := &StateExportManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, nil, err
+	}
+	if manifest.Version > STATE_EXPORT_VERSION {
+		return nil, nil, fmt.Errorf("the export is version %d, this 50mm only reads up to %d", manifest.Version,
+			STATE_EXPORT_VERSION)
+	}
+
+	summary := &StateExportSummary{}
+	store := localDerivativeStore()
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dir, file := path.Split(header.Name)
+		switch {
+		case dir == "state/" && isStateFile(file):
+			if err := saveJSONState(file, json.RawMessage(data)); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			summary.State = append(summary.State, file)
+		case dir == ACTIVITYPUB_KEYS_DIR_NAME+"/" && strings.HasSuffix(file, ".pem"):
+			if err := writeDataFile(path.Join(ACTIVITYPUB_KEYS_DIR_NAME, file), data, force); err != nil {
+				return nil, nil, err
+			}
+			summary.Keys++
+		case header.Name == AUDIT_LOG_FILE || header.Name == AUDIT_LOG_FILE+".1":
+			if err := writeDataFile(header.Name, data, force); err != nil {
+				return nil, nil, err
+			}
+			summary.AuditLog = true
+		case strings.HasPrefix(dir, DEFAULT_DERIVATIVES_DIR_NAME+"/"):
+			kind := strings.TrimSuffix(strings.TrimPrefix(dir, DEFAULT_DERIVATIVES_DIR_NAME+"/"), "/")
+			if kind == "" || strings.Contains(kind, "/") || derivativeName(file) != file {
+				return nil, nil, fmt.Errorf("invalid derivative %s", header.Name)
+			}
+			if err := store.Put(context.Background(), kind, file, data); err != nil {
+				return nil, nil, err
+			}
+			summary.Derivatives++
+		default:
+			fmt.Printf("Skipping %s, which this 50mm doesn't know\n", header.Name)
+		}
+	}
+	return manifest, summary, nil
+}
+
+func isStateFile(name string) bool {
+	for _, n := range STATE_FILES {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a file into the data dir, only over an existing one if force is set
+func writeDataFile(name string, data []byte, force bool) error {
+	p := filepath.Join(app.dataDir, name)
+	if _, err := os.Stat(p); err == nil && !force {
+		fmt.Printf("Keeping the existing %s, use -force to replace it\n", name)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0600)
+}
+
+func eachLocalDerivative(fn func(kind, name string, data []byte) error) error {
+	if app.stateDB != nil {
+		return app.stateDB.eachDerivative(fn)
+	}
+
+	return filepath.Walk(app.derivativesDir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+
+		// Laid out as <kind>/<first two letters>/<name>
+		rel, err := filepath.Rel(app.derivativesDir, p)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return fn(parts[0], parts[2], data)
+	})
+}
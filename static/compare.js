@@ -0,0 +1,107 @@
+// On the album page, at most 4 photos can be ticked and the compare button needs at least 2
+(function () {
+    var form = document.getElementById("compare-form");
+    if (!form) {
+        return;
+    }
+    var boxes = document.querySelectorAll("input.compare-select");
+    var button = form.querySelector("button");
+    function update() {
+        var checked = document.querySelectorAll("input.compare-select:checked").length;
+        for (var i = 0; i < boxes.length; i++) {
+            boxes[i].disabled = checked >= 4 && !boxes[i].checked;
+        }
+        button.disabled = checked < 2;
+    }
+    for (var i = 0; i < boxes.length; i++) {
+        boxes[i].addEventListener("change", update);
+    }
+    update();
+})();
+
+/*
+On the compare page, zooming or dragging one photo does the same to all of them. The position is kept relative to each
+pane's size, so photos of different sizes still show the same part of the frame.
+*/
+(function () {
+    var panes = document.querySelectorAll("div.compare-pane");
+    if (panes.length === 0) {
+        return;
+    }
+    var MAX_SCALE = 8;
+    var view = {scale: 1, x: 0, y: 0};
+
+    function render() {
+        // Never further than the edge of the photo
+        var limit = (view.scale - 1) / 2;
+        view.x = Math.max(-limit, Math.min(limit, view.x));
+        view.y = Math.max(-limit, Math.min(limit, view.y));
+        for (var i = 0; i < panes.length; i++) {
+            var img = panes[i].querySelector("img");
+            img.style.transform = "translate(" + view.x * panes[i].clientWidth + "px, " + view.y * panes[i].clientHeight + "px) scale(" + view.scale + ")";
+        }
+    }
+
+    // Zooms keeping the point at fx, fy (from the pane's center, as a fraction of its size) where it is
+    function zoom(scale, fx, fy) {
+        scale = Math.max(1, Math.min(MAX_SCALE, scale));
+        view.x = fx - (fx - view.x) * scale / view.scale;
+        view.y = fy - (fy - view.y) * scale / view.scale;
+        view.scale = scale;
+        render();
+    }
+
+    function pointIn(pane, e) {
+        var rect = pane.getBoundingClientRect();
+        return [(e.clientX - rect.left) / rect.width - 0.5, (e.clientY - rect.top) / rect.height - 0.5];
+    }
+
+    var drag = null;
+    for (var i = 0; i < panes.length; i++) {
+        (function (pane) {
+            pane.addEventListener("wheel", function (e) {
+                e.preventDefault();
+                var p = pointIn(pane, e);
+                zoom(view.scale * (e.deltaY < 0 ? 1.2 : 1 / 1.2), p[0], p[1]);
+            }, {passive: false});
+            pane.addEventListener("dblclick", function (e) {
+                var p = pointIn(pane, e);
+                zoom(view.scale > 1 ? 1 : 2.5, p[0], p[1]);
+            });
+            pane.addEventListener("pointerdown", function (e) {
+                drag = {pane: pane, x: e.clientX, y: e.clientY};
+                pane.setPointerCapture(e.pointerId);
+            });
+            pane.addEventListener("pointermove", function (e) {
+                if (!drag || drag.pane !== pane) {
+                    return;
+                }
+                view.x += (e.clientX - drag.x) / pane.clientWidth;
+                view.y += (e.clientY - drag.y) / pane.clientHeight;
+                drag.x = e.clientX;
+                drag.y = e.clientY;
+                render();
+            });
+            pane.addEventListener("pointerup", function () {
+                drag = null;
+            });
+            pane.addEventListener("pointercancel", function () {
+                drag = null;
+            });
+        })(panes[i]);
+    }
+
+    var buttons = document.querySelectorAll("p.compare-controls button");
+    for (var i = 0; i < buttons.length; i++) {
+        buttons[i].addEventListener("click", function () {
+            var action = this.getAttribute("data-zoom");
+            if (action === "reset") {
+                view = {scale: 1, x: 0, y: 0};
+                render();
+            } else {
+                zoom(view.scale * (action === "in" ? 1.5 : 1 / 1.5), 0, 0);
+            }
+        });
+    }
+    window.addEventListener("resize", render);
+})();
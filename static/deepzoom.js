@@ -0,0 +1,31 @@
+/*
+Shows photos that were cut into tiles in OpenSeadragon, which only loads the tiles of what's on screen at the zoom
+level it's at. The photo stays as it is if OpenSeadragon can't be loaded.
+*/
+(function () {
+    var OPENSEADRAGON = "https://cdn.jsdelivr.net/npm/openseadragon@4.1.1/build/openseadragon/";
+    var container = document.querySelector("div.deep-zoom");
+    if (!container) {
+        return;
+    }
+
+    var script = document.createElement("script");
+    script.src = OPENSEADRAGON + "openseadragon.min.js";
+    script.onload = function () {
+        container.classList.add("zooming");
+        var viewer = OpenSeadragon({
+            element: container,
+            prefixUrl: OPENSEADRAGON + "images/",
+            tileSources: container.getAttribute("data-info"),
+            showNavigator: true,
+            visibilityRatio: 1,
+            crossOriginPolicy: "Anonymous"
+        });
+        // Back to the photo if the tiles are gone, e.g. because the photo was replaced since the page was cached
+        viewer.addHandler("open-failed", function () {
+            viewer.destroy();
+            container.classList.remove("zooming");
+        });
+    };
+    document.head.appendChild(script);
+})();
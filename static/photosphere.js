@@ -0,0 +1,132 @@
+/*
+Shows photospheres in a 360° viewer that can be dragged around and zoomed with the mouse wheel. The flat photo stays if
+the browser has no WebGL, or the photo can't be used as a texture because its host doesn't allow it (CORS).
+*/
+(function () {
+    var container = document.querySelector("div.photosphere");
+    var canvas = document.createElement("canvas");
+    var gl = container && canvas.getContext("webgl");
+    if (!gl) {
+        return;
+    }
+
+    // Every pixel looks up where its ray hits the sphere, so there's no mesh to build
+    var vertexSource = "attribute vec2 p; varying vec2 v; void main() { v = p; gl_Position = vec4(p, 0.0, 1.0); }";
+    var fragmentSource = [
+        "precision highp float;",
+        "uniform sampler2D photo;",
+        "uniform float yaw, pitch, fov, aspect;",
+        "varying vec2 v;",
+        "void main() {",
+        "    float t = tan(fov / 2.0);",
+        "    vec3 d = normalize(vec3(v.x * t * aspect, v.y * t, -1.0));",
+        "    d = vec3(d.x, d.y * cos(pitch) - d.z * sin(pitch), d.y * sin(pitch) + d.z * cos(pitch));",
+        "    d = vec3(d.x * cos(yaw) - d.z * sin(yaw), d.y, d.x * sin(yaw) + d.z * cos(yaw));",
+        "    float lon = atan(d.x, -d.z), lat = asin(clamp(d.y, -1.0, 1.0));",
+        "    gl_FragColor = texture2D(photo, vec2(lon / 6.2831853 + 0.5, 0.5 - lat / 3.1415927));",
+        "}"
+    ].join("\n");
+
+    function compile(type, source) {
+        var shader = gl.createShader(type);
+        gl.shaderSource(shader, source);
+        gl.compileShader(shader);
+        gl.attachShader(program, shader);
+    }
+
+    var program = gl.createProgram();
+    compile(gl.VERTEX_SHADER, vertexSource);
+    compile(gl.FRAGMENT_SHADER, fragmentSource);
+    gl.linkProgram(program);
+    if (!gl.getProgramParameter(program, gl.LINK_STATUS)) {
+        return;
+    }
+    gl.useProgram(program);
+
+    gl.bindBuffer(gl.ARRAY_BUFFER, gl.createBuffer());
+    gl.bufferData(gl.ARRAY_BUFFER, new Float32Array([-1, -1, 1, -1, -1, 1, 1, 1]), gl.STATIC_DRAW);
+    var position = gl.getAttribLocation(program, "p");
+    gl.enableVertexAttribArray(position);
+    gl.vertexAttribPointer(position, 2, gl.FLOAT, false, 0, 0);
+
+    var view = {yaw: 0, pitch: 0, fov: Math.PI / 2};
+    var uniforms = {};
+    ["yaw", "pitch", "fov", "aspect"].forEach(function (name) {
+        uniforms[name] = gl.getUniformLocation(program, name);
+    });
+
+    function draw() {
+        var width = container.clientWidth, height = Math.round(Math.min(width / 2, window.innerHeight * 0.7));
+        if (canvas.width !== width || canvas.height !== height) {
+            canvas.width = width;
+            canvas.height = height;
+            gl.viewport(0, 0, width, height);
+        }
+        gl.uniform1f(uniforms.yaw, view.yaw);
+        gl.uniform1f(uniforms.pitch, view.pitch);
+        gl.uniform1f(uniforms.fov, view.fov);
+        gl.uniform1f(uniforms.aspect, width / height);
+        gl.drawArrays(gl.TRIANGLE_STRIP, 0, 4);
+    }
+
+    var photo = new Image();
+    photo.crossOrigin = "anonymous";
+    photo.onload = function () {
+        gl.bindTexture(gl.TEXTURE_2D, gl.createTexture());
+        try {
+            gl.texImage2D(gl.TEXTURE_2D, 0, gl.RGBA, gl.RGBA, gl.UNSIGNED_BYTE, photo);
+        } catch (e) {
+            return;
+        }
+        // Photos are rarely a power of two in size, which WebGL only allows with these
+        gl.texParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE);
+        gl.texParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE);
+        gl.texParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR);
+
+        container.querySelector("picture").hidden = true;
+        container.appendChild(canvas);
+        draw();
+    };
+    photo.src = container.getAttribute("data-src");
+
+    var dragging = null;
+    canvas.addEventListener("pointerdown", function (e) {
+        dragging = {x: e.clientX, y: e.clientY};
+        canvas.setPointerCapture(e.pointerId);
+    });
+    canvas.addEventListener("pointermove", function (e) {
+        if (!dragging) {
+            return;
+        }
+        var scale = view.fov / canvas.height;
+        view.yaw -= (e.clientX - dragging.x) * scale;
+        view.pitch = Math.max(-Math.PI / 2, Math.min(Math.PI / 2, view.pitch + (e.clientY - dragging.y) * scale));
+        dragging = {x: e.clientX, y: e.clientY};
+        draw();
+    });
+    canvas.addEventListener("pointerup", function () {
+        dragging = null;
+    });
+    canvas.addEventListener("wheel", function (e) {
+        e.preventDefault();
+        view.fov = Math.max(Math.PI / 6, Math.min(Math.PI * 0.6, view.fov * Math.exp(e.deltaY * 0.001)));
+        draw();
+    });
+    // Arrow keys look around and +/- zoom, so the viewer works without a pointer
+    canvas.tabIndex = 0;
+    canvas.addEventListener("keydown", function (e) {
+        var step = Math.PI / 36;
+        switch (e.key) {
+            case "ArrowLeft": view.yaw += step; break;
+            case "ArrowRight": view.yaw -= step; break;
+            case "ArrowUp": view.pitch = Math.min(Math.PI / 2, view.pitch + step); break;
+            case "ArrowDown": view.pitch = Math.max(-Math.PI / 2, view.pitch - step); break;
+            case "+": case "=": view.fov = Math.max(Math.PI / 6, view.fov * 0.9); break;
+            case "-": view.fov = Math.min(Math.PI * 0.6, view.fov / 0.9); break;
+            default: return;
+        }
+        e.preventDefault();
+        draw();
+    });
+    window.addEventListener("resize", draw);
+})();
@@ -0,0 +1,8 @@
+// Sensitive photos are blurred until clicked. The first click shows the photo instead of following its link.
+document.addEventListener("click", function (e) {
+    var tile = e.target.closest("li.sensitive");
+    if (tile) {
+        e.preventDefault();
+        tile.classList.remove("sensitive");
+    }
+});
@@ -0,0 +1,18 @@
+// Stacks of similar photos show their first photo, its button shows the rest of the stack and hides it again
+document.addEventListener("click", function (e) {
+    var toggle = e.target.closest("button.stack-toggle");
+    if (!toggle) {
+        return;
+    }
+    var open = toggle.getAttribute("aria-expanded") !== "true";
+    var photos = document.querySelectorAll("li.stacked");
+    for (var i = 0; i < photos.length; i++) {
+        if (photos[i].getAttribute("data-stack") === toggle.getAttribute("data-stack")) {
+            photos[i].classList.toggle("stack-open", open);
+        }
+    }
+    toggle.setAttribute("aria-expanded", open ? "true" : "false");
+    toggle.textContent = open ? toggle.getAttribute("data-less") : toggle.getAttribute("data-more");
+    // Lazy photos that were hidden are only loaded once echo looks again
+    echo.render();
+});
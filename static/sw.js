@@ -0,0 +1,117 @@
+// Keeps the albums a visitor has looked at browsable when the connection drops. Served at /sw.js by sites with
+// OfflineCache. Pages of password protected albums are marked private and never cached, and neither is anything they load.
+const CACHE = 'fiftymm-offline-v1';
+const MAX_PAGES = 50;
+const MAX_IMAGES = 500;
+
+// The URLs of private pages. Browsers stop and start service workers whenever they like, so the marks are kept in a
+// cache of their own rather than in memory.
+const PRIVATE_PAGES = 'fiftymm-private-pages-v1';
+
+self.addEventListener('install', () => self.skipWaiting());
+
+self.addEventListener('activate', event => {
+    event.waitUntil(caches.keys()
+        .then(names => Promise.all(names.filter(name => name !== CACHE && name !== PRIVATE_PAGES)
+            .map(name => caches.delete(name))))
+        .then(() => self.clients.claim()));
+});
+
+// Opaque responses, like photos from another origin, hide their headers, so there's no telling whether they're private
+function isCacheable(response) {
+    if (response.type === 'opaque') {
+        return false;
+    }
+    const cacheControl = response.headers.get('Cache-Control') || '';
+    return response.ok && !/private|no-store/.test(cacheControl);
+}
+
+// Drops the oldest entries of a kind once there are too many of them
+async function trim(cache, isKind, max) {
+    const keys = (await cache.keys()).filter(isKind);
+    await Promise.all(keys.slice(0, Math.max(0, keys.length - max)).map(key => cache.delete(key)));
+}
+
+async function store(request, response, isKind, max) {
+    const cache = await caches.open(CACHE);
+    await cache.delete(request);
+    await cache.put(request, response);
+    await trim(cache, isKind, max);
+}
+
+const isPage = request => request.mode === 'navigate' || request.destination === 'document';
+const isImage = request => !isPage(request);
+
+async function markPrivate(url, isPrivate) {
+    const cache = await caches.open(PRIVATE_PAGES);
+    if (isPrivate) {
+        await cache.put(url, new Response(''));
+    } else {
+        await cache.delete(url);
+    }
+}
+
+// Whether a request comes from a private page, by the page's URL, which stays the same when the worker restarts
+async function isFromPrivatePage(event) {
+    const client = event.clientId && await self.clients.get(event.clientId);
+    if (!client) {
+        return false;
+    }
+    const cache = await caches.open(PRIVATE_PAGES);
+    return !!(await cache.match(client.url));
+}
+
+async function match(request) {
+    const cache = await caches.open(CACHE);
+    return cache.match(request);
+}
+
+// Pages come from the network when there is one, so visitors see new photos, and from the cache when there isn't
+async function handlePage(event) {
+    try {
+        const response = await fetch(event.request);
+        const url = response.url || event.request.url;
+        if (isCacheable(response)) {
+            event.waitUntil(Promise.all([
+                markPrivate(url, false),
+                store(event.request, response.clone(), isPage, MAX_PAGES),
+            ]));
+        } else {
+            // Marked before the page is returned, so nothing it loads is cached
+            await markPrivate(url, true);
+            event.waitUntil(caches.open(CACHE).then(cache => cache.delete(event.request)));
+        }
+        return response;
+    } catch (err) {
+        const cached = await match(event.request);
+        if (cached) {
+            return cached;
+        }
+        throw err;
+    }
+}
+
+// Photos, thumbnails and hashed static files don't change under the same URL, so the cache goes first
+async function handleAsset(event) {
+    const cached = await match(event.request);
+    if (cached) {
+        return cached;
+    }
+    const response = await fetch(event.request);
+    if (isCacheable(response) && !await isFromPrivatePage(event)) {
+        event.waitUntil(store(event.request, response.clone(), isImage, MAX_IMAGES));
+    }
+    return response;
+}
+
+self.addEventListener('fetch', event => {
+    const request = event.request;
+    if (request.method !== 'GET' || request.url.startsWith(self.location.origin + '/admin/')) {
+        return;
+    }
+    if (isPage(request)) {
+        event.respondWith(handlePage(event));
+    } else if (request.destination === 'image' || request.destination === 'style' || request.destination === 'script') {
+        event.respondWith(handleAsset(event));
+    }
+});
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3 can delete at most this many objects per request
+const STORAGE_DELETE_BATCH_SIZE = 1000
+
+// An object at the top level of an album's prefix
+type StoredObject struct {
+	Key  string
+	ETag string // Without quotes
+}
+
+// Where the import, sync and migrate commands put an album's photos. Keys are whole bucket keys, see albumObjectKey.
+type AlbumStorage interface {
+	// Every object at the top level of the album's prefix, by key
+	List(ctx context.Context) (map[string]*StoredObject, error)
+	Upload(ctx context.Context, key, contentType string, data []byte) error
+	Delete(ctx context.Context, keys []string) error
+	// The ETag a local file gets once it's uploaded, to tell whether it changed
+	LocalETag(path string) (string, error)
+	// Where the album's photos are, for messages
+	Location() string
+}
+
+// The album's prefix in the site's bucket, with the site's credentials, which are its tenant's for tenant sites
+type S3AlbumStorage struct {
+	album *Album
+}
+
+// The album's folder in a fixture directory, like `serve -fixtures` reads, so changes can be tried out offline
+type FixtureAlbumStorage struct {
+	album *Album
+	root  string
+}
+
+// Returns the storage for an album, which is the fixture directory if one is given and S3 otherwise
+func newAlbumStorage(album *Album, fixtures string) (AlbumStorage, error) {
+	if fixtures == "" {
+		return &S3AlbumStorage{album}, nil
+	}
+	if _, err := NewFixtureBucket(fixtures); err != nil {
+		return nil, err
+	}
+	return &FixtureAlbumStorage{album, fixtures}, nil
+}
+
+// Unlike GetAllObjects it follows the listing past its first page, as sync deletes whatever it doesn't find locally
+func (s *S3AlbumStorage) List(ctx context.Context) (map[string]*StoredObject, error) {
+	svc, err := s.album.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]*StoredObject)
+	err = svc.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket:    aws.String(s.album.site.BucketName),
+		Prefix:    aws.String(albumObjectKey(s.album, "")),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects[*obj.Key] = &StoredObject{*obj.Key, strings.Trim(aws.StringValue(obj.ETag), `"`)}
+		}
+		return true
+	})
+	return objects, err
+}
+
+// Big files are split into parts that are uploaded in parallel
+func (s *S3AlbumStorage) Upload(ctx context.Context, key, contentType string, data []byte) error {
+	_, err := s3manager.NewUploader(s.album.site.awsSession).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.album.site.BucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3AlbumStorage) Delete(ctx context.Context, keys []string) error {
+	svc, err := s.album.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += STORAGE_DELETE_BATCH_SIZE {
+		end := min(start+STORAGE_DELETE_BATCH_SIZE, len(keys))
+
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.album.site.BucketName),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("Unable to delete %s. Error: %s", aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+/*
+Works out the ETag S3 gives a file uploaded by s3manager. That's the MD5 of the file, except for files big enough to be
+uploaded in parts, where it's the MD5 of the parts' MD5s followed by the number of parts.
+*/
+func (s *S3AlbumStorage) LocalETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var partSums []byte
+	parts := 0
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, s3manager.DefaultUploadPartSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n > 0 || parts == 0 {
+			partSums = append(partSums, h.Sum(nil)...)
+			parts++
+		}
+		if n < s3manager.DefaultUploadPartSize {
+			break
+		}
+	}
+
+	if parts == 1 {
+		return hex.EncodeToString(partSums), nil
+	}
+	sum := md5.Sum(partSums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+func (s *S3AlbumStorage) Location() string {
+	return fmt.Sprintf("s3://%s/%s", s.album.site.BucketName, albumObjectKey(s.album, ""))
+}
+
+// Keys are cleaned like FixtureBucket does, so they can't point outside the fixture directory
+func (s *FixtureAlbumStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *FixtureAlbumStorage) List(ctx context.Context) (map[string]*StoredObject, error) {
+	prefix := albumObjectKey(s.album, "")
+	objects := make(map[string]*StoredObject)
+	entries, err := os.ReadDir(s.path(prefix))
+	if os.IsNotExist(err) {
+		return objects, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		key := prefix + entry.Name()
+		objects[key] = &StoredObject{key, strings.Trim(fixtureETag(s.path(key)), `"`)}
+	}
+	return objects, nil
+}
+
+func (s *FixtureAlbumStorage) Upload(ctx context.Context, key, contentType string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(key)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(key), data, 0644)
+}
+
+func (s *FixtureAlbumStorage) Delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// The fixture bucket's ETags are the MD5 of the whole file, however big it is
+func (s *FixtureAlbumStorage) LocalETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *FixtureAlbumStorage) Location() string {
+	return s.path(albumObjectKey(s.album, ""))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+Whether sync would have uploaded a key, going by its extension like findImportFiles does first. Only those are deleted,
+so the videos, RAW files and sidecars next to the photos are left alone. Keys without an extension it knows could be
+anything, so they're left alone too.
+*/
+func isSyncedKey(key string) bool {
+	contentType := mime.TypeByExtension(strings.ToLower(path.Ext(key)))
+	return strings.HasPrefix(contentType, "image/") && !hasExtension(key, pairRawExtensions)
+}
+
+/*
+Compares files with what's in the album: returns the files that are new or have changed (by their ETags), and the keys
+of objects in the album that aren't among the files
+*/
+func planSync(ctx context.Context, storage AlbumStorage, files []*importFile) ([]*importFile, []string, error) {
+	remote, err := storage.List(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to list %s. Error: %s", storage.Location(), err.Error())
+	}
+
+	var uploads []*importFile
+	for _, file := range files {
+		if obj, ok := remote[file.key]; ok {
+			delete(remote, file.key)
+
+			etag, err := storage.LocalETag(file.path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to read %s. Error: %s", file.path, err.Error())
+			}
+			if obj.ETag == etag {
+				continue
+			}
+		}
+		uploads = append(uploads, file)
+	}
+
+	// Whatever is left in the listing isn't among the files any more
+	var removed []string
+	for key := range remote {
+		if isSyncedKey(key) {
+			removed = append(removed, key)
+		}
+	}
+	return uploads, removed, nil
+}
+
+func runSync(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	domain := flags.String("site", "", "Domain of the album's site, if more than one site is configured")
+	deleteRemoved := flags.Bool("delete", false, "Delete photos from the album that aren't in the folder")
+	dryRun := flags.Bool("dry-run", false, "Only show what would be uploaded and deleted")
+	concurrency := flags.Int("concurrency", 4, "Number of photos to upload at the same time")
+	server := flags.String("server", "", "URL of the running 50mm server to refresh the album cache on (default http://localhost:$FIFTYMM_PORT)")
+	fixtures := flags.String("fixtures", "", "Sync to this local directory, as read by 'serve -fixtures', instead of S3")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: 50mm sync <dir> <album path> [flags]\n\n")
+		flags.PrintDefaults()
+	}
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) != 2 || *concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+	dir := positional[0]
+
+	app = NewApp()
+	album, err := findAlbum(*domain, positional[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	storage, err := newAlbumStorage(album, *fixtures)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to use fixtures directory %s. Error: %s\n", *fixtures, err.Error())
+		return 1
+	}
+
+	files, err := findImportFiles(dir, album)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s. Error: %s\n", dir, err.Error())
+		return 1
+	}
+
+	ctx := context.Background()
+	uploads, removed, err := planSync(ctx, storage, files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	var deletes []string
+	if *deleteRemoved {
+		deletes = removed
+	}
+
+	if len(uploads) == 0 && len(deletes) == 0 {
+		fmt.Printf("%s is up to date\n", storage.Location())
+		return 0
+	}
+
+	if *dryRun {
+		for _, file := range uploads {
+			fmt.Printf("Would upload %s\n", file.key)
+		}
+		for _, key := range deletes {
+			fmt.Printf("Would delete %s\n", key)
+		}
+		fmt.Printf("%d to upload, %d to delete\n", len(uploads), len(deletes))
+		return 0
+	}
+
+	status, uploaded, deleted := 0, len(uploads), len(deletes)
+	if len(uploads) > 0 {
+		if failed := uploadImportFiles(storage, uploads, &importOptions{*concurrency, 0, album.site.GetColorProfile()}); failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d photos failed to upload\n", failed, len(uploads))
+			status, uploaded = 1, len(uploads)-failed
+		}
+	}
+	if len(deletes) > 0 {
+		if err := storage.Delete(ctx, deletes); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			status, deleted = 1, 0
+		} else {
+			for _, key := range deletes {
+				fmt.Printf("Deleted %s\n", key)
+			}
+		}
+	}
+
+	if *server == "" {
+		*server = fmt.Sprintf("http://localhost:%s", app.port)
+	}
+	if err := refreshServerCache(*server, album, uploaded, deleted); err != nil {
+		fmt.Printf("Unable to refresh the album cache on %s, changes will show up within %s. Error: %s\n", *server, CACHE_INTERVAL, err.Error())
+	} else {
+		fmt.Printf("Refreshed the album cache on %s\n", *server)
+	}
+	return status
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+const TEMPLATES_DIR_ENV_VAR = "FIFTYMM_TEMPLATES_DIR"
+const DEFAULT_TEMPLATES_DIR = "templates"
+
+// Themes say which version of the template data they were written for in a theme.ini in their folder
+const THEME_CONFIG_FILE = "theme.ini"
+
+/*
+The version of the data templates get in .Site, .Album and .PhotoView. Those views only ever grow within a version, so a
+theme written against them keeps working. Anything that renames or removes a field bumps the version, with a note in
+TEMPLATE_API_CHANGES for theme authors. The rest of the page context follows the Go code and may change any time.
+*/
+const TEMPLATE_API_VERSION = 1
+
+var TEMPLATE_API_CHANGES = map[int]string{
+	1: "Added .Site, .Album and .PhotoView",
+}
+
+var templatesDir = DEFAULT_TEMPLATES_DIR
+
+type SiteView struct {
+	Title        string
+	Url          string
+	Lang         string
+	OfflineCache bool
+
+	AppManifest bool
+	AppName     string
+	ThemeColor  string
+	AppIconUrl  string
+
+	GoogleSiteVerification string
+	BingSiteVerification   string
+	MetaTags               []*MetaTag
+	StructuredData         bool
+
+	site *Site // For Inject
+}
+
+type AlbumView struct {
+	Title       string
+	Description string
+	MetaTitle   string
+	Path        string
+	Url         string // Photo URLs are this followed by their slug
+	PageUrl     string
+	Photos      []*PhotoView // Only on album pages and embeds
+	Truncated   int          // Photos left out of Photos because of the album's MaxPhotos
+}
+
+type PhotoView struct {
+	Slug      string
+	Type      string // photo, or the type of a file that isn't a photo, like video
+	PageUrl   string
+	Width     int // Zero until the photo's size is known
+	Height    int
+	Sensitive bool
+	Archived  bool
+	Alt       string
+	Caption   string
+	Tags      []string
+	Title     string    // From the album's FilenamePattern, empty if there's none or the name doesn't match
+	Date      time.Time // Also from the FilenamePattern, zero if unknown
+
+	DeepZoomUrl string // The info.json of the photo's IIIF tiles, empty if it has none
+
+	photo Renderable
+	width int
+}
+
+// The photo at the page's photo width. Only worked out when a template asks, as S3 URLs have to be signed.
+func (p *PhotoView) Src() string {
+	return p.photo.GetPhotoForWidth(p.width)
+}
+
+func newSiteView(s *Site) *SiteView {
+	return &SiteView{s.SiteTitle, s.GetCanonicalUrl().String(), s.GetLanguage(), s.OfflineCache,
+		s.AppManifest, s.GetAppName(), s.GetThemeColor(), s.GetAppIconUrl(APP_ICON_SIZES[0]),
+		s.GoogleSiteVerification, s.BingSiteVerification, s.metaTags, s.StructuredData, s}
+}
+
+func newAlbumView(a *Album, photos []Renderable, width int) *AlbumView {
+	view := &AlbumView{a.AlbumTitle, a.Description, a.MetaTitle, a.Path, a.GetSiteUrl().String(), a.GetPageUrl(), nil, 0}
+	for _, photo := range photos {
+		view.Photos = append(view.Photos, newPhotoView(a, photo, width))
+	}
+	return view
+}
+
+func newPhotoView(a *Album, photo Renderable, width int) *PhotoView {
+	view := &PhotoView{
+		Slug:      photo.Slug(),
+		Type:      photo.Type(),
+		PageUrl:   a.GetSiteUrl().String() + photo.Slug(),
+		Sensitive: photo.IsSensitive(),
+		Archived:  photo.IsArchived(),
+		Alt:       photo.Alt(),
+		Caption:   photo.Caption(),
+		Tags:      photo.Tags(),
+		Title:     photo.Title(),
+		Date:      photo.Date(),
+		photo:     photo,
+		width:     width,
+	}
+	if info := photo.Info(); info != nil {
+		view.Width, view.Height = info.Width, info.Height
+	}
+	if a.DeepZoom {
+		view.DeepZoomUrl = a.deepZoomUrl(a.keyForSlug(photo.Slug()))
+	}
+	return view
+}
+
+// Every page context embeds BasePageContext, so templates can check {{.TemplateAPIVersion}}
+func (c *BasePageContext) TemplateAPIVersion() int {
+	return TEMPLATE_API_VERSION
+}
+
+func templatesDirFromEnv() string {
+	if dir := os.Getenv(TEMPLATES_DIR_ENV_VAR); dir != "" {
+		return dir
+	}
+	return DEFAULT_TEMPLATES_DIR
+}
+
+/*
+Warns about themes written for another version of the template data, which may render pages with missing parts without
+any error. Themes that don't say which version they target are assumed to target the first one.
+*/
+func checkTemplateAPIVersion(dir string) []string {
+	version := 1
+	path := filepath.Join(dir, THEME_CONFIG_FILE)
+	if cfg, err := ini.Load(path); err == nil {
+		if version, err = cfg.Section(ini.DEFAULT_SECTION).Key("TemplateAPIVersion").Int(); err != nil {
+			return []string{fmt.Sprintf("TemplateAPIVersion in %s must be a number", path)}
+		}
+	} else if !os.IsNotExist(err) {
+		return []string{fmt.Sprintf("Unable to read %s. Error: %s", path, err.Error())}
+	}
+
+	var warnings []string
+	if version > TEMPLATE_API_VERSION {
+		warnings = append(warnings, fmt.Sprintf("The templates in %s are for template API version %d, but this 50mm only has version %d",
+			dir, version, TEMPLATE_API_VERSION))
+	}
+	for v := version + 1; v <= TEMPLATE_API_VERSION; v++ {
+		warnings = append(warnings, fmt.Sprintf("The templates in %s are for template API version %d. Changed in version %d: %s",
+			dir, version, v, TEMPLATE_API_CHANGES[v]))
+	}
+	return warnings
+}
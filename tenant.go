@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// Each folder in here holds the site configs of one tenant, like a photographer sharing the server with others
+const TENANTS_DIR_NAME = "tenants"
+const TENANT_CONFIG_FILE = "tenant.ini"
+
+func init() {
+	metrics.RegisterCounter("fiftymm_tenant_requests_total", "Number of HTTP requests served, by tenant.")
+	metrics.RegisterCounter("fiftymm_tenant_rate_limited_total", "Number of HTTP requests rejected by the tenant rate limiter, by tenant.")
+	metrics.RegisterGauge("fiftymm_tenant_page_cache_bytes", "Size of the cached pages of each tenant's albums.")
+}
+
+/*
+Limits shared by all of a tenant's sites, so one tenant's traffic can't slow down everyone else's galleries. They're
+read from the DEFAULT section of tenant.ini in the tenant's folder, which is optional.
+*/
+type Tenant struct {
+	Name string `ini:"-"`
+
+	PageCacheMB   int `default:"unlimited" desc:"Memory the tenant's cached pages can use, in MB"`
+	RateLimit     int `default:"600" desc:"Requests per minute from each visitor, across all of the tenant's sites"`
+	S3Concurrency int `default:"unlimited" desc:"S3 calls the tenant's sites can make at once, within the server wide limit"`
+
+	rateLimiter *RateLimiter
+	s3Semaphore *Semaphore
+}
+
+func LoadTenant(dir string) (*Tenant, error) {
+	t := &Tenant{Name: filepath.Base(dir)}
+
+	path := filepath.Join(dir, TENANT_CONFIG_FILE)
+	if _, err := os.Stat(path); err == nil {
+		cfg, err := ini.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.Section(ini.DEFAULT_SECTION).MapTo(t); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.PageCacheMB < 0 || t.RateLimit < 0 || t.S3Concurrency < 0 {
+		return nil, fmt.Errorf("PageCacheMB, RateLimit and S3Concurrency of tenant %s can't be negative", t.Name)
+	}
+
+	limit := t.RateLimit
+	if limit <= 0 {
+		limit = DEFAULT_RATE_LIMIT
+	}
+	t.rateLimiter = NewRateLimiter(limit, 1*time.Minute)
+	if t.S3Concurrency > 0 {
+		t.s3Semaphore = NewSemaphore(t.S3Concurrency)
+	}
+	return t, nil
+}
+
+func (t *Tenant) GetPageCacheBytes() int {
+	return t.PageCacheMB * 1024 * 1024
+}
+
+/*
+Loads the sites of every tenant folder. A tenant can't take over a domain that's already configured, by the server's
+own configs or by another tenant, those sites are left out like configs that don't load.
+*/
+func loadTenantSites(configDir string, sites map[string]*Site) (failed []string) {
+	dirs, _ := filepath.Glob(filepath.Join(configDir, TENANTS_DIR_NAME, "*"))
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+
+		tenant, err := LoadTenant(dir)
+		if err != nil {
+			fmt.Printf("Unable to load tenant %s. Error: %s\n", dir, err.Error())
+			failed = append(failed, filepath.Join(dir, TENANT_CONFIG_FILE))
+			continue
+		}
+
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.ini"))
+		sort.Strings(paths)
+		for _, path := range paths {
+			if filepath.Base(path) == TENANT_CONFIG_FILE {
+				continue
+			}
+
+			site, err := loadSite(path, tenant)
+			if err == nil && sites[site.Domain] != nil {
+				err = fmt.Errorf("Site %s is already configured elsewhere", site.Domain)
+			}
+			if err != nil {
+				fmt.Printf("Unable to load config from file %s. Error: %s\n", path, err.Error())
+				failed = append(failed, path)
+				continue
+			}
+			sites[site.Domain] = site
+		}
+	}
+	return failed
+}
+
+// Labels for the site's metrics, with its tenant if it has one
+func (s *Site) metricLabels(labels ...string) []string {
+	labels = append([]string{"site", s.Domain}, labels...)
+	if s.tenant != nil {
+		labels = append(labels, "tenant", s.tenant.Name)
+	}
+	return labels
+}
+
+// Counts the tenant's requests and rate limits visitors across all of the tenant's sites
+func tenantMiddleware(site *Site) Middleware {
+	tenant := site.tenant
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			metrics.Add("fiftymm_tenant_requests_total", 1, "tenant", tenant.Name)
+			if !tenant.rateLimiter.Allow(clientIP(r)) {
+				metrics.Add("fiftymm_tenant_rate_limited_total", 1, "tenant", tenant.Name)
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("Too many requests\n"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+const DEFAULT_THEME = "light"
+const DEFAULT_GRID_GAP = 10
+
+var THEMES = []string{"light", "dark"}
+
+// Hex colors, rgb()/hsl() colors, and color names. Anything else could break out of the style attribute.
+var cssColorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|(rgb|rgba|hsl|hsla)\([0-9.,%\s]+\)|[a-zA-Z]+)$`)
+
+/*
+The look of a page. Themes set the colors with CSS classes in base.css, and the color options override single colors
+of the theme. Albums inherit each setting from the site, and sites from the defaults, so an album can for example have a
+black background while the rest of the site stays light.
+*/
+type Theme struct {
+	Name            string
+	BackgroundColor string
+	TextColor       string
+	GridGap         int
+}
+
+func validateTheme(name, backgroundColor, textColor string, gridGap int) error {
+	if name != "" {
+		known := false
+		for _, t := range THEMES {
+			known = known || name == t
+		}
+		if !known {
+			return fmt.Errorf("Theme must be one of %s", strings.Join(THEMES, ", "))
+		}
+	}
+
+	for option, color := range map[string]string{"BackgroundColor": backgroundColor, "TextColor": textColor} {
+		if color != "" && !cssColorPattern.MatchString(color) {
+			return fmt.Errorf("%s must be a CSS color like #1A1A1A or rgb(26, 26, 26)", option)
+		}
+	}
+
+	if gridGap < 0 && gridGap != UNSET {
+		return fmt.Errorf("GridGap can't be negative")
+	}
+	return nil
+}
+
+// CSS custom properties for the style attribute of the page body, which base.css picks up
+func (t *Theme) Style() template.CSS {
+	style := fmt.Sprintf("--grid-gap: %dpx;", t.GridGap)
+	if t.BackgroundColor != "" {
+		style += fmt.Sprintf(" --background-color: %s;", t.BackgroundColor)
+	}
+	if t.TextColor != "" {
+		style += fmt.Sprintf(" --text-color: %s;", t.TextColor)
+	}
+	// The values are checked when the config is loaded
+	return template.CSS(style)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *Site) GetTheme() *Theme {
+	gridGap := DEFAULT_GRID_GAP
+	if s.GridGap != UNSET {
+		gridGap = s.GridGap
+	}
+
+	return &Theme{
+		firstNonEmpty(s.Theme, DEFAULT_THEME),
+		s.BackgroundColor,
+		s.TextColor,
+		gridGap,
+	}
+}
+
+func (a *Album) GetTheme() *Theme {
+	theme := a.site.GetTheme()
+	theme.Name = firstNonEmpty(a.Theme, theme.Name)
+
+	// An album with its own theme doesn't inherit the site's colors, they were picked for the site's theme
+	if a.Theme != "" {
+		theme.BackgroundColor, theme.TextColor = "", ""
+	}
+	theme.BackgroundColor = firstNonEmpty(a.BackgroundColor, theme.BackgroundColor)
+	theme.TextColor = firstNonEmpty(a.TextColor, theme.TextColor)
+
+	if a.GridGap != UNSET {
+		theme.GridGap = a.GridGap
+	}
+	return theme
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Big enough for a grid cell on a phone, and a cheap source for the blurhash
+const THUMBNAIL_SIZE = 400
+
+const DERIVATIVE_THUMBNAIL = "thumb-400-v1"
+const DERIVATIVE_BLURHASH = "blurhash-v1"
+
+// Components of the blurhash across and down. 4 by 3 is what blurha.sh suggests for photos in landscape.
+const BLURHASH_X_COMPONENTS = 4
+const BLURHASH_Y_COMPONENTS = 3
+
+const BLURHASH_CHARACTERS = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+var thumbnailExtensions = []string{".jpg", ".jpeg", ".png"}
+
+func (a *Album) isThumbnailable(key string) bool {
+	return !a.isArchived(key) && rendererForKey(key) == nil && hasExtension(key, thumbnailExtensions)
+}
+
+/*
+Returns a small copy of one of the album's photos. Albums with BlurFaces shrink the blurred photo, so no thumbnail shows
+a face the album hides. Photos that are too big to read or aren't JPEGs or PNGs get an empty derivative, so they aren't
+downloaded again.
+*/
+func (a *Album) GetPhotoThumbnail(ctx context.Context, key string) ([]byte, error) {
+	kind := DERIVATIVE_THUMBNAIL
+	if a.BlurFaces {
+		kind += "-faces"
+	}
+	return a.GetDerivative(ctx, kind, key, func(ctx context.Context) ([]byte, error) {
+		var data []byte
+		var err error
+		if a.BlurFaces {
+			data, err = a.GetDerivative(ctx, DERIVATIVE_BLURRED_FACES, key, func(ctx context.Context) ([]byte, error) {
+				return a.buildBlurredPhoto(ctx, key)
+			})
+		} else {
+			data, err = a.getObjectData(ctx, key)
+		}
+		if err == errObjectTooLarge {
+			return []byte{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		contentType := http.DetectContentType(data)
+		if contentType != "image/jpeg" && contentType != "image/png" {
+			return []byte{}, nil
+		}
+		return resizeImage(data, contentType, THUMBNAIL_SIZE, a.site.GetColorProfile())
+	})
+}
+
+/*
+Returns the blurhash of one of the album's photos, made from its thumbnail, so pages can show the photo's colors while
+it loads. Photos without a thumbnail have no blurhash.
+*/
+func (a *Album) GetPhotoBlurhash(ctx context.Context, key string) (string, error) {
+	data, err := a.GetDerivative(ctx, DERIVATIVE_BLURHASH, key, func(ctx context.Context) ([]byte, error) {
+		thumbnail, err := a.GetPhotoThumbnail(ctx, key)
+		if err != nil || len(thumbnail) == 0 {
+			return []byte{}, err
+		}
+		img, _, err := decodeImage(thumbnail)
+		if err != nil {
+			return []byte{}, nil
+		}
+		return []byte(encodeBlurhash(img, BLURHASH_X_COMPONENTS, BLURHASH_Y_COMPONENTS)), nil
+	})
+	if err != nil || len(data) == 0 {
+		return "", err
+	}
+
+	hash := string(data)
+	if previous, loaded := a.blurhashCache.Swap(key, hash); !loaded || previous != hash {
+		a.photosChanged()
+	}
+	return hash, nil
+}
+
+// The blurhash of a photo, empty until it's made
+func (a *Album) photoBlurhash(key string) string {
+	if hash, ok := a.blurhashCache.Load(key); ok {
+		return hash.(string)
+	}
+	return ""
+}
+
+// Making the blurhash makes the thumbnail along the way, so one job does both
+func (a *Album) queueThumbnail(key string, priority JobPriority) {
+	jobQueue.Enqueue(&Job{
+		Name:     DERIVATIVE_BLURHASH + ":" + a.site.Domain + ":" + key,
+		Priority: priority,
+		Run: func(ctx context.Context) error {
+			_, err := a.GetPhotoBlurhash(ctx, key)
+			return err
+		},
+		ErrorContext: albumErrorContext(a),
+	})
+}
+
+// Encodes an image the way https://blurha.sh does, as the average color plus a few cosine components
+func encodeBlurhash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Colors are averaged in linear light, each pixel is converted once up front
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixels[y*width+x] = [3]float64{srgbToLinear(float64(r) / 0xffff), srgbToLinear(float64(g) / 0xffff),
+				srgbToLinear(float64(b) / 0xffff)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * pixels[y*width+x][c]
+					}
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	writeBlurhashDigits(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		writeBlurhashDigits(&hash, quantisedMax, 1)
+	} else {
+		writeBlurhashDigits(&hash, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBlurhashDigits(&hash, blurhashColor(dc[0])<<16|blurhashColor(dc[1])<<8|blurhashColor(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, v := range factor {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signedSqrt(v/maxValue)*9+9.5))))
+			value = value*19 + quantised
+		}
+		writeBlurhashDigits(&hash, value, 2)
+	}
+	return hash.String()
+}
+
+// Writes value in base 83, padded to length digits
+func writeBlurhashDigits(b *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		b.WriteByte(BLURHASH_CHARACTERS[value/int(math.Pow(83, float64(i)))%83])
+	}
+}
+
+// A linear color channel as an 8 bit sRGB value
+func blurhashColor(value float64) int {
+	return int(linearToSRGB(math.Max(0, math.Min(1, value)))*255 + 0.5)
+}
+
+func signedSqrt(v float64) float64 {
+	if v < 0 {
+		return -math.Sqrt(-v)
+	}
+	return math.Sqrt(v)
+}
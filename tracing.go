@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is turned on by pointing the standard OpenTelemetry variable at an OTLP/HTTP collector
+const OTLP_ENDPOINT_ENV_VAR = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+const TRACER_NAME = "github.com/agile-leaf/50mm"
+
+// Until tracing is set up this is a no-op tracer, so instrumented code doesn't need to check if tracing is on
+var tracer = otel.Tracer(TRACER_NAME)
+
+func tracingEnabled() bool {
+	return os.Getenv(OTLP_ENDPOINT_ENV_VAR) != ""
+}
+
+// Sets up the OTLP exporter and returns a function that flushes pending spans on shutdown
+func initTracing() (func(), error) {
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("50mm")))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = provider.Tracer(TRACER_NAME)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			fmt.Printf("Unable to flush traces. Error: %s\n", err.Error())
+		}
+	}, nil
+}
+
+// Returns a context that keeps the trace of ctx but isn't cancelled when ctx is
+func detachContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+type s3SpanKey struct{}
+
+// Wraps every S3 API call made through the session in a span, so the calls show up under the request that made them
+func instrumentAWSSession(sess *session.Session, site *Site) {
+	sess.Handlers.Validate.PushFront(func(r *request.Request) {
+		ctx, span := tracer.Start(r.Context(), "s3."+r.Operation.Name, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("site", site.Domain),
+				attribute.String("aws.s3.bucket", site.BucketName),
+			))
+		r.SetContext(context.WithValue(ctx, s3SpanKey{}, span))
+	})
+
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		span, ok := r.Context().Value(s3SpanKey{}).(trace.Span)
+		if !ok {
+			return
+		}
+
+		if r.HTTPResponse != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", r.HTTPResponse.StatusCode))
+		}
+		span.SetAttributes(attribute.Int("aws.retries", r.RetryCount))
+		if r.Error != nil {
+			span.RecordError(r.Error)
+			span.SetStatus(codes.Error, r.Error.Error())
+		}
+		span.End()
+	})
+}
+
+// Starts a server span for every request to a site, named after the route that handled it
+func tracingMiddleware(site *Site) Middleware {
+	propagator := propagation.TraceContext{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				attribute.String("site", site.Domain),
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+			defer span.End()
+
+			r = r.WithContext(ctx)
+			rec := recordStatus(w)
+			next.ServeHTTP(rec, r)
+
+			if r.Pattern != "" {
+				span.SetName(r.Method + " " + r.Pattern)
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+			if rec.status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+The photos of an album and their template views, built once per cache generation and shared by every request for the
+album. They're read only once built, so requests can't change them. Photos are also rebuilt when the background jobs
+learn something about one of them, like its size, which drops the cached pages as well, and when the signed URLs in
+them get close to expiring.
+*/
+type albumPhotoCache struct {
+	mutex      sync.Mutex
+	entry      *albumPhotos
+	generation uint64
+}
+
+type albumPhotos struct {
+	photos    []Renderable
+	truncated int // Photos left out because of the album's MaxPhotos
+	built     time.Time
+
+	viewsMutex sync.Mutex
+	views      map[int]*AlbumView // By photo width
+}
+
+// Buffers for rendering pages, which grow to the size of the biggest album page and are reused from then on
+var renderBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+/*
+Albums with a MaxPhotos only get the first ones, so a prefix with tens of thousands of photos doesn't turn into a page
+with as many tiles. The rest still have their own pages, they're just not in the album's grid, sheet or manifest.
+*/
+func newAlbumPhotos(a *Album, keys []string) *albumPhotos {
+	truncated := len(keys)
+	keys = a.shownKeys(keys)
+	if truncated -= len(keys); truncated > 0 {
+		metrics.Add("fiftymm_album_truncations_total", 1, a.site.metricLabels("album", a.Path)...)
+	}
+
+	photos := make([]Renderable, 0, len(keys))
+	for _, key := range keys {
+		photos = append(photos, a.GetPhotoForKey(key))
+	}
+	a.stackPhotos(keys, photos)
+	return &albumPhotos{photos: photos, truncated: truncated, built: time.Now(), views: make(map[int]*AlbumView)}
+}
+
+// The first MaxPhotos of the keys, for albums with one
+func (a *Album) shownKeys(keys []string) []string {
+	if a.MaxPhotos > 0 && len(keys) > a.MaxPhotos {
+		return keys[:a.MaxPhotos]
+	}
+	return keys
+}
+
+/*
+Photo URLs are presigned or signed when the photos are built, so an album nobody refreshes can't keep them forever.
+Pages made from them are cached for up to PAGE_CACHE_MAX_AGE, so they're rebuilt halfway through what's left after
+that, which leaves the rest for visitors who keep a page open.
+*/
+func (p *albumPhotos) expired(s *Site) bool {
+	return time.Since(p.built) > (s.GetPhotoUrlLifetime()-PAGE_CACHE_MAX_AGE)/2
+}
+
+func init() {
+	metrics.RegisterCounter("fiftymm_album_truncations_total", "Number of times an album's photos were cut down to its MaxPhotos, by album.")
+}
+
+func (p *albumPhotos) view(a *Album, width int) *AlbumView {
+	p.viewsMutex.Lock()
+	defer p.viewsMutex.Unlock()
+
+	view, ok := p.views[width]
+	if !ok {
+		view = newAlbumView(a, p.photos, width)
+		view.Truncated = p.truncated
+		p.views[width] = view
+	}
+	return view
+}
+
+func (a *Album) currentPhotos(ctx context.Context) (*albumPhotos, error) {
+	// Read before the keys, a refresh in between only means the next request builds the photos again
+	generation := a.CacheGeneration()
+
+	keys, err := a.GetAllImageKeys(ctx)
+	if err != nil {
+		reportError("get image keys from S3", err, albumErrorContext(a))
+		return nil, err
+	}
+
+	// No caching in dev mode, like the keys
+	if app.devMode {
+		return newAlbumPhotos(a, keys), nil
+	}
+
+	a.photoCache.mutex.Lock()
+	defer a.photoCache.mutex.Unlock()
+
+	if a.photoCache.entry != nil && a.photoCache.generation == generation && !a.photoCache.entry.expired(a.site) {
+		return a.photoCache.entry, nil
+	}
+	entry := newAlbumPhotos(a, keys)
+	a.photoCache.entry, a.photoCache.generation = entry, generation
+	return entry, nil
+}
+
+// The album's photos along with their view for templates at the given width
+func (a *Album) GetPhotosAndView(ctx context.Context, width int) ([]Renderable, *AlbumView, error) {
+	entry, err := a.currentPhotos(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.photos, entry.view(a, width), nil
+}
+
+// Drops the built photos and the cached pages, for when something the photos show changed without a cache refresh
+func (a *Album) photosChanged() {
+	a.photoCache.mutex.Lock()
+	a.photoCache.entry = nil
+	a.photoCache.mutex.Unlock()
+
+	pageCache.Invalidate(a)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const VISITORS_STATE_FILE = "visitors.json"
+const VISITORS_SAVE_INTERVAL = 1 * time.Minute
+const VISITORS_HISTORY_DAYS = 90
+const VISITORS_FOOTER_DAYS = 30
+
+// Each visitor's hash is kept for the rest of the day, so a flood of made up user agents could fill up memory and the state file
+const VISITORS_MAX_SEEN_PER_DAY = 50000
+const ADMIN_VISITORS_PATH = "/admin/visitors"
+
+// Who gets to see an album's visitor count
+const VISITOR_COUNTER_OFF = "off"
+const VISITOR_COUNTER_OWNER = "owner"
+const VISITOR_COUNTER_PUBLIC = "public"
+
+var VISITOR_COUNTERS = []string{VISITOR_COUNTER_OFF, VISITOR_COUNTER_OWNER, VISITOR_COUNTER_PUBLIC}
+
+type AlbumVisitors struct {
+	Seen  map[string]bool // Hashed visitors of the current day, forgotten when it ends
+	Daily map[string]int  // Unique visitors by day, like 2024-05-01
+}
+
+/*
+Visitors are told apart by a hash of their IP address and user agent with a salt that changes every day. The salt is
+saved with the counts, so restarts don't count everyone again, but is thrown away at the end of the day, after which
+the hashes can't be linked to anyone, or to the next day's visitors.
+*/
+type VisitorState struct {
+	Day    string
+	Salt   []byte
+	Albums map[string]*AlbumVisitors // By domain and album path
+}
+
+type VisitorTracker struct {
+	mutex sync.Mutex
+	state *VisitorState
+	dirty bool
+}
+
+var visitors = &VisitorTracker{state: &VisitorState{Albums: make(map[string]*AlbumVisitors)}}
+
+func currentVisitorDay() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+func (v *VisitorTracker) Load() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err := loadJSONState(VISITORS_STATE_FILE, v.state); err != nil {
+		return err
+	}
+	if v.state.Albums == nil {
+		v.state.Albums = make(map[string]*AlbumVisitors)
+	}
+	return nil
+}
+
+func (v *VisitorTracker) Save() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if !v.dirty {
+		return nil
+	}
+	if err := saveJSONState(VISITORS_STATE_FILE, v.state); err != nil {
+		return err
+	}
+	v.dirty = false
+	return nil
+}
+
+// Saves the counts every now and then. A crash loses at most VISITORS_SAVE_INTERVAL of them.
+func (v *VisitorTracker) SaveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := v.Save(); err != nil {
+			fmt.Printf("Unable to save visitor counts. Error: %s\n", err.Error())
+		}
+	}
+}
+
+// Starts a new day with a new salt once the current one is over. Must be called with the mutex held.
+func (v *VisitorTracker) rollDay() {
+	day := currentVisitorDay()
+	if v.state.Day == day {
+		return
+	}
+
+	v.state.Day = day
+	v.state.Salt = make([]byte, 32)
+	rand.Read(v.state.Salt)
+
+	oldest := time.Now().UTC().AddDate(0, 0, -VISITORS_HISTORY_DAYS).Format("2006-01-02")
+	for _, album := range v.state.Albums {
+		album.Seen = nil
+		for d := range album.Daily {
+			if d < oldest {
+				delete(album.Daily, d)
+			}
+		}
+	}
+	v.dirty = true
+}
+
+func visitorAlbumKey(album *Album) string {
+	return album.site.Domain + album.Path
+}
+
+func (v *VisitorTracker) Record(album *Album, r *http.Request) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.rollDay()
+
+	h := sha256.New()
+	h.Write(v.state.Salt)
+	h.Write([]byte(clientIP(r) + "\x00" + r.UserAgent()))
+	visitor := hex.EncodeToString(h.Sum(nil)[:16])
+
+	counts, ok := v.state.Albums[visitorAlbumKey(album)]
+	if !ok {
+		counts = &AlbumVisitors{Daily: make(map[string]int)}
+		v.state.Albums[visitorAlbumKey(album)] = counts
+	}
+	if counts.Seen == nil {
+		counts.Seen = make(map[string]bool)
+	}
+	if counts.Seen[visitor] {
+		return
+	}
+	// Past the cap visitors are still counted, but not remembered, so their next visits count again
+	if len(counts.Seen) < VISITORS_MAX_SEEN_PER_DAY {
+		counts.Seen[visitor] = true
+	}
+	counts.Daily[v.state.Day]++
+	v.dirty = true
+}
+
+// Adds up the daily unique visitors of the last few days, today included
+func (v *VisitorTracker) Count(album *Album, days int) int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	counts, ok := v.state.Albums[visitorAlbumKey(album)]
+	if !ok {
+		return 0
+	}
+
+	total := 0
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+	for day, n := range counts.Daily {
+		if day >= since {
+			total += n
+		}
+	}
+	return total
+}
+
+func (v *VisitorTracker) Daily(album *Album) map[string]int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	daily := make(map[string]int)
+	if counts, ok := v.state.Albums[visitorAlbumKey(album)]; ok {
+		for day, n := range counts.Daily {
+			daily[day] = n
+		}
+	}
+	return daily
+}
+
+func (a *Album) GetVisitorCounter() string {
+	return firstNonEmpty(a.VisitorCounter, VISITOR_COUNTER_OFF)
+}
+
+func validateVisitorCounter(a *Album) error {
+	for _, c := range VISITOR_COUNTERS {
+		if a.GetVisitorCounter() == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("VisitorCounter must be one of %s", strings.Join(VISITOR_COUNTERS, ", "))
+}
+
+// Counts a visit to the album page. Visitors who ask not to be tracked aren't counted, and neither are uptime checkers' HEADs.
+func recordAlbumVisit(album *Album, r *http.Request) {
+	if album.GetVisitorCounter() == VISITOR_COUNTER_OFF || r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" ||
+		r.Method == http.MethodHead {
+		return
+	}
+	visitors.Record(album, r)
+}
+
+// The count for the album footer, zero unless the album shows it publicly
+func (a *Album) GetPublicVisitorCount() int {
+	if a.GetVisitorCounter() != VISITOR_COUNTER_PUBLIC {
+		return 0
+	}
+	return visitors.Count(a, VISITORS_FOOTER_DAYS)
+}
+
+type AlbumVisitorStats struct {
+	Site    string
+	Album   string
+	Counter string
+	Today   int
+	Last30  int
+	Daily   map[string]int
+}
+
+// Visitor counts of every album that has a counter, for the site owner. Filter with ?site=<domain>.
+func handleAdminVisitors(w http.ResponseWriter, r *http.Request) {
+	var stats []*AlbumVisitorStats
+	for _, site := range app.sites {
+		if domain := r.URL.Query().Get("site"); domain != "" && domain != site.Domain {
+			continue
+		}
+		for _, album := range site.Albums {
+			if album.GetVisitorCounter() == VISITOR_COUNTER_OFF {
+				continue
+			}
+			stats = append(stats, &AlbumVisitorStats{
+				Site:    site.Domain,
+				Album:   album.Path,
+				Counter: album.GetVisitorCounter(),
+				Today:   visitors.Count(album, 1),
+				Last30:  visitors.Count(album, VISITORS_FOOTER_DAYS),
+				Daily:   visitors.Daily(album),
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Site != stats[j].Site {
+			return stats[i].Site < stats[j].Site
+		}
+		return stats[i].Album < stats[j].Album
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
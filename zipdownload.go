@@ -0,0 +1,561 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+/*
+Albums with ZipDownload let visitors download all of their photos, or the ones they tick, as one zip. Big albums take a
+while to pack, so zips are made by the job queue while the visitor waits on a page that refreshes itself, and can have
+the link emailed to them on sites with SMTP. Zips are kept for ZIP_LIFETIME, in the bucket for sites with a
+DerivativesPrefix and in FIFTYMM_DATA_DIR otherwise.
+*/
+const ZIP_SLUG = "zip"
+const ZIP_DIR_NAME = "zips"
+const ZIP_LIFETIME = 24 * time.Hour
+const DEFAULT_ZIP_MAX_MB = 2048
+
+// Room zips can take up in the data dir at once, across all sites, while they're packed or kept there
+const ZIP_DISK_MAX_MB_ENV_VAR = "FIFTYMM_ZIP_DISK_MAX_MB"
+const DEFAULT_ZIP_DISK_MAX_MB = 20480
+
+// Big albums over slow S3 connections need much longer than other jobs
+const ZIP_JOB_TIMEOUT = 30 * time.Minute
+
+const ZIP_PENDING = "pending"
+const ZIP_READY = "ready"
+const ZIP_FAILED = "failed"
+
+var zipRateLimiter = NewRateLimiter(10, 1*time.Hour)
+
+var errZipEmpty = errors.New("no photos to download")
+var errZipTooBig = errors.New("too big for a zip download")
+var errZipNoRoom = errors.New("no room left for zips in the data dir")
+
+type ZipDownload struct {
+	ID      string
+	Status  string
+	Photos  int
+	Size    int64 // Of the photos, the zip is about the same as they're stored as they are
+	Created time.Time
+	Emails  []string // Sent the link when the zip is ready
+
+	album *Album
+	keys  []string
+	// Where the finished zip is, a file in the data dir or a key in the bucket
+	file      string
+	bucketKey string
+}
+
+type ZipPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	Zip        *ZipDownload
+	FileUrl    string
+	SizeMB     int64
+}
+
+type ZipEmail struct {
+	SiteTitle  string
+	AlbumTitle string
+	Url        string
+	Expires    time.Time
+}
+
+// Zips being made or ready to download, by ID. They're forgotten on restart, like the files in the data dir.
+var zipDownloads = struct {
+	mutex sync.Mutex
+	byID  map[string]*ZipDownload
+}{byID: make(map[string]*ZipDownload)}
+
+func (a *Album) GetZipMaxBytes() int64 {
+	mb := a.ZipMaxMB
+	if mb <= 0 {
+		mb = a.site.ZipMaxMB
+	}
+	if mb <= 0 {
+		mb = DEFAULT_ZIP_MAX_MB
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+// Zips are packed from the originals, so albums with BlurFaces don't offer them, they'd give away the faces the album hides
+func (a *Album) HasZipDownload() bool {
+	return a.ZipDownload && !a.BlurFaces
+}
+
+func zipDiskMaxBytes() int64 {
+	if mb, err := strconv.Atoi(os.Getenv(ZIP_DISK_MAX_MB_ENV_VAR)); err == nil && mb > 0 {
+		return int64(mb) * 1024 * 1024
+	}
+	return DEFAULT_ZIP_DISK_MAX_MB * 1024 * 1024
+}
+
+// How much of the data dir zips take up, the ones being packed and the ones kept there. Must be called with the mutex held.
+func zipDiskUsage() int64 {
+	var used int64
+	for _, d := range zipDownloads.byID {
+		if d.Status == ZIP_PENDING || d.file != "" {
+			used += d.Size
+		}
+	}
+	return used
+}
+
+func (a *Album) getZipUrl(id string) string {
+	return a.GetSiteUrl().String() + ZIP_SLUG + "/" + id
+}
+
+// The same photos of the same album make the same zip, so visitors asking again get the one already made
+func zipID(album *Album, keys []string, etags map[string]string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00", album.site.Domain, album.Path)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s\x00%s\x00", key, etags[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:24]
+}
+
+// The name the zip is downloaded as, after the album's path
+func (a *Album) zipFilename() string {
+	name := safeSlugPart(path.Base(strings.Trim(a.Path, "/")))
+	return firstNonEmpty(name, "photos") + ".zip"
+}
+
+/*
+Works out which photos go in the zip: the ones ticked on the album page, or all of them. Archived photos can't be read,
+so they're left out.
+*/
+func (a *Album) zipObjects(ctx context.Context, slugs []string) ([]*s3.Object, error) {
+	keys, err := a.GetAllImageKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The listing has the sizes the key cache doesn't
+	objects, err := a.GetAllObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, key := range keys {
+		wanted[key] = len(slugs) == 0
+	}
+	for _, slug := range slugs {
+		if key := a.keyForSlug(slug); key != "" {
+			if _, ok := wanted[key]; ok {
+				wanted[key] = true
+			}
+		}
+	}
+
+	var result []*s3.Object
+	for _, obj := range objects {
+		if wanted[*obj.Key] && !a.isArchived(*obj.Key) {
+			result = append(result, obj)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return *result[i].Key < *result[j].Key })
+	return result, nil
+}
+
+// Starts making a zip, or returns the one that's already being made or ready for the same photos
+func (a *Album) startZip(ctx context.Context, slugs []string, email string) (*ZipDownload, error) {
+	objects, err := a.zipObjects(ctx, slugs)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, errZipEmpty
+	}
+
+	keys := make([]string, len(objects))
+	etags := make(map[string]string, len(objects))
+	var size int64
+	for i, obj := range objects {
+		keys[i] = *obj.Key
+		etags[*obj.Key] = aws.StringValue(obj.ETag)
+		size += aws.Int64Value(obj.Size)
+	}
+	if size > a.GetZipMaxBytes() {
+		return nil, errZipTooBig
+	}
+
+	id := zipID(a, keys, etags)
+	zipDownloads.mutex.Lock()
+	defer zipDownloads.mutex.Unlock()
+
+	if d, ok := zipDownloads.byID[id]; ok && d.Status != ZIP_FAILED {
+		if email != "" && d.Status == ZIP_PENDING {
+			if !slices.Contains(d.Emails, email) {
+				d.Emails = append(d.Emails, email)
+			}
+		} else if email != "" {
+			go a.sendZipEmail(d, email)
+		}
+		return d, nil
+	}
+	if zipDiskUsage()+size > zipDiskMaxBytes() {
+		return nil, errZipNoRoom
+	}
+
+	d := &ZipDownload{ID: id, Status: ZIP_PENDING, Photos: len(keys), Size: size, Created: time.Now(), album: a, keys: keys}
+	if email != "" {
+		d.Emails = []string{email}
+	}
+	zipDownloads.byID[id] = d
+	jobQueue.Enqueue(&Job{
+		Name:         "zip " + id,
+		Priority:     PRIORITY_LOW,
+		Timeout:      ZIP_JOB_TIMEOUT,
+		Run:          d.build,
+		OnFailure:    func(error) { d.setStatus(ZIP_FAILED) },
+		ErrorContext: albumErrorContext(a),
+	})
+	return d, nil
+}
+
+func (d *ZipDownload) setStatus(status string) {
+	zipDownloads.mutex.Lock()
+	d.Status = status
+	zipDownloads.mutex.Unlock()
+}
+
+func (d *ZipDownload) getStatus() string {
+	zipDownloads.mutex.Lock()
+	defer zipDownloads.mutex.Unlock()
+	return d.Status
+}
+
+// Packs the photos into a file in the data dir, and moves it into the bucket for sites with a DerivativesPrefix
+func (d *ZipDownload) build(ctx context.Context) error {
+	a := d.album
+	dir := filepath.Join(app.dataDir, ZIP_DIR_NAME)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file := filepath.Join(dir, d.ID+".zip")
+	if err := a.writeZip(ctx, file+".tmp", d.keys); err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+
+	bucketKey := ""
+	if prefix := a.site.DerivativesPrefix; prefix != "" {
+		bucketKey = path.Join(prefix, ZIP_DIR_NAME, d.ID+".zip")
+		if err := a.uploadZip(ctx, file, bucketKey); err != nil {
+			return err
+		}
+		os.Remove(file)
+		file = ""
+	}
+
+	zipDownloads.mutex.Lock()
+	d.file, d.bucketKey, d.Status = file, bucketKey, ZIP_READY
+	emails := d.Emails
+	zipDownloads.mutex.Unlock()
+
+	// Everyone who asked for the same photos while the zip was packed is sent the link
+	for _, email := range emails {
+		a.sendZipEmail(d, email)
+	}
+	return nil
+}
+
+// Photos are already compressed, so they're stored as they are, which is much quicker than deflating them again
+func (a *Album) writeZip(ctx context.Context, file string, keys []string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(f)
+	for _, key := range keys {
+		if err := a.addToZip(ctx, svc, zw, key); err != nil {
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (a *Album) addToZip(ctx context.Context, svc *s3.S3, zw *zip.Writer, key string) error {
+	release, err := a.acquireS3(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(a.site.BucketName), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	// Photos in folders below the album's prefix keep their folder in the zip
+	name := strings.TrimPrefix(strings.TrimPrefix(key, a.BucketPrefix), "/")
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: aws.TimeValue(obj.LastModified)})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, obj.Body)
+	return err
+}
+
+func (a *Album) uploadZip(ctx context.Context, file, key string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+	_, err = s3manager.NewUploaderWithClient(svc).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:             aws.String(a.site.BucketName),
+		Key:                aws.String(key),
+		Body:               f,
+		ContentType:        aws.String("application/zip"),
+		ContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", a.zipFilename())),
+	})
+	return err
+}
+
+func (a *Album) sendZipEmail(d *ZipDownload, to string) {
+	s := a.site
+	tmpl, err := template.ParseFiles("templates/email/zip.txt")
+	if err != nil {
+		reportError("send zip email", err, albumErrorContext(a))
+		return
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.GetContactFrom())
+	fmt.Fprintf(&body, "To: %s\r\n", to)
+	fmt.Fprintf(&body, "Subject: [%s] Your download of %s is ready\r\n", s.SiteTitle, a.AlbumTitle)
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	if err := tmpl.Execute(&body, &ZipEmail{s.SiteTitle, a.AlbumTitle, a.getZipUrl(d.ID), d.Created.Add(ZIP_LIFETIME)}); err != nil {
+		reportError("send zip email", err, albumErrorContext(a))
+		return
+	}
+
+	var auth smtp.Auth
+	if s.SmtpUser != "" {
+		auth = smtp.PlainAuth("", s.SmtpUser, s.SmtpPass, s.SmtpHost)
+	}
+	if err := smtp.SendMail(s.GetSmtpAddr(), auth, s.GetContactFrom(), []string{to}, body.Bytes()); err != nil {
+		reportError("send zip email", err, albumErrorContext(a))
+	}
+}
+
+/*
+Forgets zips older than ZIP_LIFETIME and deletes their files, run whenever a new zip is asked for. Files left in the data
+dir from before a restart are deleted once they're that old too.
+*/
+func expireZipDownloads() {
+	files, _ := filepath.Glob(filepath.Join(app.dataDir, ZIP_DIR_NAME, "*.zip*"))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && time.Now().Sub(info.ModTime()) > ZIP_LIFETIME+ZIP_JOB_TIMEOUT {
+			os.Remove(file)
+		}
+	}
+
+	zipDownloads.mutex.Lock()
+	var expired []*ZipDownload
+	for id, d := range zipDownloads.byID {
+		if time.Now().Sub(d.Created) > ZIP_LIFETIME && d.Status != ZIP_PENDING {
+			expired = append(expired, d)
+			delete(zipDownloads.byID, id)
+		}
+	}
+	zipDownloads.mutex.Unlock()
+
+	for _, d := range expired {
+		if d.file != "" {
+			os.Remove(d.file)
+		}
+		if d.bucketKey == "" {
+			continue
+		}
+		svc, err := d.album.site.GetS3Service()
+		if err == nil {
+			_, err = svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(d.album.site.BucketName),
+				Key: aws.String(d.bucketKey)})
+		}
+		if err != nil {
+			reportError("delete expired zip", err, albumErrorContext(d.album))
+		}
+	}
+}
+
+func handleZipStart(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !album.HasZipDownload() {
+		renderErrorPage(album.site, w, http.StatusNotFound, "Not found")
+		return
+	}
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	if !zipRateLimiter.Allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "3600")
+		renderErrorPage(album.site, w, http.StatusTooManyRequests, translate(album.site.GetLanguage(), "zip_too_many"))
+		return
+	}
+
+	r.ParseForm()
+	email := ""
+	if album.site.HasSmtp() {
+		email = strings.TrimSpace(r.PostFormValue("email"))
+		// Header values can't contain new lines, otherwise visitors could inject their own headers into the email
+		if _, err := mail.ParseAddress(email); email != "" && (err != nil || strings.ContainsAny(email, "\r\n")) {
+			renderErrorPage(album.site, w, http.StatusBadRequest, "Invalid email address")
+			return
+		}
+	}
+
+	go expireZipDownloads()
+	d, err := album.startZip(r.Context(), r.PostForm["photo"], email)
+	lang := album.site.GetLanguage()
+	if err == errZipTooBig {
+		renderErrorPage(album.site, w, http.StatusRequestEntityTooLarge, translate(lang, "zip_too_big", album.GetZipMaxBytes()/1024/1024))
+		return
+	} else if err == errZipNoRoom {
+		w.Header().Set("Retry-After", "3600")
+		renderErrorPage(album.site, w, http.StatusServiceUnavailable, translate(lang, "zip_busy"))
+		return
+	} else if err == errZipEmpty {
+		renderErrorPage(album.site, w, http.StatusBadRequest, translate(lang, "zip_empty"))
+		return
+	} else if err != nil {
+		reportError("start zip download", err, albumErrorContext(album))
+		renderErrorPage(album.site, w, http.StatusBadGateway, translate(lang, "zip_failed"))
+		return
+	}
+	http.Redirect(w, r, album.Path+ZIP_SLUG+"/"+d.ID, http.StatusSeeOther)
+}
+
+func lookupZip(album *Album, id string) *ZipDownload {
+	zipDownloads.mutex.Lock()
+	defer zipDownloads.mutex.Unlock()
+	if d, ok := zipDownloads.byID[id]; ok && d.album == album && time.Now().Sub(d.Created) <= ZIP_LIFETIME {
+		return d
+	}
+	return nil
+}
+
+// Shows how the zip is coming along, and the link to it once it's ready. The page refreshes itself until then.
+func handleZipStatus(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	d := lookupZip(album, r.PathValue("id"))
+	if d == nil {
+		renderErrorPage(album.site, w, http.StatusNotFound, translate(album.site.GetLanguage(), "zip_expired"))
+		return
+	}
+	status := d.getStatus()
+
+	ctx := &ZipPageContext{
+		&BasePageContext{
+			album.site.GetCanonicalUrl().String(),
+			album.GetCanonicalUrl().String(),
+			album.GetSiteUrl().String(),
+			album.MetaTitle,
+			album.site.SiteTitle,
+			album.GetNavigation(),
+			album.site.GetLanguage(),
+			album.GetTheme(),
+			album.site.GetPhotoWidth(false),
+			false,
+			newSiteView(album.site),
+		},
+		album.AlbumTitle,
+		&ZipDownload{ID: d.ID, Status: status, Photos: d.Photos, Size: d.Size, Created: d.Created},
+		album.Path + ZIP_SLUG + "/" + d.ID + "/file",
+		(d.Size + 1024*1024 - 1) / 1024 / 1024,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	executeTemplateHelper(w, "zip.html", ctx)
+}
+
+func handleZipFile(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	d := lookupZip(album, r.PathValue("id"))
+	if d == nil {
+		renderErrorPage(album.site, w, http.StatusNotFound, translate(album.site.GetLanguage(), "zip_expired"))
+		return
+	}
+	if status := d.getStatus(); status != ZIP_READY {
+		renderErrorPage(album.site, w, http.StatusNotFound, translate(album.site.GetLanguage(), "zip_expired"))
+		return
+	}
+
+	if d.bucketKey != "" {
+		svc, err := album.site.GetS3Service()
+		if err != nil {
+			renderErrorPage(album.site, w, http.StatusBadGateway, err.Error())
+			return
+		}
+		req, _ := svc.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(album.site.BucketName), Key: aws.String(d.bucketKey)})
+		signedUrl, err := req.Presign(time.Until(d.Created.Add(ZIP_LIFETIME)))
+		if err != nil {
+			reportError("sign zip URL", err, albumErrorContext(album))
+			renderErrorPage(album.site, w, http.StatusBadGateway, "Unable to sign the zip's URL")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, signedUrl, http.StatusFound)
+		return
+	}
+
+	f, err := os.Open(d.file)
+	if err != nil {
+		renderErrorPage(album.site, w, http.StatusNotFound, translate(album.site.GetLanguage(), "zip_expired"))
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", album.zipFilename()))
+	http.ServeContent(w, r, "", d.Created, f)
+}